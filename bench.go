@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Workload is a YCSB-style mix of operations, given as the share of each
+// operation kind.
+type Workload struct {
+	Read   float64
+	Update float64
+	Insert float64
+	Scan   float64
+}
+
+var Workloads = map[string]Workload{
+	"read-heavy":   {Read: 0.95, Update: 0.05},
+	"update-heavy": {Read: 0.5, Update: 0.5},
+	"insert-only":  {Insert: 1},
+	"scan":         {Scan: 0.95, Insert: 0.05},
+}
+
+const (
+	DistributionUniform = "uniform"
+	DistributionZipfian = "zipfian"
+)
+
+// BenchConfig describes a benchmark run. Records keys are loaded before it
+// starts; reads, updates and scans then pick among them with the key
+// distribution, while inserts add new keys. Each scan reads ScanLength
+// items.
+type BenchConfig struct {
+	Workload     string
+	Distribution string
+	Records      int
+	Operations   int
+	Clients      int
+	ScanLength   int
+	Seed         int64
+}
+
+// LatencyStats describes the latencies of one operation kind. In JSON,
+// durations are in nanoseconds.
+type LatencyStats struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"meanNs"`
+	P50   time.Duration `json:"p50Ns"`
+	P95   time.Duration `json:"p95Ns"`
+	P99   time.Duration `json:"p99Ns"`
+	Max   time.Duration `json:"maxNs"`
+}
+
+type BenchResult struct {
+	Workload     string                  `json:"workload"`
+	Distribution string                  `json:"distribution"`
+	Records      int                     `json:"records"`
+	Clients      int                     `json:"clients"`
+	Operations   int                     `json:"operations"`
+	Duration     time.Duration           `json:"durationNs"`
+	Throughput   float64                 `json:"throughput"`
+	Ops          map[string]LatencyStats `json:"ops"`
+}
+
+var errScanDone = errors.New("scan done")
+
+// benchKey returns the key id of the ith record. Hashing the index spreads
+// the keys, and so the hot ones of a Zipfian distribution, over the key
+// space.
+func benchKey(i int64) uuid.UUID {
+	sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+	id, _ := uuid.FromBytes(sum[:16])
+	return id
+}
+
+func benchBook(r *rand.Rand) *Book {
+	return &Book{Title: fmt.Sprintf("book %08x", r.Uint32()), Year: uint16(1900 + r.Intn(125))}
+}
+
+// benchClient runs one client's share of the operations, keeping the
+// latencies of each kind.
+type benchClient struct {
+	c         Collection
+	config    BenchConfig
+	workload  Workload
+	r         *rand.Rand
+	zipf      *rand.Zipf
+	next      *atomic.Int64
+	latencies map[string][]time.Duration
+}
+
+func (bc *benchClient) pick() int64 {
+	if bc.zipf != nil {
+		return int64(bc.zipf.Uint64())
+	}
+
+	return bc.r.Int63n(int64(bc.config.Records))
+}
+
+func (bc *benchClient) op() (string, error) {
+	w := bc.workload
+	switch p := bc.r.Float64(); {
+	case p < w.Read:
+		id := benchKey(bc.pick())
+		return "read", bc.c.Get(&id, &Book{})
+	case p < w.Read+w.Update:
+		id := benchKey(bc.pick())
+		return "update", bc.c.Put(&id, benchBook(bc.r))
+	case p < w.Read+w.Update+w.Insert:
+		id := benchKey(bc.next.Add(1) - 1)
+		return "insert", bc.c.Put(&id, benchBook(bc.r))
+	default:
+		read := 0
+		err := bc.c.Scan(&Book{}, func(KeyId, Item) error {
+			if read++; read >= bc.config.ScanLength {
+				return errScanDone
+			}
+			return nil
+		})
+		if err == errScanDone {
+			err = nil
+		}
+		return "scan", err
+	}
+}
+
+func (bc *benchClient) run(n int) error {
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		kind, err := bc.op()
+		bc.latencies[kind] = append(bc.latencies[kind], time.Since(start))
+		if err != nil {
+			return errors.Wrap(err, kind)
+		}
+	}
+
+	return nil
+}
+
+func latencyStats(latencies []time.Duration) LatencyStats {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	total := time.Duration(0)
+	for _, d := range latencies {
+		total += d
+	}
+
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	return LatencyStats{
+		Count: len(latencies),
+		Mean:  total / time.Duration(len(latencies)),
+		P50:   percentile(0.50),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		Max:   latencies[len(latencies)-1],
+	}
+}
+
+// loadBenchRecords puts the records the run starts with.
+func loadBenchRecords(c Collection, records int, r *rand.Rand) error {
+	const batch = 1000
+
+	for start := 0; start < records; start += batch {
+		entries := []Entry{}
+		for i := start; i < records && i < start+batch; i++ {
+			id := benchKey(int64(i))
+			entries = append(entries, Entry{Id: &id, Item: benchBook(r)})
+		}
+
+		if _, err := c.Load(entries, ConflictOverwrite); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunBench loads config.Records books into c and runs the workload from
+// config.Clients goroutines.
+func RunBench(c Collection, config BenchConfig) (*BenchResult, error) {
+	workload, ok := Workloads[config.Workload]
+	if !ok {
+		return nil, errors.Errorf("unknown workload %q", config.Workload)
+	}
+
+	if config.Distribution != DistributionUniform && config.Distribution != DistributionZipfian {
+		return nil, errors.Errorf("unknown key distribution %q", config.Distribution)
+	}
+
+	if config.Clients < 1 || config.Operations < 0 || config.ScanLength < 1 {
+		return nil, errors.New("invalid benchmark configuration")
+	}
+
+	if config.Records < 1 && workload.Insert < 1 {
+		return nil, errors.Errorf("workload %q needs records to read", config.Workload)
+	}
+
+	if err := loadBenchRecords(c, config.Records, rand.New(rand.NewSource(config.Seed))); err != nil {
+		return nil, errors.Wrap(err, "loading records")
+	}
+
+	next := &atomic.Int64{}
+	next.Store(int64(config.Records))
+	clients := make([]*benchClient, config.Clients)
+	for i := range clients {
+		r := rand.New(rand.NewSource(config.Seed + int64(i) + 1))
+		bc := &benchClient{
+			c:         c,
+			config:    config,
+			workload:  workload,
+			r:         r,
+			next:      next,
+			latencies: map[string][]time.Duration{},
+		}
+		if config.Distribution == DistributionZipfian && config.Records > 1 {
+			bc.zipf = rand.NewZipf(r, 1.01, 1, uint64(config.Records-1))
+		}
+		clients[i] = bc
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	start := time.Now()
+	for i, bc := range clients {
+		n := config.Operations / config.Clients
+		if i < config.Operations%config.Clients {
+			n++
+		}
+
+		wg.Add(1)
+		go func(i int, bc *benchClient, n int) {
+			defer wg.Done()
+			errs[i] = bc.run(n)
+		}(i, bc, n)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &BenchResult{
+		Workload:     config.Workload,
+		Distribution: config.Distribution,
+		Records:      config.Records,
+		Clients:      config.Clients,
+		Operations:   config.Operations,
+		Duration:     elapsed,
+		Ops:          map[string]LatencyStats{},
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(config.Operations) / elapsed.Seconds()
+	}
+
+	latencies := map[string][]time.Duration{}
+	for _, bc := range clients {
+		for kind, l := range bc.latencies {
+			latencies[kind] = append(latencies[kind], l...)
+		}
+	}
+	for kind, l := range latencies {
+		result.Ops[kind] = latencyStats(l)
+	}
+
+	return result, nil
+}
+
+func printBenchResult(w io.Writer, result *BenchResult) {
+	fmt.Fprintf(w, "workload: %s, %s keys, %d records, %d clients\n", result.Workload, result.Distribution, result.Records, result.Clients)
+	fmt.Fprintf(w, "operations: %d in %v, %.0f ops/s\n", result.Operations, result.Duration.Round(time.Millisecond), result.Throughput)
+
+	kinds := make([]string, 0, len(result.Ops))
+	for kind := range result.Ops {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		s := result.Ops[kind]
+		fmt.Fprintf(w, "  %-7s %8d  mean %-10v p50 %-10v p95 %-10v p99 %-10v max %v\n", kind, s.Count, s.Mean, s.P50, s.P95, s.P99, s.Max)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+var benchSizes = []int{100, 1000, 10000}
+
+func setupBenchTest(tb testing.TB, size int) (func(tb testing.TB), Collection) {
+	c, err := newTestCollection(fmt.Sprintf("./data/test/bench-%d", size))
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		tb.Fatalf("collection reset failed: %v", err)
+	}
+
+	if err := loadBenchRecords(c, size, rand.New(rand.NewSource(1))); err != nil {
+		tb.Fatalf("collection load failed: %v", err)
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c
+}
+
+// runBenchSizes runs fn as a sub-benchmark for each collection size.
+func runBenchSizes(b *testing.B, fn func(b *testing.B, c Collection, size int)) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			teardown, c := setupBenchTest(b, size)
+			defer teardown(b)
+
+			b.ResetTimer()
+			fn(b, c, size)
+		})
+	}
+}
+
+func BenchmarkCollectionPut(b *testing.B) {
+	r := rand.New(rand.NewSource(2))
+
+	b.Run("update", func(b *testing.B) {
+		runBenchSizes(b, func(b *testing.B, c Collection, size int) {
+			for i := 0; i < b.N; i++ {
+				id := benchKey(r.Int63n(int64(size)))
+				if err := c.Put(&id, benchBook(r)); err != nil {
+					b.Fatalf("collection put failed: %v", err)
+				}
+			}
+		})
+	})
+
+	b.Run("insert", func(b *testing.B) {
+		runBenchSizes(b, func(b *testing.B, c Collection, size int) {
+			for i := 0; i < b.N; i++ {
+				id := benchKey(int64(size + i))
+				if err := c.Put(&id, benchBook(r)); err != nil {
+					b.Fatalf("collection put failed: %v", err)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkCollectionGet(b *testing.B) {
+	r := rand.New(rand.NewSource(2))
+
+	runBenchSizes(b, func(b *testing.B, c Collection, size int) {
+		book := &Book{}
+		for i := 0; i < b.N; i++ {
+			id := benchKey(r.Int63n(int64(size)))
+			if err := c.Get(&id, book); err != nil {
+				b.Fatalf("collection get failed: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkCollectionRemove puts each removed key back outside the timer, so
+// the collection keeps its size.
+func BenchmarkCollectionRemove(b *testing.B) {
+	r := rand.New(rand.NewSource(2))
+
+	runBenchSizes(b, func(b *testing.B, c Collection, size int) {
+		for i := 0; i < b.N; i++ {
+			id := benchKey(r.Int63n(int64(size)))
+			if err := c.Remove(&id); err != nil {
+				b.Fatalf("collection remove failed: %v", err)
+			}
+
+			b.StopTimer()
+			if err := c.Put(&id, benchBook(r)); err != nil {
+				b.Fatalf("collection put failed: %v", err)
+			}
+			b.StartTimer()
+		}
+	})
+}
+
+func BenchmarkCollectionScan(b *testing.B) {
+	runBenchSizes(b, func(b *testing.B, c Collection, size int) {
+		for i := 0; i < b.N; i++ {
+			if err := c.Scan(&Book{}, func(KeyId, Item) error { return nil }); err != nil {
+				b.Fatalf("collection scan failed: %v", err)
+			}
+		}
+	})
+}
+
+func TestRunBench(t *testing.T) {
+	for name := range Workloads {
+		for _, distribution := range []string{DistributionUniform, DistributionZipfian} {
+			t.Run(name+"/"+distribution, func(t *testing.T) {
+				teardown, c := setupImportTest(t)
+				defer teardown(t)
+
+				result, err := RunBench(c, BenchConfig{
+					Workload:     name,
+					Distribution: distribution,
+					Records:      50,
+					Operations:   203,
+					Clients:      4,
+					ScanLength:   10,
+					Seed:         1,
+				})
+				if err != nil {
+					t.Fatalf("bench run failed: %v", err)
+				}
+
+				total := 0
+				for kind, s := range result.Ops {
+					total += s.Count
+					if s.P50 > s.P95 || s.P95 > s.P99 || s.P99 > s.Max {
+						t.Fatalf("expected %s percentiles to be ordered; got %+v", kind, s)
+					}
+				}
+
+				if total != 203 {
+					t.Fatalf("expected 203 operations; got %d", total)
+				}
+
+				inserts := int64(result.Ops["insert"].Count)
+				if count, err := c.Count(); err != nil || count != 50+inserts {
+					t.Fatalf("expected %d keys; got %d (%v)", 50+inserts, count, err)
+				}
+			})
+		}
+	}
+}
+
+func TestRunBenchInvalid(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	configs := []BenchConfig{
+		{Workload: "unknown", Distribution: DistributionUniform, Records: 1, Clients: 1, ScanLength: 1},
+		{Workload: "read-heavy", Distribution: "unknown", Records: 1, Clients: 1, ScanLength: 1},
+		{Workload: "read-heavy", Distribution: DistributionUniform, Records: 1, Clients: 0, ScanLength: 1},
+		{Workload: "read-heavy", Distribution: DistributionUniform, Records: 0, Clients: 1, ScanLength: 1},
+	}
+
+	for _, config := range configs {
+		if _, err := RunBench(c, config); err == nil {
+			t.Fatalf("expected bench run with %+v to fail", config)
+		}
+	}
+}
+
+func TestBenchResultOutput(t *testing.T) {
+	result := &BenchResult{
+		Workload:     "read-heavy",
+		Distribution: DistributionZipfian,
+		Records:      10,
+		Clients:      2,
+		Operations:   4,
+		Duration:     time.Second,
+		Throughput:   4,
+		Ops: map[string]LatencyStats{
+			"read":   {Count: 3, Mean: time.Millisecond, P50: time.Millisecond, P95: 2 * time.Millisecond, P99: 2 * time.Millisecond, Max: 2 * time.Millisecond},
+			"update": {Count: 1, Mean: time.Millisecond, P50: time.Millisecond, P95: time.Millisecond, P99: time.Millisecond, Max: time.Millisecond},
+		},
+	}
+
+	var buf bytes.Buffer
+	printBenchResult(&buf, result)
+	out := buf.String()
+	for _, expected := range []string{"read-heavy", "zipfian", "4 ops/s", "read", "update", "p99 2ms"} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected output to contain %q; got %q", expected, out)
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("result marshal failed: %v", err)
+	}
+
+	var decoded BenchResult
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("result unmarshal failed: %v", err)
+	}
+
+	if decoded.Ops["read"] != result.Ops["read"] || decoded.Duration != result.Duration {
+		t.Fatalf("expected result to round trip; got %+v", decoded)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const bloomHeaderSize = 1 + 1 + 8 + 8 + 8
+
+type BloomStats struct {
+	Bits              uint64
+	Hashes            uint
+	Items             uint64
+	Removed           uint64
+	Lookups           uint64
+	Skipped           uint64
+	FalsePositives    uint64
+	FalsePositiveRate float64
+}
+
+// bloomFilter answers whether a key id may be stored. Removed keys cannot be
+// cleared from it, so they are counted and the filter is rebuilt from the
+// index once they make up too large a share of it.
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64
+	k        uint
+	n        uint64
+	removed  uint64
+	expected int
+	fpRate   float64
+
+	lookups        atomic.Uint64
+	skipped        atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+func newBloomFilter(expected int, fpRate float64) *bloomFilter {
+	if expected < 1 {
+		expected = 1
+	}
+
+	m := uint64(math.Ceil(-float64(expected) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint(math.Round(float64(m) / float64(expected) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        k,
+		expected: expected,
+		fpRate:   fpRate,
+	}
+}
+
+func (f *bloomFilter) positions(id []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write(id)
+	h2 := fnv.New64()
+	h2.Write(id)
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (f *bloomFilter) add(id []byte) {
+	a, b := f.positions(id)
+	for i := uint(0); i < f.k; i++ {
+		bit := (a + uint64(i)*b) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.n++
+}
+
+func (f *bloomFilter) mayContain(id []byte) bool {
+	f.lookups.Add(1)
+
+	a, b := f.positions(id)
+	for i := uint(0); i < f.k; i++ {
+		bit := (a + uint64(i)*b) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			f.skipped.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) remove() {
+	f.removed++
+}
+
+// stale reports whether removals or growth past the expected item count have
+// degraded the false-positive rate enough to warrant a rebuild.
+func (f *bloomFilter) stale() bool {
+	return f.removed > f.n/2 || f.n > uint64(f.expected)*2
+}
+
+func (f *bloomFilter) stats() *BloomStats {
+	return &BloomStats{
+		Bits:              f.m,
+		Hashes:            f.k,
+		Items:             f.n,
+		Removed:           f.removed,
+		Lookups:           f.lookups.Load(),
+		Skipped:           f.skipped.Load(),
+		FalsePositives:    f.falsePositives.Load(),
+		FalsePositiveRate: math.Pow(1-math.Exp(-float64(f.k)*float64(f.n)/float64(f.m)), float64(f.k)),
+	}
+}
+
+func (f *bloomFilter) marshal(clean bool) []byte {
+	b := make([]byte, bloomHeaderSize+len(f.bits)*8)
+	if clean {
+		b[0] = 1
+	}
+	b[1] = byte(f.k)
+	binary.LittleEndian.PutUint64(b[2:], f.m)
+	binary.LittleEndian.PutUint64(b[10:], f.n)
+	binary.LittleEndian.PutUint64(b[18:], f.removed)
+	for i, word := range f.bits {
+		binary.LittleEndian.PutUint64(b[bloomHeaderSize+i*8:], word)
+	}
+	return b
+}
+
+// save writes the filter. Only a filter saved as clean on close is trusted
+// when the collection is opened again; a crash leaves it marked dirty.
+func (f *bloomFilter) save(vfs VFS, filename string, clean bool) error {
+	return writeFile(vfs, filename, f.marshal(clean))
+}
+
+// loadBloomFilter returns nil when the file is missing or was not closed
+// cleanly, meaning the filter must be rebuilt from the index.
+func loadBloomFilter(vfs VFS, filename string, expected int, fpRate float64) (*bloomFilter, error) {
+	b, err := readFile(vfs, filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < bloomHeaderSize {
+		return nil, errors.New("invalid bloom filter file")
+	}
+
+	if b[0] != 1 {
+		return nil, nil
+	}
+
+	f := newBloomFilter(expected, fpRate)
+	f.k = uint(b[1])
+	f.m = binary.LittleEndian.Uint64(b[2:])
+	f.n = binary.LittleEndian.Uint64(b[10:])
+	f.removed = binary.LittleEndian.Uint64(b[18:])
+	if f.m%64 != 0 || uint64(len(b)-bloomHeaderSize) != f.m/8 {
+		return nil, errors.New("invalid bloom filter file")
+	}
+
+	f.bits = make([]uint64, f.m/64)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(b[bloomHeaderSize+i*8:])
+	}
+
+	if f.n > uint64(expected) {
+		f.expected = int(f.n)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func setupBloomTest(tb testing.TB) (func(tb testing.TB), *collection, []uuid.UUID) {
+	if err := os.RemoveAll("./data/test/bloom"); err != nil {
+		tb.Fatalf("removing test data failed: %v", err)
+	}
+
+	c, err := NewCollection("./data/test/bloom", KeySize, KeyIdSize, BookSize, WithBloomFilter(100, 0.01))
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	ids := make([]uuid.UUID, 10)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: "Book", Year: uint16(2000 + i)}); err != nil {
+			tb.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c.(*collection), ids
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000, 0.01)
+
+	ids := make([][]byte, 1000)
+	for i := range ids {
+		id := uuid.New()
+		ids[i] = id[:]
+		f.add(ids[i])
+	}
+
+	for _, id := range ids {
+		if !f.mayContain(id) {
+			t.Fatalf("bloom filter missed added id %x", id)
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		id := uuid.New()
+		if f.mayContain(id[:]) {
+			positives++
+		}
+	}
+
+	if positives > 300 {
+		t.Fatalf("expected false-positive rate near 1%%, got %d/10000", positives)
+	}
+
+	if rate := f.stats().FalsePositiveRate; rate <= 0 || rate > 0.02 {
+		t.Fatalf("expected estimated false-positive rate near 0.01, got %f", rate)
+	}
+}
+
+func TestCollectionBloomSkipsMisses(t *testing.T) {
+	teardown, c, ids := setupBloomTest(t)
+	defer teardown(t)
+
+	book := &Book{}
+	for _, id := range ids {
+		if err := c.Get(&id, book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+	}
+
+	before, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		id := uuid.New()
+		if err := c.Get(&id, book); err == nil {
+			t.Fatalf("expected get of absent key to fail")
+		}
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.Bloom == nil {
+		t.Fatalf("expected bloom filter stats")
+	}
+
+	skipped := stats.Bloom.Skipped - before.Bloom.Skipped
+	falsePositives := stats.Bloom.FalsePositives - before.Bloom.FalsePositives
+	if skipped+falsePositives != 100 {
+		t.Fatalf("expected 100 misses, got %d skipped and %d false positives", skipped, falsePositives)
+	}
+
+	if skipped < 90 {
+		t.Fatalf("expected most misses to be skipped, got %d", skipped)
+	}
+
+	if stats.Bloom.Items != uint64(len(ids)) {
+		t.Fatalf("expected %d items, got %d", len(ids), stats.Bloom.Items)
+	}
+}
+
+func TestCollectionBloomPersisted(t *testing.T) {
+	teardown, c, ids := setupBloomTest(t)
+	teardown(t)
+
+	filename := filepath.Join("./data/test/bloom", "bloom")
+	loaded, err := loadBloomFilter(osFS{}, filename, 100, 0.01)
+	if err != nil {
+		t.Fatalf("bloom filter load failed: %v", err)
+	}
+
+	if loaded == nil || loaded.n != uint64(len(ids)) {
+		t.Fatalf("expected clean bloom filter with %d items", len(ids))
+	}
+
+	if err := loaded.save(osFS{}, filename, false); err != nil {
+		t.Fatalf("bloom filter save failed: %v", err)
+	}
+
+	if loaded, err := loadBloomFilter(osFS{}, filename, 100, 0.01); err != nil || loaded != nil {
+		t.Fatalf("expected dirty bloom filter to be discarded, got %v, %v", loaded, err)
+	}
+
+	reopened, err := NewCollection("./data/test/bloom", KeySize, KeyIdSize, BookSize, WithBloomFilter(100, 0.01))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer reopened.Close()
+
+	book := &Book{}
+	for _, id := range ids {
+		if err := reopened.Get(&id, book); err != nil {
+			t.Fatalf("collection get after rebuild failed: %v", err)
+		}
+	}
+
+	if c.bloomFile != filename {
+		t.Fatalf("expected bloom file %s, got %s", filename, c.bloomFile)
+	}
+}
+
+func TestCollectionBloomRebuildsAfterRemove(t *testing.T) {
+	teardown, c, ids := setupBloomTest(t)
+	defer teardown(t)
+
+	for _, id := range ids[:6] {
+		if err := c.Remove(&id); err != nil {
+			t.Fatalf("collection remove failed: %v", err)
+		}
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.Bloom.Items != 4 || stats.Bloom.Removed != 0 {
+		t.Fatalf("expected rebuilt filter with 4 items, got %d items and %d removed", stats.Bloom.Items, stats.Bloom.Removed)
+	}
+
+	book := &Book{}
+	for _, id := range ids[6:] {
+		if err := c.Get(&id, book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("collection reset failed: %v", err)
+	}
+
+	if err := c.Get(&ids[9], book); err == nil {
+		t.Fatalf("expected get after reset to fail")
+	}
+}
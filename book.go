@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,14 +14,22 @@ const BookTitleSize = 4 * 32
 const BookYearSize = 2
 const BookSize = BookTitleSize + BookYearSize
 const KeyIdSize = 16
-const KeySize = KeyIdSize + KeyOffsetSize
+const KeySize = KeyIdSize + KeyMetaSize
 
 type Book struct {
-	Title string
-	Year  uint16
+	Title string `json:"title"`
+	Year  uint16 `json:"year"`
 }
 
 func (b *Book) MarshalBinary() ([]byte, error) {
+	if len(b.Title) > BookTitleSize {
+		return nil, errors.Errorf("title longer than %d bytes", BookTitleSize)
+	}
+
+	if strings.IndexByte(b.Title, 0) >= 0 {
+		return nil, errors.New("title contains a NUL byte")
+	}
+
 	var buf [BookSize]byte
 	copy(buf[:BookTitleSize], []byte(b.Title))
 	binary.LittleEndian.PutUint16(buf[BookTitleSize:], b.Year)
@@ -31,13 +41,67 @@ func (book *Book) UnmarshalBinary(b []byte) error {
 		return errors.New("invalid slice size")
 	}
 
-	title_b := b[:bytes.IndexByte(b[:BookTitleSize], 0)]
-	book.Title = string(title_b)
+	// A title of BookTitleSize bytes is not NUL-terminated.
+	titleSize := bytes.IndexByte(b[:BookTitleSize], 0)
+	if titleSize < 0 {
+		titleSize = BookTitleSize
+	}
+
+	book.Title = string(b[:titleSize])
 	book.Year = binary.LittleEndian.Uint16(b[BookTitleSize:])
 	return nil
 }
 
-func NewBookCollection(dataPath string) (Collection, error) {
+func (b *Book) CSVHeader() []string {
+	return []string{"title", "year"}
+}
+
+func (b *Book) MarshalCSV() ([]string, error) {
+	return []string{b.Title, strconv.FormatUint(uint64(b.Year), 10)}, nil
+}
+
+func (b *Book) UnmarshalCSV(fields []string) error {
+	if len(fields) != 2 {
+		return errors.New("invalid field count")
+	}
+
+	year, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return errors.Wrap(err, "invalid year")
+	}
+
+	b.Title = fields[0]
+	b.Year = uint16(year)
+	return nil
+}
+
+// WithBookTitleIndex indexes the words of book titles for Search.
+func WithBookTitleIndex() Option {
+	return WithTextIndex(func() Item { return &Book{} }, func(item Item) string {
+		return item.(*Book).Title
+	})
+}
+
+var BookSpec = CollectionSpec{Name: "book", KeyIdSize: KeyIdSize, ItemSize: BookSize, Index: IndexSorted}
+
+func NewBookCollection(dataPath string, opts ...Option) (Collection, error) {
 	collectionDir := filepath.Join(dataPath, "book")
-	return NewCollection(collectionDir, KeySize, KeyIdSize, BookSize)
+	return NewCollection(collectionDir, KeySize, KeyIdSize, BookSize, opts...)
+}
+
+// BookDataKeys rewrites a book collection created before data records started
+// with their key ids, which Repair needs.
+var BookDataKeys = &Migration{
+	Name:        "book-data-keys",
+	KeyIdSize:   KeyIdSize,
+	OldItemSize: BookSize,
+	NewItemSize: BookSize,
+	OldItem:     func() Item { return &Book{} },
+	Transform:   func(old Item) (Item, error) { return old, nil },
+}
+
+func init() {
+	if err := RegisterMigration(BookDataKeys); err != nil {
+		panic(err)
+	}
 }
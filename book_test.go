@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -49,3 +50,30 @@ func TestBookUnmarshallBinaryInvalidByteSliceSize(t *testing.T) {
 		t.Fatalf(`expected error to be "invalid slice size"; got "%s"`, err.Error())
 	}
 }
+
+func TestBookFullLengthTitle(t *testing.T) {
+	book := Book{Title: strings.Repeat("a", BookTitleSize), Year: 1996}
+
+	b, err := book.MarshalBinary()
+	if err != nil {
+		t.Fatalf("binary marshalling failed: %v", err)
+	}
+
+	newBook := Book{}
+	if err := newBook.UnmarshalBinary(b); err != nil {
+		t.Fatalf("binary unmarshalling failed: %v", err)
+	}
+
+	if newBook != book {
+		t.Fatalf("expected %+v; got %+v", book, newBook)
+	}
+}
+
+func TestBookInvalidTitle(t *testing.T) {
+	for _, title := range []string{strings.Repeat("a", BookTitleSize+1), "Game\x00of Thrones"} {
+		book := Book{Title: title}
+		if _, err := book.MarshalBinary(); err == nil {
+			t.Fatalf("expected title %q to fail to marshal", title)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// anyVersion makes a write unconditional.
+const anyVersion = ^uint64(0)
+
+const maxUpdateRetries = 16
+
+var ErrNotFound = errors.New("item not found")
+
+// ErrConflict is matched by every ConflictError.
+var ErrConflict = errors.New("version conflict")
+
+// ConflictError reports a conditional write that found the key at another
+// version than the expected one. Version 0 stands for an absent key, so a
+// failed PutIfAbsent also matches ErrKeyExists.
+type ConflictError struct {
+	Id       []byte
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *ConflictError) Error() string {
+	switch {
+	case e.Expected == 0:
+		return fmt.Sprintf("key %x already exists at version %d", e.Id, e.Actual)
+	case e.Actual == 0:
+		return fmt.Sprintf("key %x not found; expected version %d", e.Id, e.Expected)
+	}
+
+	return fmt.Sprintf("key %x is at version %d; expected version %d", e.Id, e.Actual, e.Expected)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict || (target == ErrKeyExists && e.Expected == 0)
+}
+
+func checkVersion(id []byte, expected uint64, actual uint64) error {
+	if expected == anyVersion || expected == actual {
+		return nil
+	}
+
+	return &ConflictError{Id: id, Expected: expected, Actual: actual}
+}
+
+// update runs the read-modify-write loop of Collection.Update, retrying when
+// another writer changed the key between the read and the write.
+func update(c Collection, id KeyId, item Item, fn func(old Item) (Item, error)) error {
+	var err error
+	for attempt := 0; attempt < maxUpdateRetries; attempt++ {
+		old := item
+		version, getErr := c.GetWithVersion(id, item)
+		if errors.Is(getErr, ErrNotFound) {
+			old = nil
+		} else if getErr != nil {
+			return getErr
+		}
+
+		updated, fnErr := fn(old)
+		if fnErr != nil {
+			return fnErr
+		}
+
+		if updated == nil {
+			err = c.RemoveIfVersion(id, version)
+		} else {
+			err = c.CompareAndSwap(id, version, updated)
+		}
+
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+
+	return errors.Wrapf(err, "update gave up after %d attempts", maxUpdateRetries)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// getVersion returns the version of the key id holds.
+func getVersion(t *testing.T, c Collection, id uuid.UUID) uint64 {
+	t.Helper()
+
+	version, err := c.GetWithVersion(&id, &Book{})
+	if err != nil {
+		t.Fatalf("collection get with version failed: %v", err)
+	}
+
+	return version
+}
+
+func TestCollectionPutIfAbsent(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	existing := getVersion(t, c, ids[0])
+	err := c.PutIfAbsent(&ids[0], &Book{Title: "Overwritten", Year: 2000})
+	if !errors.Is(err, ErrKeyExists) || !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected key exists conflict; got %v", err)
+	}
+
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Expected != 0 || conflict.Actual != existing {
+		t.Fatalf("expected conflict at version %d; got %v", existing, err)
+	}
+
+	id := uuid.New()
+	if err := c.PutIfAbsent(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put if absent failed: %v", err)
+	}
+
+	book := &Book{}
+	version, err := c.GetWithVersion(&id, book)
+	if err != nil {
+		t.Fatalf("collection get with version failed: %v", err)
+	}
+
+	if version != c.LastSeq() || book.Title != "Dune" {
+		t.Fatalf("expected Dune at version %d; got %s at version %d", c.LastSeq(), book.Title, version)
+	}
+}
+
+func TestCollectionCompareAndSwap(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	first := getVersion(t, c, ids[0])
+	if err := c.CompareAndSwap(&ids[0], first, &Book{Title: "A Clash of Kings", Year: 1998}); err != nil {
+		t.Fatalf("collection compare and swap failed: %v", err)
+	}
+	second := c.LastSeq()
+
+	err := c.CompareAndSwap(&ids[0], first, &Book{Title: "Lost Update", Year: 1998})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Expected != first || conflict.Actual != second {
+		t.Fatalf("expected conflict at version %d; got %v", second, err)
+	}
+
+	if errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected version conflict not to match ErrKeyExists")
+	}
+
+	book := &Book{}
+	version, err := c.GetWithVersion(&ids[0], book)
+	if err != nil {
+		t.Fatalf("collection get with version failed: %v", err)
+	}
+
+	if version != second || book.Title != "A Clash of Kings" {
+		t.Fatalf("expected A Clash of Kings at version %d; got %s at version %d", second, book.Title, version)
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "A Storm of Swords", Year: 2000}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if version := getVersion(t, c, ids[0]); version <= second {
+		t.Fatalf("expected blind put to raise the version above %d; got %d", second, version)
+	}
+
+	id := uuid.New()
+	if err := c.CompareAndSwap(&id, first, &Book{Title: "Dune", Year: 1965}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict on absent key; got %v", err)
+	}
+
+	if err := c.CompareAndSwap(&id, 0, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection compare and swap of absent key failed: %v", err)
+	}
+}
+
+func TestCollectionRemoveIfVersion(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	version := getVersion(t, c, ids[0])
+	if err := c.RemoveIfVersion(&ids[0], version+1); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict; got %v", err)
+	}
+
+	if err := c.Get(&ids[0], &Book{}); err != nil {
+		t.Fatalf("expected book to remain after conflict: %v", err)
+	}
+
+	if err := c.RemoveIfVersion(&ids[0], version); err != nil {
+		t.Fatalf("collection remove if version failed: %v", err)
+	}
+
+	if err := c.Get(&ids[0], &Book{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected removed book to be not found; got %v", err)
+	}
+
+	if err := c.PutIfAbsent(&ids[0], &Book{Title: "Reinserted", Year: 2020}); err != nil {
+		t.Fatalf("collection put if absent after remove failed: %v", err)
+	}
+
+	reinserted := getVersion(t, c, ids[0])
+	if reinserted <= version {
+		t.Fatalf("expected reinserted book above version %d; got %d", version, reinserted)
+	}
+
+	if err := c.CompareAndSwap(&ids[0], version, &Book{Title: "Stale", Year: 2020}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected compare and swap with the version from before the remove to conflict; got %v", err)
+	}
+}
+
+func TestCollectionUpdateRetries(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	if err := c.Put(&ids[0], &Book{Title: "Counter", Year: 0}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	workers := 4
+	increments := 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				err := c.Update(&ids[0], &Book{}, func(old Item) (Item, error) {
+					book := *old.(*Book)
+					book.Year++
+					return &book, nil
+				})
+				if err != nil && !errors.Is(err, ErrConflict) {
+					errs <- err
+					return
+				}
+				if err != nil {
+					i--
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("collection update failed: %v", err)
+	}
+
+	book := &Book{}
+	if err := c.Get(&ids[0], book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if int(book.Year) != workers*increments {
+		t.Fatalf("expected %d increments; got %d", workers*increments, book.Year)
+	}
+
+	id := uuid.New()
+	err := c.Update(&id, &Book{}, func(old Item) (Item, error) {
+		if old != nil {
+			t.Fatalf("expected absent key to pass nil")
+		}
+		return &Book{Title: "Created", Year: 1}, nil
+	})
+	if err != nil {
+		t.Fatalf("collection update of absent key failed: %v", err)
+	}
+
+	err = c.Update(&id, &Book{}, func(old Item) (Item, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("collection update removing key failed: %v", err)
+	}
+
+	if err := c.Get(&id, book); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected key removed by update to be not found; got %v", err)
+	}
+}
+
+func TestCollectionVersionsSurviveReopen(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Put(&ids[0], &Book{Title: "Revised", Year: uint16(i)}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+	revised, inserted := getVersion(t, c, ids[0]), getVersion(t, c, ids[1])
+	teardown(t)
+
+	c, err := newTestCollection("./data/test")
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	if version := getVersion(t, c, ids[0]); version != revised {
+		t.Fatalf("expected version %d after reopening; got %d", revised, version)
+	}
+
+	if version := getVersion(t, c, ids[1]); version != inserted {
+		t.Fatalf("expected version %d after reopening; got %d", inserted, version)
+	}
+}
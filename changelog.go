@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const changeSeqSize = 8
+const changeOpSize = 1
+const changeExpirySize = 8
+const changeVersionSize = 8
+const changeHeaderSize = changeSeqSize + changeOpSize + changeExpirySize + changeVersionSize
+
+var ErrChangesTruncated = errors.New("changes truncated")
+
+// Change is a mutation read from a change log. Version is the version a put
+// gave its key; it is 0 for other operations and for puts recorded before
+// format version 4.
+type Change struct {
+	Seq       uint64
+	Op        Op
+	Id        KeyId
+	Value     []byte
+	ExpiresAt int64
+	Version   uint64
+}
+
+// changelog keeps one fixed-size record per mutation. The first slot of the
+// storage is a header holding the sequence number of the first retained
+// record, so sequence numbers survive truncation of the whole log. Records
+// are kept until truncated; nothing truncates the log on its own.
+type changelog struct {
+	mu        sync.Mutex // held while truncate replaces the storage
+	vfs       VFS
+	filename  string
+	open      storageOpener
+	storage   Storage
+	keyIdSize uint16
+	itemSize  uint16
+	first     uint64
+	next      uint64
+}
+
+func (l *changelog) recordSize() int {
+	return changeHeaderSize + int(l.keyIdSize) + int(l.itemSize)
+}
+
+func (l *changelog) writeHeader() error {
+	b := make([]byte, l.recordSize())
+	binary.LittleEndian.PutUint64(b, l.first)
+	_, err := l.storage.WriteOffset(b, 0)
+	return err
+}
+
+func (l *changelog) load() error {
+	count, err := l.storage.Count()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		l.first = 1
+		l.next = 1
+		return l.writeHeader()
+	}
+
+	b := make([]byte, l.recordSize())
+	if _, err := l.storage.ReadOffset(b, 0); err != nil {
+		return err
+	}
+
+	l.first = binary.LittleEndian.Uint64(b)
+	l.next = l.first + uint64(count-1)
+	return nil
+}
+
+func (l *changelog) lastSeq() uint64 {
+	return l.next - 1
+}
+
+func (l *changelog) append(op Op, id []byte, value []byte, expiresAt int64, version uint64) (uint64, error) {
+	seq := l.next
+	b := make([]byte, l.recordSize())
+	binary.LittleEndian.PutUint64(b, seq)
+	b[changeSeqSize] = byte(op)
+	binary.LittleEndian.PutUint64(b[changeSeqSize+changeOpSize:], uint64(expiresAt))
+	binary.LittleEndian.PutUint64(b[changeSeqSize+changeOpSize+changeExpirySize:], version)
+	copy(b[changeHeaderSize:], id)
+	copy(b[changeHeaderSize+int(l.keyIdSize):], value)
+
+	if _, err := l.storage.WriteOffset(b, int64(seq-l.first+1)); err != nil {
+		return 0, err
+	}
+
+	l.next++
+	return seq, nil
+}
+
+// rollback drops the records from seq on, which were logged for mutations
+// that then failed.
+func (l *changelog) rollback(seq uint64) error {
+	if err := l.storage.Truncate(int64(seq - l.first + 1)); err != nil {
+		return err
+	}
+
+	l.next = seq
+	return nil
+}
+
+func (l *changelog) decode(b []byte) (Change, error) {
+	change := Change{
+		Seq:       binary.LittleEndian.Uint64(b),
+		Op:        Op(b[changeSeqSize]),
+		ExpiresAt: int64(binary.LittleEndian.Uint64(b[changeSeqSize+changeOpSize:])),
+		Version:   binary.LittleEndian.Uint64(b[changeSeqSize+changeOpSize+changeExpirySize:]),
+	}
+
+	if change.Op == OpReset {
+		return change, nil
+	}
+
+	change.Id = newKeyId()
+	idEnd := changeHeaderSize + int(l.keyIdSize)
+	if err := change.Id.UnmarshalBinary(b[changeHeaderSize:idEnd]); err != nil {
+		return change, err
+	}
+
+	if change.Op == OpPut {
+		change.Value = append([]byte{}, b[idEnd:]...)
+	}
+
+	return change, nil
+}
+
+func (l *changelog) read(from uint64, fn func(Change) error) error {
+	if from < l.first {
+		return errors.Wrapf(ErrChangesTruncated, "first retained sequence is %d", l.first)
+	}
+
+	b := make([]byte, l.recordSize())
+	for seq := from; seq < l.next; seq++ {
+		if _, err := l.storage.ReadOffset(b, int64(seq-l.first+1)); err != nil {
+			return err
+		}
+
+		change, err := l.decode(b)
+		if err != nil {
+			return err
+		}
+
+		if change.Seq != seq {
+			return errors.Errorf("change log corrupted: expected sequence %d; got %d", seq, change.Seq)
+		}
+
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncate drops every record with a sequence number below the given one. The
+// retained records are written to a new file that replaces the log, so that a
+// crash leaves either the old or the new one.
+func (l *changelog) truncate(below uint64) error {
+	if below <= l.first {
+		return nil
+	}
+
+	if below > l.next {
+		below = l.next
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tmp := l.filename + ".tmp"
+	dst, err := l.open(tmp, uint16(l.recordSize()))
+	if err != nil {
+		return err
+	}
+
+	if err := l.copyFrom(dst, below); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := syncStorage(dst); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := l.storage.Close(); err != nil {
+		return err
+	}
+
+	renameErr := renameSynced(l.vfs, tmp, l.filename)
+	if l.storage, err = l.open(l.filename, uint16(l.recordSize())); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	l.first = below
+	return nil
+}
+
+// copyFrom writes a header for below and the records from below on to dst.
+func (l *changelog) copyFrom(dst Storage, below uint64) error {
+	if err := dst.Reset(); err != nil {
+		return err
+	}
+
+	b := make([]byte, l.recordSize())
+	binary.LittleEndian.PutUint64(b, below)
+	if _, err := dst.WriteOffset(b, 0); err != nil {
+		return err
+	}
+
+	for seq := below; seq < l.next; seq++ {
+		if _, err := l.storage.ReadOffset(b, int64(seq-l.first+1)); err != nil {
+			return err
+		}
+
+		if _, err := dst.WriteOffset(b, int64(seq-below+1)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencrypt is a key rotation pass over the records of an encrypted log.
+func (l *changelog) reencrypt(stop <-chan struct{}) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return unwrapStorage(l.storage).(*encryptedStorage).reencrypt(stop)
+}
+
+func (l *changelog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return syncStorage(l.storage)
+}
+
+func (l *changelog) close() error {
+	if err := l.sync(); err != nil {
+		l.storage.Close()
+		return err
+	}
+
+	return l.storage.Close()
+}
+
+func openChangelog(vfs VFS, filename string, keyIdSize uint16, itemSize uint16, open storageOpener) (*changelog, error) {
+	recordSize := changeHeaderSize + int(keyIdSize) + int(itemSize)
+	if recordSize > math.MaxUint16 {
+		return nil, errors.New("item size too large for change log")
+	}
+
+	storage, err := open(filename, uint16(recordSize))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &changelog{vfs: vfs, filename: filename, open: open, storage: storage, keyIdSize: keyIdSize, itemSize: itemSize}
+	if err := l.load(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
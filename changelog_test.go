@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+func readChanges(t *testing.T, c Collection, from uint64) []Change {
+	changes := []Change{}
+	err := c.Changes(from, func(change Change) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("collection changes failed: %v", err)
+	}
+	return changes
+}
+
+func TestChangesRecordMutations(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	from := c.LastSeq() + 1
+
+	updated := &Book{Title: "A Clash of Kings", Year: 1998}
+	if err := c.Put(&ids[0], updated); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	changes := readChanges(t, c, from)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes; got %d", len(changes))
+	}
+
+	if changes[0].Seq != from || changes[1].Seq != from+1 {
+		t.Fatalf("expected sequences %d and %d; got %d and %d", from, from+1, changes[0].Seq, changes[1].Seq)
+	}
+
+	if changes[0].Op != OpPut || changes[1].Op != OpRemove {
+		t.Fatalf("expected put then remove; got %v then %v", changes[0].Op, changes[1].Op)
+	}
+
+	book := &Book{}
+	if err := book.UnmarshalBinary(changes[0].Value); err != nil {
+		t.Fatalf("change value unmarshalling failed: %v", err)
+	}
+
+	if *book != *updated {
+		t.Fatalf("expected change value to be %v; got %v", *updated, *book)
+	}
+
+	id, err := changes[1].Id.MarshalBinary()
+	if err != nil {
+		t.Fatalf("change id marshalling failed: %v", err)
+	}
+
+	if !bytes.Equal(id, ids[1][:]) {
+		t.Fatalf("expected change id to be %v; got %x", ids[1], id)
+	}
+}
+
+func TestChangesSurviveReopen(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	last := c.LastSeq()
+	teardown(t)
+
+	c, err := newTestCollection("./data/test")
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	if c.LastSeq() != last {
+		t.Fatalf("expected last sequence to be %d after reopening; got %d", last, c.LastSeq())
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if c.LastSeq() != last+1 {
+		t.Fatalf("expected last sequence to be %d; got %d", last+1, c.LastSeq())
+	}
+}
+
+func TestTruncateChanges(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	last := c.LastSeq()
+	if err := c.TruncateChanges(last - 1); err != nil {
+		t.Fatalf("collection truncate changes failed: %v", err)
+	}
+
+	if err := c.Changes(last-2, func(Change) error { return nil }); !errors.Is(err, ErrChangesTruncated) {
+		t.Fatalf("expected error to be %v; got %v", ErrChangesTruncated, err)
+	}
+
+	changes := readChanges(t, c, last-1)
+	if len(changes) != 2 || changes[0].Seq != last-1 || changes[1].Seq != last {
+		t.Fatalf("expected changes %d and %d to be retained; got %v", last-1, last, changes)
+	}
+
+	id, err := changes[1].Id.MarshalBinary()
+	if err != nil {
+		t.Fatalf("change id marshalling failed: %v", err)
+	}
+
+	if !bytes.Equal(id, ids[3][:]) {
+		t.Fatalf("expected last change id to be %v; got %x", ids[3], id)
+	}
+
+	if err := c.TruncateChanges(last + 1); err != nil {
+		t.Fatalf("collection truncate changes failed: %v", err)
+	}
+
+	if c.LastSeq() != last {
+		t.Fatalf("expected last sequence to stay %d; got %d", last, c.LastSeq())
+	}
+
+	if len(readChanges(t, c, last+1)) != 0 {
+		t.Fatal("expected no changes after truncating everything")
+	}
+}
+
+func TestTruncateChangesCrash(t *testing.T) {
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for write := 1; ; write++ {
+		mem := NewMemFS()
+		c, err := NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(mem))
+		if err != nil {
+			t.Fatalf("collection creation failed: %v", err)
+		}
+
+		for i := range ids {
+			if err := c.Put(&ids[i], &Book{Title: "Dune", Year: uint16(1965 + i)}); err != nil {
+				t.Fatalf("collection put failed: %v", err)
+			}
+		}
+		c.Close()
+
+		vfs := newFaultFS(mem, kvdbtest.Fault{})
+		if c, err = NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(vfs)); err != nil {
+			t.Fatalf("collection creation failed: %v", err)
+		}
+		vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Crash: true})
+
+		truncateErr := c.TruncateChanges(3)
+		if _, err := vfs.crash(false); err != nil {
+			t.Fatalf("crash failed: %v", err)
+		}
+
+		if c, err = NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(mem)); err != nil {
+			t.Fatalf("collection reopening failed: %v", err)
+		}
+
+		if c.LastSeq() != 3 {
+			t.Fatalf("write %d: expected last sequence 3; got %d", write, c.LastSeq())
+		}
+
+		from := uint64(1)
+		if err := c.Changes(1, func(Change) error { return nil }); errors.Is(err, ErrChangesTruncated) {
+			from = 3
+		}
+
+		if changes := readChanges(t, c, from); len(changes) != int(4-from) {
+			t.Fatalf("write %d: expected %d changes from %d; got %d", write, 4-from, from, len(changes))
+		}
+		c.Close()
+
+		if truncateErr == nil {
+			if from != 3 {
+				t.Fatalf("expected the truncation to be kept")
+			}
+			return
+		}
+	}
+}
+
+// expectChangesMatch checks that replaying the change log of c gives the books
+// it holds under ids.
+func expectChangesMatch(t *testing.T, c Collection, ids []uuid.UUID, write int) {
+	t.Helper()
+
+	logged := map[uuid.UUID]Book{}
+	for _, change := range readChanges(t, c, 1) {
+		switch change.Op {
+		case OpPut:
+			book := Book{}
+			if err := book.UnmarshalBinary(change.Value); err != nil {
+				t.Fatalf("book unmarshalling failed: %v", err)
+			}
+			logged[change.Id.(*uuid.NullUUID).UUID] = book
+		case OpRemove:
+			delete(logged, change.Id.(*uuid.NullUUID).UUID)
+		case OpReset:
+			logged = map[uuid.UUID]Book{}
+		}
+	}
+
+	for _, id := range ids {
+		book := Book{}
+		err := c.Get(&id, &book)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatalf("write %d: collection get failed: %v", write, err)
+		}
+
+		expected, ok := logged[id]
+		if ok != (err == nil) || book != expected {
+			t.Fatalf("write %d: expected the log to hold %v (%v) for %s; got %v (%v)", write, expected, ok, id, book, err == nil)
+		}
+	}
+}
+
+func TestChangesMatchFailedWrites(t *testing.T) {
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	ops := []func(c Collection) error{
+		func(c Collection) error { return c.Put(&ids[0], &Book{Title: "Dune", Year: 1965}) },
+		func(c Collection) error { return c.Put(&ids[1], &Book{Title: "Emma", Year: 1815}) },
+		func(c Collection) error { return c.Put(&ids[0], &Book{Title: "Dune Messiah", Year: 1969}) },
+		func(c Collection) error { return c.Remove(&ids[1]) },
+		func(c Collection) error {
+			_, err := c.Load([]Entry{
+				{Id: &ids[2], Item: &Book{Title: "Ulysses", Year: 1922}},
+				{Id: &ids[3], Item: &Book{Title: "Walden", Year: 1854}},
+			}, ConflictOverwrite)
+			return err
+		},
+		func(c Collection) error { return c.Reset() },
+		func(c Collection) error { return c.Put(&ids[1], &Book{Title: "Persuasion", Year: 1817}) },
+	}
+
+	indexes := map[string]IndexType{
+		"Sorted": IndexSorted,
+		"Hash":   IndexHash,
+	}
+
+	for name, index := range indexes {
+		t.Run(name, func(t *testing.T) {
+			for write := 1; ; write++ {
+				vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+				c, err := NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(vfs), WithIndex(index))
+				if err != nil {
+					t.Fatalf("collection creation failed: %v", err)
+				}
+				vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write})
+
+				failed := false
+				for _, op := range ops {
+					if err := op(c); err != nil {
+						if !errors.Is(err, kvdbtest.ErrInjected) {
+							t.Fatalf("write %d: operation failed: %v", write, err)
+						}
+						failed = true
+					}
+					expectChangesMatch(t, c, ids, write)
+				}
+				c.Close()
+
+				if !failed {
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"demo", "run the example book workflow", runDemo},
+		{"export", "export books as JSON Lines or CSV", runExport},
+		{"import", "bulk-load books from JSON Lines or CSV", runImport},
+		{"rotate-key", "re-encrypt books with the last key of the key file", runRotateKey},
+		{"migrate", "rewrite a collection with a registered migration", runMigrate},
+		{"stats", "print the size and layout of the book collection", runStats},
+		{"repair", "rebuild the key index of the book collection from its data", runRepair},
+		{"bench", "run a workload against a scratch book collection", runBench},
+	}
+}
+
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return errors.New("missing command")
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+
+	printUsage(os.Stderr)
+	return errors.Errorf("unknown command %q", args[0])
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: kvdb <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+func parseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "overwrite":
+		return ConflictOverwrite, nil
+	case "skip":
+		return ConflictSkip, nil
+	case "fail":
+		return ConflictFail, nil
+	}
+
+	return 0, errors.Errorf("unknown conflict policy %q", s)
+}
+
+// collectionOptions returns the options for opening the book collection,
+// encrypting it with the keys in keyFile if one is given.
+func collectionOptions(keyFile string) ([]Option, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	p, err := LoadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Option{WithEncryption(p)}, nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	formatName := fs.String("format", "jsonl", "output format: jsonl or csv")
+	out := fs.String("out", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	format, err := ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	collection, err := NewBookCollection(*dataPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	if *out == "" {
+		return Export(os.Stdout, collection, format, &Book{})
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+
+	if err := Export(f, collection, format, &Book{}); err != nil {
+		f.Close()
+		return err
+	}
+
+	// A failed close can leave the export truncated.
+	return f.Close()
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	formatName := fs.String("format", "jsonl", "input format: jsonl or csv")
+	in := fs.String("in", "", "input file (default stdin)")
+	conflict := fs.String("conflict", "overwrite", "on existing key: overwrite, skip or fail")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	fs.Parse(args)
+
+	format, err := ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	onConflict, err := parseConflictPolicy(*conflict)
+	if err != nil {
+		return err
+	}
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	collection, err := NewBookCollection(*dataPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := Import(r, collection, format, func() Item { return &Book{} }, onConflict)
+	fmt.Fprintln(os.Stderr, "imported books:", n)
+	return err
+}
+
+func runRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	keyFile := fs.String("key-file", "", "encryption key file; its last key becomes current")
+	fs.Parse(args)
+
+	if *keyFile == "" {
+		return errors.New("rotate-key requires -key-file")
+	}
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	collection, err := NewBookCollection(*dataPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	rotator, ok := collection.(keyRotator)
+	if !ok {
+		return errors.New("collection does not support key rotation")
+	}
+
+	if err := rotator.WaitKeyRotation(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "key rotation complete")
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	collectionName := fs.String("collection", "book", "collection to migrate")
+	name := fs.String("name", "", "registered migration to run")
+	dryRun := fs.Bool("dry-run", false, "rewrite and verify without replacing the collection")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	fs.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "registered migrations:")
+		for _, name := range Migrations() {
+			fmt.Fprintln(os.Stderr, " ", name)
+		}
+		return errors.New("migrate requires -name")
+	}
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	result, err := migrateCollection(*dataPath, *collectionName, *name, *dryRun, opts)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		fmt.Fprintln(os.Stderr, "dry run; collection left unchanged")
+	}
+	fmt.Fprintln(os.Stderr, "migrated records:", result.Migrated)
+	fmt.Fprintln(os.Stderr, "dropped expired records:", result.Expired)
+	return nil
+}
+
+// migrateCollection migrates a collection of the DB in dataPath through its
+// catalog, which keeps the item size of the collection. Collections not in
+// the catalog, like the book collection, are migrated on their own.
+func migrateCollection(dataPath string, collection string, name string, dryRun bool, opts []Option) (_ MigrationResult, err error) {
+	db, err := Open(dataPath, opts...)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	result, err := db.MigrateCollection(collection, name, dryRun)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return Migrate(filepath.Join(dataPath, collection), name, dryRun, opts...)
+	}
+
+	return result, err
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	fs.Parse(args)
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	collection, err := NewBookCollection(*dataPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	stats, err := collection.Stats()
+	if err != nil {
+		return err
+	}
+
+	return printStats(os.Stdout, stats)
+}
+
+func printStats(w io.Writer, stats Stats) error {
+	fmt.Fprintln(w, "keys:", stats.Count)
+	fmt.Fprintln(w, "data slots:", stats.DataSlots)
+	fmt.Fprintf(w, "dead slots: %d (%d bytes)\n", stats.DeadSlots, stats.DeadBytes)
+
+	names := make([]string, 0, len(stats.Files))
+	for name := range stats.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "files: %d bytes\n", stats.FileBytes)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %d\n", name, stats.Files[name])
+	}
+
+	if stats.Shifts.Samples > 0 {
+		fmt.Fprintf(w, "shift distance: average %.1f, max %d over %d inserts\n", stats.Shifts.Average, stats.Shifts.Max, stats.Shifts.Samples)
+	}
+
+	for _, k := range []struct {
+		label string
+		id    KeyId
+	}{{"min key", stats.MinKey}, {"max key", stats.MaxKey}} {
+		if k.id == nil {
+			continue
+		}
+
+		text, err := marshalKeyText(k.id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %s\n", k.label, text)
+	}
+
+	if b := stats.Bloom; b != nil {
+		fmt.Fprintf(w, "bloom filter: %d bits, %d hashes, %d items, %d removed\n", b.Bits, b.Hashes, b.Items, b.Removed)
+		fmt.Fprintf(w, "bloom lookups: %d, skipped %d, false positives %d (expected rate %.4f)\n", b.Lookups, b.Skipped, b.FalsePositives, b.FalsePositiveRate)
+	}
+
+	return nil
+}
+
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dataPath := fs.String("data", "./data", "data directory")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	out := fs.String("report", "", "report file (default stdout)")
+	fs.Parse(args)
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := Repair(filepath.Join(*dataPath, "book"), KeyIdSize, BookSize, opts...)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	for _, change := range report.Changes {
+		fmt.Fprintln(w, change)
+	}
+	fmt.Fprintf(w, "keys: %d, dropped: %d, recovered: %d, freed data slots: %d, reordered: %t\n",
+		report.Keys, report.Dropped, report.Recovered, report.Freed, report.Reordered)
+	return nil
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	tmpPath := fs.String("tmp", "", "directory to create the scratch collection in (default the system temporary directory)")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	workload := fs.String("workload", "read-heavy", "workload: read-heavy, update-heavy, insert-only or scan")
+	distribution := fs.String("distribution", DistributionUniform, "key distribution: uniform or zipfian")
+	index := fs.String("index", string(IndexSorted), "key index: sorted or hash")
+	records := fs.Int("records", 10000, "records loaded before the run")
+	operations := fs.Int("ops", 100000, "operations to run")
+	clients := fs.Int("clients", 4, "concurrent clients")
+	scanLength := fs.Int("scan-length", 100, "items read by each scan")
+	seed := fs.Int64("seed", 1, "random seed")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, WithIndex(IndexType(*index)))
+
+	// The scratch collection gets a directory of its own, so that removing it
+	// never touches a collection someone else named.
+	dir, err := os.MkdirTemp(*tmpPath, "kvdb-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	collection, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	result, err := RunBench(collection, BenchConfig{
+		Workload:     *workload,
+		Distribution: *distribution,
+		Records:      *records,
+		Operations:   *operations,
+		Clients:      *clients,
+		ScanLength:   *scanLength,
+		Seed:         *seed,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	printBenchResult(os.Stdout, result)
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var cliIds = []uuid.UUID{
+	uuid.MustParse("a4a39129-7fb5-4855-9f80-6d290d52b812"),
+	uuid.MustParse("1b9d6bcd-bbfd-4b2d-9b5d-ab8dfbbd4bed"),
+}
+
+var cliBooks = []Book{{Title: "Dune", Year: 1965}, {Title: "Emma", Year: 1815}}
+
+// cliTest runs a command against a book collection holding cliBooks in
+// dataPath.
+type cliTest struct {
+	opts  []Option
+	setup func(tb testing.TB, dataPath string)
+	args  func(dataPath string) []string
+	check func(t *testing.T, dataPath string, stdout string)
+}
+
+var cliTests = map[string]cliTest{
+	"Bench": {
+		setup: func(tb testing.TB, dataPath string) {
+			if err := os.MkdirAll(filepath.Join(dataPath, "bench"), os.ModePerm); err != nil {
+				tb.Fatalf("mkdir failed: %v", err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dataPath, "bench", "keep"), nil, 0644); err != nil {
+				tb.Fatalf("writing file failed: %v", err)
+			}
+		},
+		args: func(dataPath string) []string {
+			return []string{"bench", "-tmp", dataPath, "-workload", "update-heavy", "-records", "20", "-ops", "50", "-clients", "2", "-json"}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			result := BenchResult{}
+			if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+				t.Fatalf("decoding bench result failed: %v", err)
+			}
+
+			if result.Workload != "update-heavy" || result.Operations != 50 || result.Records != 20 {
+				t.Fatalf("expected the configured workload; got %+v", result)
+			}
+
+			if _, err := os.Stat(filepath.Join(dataPath, "bench", "keep")); err != nil {
+				t.Fatalf("expected a collection named bench to be left alone; got %v", err)
+			}
+
+			if scratch, _ := filepath.Glob(filepath.Join(dataPath, "kvdb-bench-*")); len(scratch) != 0 {
+				t.Fatalf("expected the scratch collection to be removed; got %v", scratch)
+			}
+
+			expectCLIBooks(t, dataPath, nil, map[string]Book{
+				cliIds[0].String(): cliBooks[0],
+				cliIds[1].String(): cliBooks[1],
+			})
+		},
+	},
+	"Export": {
+		args: func(dataPath string) []string {
+			return []string{"export", "-data", dataPath, "-format", "csv", "-out", filepath.Join(dataPath, "books.csv")}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			b, err := os.ReadFile(filepath.Join(dataPath, "books.csv"))
+			if err != nil {
+				t.Fatalf("reading export failed: %v", err)
+			}
+
+			for _, line := range []string{"id,title,year", cliIds[0].String() + ",Dune,1965", cliIds[1].String() + ",Emma,1815"} {
+				if !strings.Contains(string(b), line+"\n") {
+					t.Fatalf("expected the export to hold %q; got %q", line, b)
+				}
+			}
+		},
+	},
+	"Import": {
+		setup: func(tb testing.TB, dataPath string) {
+			lines := `{"id":"` + cliIds[0].String() + `","item":{"title":"Dune Messiah","year":1969}}` + "\n" +
+				`{"id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","item":{"title":"Ulysses","year":1922}}` + "\n"
+			if err := os.WriteFile(filepath.Join(dataPath, "books.jsonl"), []byte(lines), 0644); err != nil {
+				tb.Fatalf("writing import failed: %v", err)
+			}
+		},
+		args: func(dataPath string) []string {
+			return []string{"import", "-data", dataPath, "-in", filepath.Join(dataPath, "books.jsonl"), "-conflict", "skip"}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			expectCLIBooks(t, dataPath, nil, map[string]Book{
+				cliIds[0].String():                     cliBooks[0],
+				cliIds[1].String():                     cliBooks[1],
+				"6ba7b810-9dad-11d1-80b4-00c04fd430c8": {Title: "Ulysses", Year: 1922},
+			})
+		},
+	},
+	"Migrate": {
+		setup: func(tb testing.TB, dataPath string) {
+			writeV1Collection(tb, filepath.Join(dataPath, "book"), cliIds, cliBooks)
+		},
+		args: func(dataPath string) []string {
+			return []string{"migrate", "-data", dataPath, "-name", "book-data-keys"}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			if _, err := Repair(filepath.Join(dataPath, "book"), KeyIdSize, BookSize); err != nil {
+				t.Fatalf("repair after migration failed: %v", err)
+			}
+
+			expectCLIBooks(t, dataPath, nil, map[string]Book{
+				cliIds[0].String(): cliBooks[0],
+				cliIds[1].String(): cliBooks[1],
+			})
+		},
+	},
+	"MigrateCatalog": {
+		setup: func(tb testing.TB, dataPath string) {
+			db, err := Open(dataPath)
+			if err != nil {
+				tb.Fatalf("db opening failed: %v", err)
+			}
+			defer db.Close()
+
+			c, err := db.CreateCollection(bookSpec("books"))
+			if err != nil {
+				tb.Fatalf("collection creation failed: %v", err)
+			}
+
+			if err := c.Put(&cliIds[0], &cliBooks[0]); err != nil {
+				tb.Fatalf("collection put failed: %v", err)
+			}
+		},
+		args: func(dataPath string) []string {
+			return []string{"migrate", "-data", dataPath, "-collection", "books", "-name", "test-book-pages"}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			db, err := Open(dataPath)
+			if err != nil {
+				t.Fatalf("db opening failed: %v", err)
+			}
+			defer db.Close()
+
+			if specs := db.ListCollections(); len(specs) != 1 || specs[0].ItemSize != pagedBookSize {
+				t.Fatalf("expected the catalog to hold the migrated item size; got %v", specs)
+			}
+
+			c, err := db.Collection("books")
+			if err != nil {
+				t.Fatalf("collection lookup failed: %v", err)
+			}
+
+			book := &pagedBook{}
+			if err := c.Get(&cliIds[0], book); err != nil || book.Title != cliBooks[0].Title || book.Pages != 100 {
+				t.Fatalf("expected the migrated book; got %+v, %v", *book, err)
+			}
+		},
+	},
+	"Stats": {
+		args: func(dataPath string) []string {
+			return []string{"stats", "-data", dataPath}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			for _, line := range []string{"keys: 2", "data slots: 2", "dead slots: 0 (0 bytes)", "min key: " + cliIds[1].String(), "max key: " + cliIds[0].String()} {
+				if !strings.Contains(stdout, line+"\n") {
+					t.Fatalf("expected the stats to hold %q; got %q", line, stdout)
+				}
+			}
+		},
+	},
+	"Repair": {
+		setup: func(tb testing.TB, dataPath string) {
+			if err := os.Truncate(filepath.Join(dataPath, "book", "key"), 0); err != nil {
+				tb.Fatalf("truncating key file failed: %v", err)
+			}
+		},
+		args: func(dataPath string) []string {
+			return []string{"repair", "-data", dataPath, "-report", filepath.Join(dataPath, "report.txt")}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			b, err := os.ReadFile(filepath.Join(dataPath, "report.txt"))
+			if err != nil {
+				t.Fatalf("reading report failed: %v", err)
+			}
+
+			if !strings.Contains(string(b), "keys: 2, dropped: 0, recovered: 2,") {
+				t.Fatalf("expected the report to recover both keys; got %q", b)
+			}
+
+			expectCLIBooks(t, dataPath, nil, map[string]Book{
+				cliIds[0].String(): cliBooks[0],
+				cliIds[1].String(): cliBooks[1],
+			})
+		},
+	},
+	"RotateKey": {
+		opts: []Option{WithEncryption(NewStaticKeyProvider("k1", testKeys))},
+		setup: func(tb testing.TB, dataPath string) {
+			keys := "k1 " + strings.Repeat("01", 32) + "\nk2 " + strings.Repeat("02", 32) + "\n"
+			if err := os.WriteFile(filepath.Join(dataPath, "keys"), []byte(keys), 0600); err != nil {
+				tb.Fatalf("writing key file failed: %v", err)
+			}
+		},
+		args: func(dataPath string) []string {
+			return []string{"rotate-key", "-data", dataPath, "-key-file", filepath.Join(dataPath, "keys")}
+		},
+		check: func(t *testing.T, dataPath string, stdout string) {
+			k2Only := NewStaticKeyProvider("k2", map[string][]byte{"k2": testKeys["k2"]})
+			expectCLIBooks(t, dataPath, []Option{WithEncryption(k2Only)}, map[string]Book{
+				cliIds[0].String(): cliBooks[0],
+				cliIds[1].String(): cliBooks[1],
+			})
+		},
+	},
+}
+
+func setupCLITest(tb testing.TB, name string, opts []Option) string {
+	dataPath := filepath.Join("./data/test/cli", strings.ToLower(name))
+	if err := os.RemoveAll(dataPath); err != nil {
+		tb.Fatalf("data directory removal failed: %v", err)
+	}
+
+	c, err := NewBookCollection(dataPath, opts...)
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	for i := range cliIds {
+		if err := c.Put(&cliIds[i], &cliBooks[i]); err != nil {
+			tb.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	return dataPath
+}
+
+// runCLI runs a command and returns what it printed to stdout.
+func runCLI(tb testing.TB, args []string) (string, error) {
+	f, err := os.CreateTemp(tb.TempDir(), "stdout")
+	if err != nil {
+		tb.Fatalf("stdout file creation failed: %v", err)
+	}
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	err = runCommand(args)
+	os.Stdout = stdout
+
+	b, readErr := os.ReadFile(f.Name())
+	if readErr != nil {
+		tb.Fatalf("reading stdout failed: %v", readErr)
+	}
+
+	return string(b), err
+}
+
+// expectCLIBooks checks that the book collection in dataPath holds exactly
+// books, by key id.
+func expectCLIBooks(t *testing.T, dataPath string, opts []Option, books map[string]Book) {
+	c, err := NewBookCollection(dataPath, opts...)
+	if err != nil {
+		t.Fatalf("collection opening failed: %v", err)
+	}
+	defer c.Close()
+
+	found := map[string]Book{}
+	err = c.Scan(&Book{}, func(id KeyId, item Item) error {
+		found[id.(*uuid.NullUUID).UUID.String()] = *item.(*Book)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("collection scan failed: %v", err)
+	}
+
+	if len(found) != len(books) {
+		t.Fatalf("expected %d books; got %v", len(books), found)
+	}
+
+	for id, book := range books {
+		if found[id] != book {
+			t.Fatalf("expected book %s to be %v; got %v", id, book, found[id])
+		}
+	}
+}
+
+func TestCLICommands(t *testing.T) {
+	for name, test := range cliTests {
+		t.Run(name, func(t *testing.T) {
+			dataPath := setupCLITest(t, name, test.opts)
+			if test.setup != nil {
+				test.setup(t, dataPath)
+			}
+
+			stdout, err := runCLI(t, test.args(dataPath))
+			if err != nil {
+				t.Fatalf("command failed: %v", err)
+			}
+
+			test.check(t, dataPath, stdout)
+		})
+	}
+}
+
+func TestCLIWithoutCommand(t *testing.T) {
+	dataPath := setupCLITest(t, "none", nil)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %v", err)
+	}
+
+	// Without a command, nothing runs against the default data directory.
+	if err := os.Chdir(filepath.Dir(dataPath)); err != nil {
+		t.Fatalf("chdir failed: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.RemoveAll("data"); err != nil {
+		t.Fatalf("data directory removal failed: %v", err)
+	}
+
+	if err := os.Rename("none", "data"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	if _, err := runCLI(t, nil); err == nil {
+		t.Fatal("expected running without a command to fail")
+	}
+
+	expectCLIBooks(t, "data", nil, map[string]Book{
+		cliIds[0].String(): cliBooks[0],
+		cliIds[1].String(): cliBooks[1],
+	})
+}
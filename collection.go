@@ -1,142 +1,1608 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
 
+var ErrKeyExists = errors.New("key already exists")
+
+const freeSlotSize = 8
+
 type collection struct {
+	mu          rwMutex
 	dataStorage Storage
 	keyStorage  Storage
+	freeStorage Storage
 	indexer     Indexer
+	hub         *watchHub
+	changes     *changelog
+	bloom       *bloomFilter
+	bloomFile   string
+	text        *textIndex
+	dataKeySize int
+	metrics     *metrics
+	versions    *versionStore
+	dir         string
+	meta        *collectionMeta
+	keys        *keyring
+	rotateStop  chan struct{}
+	rotateDone  chan struct{}
+	rotateErr   error
+	lock        io.Closer
+	opts        *options
+	now         func() time.Time
+	stop        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeErr    error
 }
 
-func (c *collection) Put(id KeyId, item Item) error {
-	keyOffset, err := c.indexer.Find(c.keyStorage, id)
+// find looks up the key record offset of id, skipping the index when the
+// Bloom filter rules the key out.
+func (c *collection) find(id KeyId, idBytes []byte) (int64, error) {
+	if c.bloom != nil && !c.bloom.mayContain(idBytes) {
+		return -1, nil
+	}
+
+	off, err := c.indexer.Find(c.keyStorage, id)
+	if err == nil && off < 0 && c.bloom != nil {
+		c.bloom.falsePositives.Add(1)
+	}
+
+	return off, err
+}
+
+func (c *collection) rebuildBloom() error {
+	count, err := c.indexer.Count(c.keyStorage)
 	if err != nil {
 		return err
 	}
 
-	b, err := item.MarshalBinary()
+	expected := c.opts.bloomItems
+	if int(count)*2 > expected {
+		expected = int(count) * 2
+	}
+
+	bloom := newBloomFilter(expected, c.opts.bloomFPRate)
+	err = c.indexer.Scan(c.keyStorage, func(off int64) error {
+		b := make([]byte, c.keyStorage.ItemSize())
+		if _, err := c.keyStorage.ReadOffset(b, off); err != nil {
+			return err
+		}
+
+		bloom.add(b[:c.indexer.KeySize()])
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if keyOffset < 0 {
-		dataOffset, err := c.dataStorage.Count()
-		if err != nil {
-			return err
+	c.bloom = bloom
+	return nil
+}
+
+func (c *collection) bloomAdded(idBytes []byte) error {
+	if c.bloom == nil {
+		return nil
+	}
+
+	c.bloom.add(idBytes)
+	if c.bloom.stale() {
+		return c.rebuildBloom()
+	}
+	return nil
+}
+
+func (c *collection) bloomRemoved() error {
+	if c.bloom == nil {
+		return nil
+	}
+
+	c.bloom.remove()
+	if c.bloom.stale() {
+		return c.rebuildBloom()
+	}
+	return nil
+}
+
+func (c *collection) readKey(off int64) (*key, error) {
+	k := make([]byte, c.keyStorage.ItemSize())
+	if _, err := c.keyStorage.ReadOffset(k, off); err != nil {
+		return nil, err
+	}
+
+	key := &key{id: newKeyId()}
+	if err := key.UnmarshalBinary(k); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (c *collection) readItem(off int64, item Item) error {
+	b, err := c.readData(off)
+	if err != nil {
+		return err
+	}
+
+	return item.UnmarshalBinary(b)
+}
+
+// readData returns the value in the data slot off, without the key id that
+// precedes it in collections whose data records carry it.
+func (c *collection) readData(off int64) ([]byte, error) {
+	b := make([]byte, c.dataStorage.ItemSize())
+	if _, err := c.dataStorage.ReadOffset(b, off); err != nil {
+		return nil, err
+	}
+
+	return b[c.dataKeySize:], nil
+}
+
+func (c *collection) writeData(id []byte, value []byte, off int64) error {
+	b := value
+	if c.dataKeySize > 0 {
+		b = make([]byte, c.dataKeySize+len(value))
+		copy(b, id)
+		copy(b[c.dataKeySize:], value)
+	}
+
+	_, err := c.dataStorage.WriteOffset(b, off)
+	return err
+}
+
+// oldValue returns the stored value of key for change events, or nil when
+// nobody is watching or the key had already expired.
+func (c *collection) oldValue(key *key) ([]byte, error) {
+	if !c.hub.active() || key.expired(c.now()) {
+		return nil, nil
+	}
+
+	return c.readData(int64(key.offset))
+}
+
+// emit records a mutation already applied in the change log, assigning its
+// sequence number, and publishes it.
+func (c *collection) emit(op Op, id []byte, expiresAt int64, version uint64, old []byte, new []byte) error {
+	seq, err := c.changes.append(op, id, new, expiresAt, version)
+	if err != nil {
+		return err
+	}
+
+	return c.publish(seq, op, id, old, new)
+}
+
+// commit records a mutation in the change log, applies it and publishes it.
+// The change is logged first so that no applied mutation goes unlogged. When
+// apply fails, leaving the collection as it was, the change is dropped from
+// the log again.
+func (c *collection) commit(op Op, id []byte, expiresAt int64, version uint64, old []byte, new []byte, apply func() error) error {
+	seq, err := c.changes.append(op, id, new, expiresAt, version)
+	if err != nil {
+		return err
+	}
+
+	if err := apply(); err != nil {
+		if rollbackErr := c.changes.rollback(seq); rollbackErr != nil {
+			return rollbackErr
 		}
+		return err
+	}
 
-		if _, err := c.dataStorage.WriteOffset(b, dataOffset); err != nil {
+	return c.publish(seq, op, id, old, new)
+}
+
+// publish syncs a logged mutation when commits are synced, indexes its text
+// and notifies watchers.
+func (c *collection) publish(seq uint64, op Op, id []byte, old []byte, new []byte) error {
+	if c.opts.syncOnCommit {
+		if err := c.sync(); err != nil {
 			return err
 		}
+	}
 
-		key := &key{id: id, offset: uint64(dataOffset)}
-		if _, err := c.indexer.Insert(c.keyStorage, key); err != nil {
+	if c.text != nil {
+		if err := c.text.apply(op, id, new); err != nil {
 			return err
 		}
-	} else {
-		k := make([]byte, int(c.keyStorage.ItemSize()))
-		if _, err := c.keyStorage.ReadOffset(k, keyOffset); err != nil {
+	}
+
+	return c.hub.notify(seq, op, id, old, new)
+}
+
+func (c *collection) current(id []byte) (version, error) {
+	record := rawItem(id)
+	off, err := c.find(&record, id)
+	if err != nil || off < 0 {
+		return version{}, err
+	}
+
+	key, err := c.readKey(off)
+	if err != nil {
+		return version{}, err
+	}
+
+	value, err := c.readData(int64(key.offset))
+	if err != nil {
+		return version{}, err
+	}
+
+	return version{value: value, expiresAt: key.expiresAt, keyVersion: key.version, present: true}, nil
+}
+
+func (c *collection) each(fn func(id []byte, v version) error) error {
+	return c.eachAfter(nil, fn)
+}
+
+// eachAfter is each starting past the key id after when the indexer can seek.
+// Other indexers visit every key, in no particular order.
+func (c *collection) eachAfter(after []byte, fn func(id []byte, v version) error) error {
+	visit := func(off int64) error {
+		key, err := c.readKey(off)
+		if err != nil {
 			return err
 		}
 
-		key := &key{id: id}
-		if err := key.UnmarshalBinary(k); err != nil {
+		id, err := key.id.MarshalBinary()
+		if err != nil {
 			return err
 		}
 
-		if _, err := c.dataStorage.WriteOffset(b, int64(key.offset)); err != nil {
+		value, err := c.readData(int64(key.offset))
+		if err != nil {
 			return err
 		}
+
+		return fn(id, version{value: value, expiresAt: key.expiresAt, keyVersion: key.version, present: true})
+	}
+
+	if idx, ok := c.indexer.(afterScanner); ok {
+		return idx.ScanAfter(c.keyStorage, after, visit)
+	}
+
+	return c.indexer.Scan(c.keyStorage, visit)
+}
+
+// retain keeps the current version of id for open snapshots before the next
+// mutation replaces it.
+func (c *collection) retain(id []byte) error {
+	if !c.versions.active() {
+		return nil
+	}
+
+	v, err := c.current(id)
+	if err != nil {
+		return err
 	}
 
+	c.versions.record(id, c.changes.lastSeq()+1, v)
 	return nil
 }
 
-func (c *collection) Get(id KeyId, item Item) error {
-	keyOffset, err := c.indexer.Find(c.keyStorage, id)
+func (c *collection) writeKey(key *key, off int64) error {
+	b, err := key.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	if keyOffset < 0 {
-		return errors.New("item not found")
+	_, err = c.keyStorage.WriteOffset(b, off)
+	return err
+}
+
+// store writes a data record to a slot released by Remove or Sweep if there
+// is one, otherwise past the end of the data storage, and returns the slot.
+// A released slot leaves the free list only once it holds the new record, so
+// that a crash in between cannot leave it holding the record of a removed
+// key, which Repair would bring back.
+func (c *collection) store(id []byte, value []byte) (int64, error) {
+	count, err := c.freeStorage.Count()
+	if err != nil {
+		return 0, err
 	}
 
-	k := make([]byte, c.keyStorage.ItemSize())
-	if _, err := c.keyStorage.ReadOffset(k, keyOffset); err != nil {
-		return err
+	if count == 0 {
+		off, err := c.dataStorage.Count()
+		if err != nil {
+			return 0, err
+		}
+
+		return off, c.writeData(id, value, off)
 	}
 
-	key := &key{id: &uuid.NullUUID{}}
-	if err := key.UnmarshalBinary(k); err != nil {
+	b := make([]byte, freeSlotSize)
+	if _, err := c.freeStorage.ReadOffset(b, count-1); err != nil {
+		return 0, err
+	}
+
+	off := int64(binary.LittleEndian.Uint64(b))
+	if err := c.writeData(id, value, off); err != nil {
+		return 0, err
+	}
+
+	return off, c.freeStorage.ShiftLeft(count - 1)
+}
+
+// rewrite stores a new value of key in another slot and points the key record
+// at it, so that a crash midway leaves one of the two values whole. It
+// returns the old slot, which the caller releases once the change is
+// committed.
+func (c *collection) rewrite(key *key, keyOffset int64, id []byte, value []byte) (int64, error) {
+	dataOffset, err := c.store(id, value)
+	if err != nil {
+		return 0, err
+	}
+
+	previous := int64(key.offset)
+	key.offset = uint64(dataOffset)
+	if err := c.writeKey(key, keyOffset); err != nil {
+		key.offset = uint64(previous)
+		if releaseErr := c.release(dataOffset); releaseErr != nil {
+			return 0, releaseErr
+		}
+		return 0, err
+	}
+
+	return previous, nil
+}
+
+func (c *collection) release(off int64) error {
+	count, err := c.freeStorage.Count()
+	if err != nil {
 		return err
 	}
 
-	b := make([]byte, c.dataStorage.ItemSize())
-	if _, err := c.dataStorage.ReadOffset(b, int64(key.offset)); err != nil {
+	b := make([]byte, freeSlotSize)
+	binary.LittleEndian.PutUint64(b, uint64(off))
+	_, err = c.freeStorage.WriteOffset(b, count)
+	return err
+}
+
+func (c *collection) expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	return c.now().Add(ttl).UnixNano()
+}
+
+func (c *collection) Put(id KeyId, item Item) error {
+	return c.PutCtx(context.Background(), id, item)
+}
+
+// PutCtx is Put giving up when ctx is done while it waits for the lock or
+// shifts the key records, in which case the collection is left unchanged.
+func (c *collection) PutCtx(ctx context.Context, id KeyId, item Item) error {
+	if err := c.mu.LockCtx(ctx); err != nil {
 		return err
 	}
+	defer c.mu.Unlock()
 
-	return item.UnmarshalBinary(b)
+	return c.put(ctx, id, item, 0, anyVersion, 0)
 }
 
-func (c *collection) Remove(id KeyId) error {
-	return c.indexer.Remove(c.keyStorage, id)
+func (c *collection) PutWithTTL(id KeyId, item Item, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(context.Background(), id, item, c.expiry(ttl), anyVersion, 0)
 }
 
-func (c *collection) Count() (int64, error) {
-	return c.keyStorage.Count()
+// keyVersion returns the version of key, which is 0 for absent and expired
+// keys.
+func (c *collection) keyVersion(key *key) uint64 {
+	if key == nil || key.expired(c.now()) {
+		return 0
+	}
+
+	return key.version
 }
 
-func (c *collection) Reset() error {
-	if err := c.keyStorage.Reset(); err != nil {
+// put writes item under id if its version is the expected one. The key is
+// given version next or, when next is 0, the sequence number of the put, so
+// that versions keep growing even across removes.
+func (c *collection) put(ctx context.Context, id KeyId, item Item, expiresAt int64, expected uint64, next uint64) (err error) {
+	defer c.metrics.put.observe(time.Now(), &err)
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
 		return err
 	}
 
-	return c.dataStorage.Reset()
+	defer observeOp(c.opts.observer, c.dir, "put", idBytes)(&err)
+
+	keyOffset, err := c.find(id, idBytes)
+	if err != nil {
+		return err
+	}
+
+	var current *key
+	if keyOffset >= 0 {
+		if current, err = c.readKey(keyOffset); err != nil {
+			return err
+		}
+	}
+
+	version := c.keyVersion(current)
+	if err := checkVersion(idBytes, expected, version); err != nil {
+		return err
+	}
+
+	if next == 0 {
+		next = c.changes.lastSeq() + 1
+	}
+
+	b, err := item.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if err := c.retain(idBytes); err != nil {
+		return err
+	}
+
+	if current == nil {
+		err := c.commit(OpPut, idBytes, expiresAt, next, nil, b, func() error {
+			dataOffset, err := c.store(idBytes, b)
+			if err != nil {
+				return err
+			}
+
+			key := &key{id: id, offset: uint64(dataOffset), expiresAt: expiresAt, version: next}
+			if _, err := c.indexer.Insert(withContext(ctx, c.keyStorage), key); err != nil {
+				if releaseErr := c.release(dataOffset); releaseErr != nil {
+					return releaseErr
+				}
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.bloomAdded(idBytes)
+	}
+
+	old, err := c.oldValue(current)
+	if err != nil {
+		return err
+	}
+
+	current.expiresAt = expiresAt
+	current.version = next
+	var previous int64
+	err = c.commit(OpPut, idBytes, expiresAt, next, old, b, func() (err error) {
+		previous, err = c.rewrite(current, keyOffset, idBytes, b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.release(previous)
 }
 
-func (c *collection) Close() error {
-	err1 := c.dataStorage.Close()
-	err2 := c.keyStorage.Close()
-	if err1 != nil {
-		return err1
+func (c *collection) Get(id KeyId, item Item) error {
+	_, err := c.GetWithVersion(id, item)
+	return err
+}
+
+func (c *collection) GetCtx(ctx context.Context, id KeyId, item Item) error {
+	_, err := c.getWithVersion(ctx, id, item)
+	return err
+}
+
+func (c *collection) GetWithVersion(id KeyId, item Item) (uint64, error) {
+	return c.getWithVersion(context.Background(), id, item)
+}
+
+func (c *collection) getWithVersion(ctx context.Context, id KeyId, item Item) (_ uint64, err error) {
+	defer c.metrics.get.observe(time.Now(), &err)
+
+	if err := c.mu.RLockCtx(ctx); err != nil {
+		return 0, err
 	}
-	if err2 != nil {
-		return err2
+	defer c.mu.RUnlock()
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return 0, err
 	}
-	return nil
+
+	defer observeOp(c.opts.observer, c.dir, "get", idBytes)(&err)
+
+	keyOffset, err := c.find(id, idBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	if keyOffset < 0 {
+		return 0, ErrNotFound
+	}
+
+	key, err := c.readKey(keyOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	if key.expired(c.now()) {
+		return 0, ErrNotFound
+	}
+
+	return key.version, c.readItem(int64(key.offset), item)
 }
 
-func NewCollection(collectionDir string, keySize uint16, keyIdSize uint16, itemSize uint16) (Collection, error) {
-	if err := os.MkdirAll(collectionDir, os.ModePerm); err != nil {
-		return nil, err
+func (c *collection) PutIfAbsent(id KeyId, item Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(context.Background(), id, item, 0, 0, 0)
+}
+
+// CompareAndSwap stores item only if the key is at expectedVersion, where 0
+// means the key must be absent.
+func (c *collection) CompareAndSwap(id KeyId, expectedVersion uint64, item Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(context.Background(), id, item, 0, expectedVersion, 0)
+}
+
+func (c *collection) RemoveIfVersion(id KeyId, expectedVersion uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.remove(context.Background(), id, OpRemove, expectedVersion)
+}
+
+// Update decodes the current value of id into item and stores the value
+// returned by fn, retrying when another writer got there first. fn gets nil
+// when the key is absent and removes it by returning nil.
+func (c *collection) Update(id KeyId, item Item, fn func(old Item) (Item, error)) error {
+	return update(c, id, item, fn)
+}
+
+func (c *collection) Remove(id KeyId) error {
+	return c.RemoveCtx(context.Background(), id)
+}
+
+// RemoveCtx is Remove giving up when ctx is done while it waits for the lock
+// or shifts the key records, in which case the collection is left unchanged.
+func (c *collection) RemoveCtx(ctx context.Context, id KeyId) error {
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return err
 	}
+	defer c.mu.Unlock()
 
-	dataFile := filepath.Join(collectionDir, "data")
-	keyFile := filepath.Join(collectionDir, "key")
+	return c.remove(ctx, id, OpRemove, anyVersion)
+}
+
+func (c *collection) remove(ctx context.Context, id KeyId, op Op, expected uint64) (err error) {
+	defer c.metrics.remove.observe(time.Now(), &err)
 
-	dataStorage, err := NewStorage(dataFile, itemSize)
+	idBytes, err := id.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	keyStorage, err := NewStorage(keyFile, keySize)
+	defer observeOp(c.opts.observer, c.dir, "remove", idBytes)(&err)
+
+	keyOffset, err := c.find(id, idBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	indexer := NewIndexer(keyIdSize)
+	if keyOffset < 0 {
+		return checkVersion(idBytes, expected, 0)
+	}
 
-	return &collection{
-		dataStorage: dataStorage,
-		keyStorage:  keyStorage,
-		indexer:     indexer,
+	key, err := c.readKey(keyOffset)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVersion(idBytes, expected, c.keyVersion(key)); err != nil {
+		return err
+	}
+
+	if err := c.retain(idBytes); err != nil {
+		return err
+	}
+
+	var old []byte
+	if c.hub.active() {
+		if old, err = c.readData(int64(key.offset)); err != nil {
+			return err
+		}
+	}
+
+	err = c.commit(op, idBytes, 0, 0, old, nil, func() error {
+		return c.indexer.Remove(withContext(ctx, c.keyStorage), id)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.release(int64(key.offset)); err != nil {
+		return err
+	}
+
+	return c.bloomRemoved()
+}
+
+func (c *collection) Sweep() (int, error) {
+	return c.SweepCtx(context.Background())
+}
+
+// SweepCtx is Sweep stopping when ctx is done. The keys removed by then stay
+// removed and are counted.
+func (c *collection) SweepCtx(ctx context.Context) (_ int, err error) {
+	defer observeOp(c.opts.observer, c.dir, "sweep", nil)(&err)
+
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return 0, err
+	}
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expired := []KeyId{}
+	err = c.indexer.Scan(c.keyStorage, func(off int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, err := c.readKey(off)
+		if err != nil {
+			return err
+		}
+
+		if key.expired(now) {
+			expired = append(expired, key.id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range expired {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+
+		if err := c.remove(ctx, id, OpExpire, anyVersion); err != nil {
+			return i, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+func (c *collection) sweepEvery(interval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Sweep()
+		}
+	}
+}
+
+func (c *collection) Scan(item Item, fn func(KeyId, Item) error) error {
+	return c.ScanCtx(context.Background(), item, fn)
+}
+
+func (c *collection) ScanCtx(ctx context.Context, item Item, fn func(KeyId, Item) error) (err error) {
+	defer observeOp(c.opts.observer, c.dir, "scan", nil)(&err)
+
+	if err := c.mu.RLockCtx(ctx); err != nil {
+		return err
+	}
+	defer c.mu.RUnlock()
+
+	now := c.now()
+	return c.indexer.Scan(c.keyStorage, func(off int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, err := c.readKey(off)
+		if err != nil {
+			return err
+		}
+
+		if key.expired(now) {
+			return nil
+		}
+
+		if err := c.readItem(int64(key.offset), item); err != nil {
+			return err
+		}
+
+		return fn(key.id, item)
+	})
+}
+
+type sortedInserter interface {
+	insertSorted(Storage, [][]byte) error
+}
+
+type loadEntry struct {
+	id        []byte
+	entry     Entry
+	keyOffset int64
+}
+
+func (c *collection) Load(entries []Entry, onConflict ConflictPolicy) (int, error) {
+	return c.LoadCtx(context.Background(), entries, onConflict)
+}
+
+// LoadCtx is Load giving up when ctx is done before it starts writing. Once
+// it has, the whole batch is stored.
+func (c *collection) LoadCtx(ctx context.Context, entries []Entry, onConflict ConflictPolicy) (_ int, err error) {
+	defer observeOp(c.opts.observer, c.dir, "load", nil)(&err)
+
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return 0, err
+	}
+	defer c.mu.Unlock()
+
+	batch := make([]loadEntry, 0, len(entries))
+	for _, e := range entries {
+		id, err := e.Id.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		if uint16(len(id)) != c.indexer.KeySize() {
+			return 0, errors.New("invalid key id size")
+		}
+
+		batch = append(batch, loadEntry{id: id, entry: e})
+	}
+
+	sort.SliceStable(batch, func(i, j int) bool {
+		return bytes.Compare(batch[i].id, batch[j].id) == -1
+	})
+
+	deduped := batch[:0]
+	for _, e := range batch {
+		last := len(deduped) - 1
+		if last < 0 || !bytes.Equal(deduped[last].id, e.id) {
+			deduped = append(deduped, e)
+			continue
+		}
+
+		switch onConflict {
+		case ConflictOverwrite:
+			deduped[last] = e
+		case ConflictFail:
+			return 0, errors.Wrapf(ErrKeyExists, "duplicate key %x in batch", e.id)
+		}
+	}
+
+	now := c.now()
+	updates := []loadEntry{}
+	inserts := []loadEntry{}
+	for _, e := range deduped {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		off, err := c.find(e.entry.Id, e.id)
+		if err != nil {
+			return 0, err
+		}
+
+		if off < 0 {
+			inserts = append(inserts, e)
+			continue
+		}
+
+		key, err := c.readKey(off)
+		if err != nil {
+			return 0, err
+		}
+
+		if key.expired(now) {
+			e.keyOffset = off
+			updates = append(updates, e)
+			continue
+		}
+
+		switch onConflict {
+		case ConflictOverwrite:
+			e.keyOffset = off
+			updates = append(updates, e)
+		case ConflictFail:
+			return 0, errors.Wrapf(ErrKeyExists, "key %x", e.id)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range updates {
+		if err := c.retain(e.id); err != nil {
+			return 0, err
+		}
+
+		key, err := c.readKey(e.keyOffset)
+		if err != nil {
+			return 0, err
+		}
+
+		b, err := e.entry.Item.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		old, err := c.oldValue(key)
+		if err != nil {
+			return 0, err
+		}
+
+		key.version = c.changes.lastSeq() + 1
+		key.expiresAt = 0
+		var previous int64
+		err = c.commit(OpPut, e.id, 0, key.version, old, b, func() (err error) {
+			previous, err = c.rewrite(key, e.keyOffset, e.id, b)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if err := c.release(previous); err != nil {
+			return 0, err
+		}
+	}
+
+	keys := make([][]byte, len(inserts))
+	values := make([][]byte, len(inserts))
+	offsets := make([]int64, 0, len(inserts))
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// A slot stored for a key that did not make it into the index would be
+		// referenced by nothing, and Repair would bring its record back.
+		for i, off := range offsets {
+			keyOffset, findErr := c.indexer.Find(c.keyStorage, inserts[i].entry.Id)
+			if findErr == nil && keyOffset < 0 {
+				c.release(off)
+			}
+		}
+	}()
+
+	firstSeq := c.changes.lastSeq() + 1
+	for i, e := range inserts {
+		if err := c.retain(e.id); err != nil {
+			return 0, err
+		}
+
+		b, err := e.entry.Item.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		dataOffset, err := c.store(e.id, b)
+		if err != nil {
+			return 0, err
+		}
+		offsets = append(offsets, dataOffset)
+
+		key := &key{id: e.entry.Id, offset: uint64(dataOffset), version: firstSeq + uint64(i)}
+		if keys[i], err = key.MarshalBinary(); err != nil {
+			return 0, err
+		}
+		values[i] = b
+	}
+
+	// The inserts are logged in order before they are indexed, and the records
+	// of the ones that did not make it into the index are dropped again.
+	for i, e := range inserts {
+		if _, err := c.changes.append(OpPut, e.id, values[i], 0, firstSeq+uint64(i)); err != nil {
+			if rollbackErr := c.changes.rollback(firstSeq); rollbackErr != nil {
+				return 0, rollbackErr
+			}
+			return 0, err
+		}
+	}
+
+	indexed, err := c.insertKeys(keys)
+	if err != nil {
+		if rollbackErr := c.changes.rollback(firstSeq + uint64(indexed)); rollbackErr != nil {
+			return 0, rollbackErr
+		}
+	}
+
+	for i, e := range inserts[:indexed] {
+		if err := c.publish(firstSeq+uint64(i), OpPut, e.id, nil, values[i]); err != nil {
+			return 0, err
+		}
+
+		if err := c.bloomAdded(e.id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(updates) + len(inserts), nil
+}
+
+// insertKeys indexes the marshalled key records and returns how many of them
+// made it into the index.
+func (c *collection) insertKeys(keys [][]byte) (int, error) {
+	if bulk, ok := c.indexer.(sortedInserter); ok {
+		if err := bulk.insertSorted(c.keyStorage, keys); err != nil {
+			return 0, err
+		}
+		return len(keys), nil
+	}
+
+	for i, k := range keys {
+		record := rawItem(k)
+		if _, err := c.indexer.Insert(c.keyStorage, &record); err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+func (c *collection) Watch(ctx context.Context, opts WatchOptions) <-chan Event {
+	return c.hub.subscribe(ctx, opts)
+}
+
+func (c *collection) LastSeq() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.changes.lastSeq()
+}
+
+func (c *collection) Changes(from uint64, fn func(Change) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.changes.read(from, fn)
+}
+
+func (c *collection) TruncateChanges(below uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.changes.truncate(below)
+}
+
+func (c *collection) Count() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.indexer.Count(c.keyStorage)
+}
+
+func (c *collection) Stats() (Stats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	count, err := c.indexer.Count(c.keyStorage)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{Count: count, Shifts: c.metrics.shifts.stats()}
+	if stats.DataSlots, err = c.dataStorage.Count(); err != nil {
+		return Stats{}, err
+	}
+
+	if stats.DeadSlots, err = c.freeStorage.Count(); err != nil {
+		return Stats{}, err
+	}
+	stats.DeadBytes = stats.DeadSlots * int64(c.dataStorage.ItemSize())
+
+	if stats.Files, stats.FileBytes, err = fileSizes(c.opts.vfs, c.dir); err != nil {
+		return Stats{}, err
+	}
+
+	if stats.MinKey, stats.MaxKey, err = c.keyRange(count); err != nil {
+		return Stats{}, err
+	}
+
+	if c.bloom != nil {
+		stats.Bloom = c.bloom.stats()
+	}
+
+	return stats, nil
+}
+
+// keyRange returns the smallest and largest of the count stored key ids,
+// reading them off the ends of a sorted index.
+func (c *collection) keyRange(count int64) (KeyId, KeyId, error) {
+	if count == 0 {
+		return nil, nil, nil
+	}
+
+	if _, ok := c.indexer.(*indexer); ok {
+		first, err := c.readKey(0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		last, err := c.readKey(count - 1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return first.id, last.id, nil
+	}
+
+	var minKey, maxKey KeyId
+	var minId, maxId []byte
+	err := c.indexer.Scan(c.keyStorage, func(off int64) error {
+		key, err := c.readKey(off)
+		if err != nil {
+			return err
+		}
+
+		id, err := key.id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if minId == nil || bytes.Compare(id, minId) < 0 {
+			minKey, minId = key.id, id
+		}
+		if maxId == nil || bytes.Compare(id, maxId) > 0 {
+			maxKey, maxId = key.id, id
+		}
+		return nil
+	})
+
+	return minKey, maxKey, err
+}
+
+func (c *collection) Metrics() Metrics {
+	return c.metrics.snapshot()
+}
+
+// Apply replays a change read from the change log of another collection. A
+// put gives its key the version of the change, when it has one.
+func (c *collection) Apply(change Change) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch change.Op {
+	case OpPut:
+		item := rawItem(change.Value)
+		return c.put(context.Background(), change.Id, &item, change.ExpiresAt, anyVersion, change.Version)
+	case OpRemove, OpExpire:
+		return c.remove(context.Background(), change.Id, change.Op, anyVersion)
+	case OpReset:
+		return c.reset()
+	}
+
+	return errors.Errorf("unknown change operation %d", change.Op)
+}
+
+// Snapshot pins a read-only view of the collection at its last sequence
+// number.
+func (c *collection) Snapshot() (Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.changes.lastSeq()
+	c.versions.pin(seq)
+	_, ordered := c.indexer.(afterScanner)
+	return &snapshot{
+		seq:      seq,
+		mu:       &c.mu,
+		versions: c.versions,
+		at:       c.now(),
+		current:  c.current,
+		each:     c.eachAfter,
+		ordered:  ordered,
 	}, nil
 }
+
+func (c *collection) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reset()
+}
+
+func (c *collection) reset() error {
+	if c.versions.active() {
+		seq := c.changes.lastSeq() + 1
+		err := c.each(func(id []byte, v version) error {
+			c.versions.record(id, seq, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.commit(OpReset, nil, 0, 0, nil, nil, c.keyStorage.Reset); err != nil {
+		return err
+	}
+
+	if c.bloom != nil {
+		c.bloom = newBloomFilter(c.opts.bloomItems, c.opts.bloomFPRate)
+	}
+
+	if err := c.freeStorage.Reset(); err != nil {
+		return err
+	}
+
+	return c.dataStorage.Reset()
+}
+
+// Close closes the collection's files. Only the first call does so; later
+// calls return its error.
+func (c *collection) Close() error {
+	c.closeOnce.Do(func() { c.closeErr = c.close() })
+	return c.closeErr
+}
+
+// sync flushes the data, key, free list and change log files to stable
+// storage.
+func (c *collection) sync() error {
+	for _, s := range []Storage{c.dataStorage, c.keyStorage, c.freeStorage} {
+		if err := syncStorage(s); err != nil {
+			return err
+		}
+	}
+
+	return c.changes.sync()
+}
+
+func (c *collection) close() error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+	}
+
+	if c.rotateStop != nil {
+		close(c.rotateStop)
+		<-c.rotateDone
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hub.close()
+
+	// The Bloom filter is only saved as clean once the keys it covers are
+	// synced.
+	err0 := c.sync()
+	if c.bloom != nil && err0 == nil {
+		err0 = c.bloom.save(c.opts.vfs, c.bloomFile, true)
+	}
+
+	err1 := c.dataStorage.Close()
+	err2 := c.keyStorage.Close()
+	err3 := c.freeStorage.Close()
+	err4 := c.changes.close()
+	if c.text != nil {
+		if err := c.text.close(); err != nil && err0 == nil {
+			err0 = err
+		}
+	}
+	if err0 != nil {
+		return err0
+	}
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	if err3 != nil {
+		return err3
+	}
+	if err4 != nil {
+		return err4
+	}
+	return c.lock.Close()
+}
+
+// openBloom loads the Bloom filter saved on close, or rebuilds it from the
+// index, and marks the file dirty until the collection is closed again.
+func (c *collection) openBloom() error {
+	if c.opts.bloomFPRate <= 0 || c.opts.bloomFPRate >= 1 {
+		return errors.New("bloom filter false-positive rate must be between 0 and 1")
+	}
+
+	bloom, err := loadBloomFilter(c.opts.vfs, c.bloomFile, c.opts.bloomItems, c.opts.bloomFPRate)
+	if err != nil {
+		return err
+	}
+
+	c.bloom = bloom
+	if c.bloom == nil {
+		if err := c.rebuildBloom(); err != nil {
+			return err
+		}
+	}
+
+	return c.bloom.save(c.opts.vfs, c.bloomFile, false)
+}
+
+// openText loads the text index, or rebuilds it from the collection when it
+// was not closed cleanly.
+func (c *collection) openText(s Storage) error {
+	text, ok, err := openTextIndex(s, c.opts.text)
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	c.text = text
+	if ok {
+		return nil
+	}
+
+	return c.each(func(id []byte, v version) error {
+		return text.index(id, v.value)
+	})
+}
+
+// Search returns the keys whose indexed text matches query, best match
+// first. Expired keys are left out.
+func (c *collection) Search(query string) ([]SearchResult, error) {
+	if c.text == nil {
+		return nil, ErrNoTextIndex
+	}
+
+	groups, err := parseTextQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.now()
+	results := []SearchResult{}
+	for _, m := range c.text.search(groups) {
+		v, err := c.current([]byte(m.id))
+		if err != nil {
+			return nil, err
+		}
+
+		if !v.visible(now) {
+			continue
+		}
+
+		id := newKeyId()
+		if err := id.UnmarshalBinary([]byte(m.id)); err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{Id: id, Score: m.score})
+	}
+
+	return results, nil
+}
+
+// RotateKey starts re-encrypting the collection in the background when the
+// current key of its key provider is not the one it was last written with,
+// or resumes a rotation that was interrupted.
+func (c *collection) RotateKey() error {
+	if c.keys == nil {
+		return errors.New("collection is not encrypted")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, key, err := c.opts.keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	keys := c.meta.Encryption.Keys
+	last := keys[len(keys)-1]
+	if id != last.Id {
+		k, aead, err := newEncryptionKey(last.Gen+1, id, key)
+		if err != nil {
+			return err
+		}
+
+		c.meta.Encryption.Keys = append(keys, k)
+		if err := writeMeta(c.opts.vfs, c.dir, c.meta); err != nil {
+			c.meta.Encryption.Keys = keys
+			return err
+		}
+		c.keys.add(k.Gen, aead)
+	}
+
+	if len(c.meta.Encryption.Keys) == 1 {
+		return nil
+	}
+
+	if c.rotateDone != nil {
+		select {
+		case <-c.rotateDone:
+		default:
+			return nil
+		}
+	}
+
+	c.rotateErr = nil
+	c.rotateStop = make(chan struct{})
+	c.rotateDone = make(chan struct{})
+	go c.rotate()
+	return nil
+}
+
+// WaitKeyRotation blocks until a rotation started by RotateKey has finished
+// and returns its error.
+func (c *collection) WaitKeyRotation() error {
+	c.mu.RLock()
+	done := c.rotateDone
+	c.mu.RUnlock()
+
+	if done == nil {
+		return nil
+	}
+
+	<-done
+	return c.rotateErr
+}
+
+// rotate re-encrypts every storage under the current key generation and
+// then forgets the older keys. A RotateKey while it runs adds a newer
+// generation, so the passes start over unless the generation they rewrote
+// to is still the current one.
+func (c *collection) rotate() {
+	defer close(c.rotateDone)
+
+	storages := []Storage{c.dataStorage, c.keyStorage, c.freeStorage}
+	if c.text != nil {
+		storages = append(storages, c.text.storage)
+	}
+	passes := []func(<-chan struct{}) (int, error){c.changes.reencrypt}
+	for _, s := range storages {
+		passes = append(passes, unwrapStorage(s).(*encryptedStorage).reencrypt)
+	}
+
+	for {
+		gen := c.keys.currentGen()
+		for _, pass := range passes {
+			for {
+				n, err := pass(c.rotateStop)
+				if err != nil {
+					c.rotateErr = err
+					return
+				}
+
+				select {
+				case <-c.rotateStop:
+					return
+				default:
+				}
+
+				if n == 0 {
+					break
+				}
+			}
+		}
+
+		if c.finishRotation(gen) {
+			return
+		}
+	}
+}
+
+// finishRotation forgets the keys older than gen and returns true, or
+// returns false when a newer generation has been added since the passes
+// started.
+func (c *collection) finishRotation(gen uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := c.meta.Encryption.Keys
+	current := keys[len(keys)-1]
+	if current.Gen != gen {
+		return false
+	}
+
+	c.meta.Encryption.Keys = []encryptionKey{current}
+	if err := writeMeta(c.opts.vfs, c.dir, c.meta); err != nil {
+		c.meta.Encryption.Keys = keys
+		c.rotateErr = err
+		return true
+	}
+	c.keys.retain(current.Gen)
+	return true
+}
+
+func NewCollection(collectionDir string, keySize uint16, keyIdSize uint16, itemSize uint16, opts ...Option) (_ Collection, err error) {
+	o := newOptions(opts)
+
+	if err := checkKeyIdSize(keyIdSize); err != nil {
+		return nil, err
+	}
+
+	if err := finishMigration(o.vfs, collectionDir); err != nil {
+		return nil, err
+	}
+
+	if err := o.vfs.MkdirAll(collectionDir); err != nil {
+		return nil, err
+	}
+
+	lock, err := o.vfs.Lock(filepath.Join(collectionDir, "lock"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "collection %s", collectionDir)
+	}
+
+	// closers release what was opened so far when opening fails.
+	closers := []func() error{lock.Close}
+	defer func() {
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i]()
+			}
+		}
+	}()
+
+	meta, err := openMeta(collectionDir, itemSize, o)
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile := filepath.Join(collectionDir, "data")
+	keyFile := filepath.Join(collectionDir, "key")
+	freeFile := filepath.Join(collectionDir, "free")
+	changesFile := filepath.Join(collectionDir, "changes")
+
+	open := vfsStorageOpener(o.vfs)
+	legacy := open
+	var keys *keyring
+	if meta.Encryption != nil {
+		if keys, err = openKeyring(meta.Encryption, o.keyProvider); err != nil {
+			return nil, err
+		}
+		open = encryptedStorageOpener(o.vfs, keys)
+		legacy = legacyEncryptedStorageOpener(o.vfs, keys)
+	}
+	m := o.metrics
+	if m == nil {
+		m = &metrics{}
+	}
+	open = instrumentedStorageOpener(open, m, o.observer, collectionDir)
+
+	if err := upgradeFormat(o.vfs, collectionDir, meta, keyIdSize, itemSize, legacy, open); err != nil {
+		return nil, err
+	}
+
+	dataKeySize := 0
+	if meta.DataKeys {
+		dataKeySize = int(keyIdSize)
+	}
+
+	var dataStorage Storage
+	switch meta.Compression {
+	case CompressionNone:
+		dataStorage, err = open(dataFile, itemSize+uint16(dataKeySize))
+	case CompressionFlate:
+		dataStorage, err = instrumentedStorageOpener(compressedStorageOpener(o.vfs), m, o.observer, collectionDir)(dataFile, itemSize+uint16(dataKeySize))
+	default:
+		return nil, errors.Errorf("unknown compression %q", meta.Compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, dataStorage.Close)
+
+	keyStorage, err := open(keyFile, keySize)
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, keyStorage.Close)
+
+	freeStorage, err := open(freeFile, freeSlotSize)
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, freeStorage.Close)
+
+	changes, err := openChangelog(o.vfs, changesFile, keyIdSize, itemSize, open)
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, changes.close)
+
+	var indexer Indexer
+	switch meta.Index {
+	case IndexSorted:
+		indexer = NewIndexer(keyIdSize)
+	case IndexHash:
+		indexer = NewHashIndexer(keyIdSize)
+	default:
+		return nil, errors.Errorf("unknown index type %q", meta.Index)
+	}
+
+	c := &collection{
+		dataStorage: dataStorage,
+		keyStorage:  keyStorage,
+		freeStorage: freeStorage,
+		indexer:     indexer,
+		hub:         newWatchHub(),
+		changes:     changes,
+		bloomFile:   filepath.Join(collectionDir, "bloom"),
+		dataKeySize: dataKeySize,
+		metrics:     m,
+		versions:    newVersionStore(),
+		dir:         collectionDir,
+		meta:        meta,
+		keys:        keys,
+		lock:        lock,
+		opts:        o,
+		now:         time.Now,
+	}
+	closers = []func() error{c.Close}
+
+	if o.text != nil {
+		textStorage, err := open(filepath.Join(collectionDir, "text"), textSlotSize(keyIdSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.openText(textStorage); err != nil {
+			return nil, err
+		}
+	} else if err := o.vfs.Remove(filepath.Join(collectionDir, "text")); err != nil && !os.IsNotExist(err) {
+		// An index left by an earlier session would miss this one's writes.
+		return nil, err
+	}
+
+	if keys != nil {
+		if err := c.RotateKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.bloomItems > 0 {
+		if err := c.openBloom(); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.sweepInterval > 0 {
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+		go c.sweepEvery(o.sweepInterval)
+	}
+
+	return c, nil
+}
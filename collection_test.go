@@ -1,13 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/andyautida/kv-db/kvdbtest"
 	"github.com/google/uuid"
 )
 
+var newTestCollection = func(dir string, opts ...Option) (Collection, error) {
+	return NewCollection(dir, KeySize, KeyIdSize, BookSize, opts...)
+}
+
+func setClock(c Collection, now func() time.Time) {
+	switch c := c.(type) {
+	case *collection:
+		c.now = now
+	case *lsmCollection:
+		c.now = now
+	}
+}
+
+// scansInOrder says whether c scans keys in ascending order, which hash
+// indexes do not.
+func scansInOrder(c Collection) bool {
+	fc, ok := c.(*collection)
+	return !ok || fc.meta.Index != IndexHash
+}
+
 func setupCollectionTest(tb testing.TB) (func(tb testing.TB), Collection, []uuid.UUID, []Book) {
-	c, err := NewCollection("./data/test", KeySize, KeyIdSize, BookSize)
+	c, err := newTestCollection("./data/test")
 	if err != nil {
 		tb.Fatalf("collection creation failed: %v", err)
 	}
@@ -168,3 +193,343 @@ func TestCollectionRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestCollectionScan(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	expected := map[uuid.UUID]Book{}
+	for i, id := range ids {
+		expected[id] = books[i]
+	}
+
+	var prev []byte
+	scanned := 0
+	ordered := scansInOrder(c)
+	err := c.Scan(&Book{}, func(id KeyId, item Item) error {
+		b, err := id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if ordered && bytes.Compare(prev, b) != -1 {
+			t.Fatalf("expected scanned ids to be in ascending order")
+		}
+		prev = b
+
+		book := item.(*Book)
+		want := expected[uuid.UUID(b)]
+		if *book != want {
+			t.Fatalf("expected scanned book to be %v; got %v", want, *book)
+		}
+
+		scanned++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("collection scan failed: %v", err)
+	}
+
+	if scanned != 4 {
+		t.Fatalf("expected 4 scanned items; got %d", scanned)
+	}
+}
+
+func TestCollectionLoad(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	newIds := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	entries := []Entry{
+		{Id: &newIds[0], Item: &Book{Title: "Dune", Year: 1965}},
+		{Id: &newIds[1], Item: &Book{Title: "Emma", Year: 1815}},
+		{Id: &newIds[2], Item: &Book{Title: "Ulysses", Year: 1922}},
+		{Id: &ids[0], Item: &Book{Title: "A Clash of Kings", Year: 1998}},
+	}
+
+	n, err := c.Load(entries, ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("collection load failed: %v", err)
+	}
+
+	if n != 4 {
+		t.Fatalf("expected 4 loaded items; got %d", n)
+	}
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("collection count failed: %v", err)
+	}
+
+	if count != 7 {
+		t.Fatalf("expected item count to be 7; got %d", count)
+	}
+
+	book := &Book{}
+	for _, e := range entries {
+		if err := c.Get(e.Id, book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if *book != *e.Item.(*Book) {
+			t.Fatalf("expected loaded book to be %v; got %v", *e.Item.(*Book), *book)
+		}
+	}
+}
+
+func TestCollectionLoadConflict(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	newId := uuid.New()
+	entries := []Entry{
+		{Id: &newId, Item: &Book{Title: "Dune", Year: 1965}},
+		{Id: &ids[1], Item: &Book{Title: "Changed", Year: 2000}},
+	}
+
+	if _, err := c.Load(entries, ConflictFail); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected error to be %v; got %v", ErrKeyExists, err)
+	}
+
+	if err := c.Get(&newId, &Book{}); err == nil {
+		t.Fatal("expected failed load to not write any item")
+	}
+
+	n, err := c.Load(entries, ConflictSkip)
+	if err != nil {
+		t.Fatalf("collection load failed: %v", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 loaded item; got %d", n)
+	}
+
+	book := &Book{}
+	if err := c.Get(&ids[1], book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if *book != books[1] {
+		t.Fatalf("expected skipped book to be %v; got %v", books[1], *book)
+	}
+}
+
+func TestCollectionPutWithTTL(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	now := time.Now()
+	setClock(c, func() time.Time { return now })
+
+	id := uuid.New()
+	expiring := &Book{Title: "Dune", Year: 1965}
+	if err := c.PutWithTTL(&id, expiring, time.Minute); err != nil {
+		t.Fatalf("collection put with ttl failed: %v", err)
+	}
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if *book != *expiring {
+		t.Fatalf("expected book to be %v; got %v", *expiring, *book)
+	}
+
+	now = now.Add(time.Minute)
+	if err := c.Get(&id, book); err == nil || err.Error() != "item not found" {
+		t.Fatalf(`expected error to be "item not found"; got %v`, err)
+	}
+
+	if err := c.Get(&ids[0], book); err != nil {
+		t.Fatalf("expected item without ttl to not expire: %v", err)
+	}
+
+	if err := c.Put(&id, expiring); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	now = now.Add(time.Hour)
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("expected put to clear the ttl: %v", err)
+	}
+}
+
+func TestCollectionSweep(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	now := time.Now()
+	setClock(c, func() time.Time { return now })
+
+	expiringIds := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range expiringIds {
+		if err := c.PutWithTTL(&id, &Book{Title: "Session", Year: 2023}, time.Second); err != nil {
+			t.Fatalf("collection put with ttl failed: %v", err)
+		}
+	}
+
+	now = now.Add(time.Second)
+	swept, err := c.Sweep()
+	if err != nil {
+		t.Fatalf("collection sweep failed: %v", err)
+	}
+
+	if swept != 2 {
+		t.Fatalf("expected 2 swept items; got %d", swept)
+	}
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("collection count failed: %v", err)
+	}
+
+	if count != int64(len(ids)) {
+		t.Fatalf("expected item count to be %d; got %d", len(ids), count)
+	}
+
+	// Fixed-record collections reuse the data slots of swept keys.
+	fc, ok := c.(*collection)
+	if !ok {
+		return
+	}
+
+	dataCount, err := fc.dataStorage.Count()
+	if err != nil {
+		t.Fatalf("data storage count failed: %v", err)
+	}
+
+	newIds := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range newIds {
+		if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	reusedCount, err := fc.dataStorage.Count()
+	if err != nil {
+		t.Fatalf("data storage count failed: %v", err)
+	}
+
+	if reusedCount != dataCount {
+		t.Fatalf("expected swept data slots to be reused; data count grew from %d to %d", dataCount, reusedCount)
+	}
+}
+
+func TestCollectionBackgroundSweep(t *testing.T) {
+	c, err := newTestCollection("./data/test", WithSweepInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("collection reset failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.PutWithTTL(&id, &Book{Title: "Session", Year: 2023}, time.Millisecond); err != nil {
+		t.Fatalf("collection put with ttl failed: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		count, err := c.Count()
+		if err != nil {
+			t.Fatalf("collection count failed: %v", err)
+		}
+
+		if count == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected background sweeper to remove the expired item")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollectionCloseTwice(t *testing.T) {
+	c, err := newTestCollection("./data/test")
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("collection close failed: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("second collection close failed: %v", err)
+	}
+}
+
+func TestCollectionOpenFailureClosesFiles(t *testing.T) {
+	vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+
+	// An invalid Bloom filter rate fails the open once every file is open.
+	if _, err := NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(vfs), WithBloomFilter(100, 2)); err == nil {
+		t.Fatal("expected collection creation to fail")
+	}
+
+	if n := vfs.OpenFiles(); n != 0 {
+		t.Fatalf("expected every file to be closed; %d are open", n)
+	}
+
+	c, err := NewCollection("test", KeySize, KeyIdSize, BookSize, WithVFS(vfs))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	c.Close()
+}
+
+// failingIndexer fails every insert.
+type failingIndexer struct {
+	Indexer
+}
+
+func (idx failingIndexer) Insert(Storage, Item) (int64, error) {
+	return 0, kvdbtest.ErrInjected
+}
+
+func TestCollectionLoadFailureReleasesSlots(t *testing.T) {
+	dir := "./data/test/load"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	indexer := c.(*collection).indexer
+	c.(*collection).indexer = failingIndexer{indexer}
+
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	entries := []Entry{{Id: &ids[0], Item: &Book{Title: "Dune", Year: 1965}}, {Id: &ids[1], Item: &Book{Title: "Emma", Year: 1815}}}
+	if _, err := c.Load(entries, ConflictFail); !errors.Is(err, kvdbtest.ErrInjected) {
+		t.Fatalf("expected error to be %v; got %v", kvdbtest.ErrInjected, err)
+	}
+
+	c.(*collection).indexer = indexer
+	if err := c.Close(); err != nil {
+		t.Fatalf("collection close failed: %v", err)
+	}
+
+	if _, err := Repair(dir, KeyIdSize, BookSize); err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	if count, err := c.Count(); err != nil || count != 0 {
+		t.Fatalf("expected the failed load to leave no items; got %d (%v)", count, err)
+	}
+}
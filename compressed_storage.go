@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type Compression string
+
+const (
+	CompressionNone  Compression = "none"
+	CompressionFlate Compression = "flate"
+)
+
+const compressedBlockRecords = 64
+const compressedBlockEntrySize = 16
+
+// compressedStorage keeps fixed-size items in blocks of compressedBlockRecords
+// that are flate-compressed into the data file. A block index file holds the
+// item count in slot 0 and the offset, length and capacity of every block
+// after it, so an item is read by decompressing only its block.
+type compressedStorage struct {
+	mu       sync.Mutex
+	f        File
+	blocks   Storage
+	itemSize uint16
+	count    int64
+	size     int64
+	cached   int64
+	buf      []byte
+}
+
+type compressedBlock struct {
+	offset   int64
+	length   uint32
+	capacity uint32
+}
+
+func (s *compressedStorage) blockSize() int {
+	return compressedBlockRecords * int(s.itemSize)
+}
+
+func (s *compressedStorage) readEntry(n int64) (compressedBlock, error) {
+	count, err := s.blocks.Count()
+	if err != nil {
+		return compressedBlock{}, err
+	}
+
+	if n+1 >= count {
+		return compressedBlock{}, nil
+	}
+
+	b := make([]byte, compressedBlockEntrySize)
+	if _, err := s.blocks.ReadOffset(b, n+1); err != nil {
+		return compressedBlock{}, err
+	}
+
+	return compressedBlock{
+		offset:   int64(binary.LittleEndian.Uint64(b)),
+		length:   binary.LittleEndian.Uint32(b[8:]),
+		capacity: binary.LittleEndian.Uint32(b[12:]),
+	}, nil
+}
+
+func (s *compressedStorage) writeEntry(n int64, block compressedBlock) error {
+	b := make([]byte, compressedBlockEntrySize)
+	binary.LittleEndian.PutUint64(b, uint64(block.offset))
+	binary.LittleEndian.PutUint32(b[8:], block.length)
+	binary.LittleEndian.PutUint32(b[12:], block.capacity)
+	_, err := s.blocks.WriteOffset(b, n+1)
+	return err
+}
+
+func (s *compressedStorage) writeHeader() error {
+	b := make([]byte, compressedBlockEntrySize)
+	binary.LittleEndian.PutUint64(b, uint64(s.count))
+	binary.LittleEndian.PutUint32(b[8:], compressedBlockRecords)
+	_, err := s.blocks.WriteOffset(b, 0)
+	return err
+}
+
+// readBlock returns the decompressed block n. The returned slice is the
+// storage's cache and stays valid until another block is read.
+func (s *compressedStorage) readBlock(n int64) ([]byte, error) {
+	if n == s.cached {
+		return s.buf, nil
+	}
+
+	block, err := s.readEntry(n)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, s.blockSize())
+	if block.length > 0 {
+		b := make([]byte, block.length)
+		if _, err := s.f.ReadAt(b, block.offset); err != nil {
+			return nil, errors.Wrap(err, "reading compressed block failed")
+		}
+
+		r := flate.NewReader(bytes.NewReader(b))
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, errors.Wrap(err, "decompressing block failed")
+		}
+		r.Close()
+	}
+
+	s.cached = n
+	s.buf = raw
+	return raw, nil
+}
+
+// writeBlock compresses raw in place of block n, moving the block to the end
+// of the file when it no longer fits the space it had.
+func (s *compressedStorage) writeBlock(n int64, raw []byte) error {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	block, err := s.readEntry(n)
+	if err != nil {
+		return err
+	}
+
+	if uint32(buf.Len()) > block.capacity {
+		if block.capacity == 0 || block.offset+int64(block.capacity) != s.size {
+			block.offset = s.size
+		}
+		block.capacity = uint32(buf.Len() + buf.Len()/8)
+		s.size = block.offset + int64(block.capacity)
+	}
+	block.length = uint32(buf.Len())
+
+	if _, err := s.f.WriteAt(buf.Bytes(), block.offset); err != nil {
+		return errors.Wrap(err, "writing compressed block failed")
+	}
+
+	s.cached = n
+	s.buf = raw
+	return s.writeEntry(n, block)
+}
+
+func (s *compressedStorage) ReadOffset(b []byte, off int64) (int, error) {
+	if uint16(len(b)) > s.itemSize {
+		return 0, errors.New("slice length exceeded item size")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= s.count {
+		return 0, errors.Wrap(io.EOF, "read from storage by offset failed")
+	}
+
+	raw, err := s.readBlock(off / compressedBlockRecords)
+	if err != nil {
+		return 0, errors.Wrap(err, "read from storage by offset failed")
+	}
+
+	start := int(off%compressedBlockRecords) * int(s.itemSize)
+	return copy(b, raw[start:]), nil
+}
+
+func (s *compressedStorage) WriteOffset(b []byte, off int64) (int, error) {
+	if uint16(len(b)) > s.itemSize {
+		return 0, errors.New("slice length exceeded item size")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := off / compressedBlockRecords
+	raw, err := s.readBlock(n)
+	if err != nil {
+		return 0, errors.Wrap(err, "write to storage by offset failed")
+	}
+
+	start := int(off%compressedBlockRecords) * int(s.itemSize)
+	copy(raw[start:], b)
+	if err := s.writeBlock(n, raw); err != nil {
+		s.cached = -1
+		return 0, errors.Wrap(err, "write to storage by offset failed")
+	}
+
+	if off >= s.count {
+		s.count = off + 1
+		if err := s.writeHeader(); err != nil {
+			return 0, errors.Wrap(err, "write to storage by offset failed")
+		}
+	}
+
+	return len(b), nil
+}
+
+func (s *compressedStorage) ShiftLeft(targetOffset int64) error {
+	return shiftItemsLeft(context.Background(), s, targetOffset)
+}
+
+func (s *compressedStorage) ShiftRight(targetOffset int64) error {
+	return shiftItemsRight(context.Background(), s, targetOffset)
+}
+
+func (s *compressedStorage) ShiftLeftCtx(ctx context.Context, targetOffset int64) error {
+	return shiftItemsLeft(ctx, s, targetOffset)
+}
+
+func (s *compressedStorage) ShiftRightCtx(ctx context.Context, targetOffset int64) error {
+	return shiftItemsRight(ctx, s, targetOffset)
+}
+
+func (s *compressedStorage) Count() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.count, nil
+}
+
+// Truncate drops the items from count on, zeroing the tail of the last
+// block so that growing the storage again reads zeroes like a file would.
+func (s *compressedStorage) Truncate(count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if count < s.count {
+		blocks := (count + compressedBlockRecords - 1) / compressedBlockRecords
+		if count%compressedBlockRecords != 0 {
+			raw, err := s.readBlock(blocks - 1)
+			if err != nil {
+				return errors.Wrap(err, "truncating storage failed")
+			}
+
+			clear(raw[int(count%compressedBlockRecords)*int(s.itemSize):])
+			if err := s.writeBlock(blocks-1, raw); err != nil {
+				return errors.Wrap(err, "truncating storage failed")
+			}
+		}
+
+		if err := s.blocks.Truncate(blocks + 1); err != nil {
+			return err
+		}
+
+		size := int64(0)
+		for n := int64(0); n < blocks; n++ {
+			block, err := s.readEntry(n)
+			if err != nil {
+				return errors.Wrap(err, "truncating storage failed")
+			}
+			size = max(size, block.offset+int64(block.capacity))
+		}
+
+		if err := s.f.Truncate(size); err != nil {
+			return errors.Wrap(err, "truncating storage failed")
+		}
+
+		s.size = size
+		s.cached = -1
+	}
+
+	s.count = count
+	if err := s.writeHeader(); err != nil {
+		return errors.Wrap(err, "truncating storage failed")
+	}
+
+	return nil
+}
+
+func (s *compressedStorage) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := s.blocks.Reset(); err != nil {
+		return err
+	}
+
+	s.count = 0
+	s.size = 0
+	s.cached = -1
+	return nil
+}
+
+func (s *compressedStorage) ItemSize() uint16 {
+	return s.itemSize
+}
+
+func (s *compressedStorage) Close() error {
+	err := s.f.Close()
+	if blocksErr := s.blocks.Close(); blocksErr != nil && err == nil {
+		err = blocksErr
+	}
+	return err
+}
+
+func (s *compressedStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+
+	return syncStorage(s.blocks)
+}
+
+// NewCompressedStorage opens a Storage keeping its items flate-compressed in
+// filename, with the block index in filename.blocks.
+func NewCompressedStorage(filename string, itemSize uint16) (Storage, error) {
+	return newCompressedStorage(osFS{}, filename, itemSize)
+}
+
+func compressedStorageOpener(vfs VFS) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		return newCompressedStorage(vfs, filename, itemSize)
+	}
+}
+
+func newCompressedStorage(vfs VFS, filename string, itemSize uint16) (Storage, error) {
+	f, err := vfs.OpenFile(filename, os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := newStorage(vfs, filename+".blocks", compressedBlockEntrySize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		blocks.Close()
+		return nil, err
+	}
+
+	s := &compressedStorage{f: f, blocks: blocks, itemSize: itemSize, size: size, cached: -1}
+
+	count, err := blocks.Count()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if count > 0 {
+		b := make([]byte, compressedBlockEntrySize)
+		if _, err := blocks.ReadOffset(b, 0); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(b[8:]) != compressedBlockRecords {
+			s.Close()
+			return nil, errors.New("unsupported compressed block size")
+		}
+		s.count = int64(binary.LittleEndian.Uint64(b))
+	}
+
+	return s, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func setupCompressedStorageTest(tb testing.TB, n int) (func(tb testing.TB), Storage, [][]byte) {
+	if err := os.MkdirAll("./data/test", os.ModePerm); err != nil {
+		tb.Fatalf("storage data directory creation failed: %v", err)
+	}
+
+	s, err := NewCompressedStorage("./data/test/compressed-data", BookSize)
+	if err != nil {
+		tb.Fatalf("storage creation failed: %v", err)
+	}
+
+	if err := s.Reset(); err != nil {
+		tb.Fatalf("storage reset failed: %v", err)
+	}
+
+	records := make([][]byte, n)
+	for i := range records {
+		b, err := (&Book{Title: fmt.Sprintf("Book %d", i), Year: uint16(1900 + i)}).MarshalBinary()
+		if err != nil {
+			tb.Fatalf("book binary marshalling failed: %v", err)
+		}
+		records[i] = b
+
+		if _, err := s.WriteOffset(b, int64(i)); err != nil {
+			tb.Fatalf("storage write offset failed: %v", err)
+		}
+	}
+
+	return func(tb testing.TB) {
+		s.Close()
+	}, s, records
+}
+
+func expectStorageRecords(t *testing.T, s Storage, records [][]byte) {
+	count, err := s.Count()
+	if err != nil {
+		t.Fatalf("storage count failed: %v", err)
+	}
+
+	if count != int64(len(records)) {
+		t.Fatalf("expected count to be %d; got %d", len(records), count)
+	}
+
+	b := make([]byte, s.ItemSize())
+	for i := len(records) - 1; i >= 0; i-- {
+		if _, err := s.ReadOffset(b, int64(i)); err != nil {
+			t.Fatalf("storage read offset failed: %v", err)
+		}
+
+		if !bytes.Equal(b, records[i]) {
+			t.Fatalf("expected record %d to be %q; got %q", i, records[i], b)
+		}
+	}
+}
+
+func TestCompressedStorageReadWriteOffset(t *testing.T) {
+	teardown, s, records := setupCompressedStorageTest(t, 200)
+	defer teardown(t)
+
+	expectStorageRecords(t, s, records)
+
+	stat, err := os.Stat("./data/test/compressed-data")
+	if err != nil {
+		t.Fatalf("storage stat failed: %v", err)
+	}
+
+	if stat.Size() >= int64(len(records)*BookSize/4) {
+		t.Fatalf("expected compressed size below %d bytes; got %d", len(records)*BookSize/4, stat.Size())
+	}
+
+	if _, err := s.ReadOffset(make([]byte, BookSize), 200); err == nil {
+		t.Fatalf("expected read past the end to fail")
+	}
+}
+
+func TestCompressedStorageReopen(t *testing.T) {
+	teardown, s, records := setupCompressedStorageTest(t, 100)
+	teardown(t)
+
+	s, err := NewCompressedStorage("./data/test/compressed-data", BookSize)
+	if err != nil {
+		t.Fatalf("storage reopening failed: %v", err)
+	}
+	defer s.Close()
+
+	expectStorageRecords(t, s, records)
+}
+
+func TestCompressedStorageShift(t *testing.T) {
+	teardown, s, records := setupCompressedStorageTest(t, 70)
+	defer teardown(t)
+
+	if err := s.ShiftRight(10); err != nil {
+		t.Fatalf("storage shift right failed: %v", err)
+	}
+
+	if _, err := s.WriteOffset(records[69], 10); err != nil {
+		t.Fatalf("storage write offset failed: %v", err)
+	}
+
+	shifted := append(append(append([][]byte{}, records[:10]...), records[69]), records[10:]...)
+	expectStorageRecords(t, s, shifted)
+
+	if err := s.ShiftLeft(10); err != nil {
+		t.Fatalf("storage shift left failed: %v", err)
+	}
+
+	expectStorageRecords(t, s, records)
+}
+
+func TestCompressedStorageTruncate(t *testing.T) {
+	teardown, s, records := setupCompressedStorageTest(t, 150)
+	defer teardown(t)
+
+	if err := s.Truncate(65); err != nil {
+		t.Fatalf("storage truncate failed: %v", err)
+	}
+
+	expectStorageRecords(t, s, records[:65])
+
+	if err := s.Truncate(67); err != nil {
+		t.Fatalf("storage truncate failed: %v", err)
+	}
+
+	zero := make([]byte, BookSize)
+	expectStorageRecords(t, s, append(append([][]byte{}, records[:65]...), zero, zero))
+}
+
+func TestCollectionCompressionRecorded(t *testing.T) {
+	dir := "./data/test/compression-recorded"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithCompression(CompressionFlate))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+	c.Close()
+
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := unwrapStorage(c.(*collection).dataStorage).(*compressedStorage); !ok {
+		t.Fatalf("expected reopened collection to use compressed storage")
+	}
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if book.Title != "Dune" {
+		t.Fatalf("expected title to be Dune; got %s", book.Title)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithCompression(CompressionNone)); err == nil {
+		t.Fatalf("expected reopening with other compression to fail")
+	}
+}
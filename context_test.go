@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCollectionContext(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	book := &Book{}
+	if err := c.GetCtx(cancelled, &ids[0], book); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected get with a cancelled context to fail; got %v", err)
+	}
+
+	if err := c.GetCtx(context.Background(), &ids[0], book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if book.Title != books[0].Title {
+		t.Fatalf(`expected book title to be "%v"; got "%v"`, books[0].Title, book.Title)
+	}
+
+	// The scan holds the read lock, so the put waits for it until its
+	// deadline.
+	scanned := 0
+	err := c.Scan(&Book{}, func(KeyId, Item) error {
+		if scanned++; scanned > 1 {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		id := uuid.New()
+		if err := c.PutCtx(ctx, &id, &books[0]); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected put waiting for the lock to time out; got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("collection scan failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scanned = 0
+	err = c.ScanCtx(ctx, &Book{}, func(KeyId, Item) error {
+		scanned++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || scanned != 1 {
+		t.Fatalf("expected scan to stop after cancellation; got %d items and %v", scanned, err)
+	}
+
+	if _, err := c.SweepCtx(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected sweep with a cancelled context to fail; got %v", err)
+	}
+
+	if _, err := c.LoadCtx(cancelled, []Entry{{Id: &ids[0], Item: &books[1]}}, ConflictOverwrite); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected load with a cancelled context to fail; got %v", err)
+	}
+
+	if err := c.RemoveCtx(cancelled, &ids[0]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected remove with a cancelled context to fail; got %v", err)
+	}
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("collection count failed: %v", err)
+	}
+
+	if count != 4 {
+		t.Fatalf("expected item count to be 4; got %d", count)
+	}
+
+	if err := c.Get(&ids[0], book); err != nil || book.Title != books[0].Title {
+		t.Fatalf("expected the cancelled load to leave the key unchanged; got %v, %v", book, err)
+	}
+}
+
+func TestCollectionCancelledShiftLeavesCollectionUnchanged(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	cc := c.(*collection)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The nil UUID sorts first, so inserting it shifts every key record.
+	id := uuid.Nil
+	cc.mu.Lock()
+	err := cc.put(cancelled, &id, &books[0], 0, anyVersion, 0)
+	cc.mu.Unlock()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected put with a cancelled shift to fail; got %v", err)
+	}
+
+	first := 0
+	for i := range ids {
+		if bytes.Compare(ids[i][:], ids[first][:]) < 0 {
+			first = i
+		}
+	}
+
+	cc.mu.Lock()
+	err = cc.remove(cancelled, &ids[first], OpRemove, anyVersion)
+	cc.mu.Unlock()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected remove with a cancelled shift to fail; got %v", err)
+	}
+
+	if err := c.Get(&id, &Book{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the cancelled put not to store the key; got %v", err)
+	}
+
+	book := &Book{}
+	for i := range ids {
+		if err := c.Get(&ids[i], book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if book.Title != books[i].Title {
+			t.Fatalf(`expected book title to be "%v"; got "%v"`, books[i].Title, book.Title)
+		}
+	}
+
+	// The data slot of the cancelled put is reused.
+	if err := c.Put(&id, &books[0]); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	count, err := cc.dataStorage.Count()
+	if err != nil {
+		t.Fatalf("storage count failed: %v", err)
+	}
+
+	if count != 5 {
+		t.Fatalf("expected 5 data slots; got %d", count)
+	}
+}
+
+// cancellingStorage cancels a context on its first write.
+type cancellingStorage struct {
+	Storage
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStorage) WriteOffset(b []byte, off int64) (int, error) {
+	defer s.cancel()
+	return s.Storage.WriteOffset(b, off)
+}
+
+func expectStorageBooks(t *testing.T, s Storage, books []Book) {
+	count, err := s.Count()
+	if err != nil {
+		t.Fatalf("storage count failed: %v", err)
+	}
+
+	if count != int64(len(books)) {
+		t.Fatalf("expected item count to be %d; got %d", len(books), count)
+	}
+
+	b := make([]byte, s.ItemSize())
+	book := &Book{}
+	for i, expected := range books {
+		if _, err := s.ReadOffset(b, int64(i)); err != nil {
+			t.Fatalf("storage read offset failed: %v", err)
+		}
+
+		if err := book.UnmarshalBinary(b); err != nil {
+			t.Fatalf("book binary unmarshalling failed: %v", err)
+		}
+
+		if book.Title != expected.Title {
+			t.Fatalf(`expected book title at %d to be "%v"; got "%v"`, i, expected.Title, book.Title)
+		}
+	}
+}
+
+func TestStorageCancelledShiftRollsBack(t *testing.T) {
+	teardown, s, books := setupStorageTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := shiftItemsLeft(ctx, &cancellingStorage{Storage: s, cancel: cancel}, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected shift left to be cancelled; got %v", err)
+	}
+	expectStorageBooks(t, s, books)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := shiftItemsRight(ctx, &cancellingStorage{Storage: s, cancel: cancel}, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected shift right to be cancelled; got %v", err)
+	}
+	expectStorageBooks(t, s, books)
+}
+
+func TestRWMutexCancelledWait(t *testing.T) {
+	var mu rwMutex
+	mu.RLock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := mu.LockCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected lock to time out; got %v", err)
+	}
+
+	// The writer that gave up no longer keeps readers out.
+	if err := mu.RLockCtx(context.Background()); err != nil {
+		t.Fatalf("read lock failed: %v", err)
+	}
+	mu.RUnlock()
+	mu.RUnlock()
+
+	if err := mu.LockCtx(context.Background()); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	mu.Unlock()
+}
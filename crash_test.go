@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+const crashTestDir = "crash"
+
+// crashConfig runs the crash suites of kvdbtest on a collection in a MemFS,
+// repairing it after each crash.
+func crashConfig(syncOnCommit bool) kvdbtest.CrashConfig {
+	var opts []Option
+	if syncOnCommit {
+		opts = append(opts, WithSyncOnCommit())
+	}
+
+	return kvdbtest.CrashConfig{
+		Open: func(vfs kvdbtest.VFS) (kvdbtest.Collection, error) {
+			c, err := NewCollection(crashTestDir, KeySize, KeyIdSize, BookSize, append(opts, WithVFS(engine(vfs)))...)
+			if err != nil {
+				return nil, err
+			}
+			return kitCollection{c}, nil
+		},
+		Repair: func(vfs kvdbtest.VFS) error {
+			_, err := Repair(crashTestDir, KeyIdSize, BookSize, append(opts, WithVFS(engine(vfs)))...)
+			return err
+		},
+		NewVFS: func() kvdbtest.VFS {
+			return kitVFS{NewMemFS()}
+		},
+		KeySize:      KeyIdSize,
+		ItemSize:     BookSize,
+		NotFound:     ErrNotFound,
+		SyncsCommits: syncOnCommit,
+		LiveSlots: func(c kvdbtest.Collection) (int64, error) {
+			stats, err := c.(kitCollection).Stats()
+			if err != nil {
+				return 0, err
+			}
+			return stats.DataSlots - stats.DeadSlots, nil
+		},
+	}
+}
+
+func TestCrashKit(t *testing.T) {
+	configs := map[string]kvdbtest.CrashConfig{
+		"Close":        crashConfig(false),
+		"SyncOnCommit": crashConfig(true),
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			kvdbtest.TestCrash(t, config)
+		})
+	}
+}
+
+// TestSyncedWritesSurvivePowerLoss checks that what a collection holds when
+// closed, or after every commit with WithSyncOnCommit, survives a power loss.
+func TestSyncedWritesSurvivePowerLoss(t *testing.T) {
+	openFixed := func(opts ...Option) (Collection, error) {
+		return NewCollection(crashTestDir, KeySize, KeyIdSize, BookSize, opts...)
+	}
+	openLSM := func(opts ...Option) (Collection, error) {
+		return NewLSMCollection(crashTestDir, KeyIdSize, BookSize, opts...)
+	}
+
+	tests := map[string]struct {
+		open  func(opts ...Option) (Collection, error)
+		opts  []Option
+		close bool
+	}{
+		"Close":           {open: openFixed, close: true},
+		"SyncOnCommit":    {open: openFixed, opts: []Option{WithSyncOnCommit()}},
+		"LSMClose":        {open: openLSM, close: true},
+		"LSMSyncOnCommit": {open: openLSM, opts: []Option{WithSyncOnCommit()}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+			c, err := test.open(append(test.opts, WithVFS(vfs))...)
+			if err != nil {
+				t.Fatalf("collection creation failed: %v", err)
+			}
+
+			id := uuid.New()
+			if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+				t.Fatalf("collection put failed: %v", err)
+			}
+
+			if test.close {
+				if err := c.Close(); err != nil {
+					t.Fatalf("collection close failed: %v", err)
+				}
+			}
+
+			underlying, err := vfs.crash(true)
+			if err != nil {
+				t.Fatalf("crash failed: %v", err)
+			}
+
+			if c, err = test.open(append(test.opts, WithVFS(underlying))...); err != nil {
+				t.Fatalf("reopening after the crash failed: %v", err)
+			}
+			defer c.Close()
+
+			book := Book{}
+			if err := c.Get(&id, &book); err != nil {
+				t.Fatalf("expected the book to survive the crash; got %v", err)
+			}
+
+			if book.Title != "Dune" {
+				t.Fatalf(`expected book title to be "Dune"; got %q`, book.Title)
+			}
+		})
+	}
+}
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxOpenCollections = 64
+
+var ErrCollectionExists = errors.New("collection already exists")
+var ErrCollectionNotFound = errors.New("collection not found")
+var ErrDBClosed = errors.New("database closed")
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CollectionSpec describes a collection in the catalog of a DB.
+type CollectionSpec struct {
+	Name      string    `json:"name"`
+	KeyIdSize uint16    `json:"keyIdSize"`
+	ItemSize  uint16    `json:"itemSize"`
+	Index     IndexType `json:"index"`
+}
+
+func (s CollectionSpec) keySize() uint16 {
+	return s.KeyIdSize + KeyMetaSize
+}
+
+type catalogEntry struct {
+	spec     CollectionSpec
+	c        Collection
+	active   int
+	pins     int
+	watches  map[*dbWatch]struct{}
+	lastUsed uint64
+	dropped  bool
+	metrics  metrics
+	// ready is set while the collection is opened or closed without db.mu
+	// held, and closed when that is done.
+	ready chan struct{}
+}
+
+type dbWatch struct {
+	cancel context.CancelFunc
+}
+
+// DB owns the collections stored under one data directory. Their specs are
+// kept in a catalog file, and their files are opened when first used and
+// closed again, least recently used first, when more than the configured
+// number of collections are open.
+type DB struct {
+	mu      sync.Mutex
+	dir     string
+	opts    []Option
+	vfs     VFS
+	maxOpen int
+	entries map[string]*catalogEntry
+	open    int
+	clock   uint64
+	closed  bool
+}
+
+func (db *DB) catalogFile() string {
+	return filepath.Join(db.dir, "catalog")
+}
+
+func (db *DB) collectionDir(name string) string {
+	return filepath.Join(db.dir, name)
+}
+
+func (db *DB) loadCatalog() error {
+	b, err := readFile(db.vfs, db.catalogFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	specs := []CollectionSpec{}
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return errors.Wrap(err, "invalid catalog")
+	}
+
+	for _, spec := range specs {
+		db.entries[spec.Name] = &catalogEntry{spec: spec}
+	}
+
+	return nil
+}
+
+func (db *DB) saveCatalog() error {
+	specs := make([]CollectionSpec, 0, len(db.entries))
+	for _, e := range db.entries {
+		specs = append(specs, e.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+	b, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(db.vfs, db.catalogFile(), b)
+}
+
+// wait waits until e is neither opened nor closed without db.mu held. It is
+// called with db.mu held, which it releases while waiting.
+func (db *DB) wait(e *catalogEntry) {
+	for e.ready != nil {
+		ready := e.ready
+		db.mu.Unlock()
+		<-ready
+		db.mu.Lock()
+	}
+}
+
+// openEntry opens the files of e. It is called with db.mu held, which it
+// releases while opening them.
+func (db *DB) openEntry(e *catalogEntry) error {
+	ready := make(chan struct{})
+	e.ready = ready
+	spec := e.spec
+	db.mu.Unlock()
+
+	opts := append(append([]Option{}, db.opts...), WithIndex(spec.Index), withMetrics(&e.metrics))
+	c, err := NewCollection(db.collectionDir(spec.Name), spec.keySize(), spec.KeyIdSize, spec.ItemSize, opts...)
+
+	db.mu.Lock()
+	e.ready = nil
+	close(ready)
+	if err != nil {
+		return err
+	}
+
+	e.c = c
+	db.open++
+	return nil
+}
+
+func (db *DB) closeEntry(e *catalogEntry) error {
+	for w := range e.watches {
+		w.cancel()
+	}
+	e.watches = nil
+
+	if e.c == nil {
+		return nil
+	}
+
+	err := e.c.Close()
+	e.c = nil
+	db.open--
+	return err
+}
+
+// evict picks idle collections, least recently used first, until no more
+// than maxOpen are left open. The caller closes them with closeEvicted once
+// it has released db.mu.
+func (db *DB) evict() []*catalogEntry {
+	var evicted []*catalogEntry
+	for db.open > db.maxOpen {
+		var lru *catalogEntry
+		for _, e := range db.entries {
+			if e.c == nil || e.ready != nil || e.active > 0 || e.pins > 0 || len(e.watches) > 0 {
+				continue
+			}
+			if lru == nil || e.lastUsed < lru.lastUsed {
+				lru = e
+			}
+		}
+
+		if lru == nil {
+			break
+		}
+
+		lru.ready = make(chan struct{})
+		evicted = append(evicted, lru)
+		db.open--
+	}
+
+	return evicted
+}
+
+func (db *DB) closeEvicted(evicted []*catalogEntry) error {
+	var err error
+	for _, e := range evicted {
+		closeErr := e.c.Close()
+
+		db.mu.Lock()
+		e.c = nil
+		close(e.ready)
+		e.ready = nil
+		db.mu.Unlock()
+
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+func (db *DB) acquire(e *catalogEntry) (Collection, error) {
+	db.mu.Lock()
+	db.wait(e)
+
+	for e.c == nil || db.closed || e.dropped {
+		if db.closed {
+			db.mu.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		if e.dropped {
+			db.mu.Unlock()
+			return nil, errors.Wrapf(ErrCollectionNotFound, "collection %q", e.spec.Name)
+		}
+
+		if err := db.openEntry(e); err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	db.clock++
+	e.lastUsed = db.clock
+	e.active++
+	c := e.c
+	evicted := db.evict()
+	db.mu.Unlock()
+
+	if err := db.closeEvicted(evicted); err != nil {
+		db.release(e)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (db *DB) release(e *catalogEntry) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e.active--
+}
+
+func (db *DB) pin(e *catalogEntry, delta int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e.pins += delta
+}
+
+func (db *DB) addWatch(e *catalogEntry, w *dbWatch) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if e.watches == nil {
+		e.watches = map[*dbWatch]struct{}{}
+	}
+	e.watches[w] = struct{}{}
+}
+
+func (db *DB) endWatch(e *catalogEntry, w *dbWatch) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(e.watches, w)
+	w.cancel()
+}
+
+func validateSpec(spec CollectionSpec) error {
+	if !collectionNamePattern.MatchString(spec.Name) || spec.Name == "catalog" {
+		return errors.Errorf("invalid collection name %q", spec.Name)
+	}
+
+	if spec.ItemSize == 0 {
+		return errors.New("item size must be positive")
+	}
+
+	if err := checkKeyIdSize(spec.KeyIdSize); err != nil {
+		return err
+	}
+
+	switch spec.Index {
+	case IndexSorted, IndexHash:
+	default:
+		return errors.Errorf("unknown index type %q", spec.Index)
+	}
+
+	return nil
+}
+
+// CreateCollection adds a collection to the catalog and creates its files.
+func (db *DB) CreateCollection(spec CollectionSpec) (Collection, error) {
+	if spec.Index == "" {
+		spec.Index = IndexSorted
+	}
+
+	if err := validateSpec(spec); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	e, err := db.createEntry(spec)
+	evicted := db.evict()
+	db.mu.Unlock()
+
+	if closeErr := db.closeEvicted(evicted); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbCollection{db: db, e: e}, nil
+}
+
+func (db *DB) createEntry(spec CollectionSpec) (*catalogEntry, error) {
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	if _, ok := db.entries[spec.Name]; ok {
+		return nil, errors.Wrapf(ErrCollectionExists, "collection %q", spec.Name)
+	}
+
+	if _, err := db.vfs.Stat(db.collectionDir(spec.Name)); err == nil {
+		return nil, errors.Errorf("collection directory %q already exists", spec.Name)
+	}
+
+	// The entry keeps the name taken while its files are created.
+	e := &catalogEntry{spec: spec}
+	db.entries[spec.Name] = e
+	if err := db.openEntry(e); err != nil {
+		delete(db.entries, spec.Name)
+		return nil, err
+	}
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	if err := db.saveCatalog(); err != nil {
+		delete(db.entries, spec.Name)
+		db.closeEntry(e)
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Collection returns a handle to the named collection. Its files are opened
+// on first use; closing the handle leaves them to the DB.
+func (db *DB) Collection(name string) (Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	e, ok := db.entries[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrCollectionNotFound, "collection %q", name)
+	}
+
+	return &dbCollection{db: db, e: e}, nil
+}
+
+func (db *DB) ListCollections() []CollectionSpec {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	specs := make([]CollectionSpec, 0, len(db.entries))
+	for _, e := range db.entries {
+		specs = append(specs, e.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+	return specs
+}
+
+// DropCollection removes a collection and its files. Handles to it fail from
+// then on, and its watches end.
+func (db *DB) DropCollection(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e, ok := db.entries[name]
+	if !ok {
+		return errors.Wrapf(ErrCollectionNotFound, "collection %q", name)
+	}
+
+	db.wait(e)
+	if e.dropped || db.entries[name] != e {
+		return errors.Wrapf(ErrCollectionNotFound, "collection %q", name)
+	}
+
+	if e.active > 0 || e.pins > 0 {
+		return errors.Errorf("collection %q is in use", name)
+	}
+
+	if err := db.closeEntry(e); err != nil {
+		return err
+	}
+
+	delete(db.entries, name)
+	if err := db.saveCatalog(); err != nil {
+		db.entries[name] = e
+		return err
+	}
+
+	e.dropped = true
+	return db.vfs.RemoveAll(db.collectionDir(name))
+}
+
+// RenameCollection renames a collection and its directory. Existing handles
+// follow the rename; watches of the collection end.
+func (db *DB) RenameCollection(oldName string, newName string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e, ok := db.entries[oldName]
+	if !ok {
+		return errors.Wrapf(ErrCollectionNotFound, "collection %q", oldName)
+	}
+
+	db.wait(e)
+	if e.dropped || db.entries[oldName] != e {
+		return errors.Wrapf(ErrCollectionNotFound, "collection %q", oldName)
+	}
+
+	spec := e.spec
+	spec.Name = newName
+	if err := validateSpec(spec); err != nil {
+		return err
+	}
+
+	if _, ok := db.entries[newName]; ok {
+		return errors.Wrapf(ErrCollectionExists, "collection %q", newName)
+	}
+
+	if e.active > 0 || e.pins > 0 {
+		return errors.Errorf("collection %q is in use", oldName)
+	}
+
+	if err := db.closeEntry(e); err != nil {
+		return err
+	}
+
+	if err := renameSynced(db.vfs, db.collectionDir(oldName), db.collectionDir(newName)); err != nil {
+		return err
+	}
+
+	delete(db.entries, oldName)
+	oldSpec := e.spec
+	e.spec = spec
+	db.entries[newName] = e
+	if err := db.saveCatalog(); err != nil {
+		delete(db.entries, newName)
+		e.spec = oldSpec
+		db.entries[oldName] = e
+		if renameErr := renameSynced(db.vfs, db.collectionDir(newName), db.collectionDir(oldName)); renameErr != nil {
+			return errors.Wrapf(renameErr, "rolling back rename after %v", err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// MigrateCollection rewrites a collection with a registered migration and
+// records its new item size in the catalog. Watches of the collection end.
+func (db *DB) MigrateCollection(name string, migration string, dryRun bool) (MigrationResult, error) {
+	m, err := lookupMigration(migration)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e, ok := db.entries[name]
+	if !ok {
+		return MigrationResult{}, errors.Wrapf(ErrCollectionNotFound, "collection %q", name)
+	}
+
+	db.wait(e)
+	if e.dropped || db.entries[name] != e {
+		return MigrationResult{}, errors.Wrapf(ErrCollectionNotFound, "collection %q", name)
+	}
+
+	if e.spec.KeyIdSize != m.KeyIdSize || e.spec.ItemSize != m.OldItemSize {
+		return MigrationResult{}, errors.Errorf("migration %q does not apply to collection %q", migration, name)
+	}
+
+	if e.active > 0 || e.pins > 0 {
+		return MigrationResult{}, errors.Errorf("collection %q is in use", name)
+	}
+
+	if err := db.closeEntry(e); err != nil {
+		return MigrationResult{}, err
+	}
+
+	result, err := Migrate(db.collectionDir(name), migration, dryRun, db.opts...)
+	if err != nil || dryRun {
+		return result, err
+	}
+
+	// The files have the new layout from here on, whether or not the catalog
+	// is saved.
+	e.spec.ItemSize = m.NewItemSize
+	return result, db.saveCatalog()
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	var err error
+	for _, e := range db.entries {
+		db.wait(e)
+		if closeErr := db.closeEntry(e); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Open opens the database in dataPath, creating it if needed. The options
+// are applied to every collection opened through it.
+func Open(dataPath string, opts ...Option) (*DB, error) {
+	o := newOptions(opts)
+	if err := o.vfs.MkdirAll(dataPath); err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:     dataPath,
+		opts:    opts,
+		vfs:     o.vfs,
+		maxOpen: o.maxOpenCollections,
+		entries: map[string]*catalogEntry{},
+	}
+
+	if db.maxOpen <= 0 {
+		return nil, errors.New("max open collections must be positive")
+	}
+
+	if err := db.loadCatalog(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// dbCollection is a handle to a collection of a DB. Every call opens the
+// collection if it was closed and keeps it from being evicted while the call
+// runs; watches and snapshots keep it open until they end.
+type dbCollection struct {
+	db *DB
+	e  *catalogEntry
+}
+
+func (h *dbCollection) do(fn func(c Collection) error) error {
+	c, err := h.db.acquire(h.e)
+	if err != nil {
+		return err
+	}
+	defer h.db.release(h.e)
+
+	return fn(c)
+}
+
+func (h *dbCollection) Put(id KeyId, item Item) error {
+	return h.do(func(c Collection) error { return c.Put(id, item) })
+}
+
+func (h *dbCollection) PutWithTTL(id KeyId, item Item, ttl time.Duration) error {
+	return h.do(func(c Collection) error { return c.PutWithTTL(id, item, ttl) })
+}
+
+func (h *dbCollection) Get(id KeyId, item Item) error {
+	return h.do(func(c Collection) error { return c.Get(id, item) })
+}
+
+func (h *dbCollection) Remove(id KeyId) error {
+	return h.do(func(c Collection) error { return c.Remove(id) })
+}
+
+func (h *dbCollection) Scan(item Item, fn func(KeyId, Item) error) error {
+	return h.do(func(c Collection) error { return c.Scan(item, fn) })
+}
+
+func (h *dbCollection) Load(entries []Entry, onConflict ConflictPolicy) (n int, err error) {
+	err = h.do(func(c Collection) error {
+		n, err = c.Load(entries, onConflict)
+		return err
+	})
+	return n, err
+}
+
+func (h *dbCollection) Sweep() (n int, err error) {
+	err = h.do(func(c Collection) error {
+		n, err = c.Sweep()
+		return err
+	})
+	return n, err
+}
+
+func (h *dbCollection) PutCtx(ctx context.Context, id KeyId, item Item) error {
+	return h.do(func(c Collection) error { return c.PutCtx(ctx, id, item) })
+}
+
+func (h *dbCollection) GetCtx(ctx context.Context, id KeyId, item Item) error {
+	return h.do(func(c Collection) error { return c.GetCtx(ctx, id, item) })
+}
+
+func (h *dbCollection) RemoveCtx(ctx context.Context, id KeyId) error {
+	return h.do(func(c Collection) error { return c.RemoveCtx(ctx, id) })
+}
+
+func (h *dbCollection) ScanCtx(ctx context.Context, item Item, fn func(KeyId, Item) error) error {
+	return h.do(func(c Collection) error { return c.ScanCtx(ctx, item, fn) })
+}
+
+func (h *dbCollection) LoadCtx(ctx context.Context, entries []Entry, onConflict ConflictPolicy) (n int, err error) {
+	err = h.do(func(c Collection) error {
+		n, err = c.LoadCtx(ctx, entries, onConflict)
+		return err
+	})
+	return n, err
+}
+
+func (h *dbCollection) SweepCtx(ctx context.Context) (n int, err error) {
+	err = h.do(func(c Collection) error {
+		n, err = c.SweepCtx(ctx)
+		return err
+	})
+	return n, err
+}
+
+// Watch keeps the collection open until the watch ends: when ctx is done,
+// when a WatchBlock subscriber is dropped, or when the collection is
+// dropped, renamed or the DB closed.
+func (h *dbCollection) Watch(ctx context.Context, opts WatchOptions) <-chan Event {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &dbWatch{cancel: cancel}
+
+	var events <-chan Event
+	err := h.do(func(c Collection) error {
+		h.db.addWatch(h.e, w)
+		events = c.Watch(ctx, opts)
+		return nil
+	})
+	if err != nil {
+		cancel()
+		closed := make(chan Event)
+		close(closed)
+		return closed
+	}
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer h.db.endWatch(h.e, w)
+
+		for e := range events {
+			select {
+			case out <- e:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return out
+}
+
+func (h *dbCollection) LastSeq() (seq uint64) {
+	h.do(func(c Collection) error {
+		seq = c.LastSeq()
+		return nil
+	})
+	return seq
+}
+
+func (h *dbCollection) Changes(from uint64, fn func(Change) error) error {
+	return h.do(func(c Collection) error { return c.Changes(from, fn) })
+}
+
+func (h *dbCollection) TruncateChanges(below uint64) error {
+	return h.do(func(c Collection) error { return c.TruncateChanges(below) })
+}
+
+func (h *dbCollection) Apply(change Change) error {
+	return h.do(func(c Collection) error { return c.Apply(change) })
+}
+
+func (h *dbCollection) GetWithVersion(id KeyId, item Item) (version uint64, err error) {
+	err = h.do(func(c Collection) error {
+		version, err = c.GetWithVersion(id, item)
+		return err
+	})
+	return version, err
+}
+
+func (h *dbCollection) PutIfAbsent(id KeyId, item Item) error {
+	return h.do(func(c Collection) error { return c.PutIfAbsent(id, item) })
+}
+
+func (h *dbCollection) CompareAndSwap(id KeyId, expectedVersion uint64, item Item) error {
+	return h.do(func(c Collection) error { return c.CompareAndSwap(id, expectedVersion, item) })
+}
+
+func (h *dbCollection) RemoveIfVersion(id KeyId, expectedVersion uint64) error {
+	return h.do(func(c Collection) error { return c.RemoveIfVersion(id, expectedVersion) })
+}
+
+func (h *dbCollection) Update(id KeyId, item Item, fn func(old Item) (Item, error)) error {
+	return h.do(func(c Collection) error { return c.Update(id, item, fn) })
+}
+
+func (h *dbCollection) Snapshot() (s Snapshot, err error) {
+	err = h.do(func(c Collection) error {
+		if s, err = c.Snapshot(); err == nil {
+			h.db.pin(h.e, 1)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbSnapshot{Snapshot: s, h: h}, nil
+}
+
+func (h *dbCollection) Count() (n int64, err error) {
+	err = h.do(func(c Collection) error {
+		n, err = c.Count()
+		return err
+	})
+	return n, err
+}
+
+func (h *dbCollection) Stats() (stats Stats, err error) {
+	err = h.do(func(c Collection) error {
+		stats, err = c.Stats()
+		return err
+	})
+	return stats, err
+}
+
+func (h *dbCollection) Search(query string) (results []SearchResult, err error) {
+	err = h.do(func(c Collection) error {
+		results, err = Search(c, query)
+		return err
+	})
+	return results, err
+}
+
+// Metrics covers every time the collection was opened by the DB.
+func (h *dbCollection) Metrics() Metrics {
+	return h.e.metrics.snapshot()
+}
+
+func (h *dbCollection) Reset() error {
+	return h.do(func(c Collection) error { return c.Reset() })
+}
+
+// Close leaves the collection's files to the DB, which closes them on
+// eviction, drop, rename or its own Close.
+func (h *dbCollection) Close() error {
+	return nil
+}
+
+type dbSnapshot struct {
+	Snapshot
+	h    *dbCollection
+	once sync.Once
+}
+
+func (s *dbSnapshot) Close() error {
+	err := s.Snapshot.Close()
+	s.once.Do(func() { s.h.db.pin(s.h.e, -1) })
+	return err
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+func setupDBTest(tb testing.TB, opts ...Option) (func(tb testing.TB), *DB) {
+	if err := os.RemoveAll("./data/test/db"); err != nil {
+		tb.Fatalf("db cleanup failed: %v", err)
+	}
+
+	db, err := Open("./data/test/db", opts...)
+	if err != nil {
+		tb.Fatalf("db opening failed: %v", err)
+	}
+
+	return func(tb testing.TB) {
+		db.Close()
+	}, db
+}
+
+func bookSpec(name string) CollectionSpec {
+	spec := BookSpec
+	spec.Name = name
+	return spec
+}
+
+func TestDBCatalogSurvivesReopen(t *testing.T) {
+	teardown, db := setupDBTest(t)
+
+	books, err := db.CreateCollection(bookSpec("books"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	spec := bookSpec("hashed")
+	spec.Index = IndexHash
+	if _, err := db.CreateCollection(spec); err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := books.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	teardown(t)
+
+	db, err = Open("./data/test/db")
+	if err != nil {
+		t.Fatalf("db reopening failed: %v", err)
+	}
+	defer db.Close()
+
+	specs := db.ListCollections()
+	if len(specs) != 2 || specs[0].Name != "books" || specs[1].Name != "hashed" || specs[1].Index != IndexHash {
+		t.Fatalf("expected the books and hashed collections; got %v", specs)
+	}
+
+	books, err = db.Collection("books")
+	if err != nil {
+		t.Fatalf("collection lookup failed: %v", err)
+	}
+
+	book := &Book{}
+	if err := books.Get(&id, book); err != nil || book.Title != "Dune" {
+		t.Fatalf("expected the book to survive reopening; got %v, %v", *book, err)
+	}
+}
+
+func TestDBClosesLeastRecentlyUsed(t *testing.T) {
+	teardown, db := setupDBTest(t, WithMaxOpenCollections(1))
+	defer teardown(t)
+
+	names := []string{"a", "b", "c"}
+	ids := make([]uuid.UUID, len(names))
+	for i, name := range names {
+		c, err := db.CreateCollection(bookSpec(name))
+		if err != nil {
+			t.Fatalf("collection creation failed: %v", err)
+		}
+
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: name, Year: uint16(i)}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+
+		if db.open != 1 {
+			t.Fatalf("expected 1 open collection; got %d", db.open)
+		}
+	}
+
+	if db.entries["c"].c == nil {
+		t.Fatal("expected the most recently used collection to stay open")
+	}
+
+	for i, name := range names {
+		c, err := db.Collection(name)
+		if err != nil {
+			t.Fatalf("collection lookup failed: %v", err)
+		}
+
+		book := &Book{}
+		if err := c.Get(&ids[i], book); err != nil || book.Title != name {
+			t.Fatalf("expected book %q after reopening; got %v, %v", name, *book, err)
+		}
+	}
+
+	a, _ := db.Collection("a")
+	snapshot, err := a.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	b, _ := db.Collection("b")
+	if _, err := b.Count(); err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+
+	if db.entries["a"].c == nil || db.open != 2 {
+		t.Fatalf("expected the pinned collection to stay open; got %d open", db.open)
+	}
+
+	snapshot.Close()
+	if _, err := b.Count(); err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+
+	if db.entries["a"].c != nil || db.open != 1 {
+		t.Fatalf("expected the released collection to be closed; got %d open", db.open)
+	}
+}
+
+func TestDBDropCollection(t *testing.T) {
+	teardown, db := setupDBTest(t)
+	defer teardown(t)
+
+	c, err := db.CreateCollection(bookSpec("books"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := db.DropCollection("books"); err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	if _, err := os.Stat("./data/test/db/books"); !os.IsNotExist(err) {
+		t.Fatalf("expected the collection directory to be removed; got %v", err)
+	}
+
+	if _, err := c.Count(); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected handles to a dropped collection to fail; got %v", err)
+	}
+
+	if _, err := db.Collection("books"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected the dropped collection to be gone; got %v", err)
+	}
+
+	if err := db.DropCollection("books"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected dropping twice to fail; got %v", err)
+	}
+}
+
+func TestDBRenameCollection(t *testing.T) {
+	teardown, db := setupDBTest(t)
+
+	c, err := db.CreateCollection(bookSpec("books"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if _, err := db.CreateCollection(bookSpec("other")); err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := db.RenameCollection("books", "other"); !errors.Is(err, ErrCollectionExists) {
+		t.Fatalf("expected renaming onto an existing collection to fail; got %v", err)
+	}
+
+	if err := db.RenameCollection("books", "novels"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil || book.Title != "Dune" {
+		t.Fatalf("expected the handle to follow the rename; got %v, %v", *book, err)
+	}
+
+	if _, err := db.Collection("books"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected the old name to be gone; got %v", err)
+	}
+	teardown(t)
+
+	db, err = Open("./data/test/db")
+	if err != nil {
+		t.Fatalf("db reopening failed: %v", err)
+	}
+	defer db.Close()
+
+	novels, err := db.Collection("novels")
+	if err != nil {
+		t.Fatalf("collection lookup failed: %v", err)
+	}
+
+	if err := novels.Get(&id, book); err != nil || book.Title != "Dune" {
+		t.Fatalf("expected the renamed collection to survive reopening; got %v, %v", *book, err)
+	}
+}
+
+func TestDBRenameCollectionRollsBack(t *testing.T) {
+	vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+	db, err := Open("db", WithVFS(vfs))
+	if err != nil {
+		t.Fatalf("db opening failed: %v", err)
+	}
+	defer db.Close()
+
+	c, err := db.CreateCollection(bookSpec("books"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	for write := 1; ; write++ {
+		vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write})
+		err := db.RenameCollection("books", "novels")
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, kvdbtest.ErrInjected) {
+			t.Fatalf("expected rename to fail at write %d; got %v", write, err)
+		}
+
+		reopened, err := Open("db", WithVFS(engine(vfs.VFS)))
+		if err != nil {
+			t.Fatalf("db reopening failed: %v", err)
+		}
+		specs := reopened.ListCollections()
+		reopened.Close()
+
+		if len(specs) != 1 || specs[0].Name != "books" {
+			t.Fatalf("expected the catalog to keep the old name after failing at write %d; got %v", write, specs)
+		}
+
+		book := &Book{}
+		if err := c.Get(&id, book); err != nil || book.Title != "Dune" {
+			t.Fatalf("expected the collection to keep its name after failing at write %d; got %v, %v", write, *book, err)
+		}
+	}
+
+	if _, err := vfs.Stat("db/novels"); err != nil {
+		t.Fatalf("expected the renamed directory; got %v", err)
+	}
+}
+
+func TestDBWatchKeepsCollectionOpenUntilItEnds(t *testing.T) {
+	teardown, db := setupDBTest(t, WithMaxOpenCollections(1))
+	defer teardown(t)
+
+	a, err := db.CreateCollection(bookSpec("a"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	b, err := db.CreateCollection(bookSpec("b"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	watched := a.Watch(context.Background(), WatchOptions{})
+	blocked := a.Watch(context.Background(), WatchOptions{Buffer: 1, Policy: WatchBlock, BlockTimeout: 10 * time.Millisecond})
+	if _, err := b.Count(); err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+
+	e := db.entries["a"]
+	if e.c == nil || len(e.watches) != 2 {
+		t.Fatalf("expected the watched collection to stay open; got %d watches", len(e.watches))
+	}
+
+	// The blocking watch is dropped when its buffer stays full.
+	for i := 0; i < 3; i++ {
+		id := uuid.New()
+		if err := a.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	expectWatchEnds(t, blocked)
+	if len(e.watches) != 1 {
+		t.Fatalf("expected the dropped watch to end; got %d watches", len(e.watches))
+	}
+
+	// Dropping the collection ends a watch whose context never ends.
+	if err := db.DropCollection("a"); err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	expectWatchEnds(t, watched)
+	if len(e.watches) != 0 {
+		t.Fatalf("expected the watch to end with the collection; got %d watches", len(e.watches))
+	}
+}
+
+func expectWatchEnds(t *testing.T, events <-chan Event) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("expected the watch to end")
+		}
+	}
+}
+
+func TestDBMigrateCollection(t *testing.T) {
+	teardown, db := setupDBTest(t)
+
+	c, err := db.CreateCollection(bookSpec("books"))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if _, err := db.MigrateCollection("books", "test-book-pages", false); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	teardown(t)
+
+	db, err = Open("./data/test/db")
+	if err != nil {
+		t.Fatalf("db reopening failed: %v", err)
+	}
+	defer db.Close()
+
+	if specs := db.ListCollections(); len(specs) != 1 || specs[0].ItemSize != pagedBookSize {
+		t.Fatalf("expected the catalog to hold the migrated item size; got %v", specs)
+	}
+
+	c, err = db.Collection("books")
+	if err != nil {
+		t.Fatalf("collection lookup failed: %v", err)
+	}
+
+	book := &pagedBook{}
+	if err := c.Get(&id, book); err != nil || book.Title != "Dune" || book.Pages != 100 {
+		t.Fatalf("expected the migrated book; got %+v, %v", *book, err)
+	}
+
+	if _, err := db.MigrateCollection("books", "test-book-pages", false); err == nil {
+		t.Fatal("expected migrating from another item size to fail")
+	}
+}
+
+func TestDBRejectsInvalidCollections(t *testing.T) {
+	teardown, db := setupDBTest(t)
+	defer teardown(t)
+
+	if _, err := db.CreateCollection(bookSpec("books")); err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	if _, err := db.CreateCollection(bookSpec("books")); !errors.Is(err, ErrCollectionExists) {
+		t.Fatalf("expected a duplicate collection to fail; got %v", err)
+	}
+
+	for _, name := range []string{"", "catalog", "../books", "a/b"} {
+		if _, err := db.CreateCollection(bookSpec(name)); err == nil {
+			t.Fatalf("expected collection name %q to be rejected", name)
+		}
+	}
+
+	if err := db.RenameCollection("books", "../x"); err == nil {
+		t.Fatal("expected an invalid new name to be rejected")
+	}
+
+	// Key ids are read back as UUIDs, so no other size would round-trip.
+	for _, size := range []uint16{0, 8, 32} {
+		spec := bookSpec("short")
+		spec.KeyIdSize = size
+		if _, err := db.CreateCollection(spec); err == nil {
+			t.Fatalf("expected key id size %d to be rejected", size)
+		}
+	}
+}
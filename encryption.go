@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const encryptionGenSize = 4
+const encryptionNonceSize = 12
+const encryptionTagSize = 16
+const encryptionOverhead = encryptionGenSize + encryptionNonceSize + encryptionTagSize
+
+const keyCheckText = "kvdb encryption key check"
+
+var ErrAuthentication = errors.New("authentication failed: wrong encryption key or corrupted data")
+
+// KeyProvider supplies the AES-128, AES-192 or AES-256 keys of an encrypted
+// collection. CurrentKey is used for new writes; Key must still return every
+// older key until the collection has been re-encrypted with the current one.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown encryption key %q", id)
+	}
+
+	return key, nil
+}
+
+func NewStaticKeyProvider(currentId string, keys map[string][]byte) KeyProvider {
+	return &staticKeyProvider{current: currentId, keys: keys}
+}
+
+// LoadKeyFile reads a key provider from a file with one "<id> <hex key>" pair
+// per line. The last key in the file is the current one.
+func LoadKeyFile(filename string) (KeyProvider, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &staticKeyProvider{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("key file line %d: expected id and key", line)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "key file line %d", line)
+		}
+
+		p.keys[fields[0]] = key
+		p.current = fields[0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.current == "" {
+		return nil, errors.New("key file has no keys")
+	}
+
+	return p, nil
+}
+
+// encryptionKey records a key an encrypted collection was written with. The
+// check value lets opening fail on a wrong key before any record is read.
+type encryptionKey struct {
+	Gen   uint32 `json:"gen"`
+	Id    string `json:"id"`
+	Check []byte `json:"check"`
+}
+
+// encryptionMeta lists the keys records may be encrypted with, oldest first.
+// More than one key means a rotation to the last key has not finished.
+type encryptionMeta struct {
+	Keys []encryptionKey `json:"keys"`
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption key")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func newEncryptionKey(gen uint32, id string, key []byte) (encryptionKey, cipher.AEAD, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return encryptionKey{}, nil, err
+	}
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return encryptionKey{}, nil, err
+	}
+
+	check := aead.Seal(nonce, nonce, []byte(keyCheckText), nil)
+	return encryptionKey{Gen: gen, Id: id, Check: check}, aead, nil
+}
+
+// keyring holds the ciphers of all key generations in use by the storages of
+// one collection.
+type keyring struct {
+	mu      sync.RWMutex
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+func (r *keyring) get(gen uint32) cipher.AEAD {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.aeads[gen]
+}
+
+func (r *keyring) currentGen() uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current
+}
+
+func (r *keyring) add(gen uint32, aead cipher.AEAD) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.aeads[gen] = aead
+	r.current = gen
+}
+
+func (r *keyring) retain(gen uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for g := range r.aeads {
+		if g != gen {
+			delete(r.aeads, g)
+		}
+	}
+}
+
+func openKeyring(meta *encryptionMeta, p KeyProvider) (*keyring, error) {
+	r := &keyring{aeads: map[uint32]cipher.AEAD{}}
+	for _, k := range meta.Keys {
+		key, err := p.Key(k.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(k.Check) < encryptionNonceSize {
+			return nil, errors.New("invalid encryption key check")
+		}
+
+		plain, err := aead.Open(nil, k.Check[:encryptionNonceSize], k.Check[encryptionNonceSize:], nil)
+		if err != nil || string(plain) != keyCheckText {
+			return nil, errors.Wrapf(ErrAuthentication, "key %q", k.Id)
+		}
+
+		r.add(k.Gen, aead)
+	}
+
+	return r, nil
+}
+
+// encryptedStorage seals every item with AES-GCM into a slot of the
+// underlying storage laid out as key generation(4) | nonce(12) | ciphertext |
+// tag(16). The key generation, the slot's offset and the file's role are
+// authenticated with it, so slots moved to another offset or file fail to
+// open. Every slot up to the count is sealed, with zero items filling gaps,
+// so an all-zero slot is corrupt like any other.
+type encryptedStorage struct {
+	mu       sync.Mutex
+	s        Storage
+	itemSize uint16
+	keys     *keyring
+	file     string
+	legacy   bool // reads slots sealed before format version 5
+}
+
+// fileRole names the file an encrypted storage belongs to for
+// authentication. Suffixes after a dot are dropped, so that the temporary
+// files renamed over a file share its role.
+func fileRole(filename string) string {
+	name, _, _ := strings.Cut(filepath.Base(filename), ".")
+	return name
+}
+
+func (s *encryptedStorage) aad(gen []byte, off int64) []byte {
+	if s.legacy {
+		return gen
+	}
+
+	aad := make([]byte, encryptionGenSize+8, encryptionGenSize+8+len(s.file))
+	copy(aad, gen)
+	binary.LittleEndian.PutUint64(aad[encryptionGenSize:], uint64(off))
+	return append(aad, s.file...)
+}
+
+func (s *encryptedStorage) seal(slot []byte, plain []byte, off int64) error {
+	gen := s.keys.currentGen()
+	binary.LittleEndian.PutUint32(slot, gen)
+	nonce := slot[encryptionGenSize : encryptionGenSize+encryptionNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	s.keys.get(gen).Seal(slot[:encryptionGenSize+encryptionNonceSize], nonce, plain, s.aad(slot[:encryptionGenSize], off))
+	return nil
+}
+
+func (s *encryptedStorage) open(plain []byte, slot []byte, off int64) error {
+	if s.legacy && isZero(slot) {
+		clear(plain)
+		return nil
+	}
+
+	gen := binary.LittleEndian.Uint32(slot)
+	aead := s.keys.get(gen)
+	if aead == nil {
+		return errors.Wrapf(ErrAuthentication, "unknown encryption key generation %d", gen)
+	}
+
+	nonce := slot[encryptionGenSize : encryptionGenSize+encryptionNonceSize]
+	if _, err := aead.Open(plain[:0], nonce, slot[encryptionGenSize+encryptionNonceSize:], s.aad(slot[:encryptionGenSize], off)); err != nil {
+		return ErrAuthentication
+	}
+
+	return nil
+}
+
+func (s *encryptedStorage) read(plain []byte, off int64) error {
+	slot := make([]byte, s.s.ItemSize())
+	if _, err := s.s.ReadOffset(slot, off); err != nil {
+		return err
+	}
+
+	return s.open(plain, slot, off)
+}
+
+func (s *encryptedStorage) write(plain []byte, off int64) error {
+	slot := make([]byte, s.s.ItemSize())
+	if err := s.seal(slot, plain, off); err != nil {
+		return err
+	}
+
+	_, err := s.s.WriteOffset(slot, off)
+	return err
+}
+
+// fill seals zero items into the slots from count up to off.
+func (s *encryptedStorage) fill(count int64, off int64) error {
+	zero := make([]byte, s.itemSize)
+	for ; count < off; count++ {
+		if err := s.write(zero, count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *encryptedStorage) ReadOffset(b []byte, off int64) (int, error) {
+	if uint16(len(b)) > s.itemSize {
+		return 0, errors.New("slice length exceeded item size")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plain := make([]byte, s.itemSize)
+	if err := s.read(plain, off); err != nil {
+		return 0, errors.Wrap(err, "read from storage by offset failed")
+	}
+
+	return copy(b, plain), nil
+}
+
+func (s *encryptedStorage) WriteOffset(b []byte, off int64) (int, error) {
+	if uint16(len(b)) > s.itemSize {
+		return 0, errors.New("slice length exceeded item size")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeOffset(b, off); err != nil {
+		return 0, errors.Wrap(err, "write to storage by offset failed")
+	}
+
+	return len(b), nil
+}
+
+func (s *encryptedStorage) writeOffset(b []byte, off int64) error {
+	count, err := s.s.Count()
+	if err != nil {
+		return err
+	}
+
+	plain := make([]byte, s.itemSize)
+	if len(b) < len(plain) && off < count {
+		if err := s.read(plain, off); err != nil {
+			return err
+		}
+	}
+	copy(plain, b)
+
+	if err := s.fill(count, off); err != nil {
+		return err
+	}
+
+	return s.write(plain, off)
+}
+
+// The shifts move items through encryptedSlots, which seals each one anew
+// for its new offset.
+
+func (s *encryptedStorage) ShiftLeft(targetOffset int64) error {
+	return s.ShiftLeftCtx(context.Background(), targetOffset)
+}
+
+func (s *encryptedStorage) ShiftRight(targetOffset int64) error {
+	return s.ShiftRightCtx(context.Background(), targetOffset)
+}
+
+func (s *encryptedStorage) ShiftLeftCtx(ctx context.Context, targetOffset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shiftItemsLeft(ctx, encryptedSlots{s}, targetOffset)
+}
+
+func (s *encryptedStorage) ShiftRightCtx(ctx context.Context, targetOffset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shiftItemsRight(ctx, encryptedSlots{s}, targetOffset)
+}
+
+func (s *encryptedStorage) Count() (int64, error) {
+	return s.s.Count()
+}
+
+func (s *encryptedStorage) Truncate(count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.truncate(count)
+}
+
+func (s *encryptedStorage) truncate(count int64) error {
+	current, err := s.s.Count()
+	if err != nil {
+		return err
+	}
+
+	if count > current {
+		return s.fill(current, count)
+	}
+
+	return s.s.Truncate(count)
+}
+
+func (s *encryptedStorage) ItemSize() uint16 {
+	return s.itemSize
+}
+
+func (s *encryptedStorage) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.s.Reset()
+}
+
+func (s *encryptedStorage) Close() error {
+	return s.s.Close()
+}
+
+func (s *encryptedStorage) Sync() error {
+	return syncStorage(s.s)
+}
+
+// reencrypt rewrites the items sealed with an older key generation under the
+// current one, one item at a time, and returns how many it rewrote. Shifts
+// running concurrently can move old items behind it, so callers repeat it
+// until it rewrites nothing.
+func (s *encryptedStorage) reencrypt(stop <-chan struct{}) (int, error) {
+	count, err := s.s.Count()
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	slot := make([]byte, s.s.ItemSize())
+	plain := make([]byte, s.itemSize)
+	for off := int64(0); off < count; off++ {
+		select {
+		case <-stop:
+			return rewritten, nil
+		default:
+		}
+
+		done, err := s.reencryptOffset(slot, plain, off)
+		if err != nil {
+			return rewritten, err
+		}
+		if done {
+			rewritten++
+		}
+	}
+
+	return rewritten, nil
+}
+
+func (s *encryptedStorage) reencryptOffset(slot []byte, plain []byte, off int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, err := s.s.Count()
+	if err != nil || off >= count {
+		return false, err
+	}
+
+	if _, err := s.s.ReadOffset(slot, off); err != nil {
+		return false, err
+	}
+
+	if binary.LittleEndian.Uint32(slot) == s.keys.currentGen() {
+		return false, nil
+	}
+
+	if err := s.open(plain, slot, off); err != nil {
+		return false, err
+	}
+
+	if err := s.seal(slot, plain, off); err != nil {
+		return false, err
+	}
+
+	_, err = s.s.WriteOffset(slot, off)
+	return err == nil, err
+}
+
+func isZero(b []byte) bool {
+	return len(bytes.Trim(b, "\x00")) == 0
+}
+
+// encryptedSlots is the Storage of an encryptedStorage for the item moves
+// of shifts, which run under its lock.
+type encryptedSlots struct {
+	s *encryptedStorage
+}
+
+func (e encryptedSlots) ReadOffset(b []byte, off int64) (int, error) {
+	plain := make([]byte, e.s.itemSize)
+	if err := e.s.read(plain, off); err != nil {
+		return 0, err
+	}
+
+	return copy(b, plain), nil
+}
+
+func (e encryptedSlots) WriteOffset(b []byte, off int64) (int, error) {
+	if err := e.s.writeOffset(b, off); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (e encryptedSlots) ShiftLeft(targetOffset int64) error {
+	return shiftItemsLeft(context.Background(), e, targetOffset)
+}
+
+func (e encryptedSlots) ShiftRight(targetOffset int64) error {
+	return shiftItemsRight(context.Background(), e, targetOffset)
+}
+
+func (e encryptedSlots) Count() (int64, error) {
+	return e.s.s.Count()
+}
+
+func (e encryptedSlots) Truncate(count int64) error {
+	return e.s.truncate(count)
+}
+
+func (e encryptedSlots) ItemSize() uint16 {
+	return e.s.itemSize
+}
+
+func (e encryptedSlots) Reset() error {
+	return e.s.s.Reset()
+}
+
+func (e encryptedSlots) Close() error {
+	return nil
+}
+
+type keyRotator interface {
+	RotateKey() error
+	WaitKeyRotation() error
+}
+
+type storageOpener func(filename string, itemSize uint16) (Storage, error)
+
+func vfsStorageOpener(vfs VFS) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		return newStorage(vfs, filename, itemSize)
+	}
+}
+
+func encryptedStorageOpener(vfs VFS, keys *keyring) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		return openEncryptedStorage(vfs, keys, filename, itemSize, false)
+	}
+}
+
+// legacyEncryptedStorageOpener reads the files of encrypted collections
+// older than format version 5 for their upgrade.
+func legacyEncryptedStorageOpener(vfs VFS, keys *keyring) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		return openEncryptedStorage(vfs, keys, filename, itemSize, true)
+	}
+}
+
+func openEncryptedStorage(vfs VFS, keys *keyring, filename string, itemSize uint16, legacy bool) (Storage, error) {
+	if int(itemSize)+encryptionOverhead > math.MaxUint16 {
+		return nil, errors.New("item size too large for encryption")
+	}
+
+	s, err := newStorage(vfs, filename, itemSize+encryptionOverhead)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedStorage{s: s, itemSize: itemSize, keys: keys, file: fileRole(filename), legacy: legacy}, nil
+}
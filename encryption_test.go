@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var testKeys = map[string][]byte{
+	"k1": bytes.Repeat([]byte{1}, 32),
+	"k2": bytes.Repeat([]byte{2}, 32),
+	"k3": bytes.Repeat([]byte{3}, 32),
+}
+
+func setupEncryptionTest(tb testing.TB, dir string) (Collection, []uuid.UUID) {
+	if err := os.RemoveAll(dir); err != nil {
+		tb.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(NewStaticKeyProvider("k1", testKeys)))
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	ids := make([]uuid.UUID, 50)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: "Confidential Report", Year: uint16(2000 + i)}); err != nil {
+			tb.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	return c, ids
+}
+
+func expectBooks(t *testing.T, c Collection, ids []uuid.UUID) {
+	book := &Book{}
+	for i, id := range ids {
+		if err := c.Get(&id, book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if book.Year != uint16(2000+i) {
+			t.Fatalf("expected year to be %d; got %d", 2000+i, book.Year)
+		}
+	}
+}
+
+func TestEncryptedCollectionFiles(t *testing.T) {
+	dir := "./data/test/encrypted-files"
+	c, ids := setupEncryptionTest(t, dir)
+	c.Close()
+
+	for _, name := range []string{"data", "key", "changes"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", name, err)
+		}
+
+		if bytes.Contains(b, []byte("Confidential")) || bytes.Contains(b, ids[0][:]) {
+			t.Fatalf("expected %s file to be encrypted", name)
+		}
+	}
+}
+
+func TestEncryptedCollectionWrongKey(t *testing.T) {
+	dir := "./data/test/encrypted-wrong-key"
+	c, _ := setupEncryptionTest(t, dir)
+	c.Close()
+
+	wrong := NewStaticKeyProvider("k1", map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32)})
+	_, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(wrong))
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected authentication error; got %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize); err == nil {
+		t.Fatalf("expected opening without a key provider to fail")
+	}
+}
+
+func TestEncryptedCollectionTampered(t *testing.T) {
+	dir := "./data/test/encrypted-tampered"
+	c, ids := setupEncryptionTest(t, dir)
+	c.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "data"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("opening data file failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 40); err != nil {
+		t.Fatalf("tampering data file failed: %v", err)
+	}
+	f.Close()
+
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(NewStaticKeyProvider("k1", testKeys)))
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	failed := 0
+	for _, id := range ids {
+		if err := c.Get(&id, &Book{}); errors.Is(err, ErrAuthentication) {
+			failed++
+		}
+	}
+
+	if failed != 1 {
+		t.Fatalf("expected one record to fail authentication; got %d", failed)
+	}
+}
+
+func TestEncryptedCollectionTamperedSlots(t *testing.T) {
+	tests := map[string]struct {
+		tamper func(b []byte, slot int)
+		failed int
+	}{
+		"Zeroed": {
+			tamper: func(b []byte, slot int) {
+				copy(b[slot:2*slot], make([]byte, slot))
+			},
+			failed: 1,
+		},
+		"Swapped": {
+			tamper: func(b []byte, slot int) {
+				first := append([]byte(nil), b[:slot]...)
+				copy(b[:slot], b[slot:2*slot])
+				copy(b[slot:2*slot], first)
+			},
+			failed: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := "./data/test/encrypted-tampered-" + strings.ToLower(name)
+			c, ids := setupEncryptionTest(t, dir)
+			c.Close()
+
+			filename := filepath.Join(dir, "data")
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("reading data file failed: %v", err)
+			}
+
+			if len(b)%len(ids) != 0 {
+				t.Fatalf("expected data file to hold %d slots; got %d bytes", len(ids), len(b))
+			}
+
+			test.tamper(b, len(b)/len(ids))
+			if err := os.WriteFile(filename, b, 0644); err != nil {
+				t.Fatalf("tampering data file failed: %v", err)
+			}
+
+			c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(NewStaticKeyProvider("k1", testKeys)))
+			if err != nil {
+				t.Fatalf("collection reopening failed: %v", err)
+			}
+			defer c.Close()
+
+			failed := 0
+			for _, id := range ids {
+				if err := c.Get(&id, &Book{}); errors.Is(err, ErrAuthentication) {
+					failed++
+				} else if err != nil {
+					t.Fatalf("collection get failed: %v", err)
+				}
+			}
+
+			if failed != test.failed {
+				t.Fatalf("expected %d records to fail authentication; got %d", test.failed, failed)
+			}
+		})
+	}
+}
+
+func TestEncryptedCollectionRotateKey(t *testing.T) {
+	dir := "./data/test/encrypted-rotate"
+	c, ids := setupEncryptionTest(t, dir)
+	c.Close()
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(NewStaticKeyProvider("k2", testKeys)))
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+
+	extra := uuid.New()
+	if err := c.Put(&extra, &Book{Title: "Added During Rotation", Year: 2024}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.(keyRotator).WaitKeyRotation(); err != nil {
+		t.Fatalf("key rotation failed: %v", err)
+	}
+
+	expectBooks(t, c, ids)
+	c.Close()
+
+	k2Only := NewStaticKeyProvider("k2", map[string][]byte{"k2": testKeys["k2"]})
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(k2Only))
+	if err != nil {
+		t.Fatalf("collection reopening with the new key only failed: %v", err)
+	}
+	defer c.Close()
+
+	expectBooks(t, c, ids)
+	if err := c.Get(&extra, &Book{}); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	k1Only := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeys["k1"]})
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(k1Only)); err == nil {
+		t.Fatalf("expected opening with the retired key to fail")
+	}
+}
+
+func TestEncryptedCollectionRotateKeyTwice(t *testing.T) {
+	dir := "./data/test/encrypted-rotate-twice"
+	c, ids := setupEncryptionTest(t, dir)
+	c.Close()
+
+	keys := NewStaticKeyProvider("k2", testKeys)
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+
+	keys.(*staticKeyProvider).current = "k3"
+	if err := c.(keyRotator).RotateKey(); err != nil {
+		t.Fatalf("key rotation failed: %v", err)
+	}
+
+	if err := c.(keyRotator).WaitKeyRotation(); err != nil {
+		t.Fatalf("key rotation failed: %v", err)
+	}
+
+	expectBooks(t, c, ids)
+	c.Close()
+
+	k3Only := NewStaticKeyProvider("k3", map[string][]byte{"k3": testKeys["k3"]})
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize, WithEncryption(k3Only))
+	if err != nil {
+		t.Fatalf("collection reopening with the newest key only failed: %v", err)
+	}
+	defer c.Close()
+
+	expectBooks(t, c, ids)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	if err := os.MkdirAll("./data/test", os.ModePerm); err != nil {
+		t.Fatalf("test directory creation failed: %v", err)
+	}
+
+	filename := "./data/test/keys"
+	content := "# keys\nk1 " + strings.Repeat("01", 32) + "\n\nk2 " + strings.Repeat("02", 32) + "\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing key file failed: %v", err)
+	}
+
+	p, err := LoadKeyFile(filename)
+	if err != nil {
+		t.Fatalf("loading key file failed: %v", err)
+	}
+
+	id, key, err := p.CurrentKey()
+	if err != nil {
+		t.Fatalf("current key failed: %v", err)
+	}
+
+	if id != "k2" || !bytes.Equal(key, testKeys["k2"]) {
+		t.Fatalf("expected current key k2; got %s", id)
+	}
+
+	if key, err := p.Key("k1"); err != nil || !bytes.Equal(key, testKeys["k1"]) {
+		t.Fatalf("expected key k1; got %x, %v", key, err)
+	}
+}
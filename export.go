@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const importBatchSize = 1024
+
+type Format int
+
+const (
+	FormatJSONLines Format = iota
+	FormatCSV
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "jsonl", "ndjson":
+		return FormatJSONLines, nil
+	case "csv":
+		return FormatCSV, nil
+	}
+
+	return 0, errors.Errorf("unknown format %q", s)
+}
+
+type CSVItem interface {
+	Item
+	CSVHeader() []string
+	MarshalCSV() ([]string, error)
+	UnmarshalCSV([]string) error
+}
+
+type jsonRecord struct {
+	Id   string          `json:"id"`
+	Item json.RawMessage `json:"item"`
+}
+
+func marshalKeyText(id KeyId) (string, error) {
+	if m, ok := id.(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+
+	b, err := id.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func unmarshalKeyText(s string) (KeyId, error) {
+	id := newKeyId()
+	if u, ok := id.(encoding.TextUnmarshaler); ok {
+		return id, u.UnmarshalText([]byte(s))
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return id, id.UnmarshalBinary(b)
+}
+
+func Export(w io.Writer, c Collection, format Format, item Item) error {
+	switch format {
+	case FormatJSONLines:
+		return exportJSONLines(w, c, item)
+	case FormatCSV:
+		csvItem, ok := item.(CSVItem)
+		if !ok {
+			return errors.New("item does not support csv")
+		}
+		return exportCSV(w, c, csvItem)
+	}
+
+	return errors.New("unknown format")
+}
+
+func exportJSONLines(w io.Writer, c Collection, item Item) error {
+	enc := json.NewEncoder(w)
+	return c.Scan(item, func(id KeyId, item Item) error {
+		idText, err := marshalKeyText(id)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+
+		return enc.Encode(jsonRecord{Id: idText, Item: b})
+	})
+}
+
+func exportCSV(w io.Writer, c Collection, item CSVItem) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"id"}, item.CSVHeader()...)); err != nil {
+		return err
+	}
+
+	err := c.Scan(item, func(id KeyId, _ Item) error {
+		idText, err := marshalKeyText(id)
+		if err != nil {
+			return err
+		}
+
+		fields, err := item.MarshalCSV()
+		if err != nil {
+			return err
+		}
+
+		return cw.Write(append([]string{idText}, fields...))
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Import loads the entries read from r into c in batches of importBatchSize.
+// Each batch is loaded at once, but an import is not: when a batch fails, as
+// with ConflictFail on an existing key, the batches before it stay loaded and
+// the returned count says how many entries they held.
+func Import(r io.Reader, c Collection, format Format, newItem func() Item, onConflict ConflictPolicy) (int, error) {
+	imported := 0
+	batch := make([]Entry, 0, importBatchSize)
+	flush := func() error {
+		n, err := c.Load(batch, onConflict)
+		imported += n
+		batch = batch[:0]
+		return err
+	}
+
+	add := func(e Entry) error {
+		batch = append(batch, e)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return flush()
+	}
+
+	var err error
+	switch format {
+	case FormatJSONLines:
+		err = importJSONLines(r, newItem, add)
+	case FormatCSV:
+		err = importCSV(r, newItem, add)
+	default:
+		err = errors.New("unknown format")
+	}
+	if err != nil {
+		return imported, err
+	}
+
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
+
+func importJSONLines(r io.Reader, newItem func() Item, add func(Entry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		var rec jsonRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return errors.Wrapf(err, "line %d", line)
+		}
+
+		id, err := unmarshalKeyText(rec.Id)
+		if err != nil {
+			return errors.Wrapf(err, "line %d: invalid id", line)
+		}
+
+		item := newItem()
+		if err := json.Unmarshal(rec.Item, item); err != nil {
+			return errors.Wrapf(err, "line %d: invalid item", line)
+		}
+
+		if err := add(Entry{Id: id, Item: item}); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func importCSV(r io.Reader, newItem func() Item, add func(Entry) error) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	item, ok := newItem().(CSVItem)
+	if !ok {
+		return errors.New("item does not support csv")
+	}
+
+	expected := append([]string{"id"}, item.CSVHeader()...)
+	if strings.Join(header, ",") != strings.Join(expected, ",") {
+		return errors.Errorf("expected csv header %q; got %q", strings.Join(expected, ","), strings.Join(header, ","))
+	}
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id, err := unmarshalKeyText(record[0])
+		if err != nil {
+			return errors.Wrapf(err, "line %d: invalid id", line)
+		}
+
+		item, ok := newItem().(CSVItem)
+		if !ok {
+			return errors.New("item does not support csv")
+		}
+
+		if err := item.UnmarshalCSV(record[1:]); err != nil {
+			return errors.Wrapf(err, "line %d: invalid item", line)
+		}
+
+		if err := add(Entry{Id: id, Item: item}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func setupImportTest(tb testing.TB) (func(tb testing.TB), Collection) {
+	c, err := newTestCollection("./data/test/import")
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		tb.Fatalf("collection reset failed: %v", err)
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c
+}
+
+func newBook() Item {
+	return &Book{}
+}
+
+func testExportImportRoundTrip(t *testing.T, format Format) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	importTeardown, imported := setupImportTest(t)
+	defer importTeardown(t)
+
+	var buf bytes.Buffer
+	if err := Export(&buf, c, format, &Book{}); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	n, err := Import(&buf, imported, format, newBook, ConflictFail)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	if n != len(ids) {
+		t.Fatalf("expected %d imported items; got %d", len(ids), n)
+	}
+
+	book := &Book{}
+	for i, id := range ids {
+		if err := imported.Get(&id, book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if *book != books[i] {
+			t.Fatalf("expected imported book to be %v; got %v", books[i], *book)
+		}
+	}
+}
+
+func TestExportImportJSONLines(t *testing.T) {
+	testExportImportRoundTrip(t, FormatJSONLines)
+}
+
+func TestExportImportCSV(t *testing.T) {
+	testExportImportRoundTrip(t, FormatCSV)
+}
+
+func TestExportJSONLinesFormat(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	id := uuid.MustParse("a4a39129-7fb5-4855-9f80-6d290d52b812")
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, c, FormatJSONLines, &Book{}); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	expected := `{"id":"a4a39129-7fb5-4855-9f80-6d290d52b812","item":{"title":"Dune","year":1965}}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("expected export to be %q; got %q", expected, buf.String())
+	}
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	id := uuid.MustParse("a4a39129-7fb5-4855-9f80-6d290d52b812")
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	input := "id,title,year\na4a39129-7fb5-4855-9f80-6d290d52b812,Dune Messiah,1969\n"
+
+	if _, err := Import(strings.NewReader(input), c, FormatCSV, newBook, ConflictFail); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected error to be %v; got %v", ErrKeyExists, err)
+	}
+
+	n, err := Import(strings.NewReader(input), c, FormatCSV, newBook, ConflictSkip)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("expected 0 imported items; got %d", n)
+	}
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if book.Title != "Dune" {
+		t.Fatalf(`expected book title to be "Dune"; got "%s"`, book.Title)
+	}
+
+	if _, err := Import(strings.NewReader(input), c, FormatCSV, newBook, ConflictOverwrite); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if book.Title != "Dune Messiah" || book.Year != 1969 {
+		t.Fatalf("expected overwritten book; got %v", *book)
+	}
+}
+
+func TestImportTitleTooLong(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	input := "id,title,year\na4a39129-7fb5-4855-9f80-6d290d52b812," + strings.Repeat("a", BookTitleSize+1) + ",1969\n"
+	if _, err := Import(strings.NewReader(input), c, FormatCSV, newBook, ConflictFail); err == nil {
+		t.Fatal("expected import of a title too long to fail")
+	}
+
+	if count, err := c.Count(); err != nil || count != 0 {
+		t.Fatalf("expected empty collection; got %d (%v)", count, err)
+	}
+}
+
+func TestImportCSVHeader(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	input := "id,year,title\na4a39129-7fb5-4855-9f80-6d290d52b812,1969,Dune Messiah\n"
+	if _, err := Import(strings.NewReader(input), c, FormatCSV, newBook, ConflictFail); err == nil {
+		t.Fatal("expected import with a mismatched csv header to fail")
+	}
+}
+
+func TestImportConflictFailCount(t *testing.T) {
+	teardown, c := setupImportTest(t)
+	defer teardown(t)
+
+	existing := uuid.New()
+	if err := c.Put(&existing, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	var input strings.Builder
+	input.WriteString("id,title,year\n")
+	for i := 0; i < importBatchSize; i++ {
+		input.WriteString(uuid.NewString() + ",Dune Messiah,1969\n")
+	}
+	input.WriteString(existing.String() + ",Children of Dune,1976\n")
+
+	n, err := Import(strings.NewReader(input.String()), c, FormatCSV, newBook, ConflictFail)
+	if !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected error to be %v; got %v", ErrKeyExists, err)
+	}
+
+	if n != importBatchSize {
+		t.Fatalf("expected %d imported items; got %d", importBatchSize, n)
+	}
+
+	if count, err := c.Count(); err != nil || count != importBatchSize+1 {
+		t.Fatalf("expected %d items; got %d (%v)", importBatchSize+1, count, err)
+	}
+}
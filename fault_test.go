@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+// faultFS runs the engine on a kvdbtest.FaultFS.
+type faultFS struct {
+	*kvdbtest.FaultFS
+}
+
+func newFaultFS(vfs VFS, f kvdbtest.Fault) faultFS {
+	return faultFS{kvdbtest.NewFaultFS(kitVFS{vfs}, f)}
+}
+
+func (f faultFS) OpenFile(name string, flag int) (File, error) {
+	return f.FaultFS.OpenFile(name, flag)
+}
+
+// crash crashes f as kvdbtest.FaultFS.Crash does and returns the engine's
+// file system to reopen the files with.
+func (f faultFS) crash(dropUnsynced bool) (VFS, error) {
+	vfs, err := f.Crash(dropUnsynced)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine(vfs), nil
+}
+
+func TestFaultFSFailsNthWrite(t *testing.T) {
+	vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{Write: 2, Err: syscall.ENOSPC, Torn: true})
+
+	f, err := vfs.OpenFile("file", os.O_CREATE)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt([]byte("abcd"), 0); err != nil {
+		t.Fatalf("first write failed: %v", err)
+	}
+
+	if n, err := f.WriteAt([]byte("efgh"), 4); !errors.Is(err, syscall.ENOSPC) || n != 2 {
+		t.Fatalf("expected a torn write of 2 bytes failing with ENOSPC; got %d, %v", n, err)
+	}
+
+	// Without crash, the faults stop after the failing write.
+	if _, err := f.WriteAt([]byte("ij"), 8); err != nil {
+		t.Fatalf("third write failed: %v", err)
+	}
+
+	b, err := readFile(vfs, "file")
+	if err != nil {
+		t.Fatalf("reading file failed: %v", err)
+	}
+
+	if !bytes.Equal(b, []byte("abcdef\x00\x00ij")) {
+		t.Fatalf("expected torn file contents; got %q", b)
+	}
+}
+
+func TestFaultFSCrashDropsUnsyncedWrites(t *testing.T) {
+	vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+	if err := vfs.MkdirAll("dir"); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	f, err := vfs.OpenFile("dir/file", os.O_CREATE)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte("synced"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte(" and lost"), 6); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if err := vfs.Rename("dir", "moved"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	if _, err := vfs.Lock("moved/lock"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	underlying, err := vfs.crash(true)
+	if err != nil {
+		t.Fatalf("crash failed: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte("late"), 0); !errors.Is(err, kvdbtest.ErrInjected) {
+		t.Fatalf("expected writes after the crash to fail; got %v", err)
+	}
+
+	b, err := readFile(underlying, "moved/file")
+	if err != nil {
+		t.Fatalf("reading file failed: %v", err)
+	}
+
+	if string(b) != "synced" {
+		t.Fatalf(`expected only "synced" to survive the crash; got %q`, b)
+	}
+
+	lock, err := underlying.Lock("moved/lock")
+	if err != nil {
+		t.Fatalf("expected the crash to release the lock; got %v", err)
+	}
+	lock.Close()
+}
+
+func TestStorageShiftsRollBackFailedWrites(t *testing.T) {
+	records := [][]byte{}
+	for i := 0; i < 5; i++ {
+		records = append(records, bytes.Repeat([]byte{byte('a' + i)}, BookSize))
+	}
+
+	// Shifting right or left around slot 1 of 5 takes 4 writes.
+	for write := 1; write <= 4; write++ {
+		for _, torn := range []bool{false, true} {
+			vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+			s, err := newStorage(vfs, "storage", BookSize)
+			if err != nil {
+				t.Fatalf("storage creation failed: %v", err)
+			}
+
+			for i, r := range records {
+				if _, err := s.WriteOffset(r, int64(i)); err != nil {
+					t.Fatalf("storage write offset failed: %v", err)
+				}
+			}
+
+			vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Torn: torn})
+			if err := s.ShiftRight(1); !errors.Is(err, kvdbtest.ErrInjected) {
+				t.Fatalf("expected shift right to fail at write %d; got %v", write, err)
+			}
+			expectStorageRecords(t, s, records)
+
+			vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Torn: torn})
+			if err := s.ShiftLeft(1); !errors.Is(err, kvdbtest.ErrInjected) {
+				t.Fatalf("expected shift left to fail at write %d; got %v", write, err)
+			}
+			expectStorageRecords(t, s, records)
+
+			s.Close()
+		}
+	}
+}
+
+func TestIndexerRollsBackFailedInserts(t *testing.T) {
+	ids := make([]uuid.UUID, 6)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+	ids = makeSortedIds(t, ids)
+
+	record := func(i int) []byte {
+		b, err := (&key{id: &ids[i]}).MarshalBinary()
+		if err != nil {
+			t.Fatalf("key marshalling failed: %v", err)
+		}
+		return b
+	}
+	records := [][]byte{record(1), record(3)}
+
+	idx := &indexer{keySize: KeyIdSize}
+	inserts := map[string]func(s Storage) error{
+		"Append": func(s Storage) error {
+			_, err := idx.Insert(s, &key{id: &ids[5]})
+			return err
+		},
+		"Sorted": func(s Storage) error {
+			return idx.insertSorted(s, [][]byte{record(0), record(2), record(4)})
+		},
+	}
+
+	for name, insert := range inserts {
+		t.Run(name, func(t *testing.T) {
+			for write, done := 1, false; !done; write++ {
+				for _, torn := range []bool{false, true} {
+					vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+					s, err := newStorage(vfs, "key", KeySize)
+					if err != nil {
+						t.Fatalf("storage creation failed: %v", err)
+					}
+
+					for i, r := range records {
+						if _, err := s.WriteOffset(r, int64(i)); err != nil {
+							t.Fatalf("storage write offset failed: %v", err)
+						}
+					}
+
+					vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Torn: torn})
+					if err := insert(s); err == nil {
+						done = true
+					} else if !errors.Is(err, kvdbtest.ErrInjected) {
+						t.Fatalf("expected the insert to fail at write %d; got %v", write, err)
+					} else {
+						expectStorageRecords(t, s, records)
+					}
+					s.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestHashIndexerSurvivesFailedSplits(t *testing.T) {
+	ids := make([]uuid.UUID, hashBucketSize+1)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	for write, done := 1, false; !done; write++ {
+		for _, crash := range []bool{false, true} {
+			vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+			s, err := newStorage(vfs, "key", KeySize)
+			if err != nil {
+				t.Fatalf("storage creation failed: %v", err)
+			}
+
+			idx := NewHashIndexer(KeyIdSize)
+			for i := range ids[:hashBucketSize] {
+				if _, err := idx.Insert(s, &key{id: &ids[i], offset: uint64(i)}); err != nil {
+					t.Fatalf("indexer insertion failed: %v", err)
+				}
+			}
+
+			vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Torn: true, Crash: crash})
+			_, err = idx.Insert(s, &key{id: &ids[hashBucketSize], offset: hashBucketSize})
+			if err == nil {
+				done = true
+				s.Close()
+				continue
+			}
+
+			if !errors.Is(err, kvdbtest.ErrInjected) {
+				t.Fatalf("expected the insert to fail at write %d; got %v", write, err)
+			}
+
+			if crash {
+				s.Close()
+				underlying, err := vfs.crash(false)
+				if err != nil {
+					t.Fatalf("crash failed: %v", err)
+				}
+
+				if s, err = newStorage(underlying, "key", KeySize); err != nil {
+					t.Fatalf("storage reopening failed: %v", err)
+				}
+				idx = NewHashIndexer(KeyIdSize)
+			}
+
+			// A torn header write stores the whole header, so the new key
+			// may have made it in.
+			expectHashIndexerFinds(t, s, idx, ids[:hashBucketSize])
+			scanned := map[uuid.UUID]bool{}
+			b := make([]byte, KeySize)
+			err = idx.Scan(s, func(off int64) error {
+				readKey := &key{id: &uuid.NullUUID{}}
+				if _, err := s.ReadOffset(b, off); err != nil {
+					return err
+				}
+				if err := readKey.UnmarshalBinary(b); err != nil {
+					return err
+				}
+
+				id := readKey.id.(*uuid.NullUUID).UUID
+				if scanned[id] {
+					t.Fatalf("write %d: key %v scanned twice", write, id)
+				}
+				scanned[id] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("indexer scan failed: %v", err)
+			}
+
+			if count, err := idx.Count(s); err != nil || count != int64(len(scanned)) {
+				t.Fatalf("write %d: expected %d keys; got %d (%v)", write, len(scanned), count, err)
+			}
+			s.Close()
+		}
+	}
+}
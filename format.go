@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DiskFormatVersion is the version of the on-disk format written by this
+// code, kept in the format file of each collection. Collections without one
+// predate it and have version 1.
+//
+//  1. key records hold the key id and data offset
+//  2. key records add an expiry
+//  3. key records and lsm table records add a version
+//  4. change log records add the key version
+//  5. encrypted slots are bound to their file and offset, and all sealed
+const DiskFormatVersion = 5
+
+// keyRecordSize returns the size of the key records of format version v.
+func keyRecordSize(v int, keyIdSize uint16) uint16 {
+	switch v {
+	case 1:
+		return keyIdSize + KeyOffsetSize
+	case 2:
+		return keyIdSize + KeyOffsetSize + KeyExpirySize
+	}
+
+	return keyIdSize + KeyMetaSize
+}
+
+// upgradeKeyRecord converts a key record of format version v to the current
+// layout. Keys written before version 2 never expire and keys written before
+// version 3 are at version 1.
+func upgradeKeyRecord(b []byte, v int, keyIdSize uint16) []byte {
+	k := make([]byte, keyIdSize+KeyMetaSize)
+	copy(k, b[:keyRecordSize(v, keyIdSize)])
+	if v < 3 {
+		binary.LittleEndian.PutUint64(k[keyIdSize+KeyOffsetSize+KeyExpirySize:], 1)
+	}
+	return k
+}
+
+// changeRecordSize returns the size of the change log records of format
+// version v.
+func changeRecordSize(v int, keyIdSize uint16, itemSize uint16) uint16 {
+	size := changeHeaderSize + int(keyIdSize) + int(itemSize)
+	if v < 4 {
+		size -= changeVersionSize
+	}
+	return uint16(size)
+}
+
+// upgradeChangeRecord converts a change log record of format version v to the
+// current layout. Changes recorded before version 4 have version 0.
+func upgradeChangeRecord(b []byte, v int) []byte {
+	if v >= 4 {
+		return b
+	}
+
+	off := changeSeqSize + changeOpSize + changeExpirySize
+	r := make([]byte, len(b)+changeVersionSize)
+	copy(r, b[:off])
+	copy(r[off+changeVersionSize:], b[off:])
+	return r
+}
+
+func readFormat(vfs VFS, collectionDir string) (int, error) {
+	b, err := readFile(vfs, filepath.Join(collectionDir, "format"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid format file")
+	}
+
+	return v, nil
+}
+
+func writeFormat(vfs VFS, collectionDir string, v int) error {
+	return writeFileAtomic(vfs, filepath.Join(collectionDir, "format"), []byte(strconv.Itoa(v)+"\n"))
+}
+
+// formatFile is a file of fixed-size records that an upgrade rewrites from
+// records of size from to records of size to.
+type formatFile struct {
+	name    string
+	from    uint16
+	to      uint16
+	convert func(b []byte, off int64) []byte
+}
+
+// keyFileUpgrade converts the key records of format version v. The bucket
+// headers of hash indexes are copied as they are.
+func keyFileUpgrade(v int, keyIdSize uint16, index IndexType) formatFile {
+	to := keyRecordSize(DiskFormatVersion, keyIdSize)
+	return formatFile{name: "key", from: keyRecordSize(v, keyIdSize), to: to, convert: func(b []byte, off int64) []byte {
+		if index == IndexHash && off%hashBucketSlots == 0 {
+			k := make([]byte, to)
+			copy(k, b[:hashHeaderSize])
+			return k
+		}
+		return upgradeKeyRecord(b, v, keyIdSize)
+	}}
+}
+
+// changesUpgrade converts the change log records of format version v.
+func changesUpgrade(v int, keyIdSize uint16, itemSize uint16) formatFile {
+	return formatFile{
+		name:    "changes",
+		from:    changeRecordSize(v, keyIdSize, itemSize),
+		to:      changeRecordSize(DiskFormatVersion, keyIdSize, itemSize),
+		convert: func(b []byte, _ int64) []byte { return upgradeChangeRecord(b, v) },
+	}
+}
+
+// resealed keeps the records of a file whose layout has not changed, for
+// encrypted files that are only sealed anew.
+func resealed(name string, size uint16) formatFile {
+	return formatFile{name: name, from: size, to: size, convert: func(b []byte, _ int64) []byte { return b }}
+}
+
+// upgradeFormat brings the collection in collectionDir to the current format
+// version, recording it for new collections. The files whose layout changed
+// are rewritten to .upgrade files first and only moved over the old ones once
+// the new version is recorded, so an interrupted upgrade is either redone or
+// finished on the next open. Encrypted files older than version 5 are read
+// with legacy and written with open.
+func upgradeFormat(vfs VFS, collectionDir string, meta *collectionMeta, keyIdSize uint16, itemSize uint16, legacy storageOpener, open storageOpener) error {
+	v, err := readFormat(vfs, collectionDir)
+	if err != nil {
+		return err
+	}
+
+	if v > DiskFormatVersion {
+		return errors.Errorf("collection format version %d is newer than %d", v, DiskFormatVersion)
+	}
+
+	names := []string{"key", "data", "free", "changes", "text"}
+	if v == DiskFormatVersion {
+		return finishUpgrade(vfs, collectionDir, names...)
+	}
+
+	if v == 0 {
+		if _, err := vfs.Stat(filepath.Join(collectionDir, "key")); os.IsNotExist(err) {
+			return writeFormat(vfs, collectionDir, DiskFormatVersion)
+		}
+		v = 1
+	}
+
+	reseal := meta.Encryption != nil && v < 5
+	read := open
+	if reseal {
+		read = legacy
+	}
+
+	var files []formatFile
+	if v < 3 || reseal {
+		files = append(files, keyFileUpgrade(v, keyIdSize, meta.Index))
+	}
+	if v < 4 || reseal {
+		files = append(files, changesUpgrade(v, keyIdSize, itemSize))
+	}
+	if reseal {
+		files = append(files, resealed("free", freeSlotSize), resealed("text", textSlotSize(keyIdSize)))
+		if meta.Compression == CompressionNone {
+			dataKeySize := uint16(0)
+			if meta.DataKeys {
+				dataKeySize = keyIdSize
+			}
+			files = append(files, resealed("data", itemSize+dataKeySize))
+		}
+	}
+
+	for _, f := range files {
+		if err := rewriteFile(vfs, collectionDir, f, read, open); err != nil {
+			return errors.Wrapf(err, "upgrading %s of format version %d", f.name, v)
+		}
+	}
+
+	if err := writeFormat(vfs, collectionDir, DiskFormatVersion); err != nil {
+		return err
+	}
+
+	return finishUpgrade(vfs, collectionDir, names...)
+}
+
+// finishUpgrade moves the .upgrade files of an upgrade whose version is
+// recorded over the files they replace.
+func finishUpgrade(vfs VFS, dir string, names ...string) error {
+	renamed := false
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		if _, err := vfs.Stat(file + ".upgrade"); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := vfs.Rename(file+".upgrade", file); err != nil {
+			return err
+		}
+		renamed = true
+	}
+
+	if !renamed {
+		return nil
+	}
+
+	return vfs.SyncDir(dir)
+}
+
+// rewriteFile writes the converted records of f in dir to its .upgrade file,
+// reading them with read and writing them with write. Missing files are left
+// missing.
+func rewriteFile(vfs VFS, dir string, f formatFile, read storageOpener, write storageOpener) error {
+	filename := filepath.Join(dir, f.name)
+	tmp := filename + ".upgrade"
+	if _, err := vfs.Stat(filename); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := vfs.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s, err := read(filename, f.from)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	dst, err := write(tmp, f.to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	count, err := s.Count()
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, f.from)
+	for off := int64(0); off < count; off++ {
+		if _, err := s.ReadOffset(b, off); err != nil {
+			return err
+		}
+
+		if _, err := dst.WriteOffset(f.convert(b, off), off); err != nil {
+			return err
+		}
+	}
+
+	// The .upgrade file has to be whole before the new version is recorded.
+	return syncStorage(dst)
+}
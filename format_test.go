@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+// writeV1Collection writes books the way format version 1 did: key records
+// of the key id and data offset, sorted by id, and no format file.
+func writeV1Collection(tb testing.TB, dir string, ids []uuid.UUID, books []Book) {
+	if err := os.RemoveAll(dir); err != nil {
+		tb.Fatalf("directory removal failed: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		tb.Fatalf("directory creation failed: %v", err)
+	}
+
+	data, err := NewStorage(filepath.Join(dir, "data"), BookSize)
+	if err != nil {
+		tb.Fatalf("storage creation failed: %v", err)
+	}
+	defer data.Close()
+
+	keys, err := NewStorage(filepath.Join(dir, "key"), keyRecordSize(1, KeyIdSize))
+	if err != nil {
+		tb.Fatalf("storage creation failed: %v", err)
+	}
+	defer keys.Close()
+
+	indexer := NewIndexer(KeyIdSize)
+	for i := range ids {
+		b, _ := books[i].MarshalBinary()
+		if _, err := data.WriteOffset(b, int64(i)); err != nil {
+			tb.Fatalf("storage write failed: %v", err)
+		}
+
+		k := &v1Key{id: ids[i], offset: uint64(i)}
+		if _, err := indexer.Insert(keys, k); err != nil {
+			tb.Fatalf("indexer insert failed: %v", err)
+		}
+	}
+}
+
+type v1Key struct {
+	id     uuid.UUID
+	offset uint64
+}
+
+func (k *v1Key) MarshalBinary() ([]byte, error) {
+	b := make([]byte, keyRecordSize(1, KeyIdSize))
+	copy(b, k.id[:])
+	binary.LittleEndian.PutUint64(b[KeyIdSize:], k.offset)
+	return b, nil
+}
+
+func (k *v1Key) UnmarshalBinary([]byte) error {
+	return errors.New("not implemented")
+}
+
+func checkFormatBooks(t *testing.T, dir string, ids []uuid.UUID, books []Book) {
+	t.Helper()
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	for i, id := range ids {
+		book := Book{}
+		if err := c.Get(&id, &book); err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if book != books[i] {
+			t.Fatalf("expected %+v; got %+v", books[i], book)
+		}
+	}
+}
+
+var updateFixtures = flag.Bool("update", false, "rewrite the format fixtures of the current version")
+
+// The fixtures in testdata/format hold these books, written by the code of
+// each format version: the first four are put, the second is updated, the
+// fourth removed and the fifth put with a TTL of 100 years from version 2
+// on.
+var fixtureIds = []uuid.UUID{
+	uuid.MustParse("0b7e6f8a-3c1d-4e52-9a41-6f2d8c0e1a01"),
+	uuid.MustParse("5f0c2b9e-7a44-4d1b-8e3f-2c6a9b1d7e02"),
+	uuid.MustParse("a1d3e5f7-0b2c-4d6e-8f10-3a5c7e9b1d03"),
+	uuid.MustParse("c94e2a71-6b3d-4f85-a017-9d2e4c6b8a04"),
+	uuid.MustParse("e2f4a6c8-1d3b-4e5f-9a7c-0b2d4f6a8c05"),
+}
+
+var fixtureBooks = []Book{
+	{Title: "Game of Thrones", Year: 1996},
+	{Title: "Harry Potter", Year: 1997},
+	{Title: "Lord of the Rings", Year: 1954},
+	{Title: "The Little Prince", Year: 1943},
+	{Title: "Dune", Year: 1965},
+}
+
+var fixtureUpdate = Book{Title: "Harry Potter and the Chamber of Secrets", Year: 1998}
+
+var fixtureTime = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var formatFixtures = []struct {
+	name    string
+	version int
+	index   IndexType
+	current bool
+	opts    []Option
+}{
+	{"v1-sorted", 1, IndexSorted, false, nil},
+	{"v2-sorted", 2, IndexSorted, false, nil},
+	{"v2-hash", 2, IndexHash, false, nil},
+	{"v3-sorted", 3, IndexSorted, false, nil},
+	{"v3-hash", 3, IndexHash, false, nil},
+	{"v4-sorted", 4, IndexSorted, false, nil},
+	{"v4-hash", 4, IndexHash, false, nil},
+	{"v4-encrypted", 4, IndexSorted, false, []Option{WithEncryption(NewStaticKeyProvider("k1", testKeys))}},
+	{"v5-sorted", 5, IndexSorted, true, nil},
+	{"v5-hash", 5, IndexHash, true, nil},
+}
+
+func writeFormatFixture(dir string, index IndexType) error {
+	c, err := newTestCollection(dir, WithIndex(index))
+	if err != nil {
+		return err
+	}
+	setClock(c, func() time.Time { return fixtureTime })
+
+	for i := range fixtureIds[:4] {
+		if err := c.Put(&fixtureIds[i], &fixtureBooks[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Put(&fixtureIds[1], &fixtureUpdate); err != nil {
+		return err
+	}
+
+	if err := c.Remove(&fixtureIds[3]); err != nil {
+		return err
+	}
+
+	if err := c.PutWithTTL(&fixtureIds[4], &fixtureBooks[4], 100*365*24*time.Hour); err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+func copyFixture(tb testing.TB, name string) string {
+	dir := filepath.Join(tb.TempDir(), name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatalf("fixture directory creation failed: %v", err)
+	}
+
+	src := filepath.Join("testdata", "format", name)
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		tb.Fatalf("fixture read failed: %v", err)
+	}
+
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			tb.Fatalf("fixture read failed: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, entry.Name()), b, 0644); err != nil {
+			tb.Fatalf("fixture copy failed: %v", err)
+		}
+	}
+
+	return dir
+}
+
+func checkFixtureBooks(t *testing.T, c Collection, version int) {
+	t.Helper()
+
+	expected := map[uuid.UUID]Book{
+		fixtureIds[0]: fixtureBooks[0],
+		fixtureIds[1]: fixtureUpdate,
+		fixtureIds[2]: fixtureBooks[2],
+		fixtureIds[4]: fixtureBooks[4],
+	}
+
+	if count, err := c.Count(); err != nil || count != int64(len(expected)) {
+		t.Fatalf("expected %d books; got %d (%v)", len(expected), count, err)
+	}
+
+	for id, book := range expected {
+		got := Book{}
+		version, err := c.GetWithVersion(&id, &got)
+		if err != nil {
+			t.Fatalf("collection get of %v failed: %v", id, err)
+		}
+
+		if got != book {
+			t.Fatalf("expected %v to hold %+v; got %+v", id, book, got)
+		}
+
+		if version == 0 {
+			t.Fatalf("expected %v to have a version", id)
+		}
+	}
+
+	if err := c.Get(&fixtureIds[3], &Book{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected removed book to be missing; got %v", err)
+	}
+
+	scanned := 0
+	err := c.Scan(&Book{}, func(id KeyId, item Item) error {
+		scanned++
+		return nil
+	})
+	if err != nil || scanned != len(expected) {
+		t.Fatalf("expected scan to visit %d books; got %d (%v)", len(expected), scanned, err)
+	}
+
+	// The TTL put from version 2 on expires once its 100 years are over.
+	setClock(c, func() time.Time { return fixtureTime.Add(200 * 365 * 24 * time.Hour) })
+	err = c.Get(&fixtureIds[4], &Book{})
+	if version >= 2 && !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected book put with a TTL to expire; got %v", err)
+	}
+	if version < 2 && err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+	setClock(c, time.Now)
+}
+
+func TestFormatFixtures(t *testing.T) {
+	for _, fixture := range formatFixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			dir := copyFixture(t, fixture.name)
+
+			c, err := newTestCollection(dir, fixture.opts...)
+			if err != nil {
+				t.Fatalf("collection creation failed: %v", err)
+			}
+			checkFixtureBooks(t, c, fixture.version)
+
+			if v, err := readFormat(NewOSFS(), dir); err != nil || v != DiskFormatVersion {
+				t.Fatalf("expected format version %d; got %d (%v)", DiskFormatVersion, v, err)
+			}
+
+			meta, err := readMeta(NewOSFS(), dir)
+			if err != nil {
+				t.Fatalf("meta read failed: %v", err)
+			}
+
+			if meta.Index != fixture.index {
+				t.Fatalf("expected %s index; got %s", fixture.index, meta.Index)
+			}
+
+			// The upgraded collection takes writes and reopens.
+			id := uuid.New()
+			if err := c.Put(&id, &fixtureBooks[3]); err != nil {
+				t.Fatalf("collection put failed: %v", err)
+			}
+
+			if err := c.Remove(&id); err != nil {
+				t.Fatalf("collection remove failed: %v", err)
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatalf("collection close failed: %v", err)
+			}
+
+			c, err = newTestCollection(dir, fixture.opts...)
+			if err != nil {
+				t.Fatalf("collection reopen failed: %v", err)
+			}
+			defer c.Close()
+			checkFixtureBooks(t, c, fixture.version)
+		})
+	}
+}
+
+// TestFormatGolden checks that the current code writes the fixtures of the
+// current version byte for byte. Run with -update after a deliberate format
+// change, which also needs a new version and the old fixtures kept.
+func TestFormatGolden(t *testing.T) {
+	for _, fixture := range formatFixtures {
+		if !fixture.current {
+			continue
+		}
+
+		t.Run(fixture.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), fixture.name)
+			if err := writeFormatFixture(dir, fixture.index); err != nil {
+				t.Fatalf("fixture write failed: %v", err)
+			}
+			os.Remove(filepath.Join(dir, "lock"))
+
+			golden := filepath.Join("testdata", "format", fixture.name)
+			if *updateFixtures {
+				if err := os.RemoveAll(golden); err != nil {
+					t.Fatalf("fixture removal failed: %v", err)
+				}
+				if err := os.Rename(dir, golden); err != nil {
+					t.Fatalf("fixture update failed: %v", err)
+				}
+				return
+			}
+
+			entries, err := os.ReadDir(golden)
+			if err != nil {
+				t.Fatalf("fixture read failed: %v", err)
+			}
+
+			written, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("collection directory read failed: %v", err)
+			}
+
+			if len(written) != len(entries) {
+				t.Fatalf("expected %d files; got %d", len(entries), len(written))
+			}
+
+			for _, entry := range entries {
+				expected, err := os.ReadFile(filepath.Join(golden, entry.Name()))
+				if err != nil {
+					t.Fatalf("fixture read failed: %v", err)
+				}
+
+				b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					t.Fatalf("collection file read failed: %v", err)
+				}
+
+				if !bytes.Equal(b, expected) {
+					t.Fatalf("expected %s to match the fixture:\n%x\ngot:\n%x", entry.Name(), expected, b)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatUpgrade(t *testing.T) {
+	dir := "./data/test/v1"
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	books := []Book{{Title: "Dune", Year: 1965}, {Title: "Emma", Year: 1815}, {Title: "Ulysses", Year: 1922}}
+	writeV1Collection(t, dir, ids, books)
+
+	checkFormatBooks(t, dir, ids, books)
+	checkFormatBooks(t, dir, ids, books)
+
+	if v, err := readFormat(NewOSFS(), dir); err != nil || v != DiskFormatVersion {
+		t.Fatalf("expected format version %d; got %d (%v)", DiskFormatVersion, v, err)
+	}
+}
+
+func TestFormatInterruptedUpgrade(t *testing.T) {
+	dir := "./data/test/v1"
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	books := []Book{{Title: "Dune", Year: 1965}, {Title: "Emma", Year: 1815}}
+	writeV1Collection(t, dir, ids, books)
+
+	// Interrupted before the version was recorded: the upgrade is redone.
+	if err := rewriteFile(NewOSFS(), dir, keyFileUpgrade(1, KeyIdSize, IndexSorted), NewStorage, NewStorage); err != nil {
+		t.Fatalf("key file upgrade failed: %v", err)
+	}
+
+	checkFormatBooks(t, dir, ids, books)
+
+	// Interrupted after it: the upgraded key file is moved in place.
+	writeV1Collection(t, dir, ids, books)
+	if err := rewriteFile(NewOSFS(), dir, keyFileUpgrade(1, KeyIdSize, IndexSorted), NewStorage, NewStorage); err != nil {
+		t.Fatalf("key file upgrade failed: %v", err)
+	}
+
+	if err := writeFormat(NewOSFS(), dir, DiskFormatVersion); err != nil {
+		t.Fatalf("format write failed: %v", err)
+	}
+
+	checkFormatBooks(t, dir, ids, books)
+}
+
+func TestFormatUpgradeSurvivesPowerLoss(t *testing.T) {
+	dir := "./data/test/v1"
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	books := []Book{{Title: "Dune", Year: 1965}, {Title: "Emma", Year: 1815}}
+	writeV1Collection(t, dir, ids, books)
+
+	faults := newFaultFS(NewOSFS(), kvdbtest.Fault{})
+	vfs := &syncDirFS{VFS: faults}
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithVFS(vfs))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	synced := false
+	for i, op := range vfs.ops {
+		if op != "rename "+filepath.Join(dir, "key") {
+			continue
+		}
+
+		for _, op := range vfs.ops[i+1:] {
+			synced = synced || op == "sync "+filepath.Clean(dir)
+		}
+	}
+
+	if !synced {
+		t.Fatalf("expected the directory to be synced after the upgrade renames; got %v", vfs.ops)
+	}
+
+	// The power loss drops whatever the upgrade did not sync.
+	if _, err := faults.crash(true); err != nil {
+		t.Fatalf("crash failed: %v", err)
+	}
+	c.Close()
+
+	checkFormatBooks(t, dir, ids, books)
+}
+
+func TestFormatNewer(t *testing.T) {
+	dir := "./data/test/v1"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("directory removal failed: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("directory creation failed: %v", err)
+	}
+
+	if err := writeFormat(NewOSFS(), dir, DiskFormatVersion+1); err != nil {
+		t.Fatalf("format write failed: %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize); err == nil {
+		t.Fatal("expected collection of a newer format version to fail to open")
+	}
+}
+
+// downgradeToV2 rewrites the key records of the closed collection in dir
+// without their version, the way format version 2 stored them, and seals
+// encrypted files the way versions before 5 did.
+func downgradeToV2(tb testing.TB, dir string, opts ...Option) {
+	meta, err := readMeta(NewOSFS(), dir)
+	if err != nil {
+		tb.Fatalf("meta read failed: %v", err)
+	}
+
+	open, legacy := storageOpener(NewStorage), storageOpener(NewStorage)
+	if meta.Encryption != nil {
+		keys, err := openKeyring(meta.Encryption, newOptions(opts).keyProvider)
+		if err != nil {
+			tb.Fatalf("keyring open failed: %v", err)
+		}
+		open, legacy = encryptedStorageOpener(NewOSFS(), keys), legacyEncryptedStorageOpener(NewOSFS(), keys)
+
+		dataSize := uint16(BookSize)
+		if meta.DataKeys {
+			dataSize += KeyIdSize
+		}
+		for name, size := range map[string]uint16{"data": dataSize, "free": freeSlotSize} {
+			file := filepath.Join(dir, name)
+			copyRecords(tb, open, legacy, file, size, file+".v2", size, func(b []byte) []byte { return b })
+			if err := os.Rename(file+".v2", file); err != nil {
+				tb.Fatalf("%s file rename failed: %v", name, err)
+			}
+		}
+	}
+
+	keyFile := filepath.Join(dir, "key")
+	copyRecords(tb, open, legacy, keyFile, KeySize, keyFile+".v2", keyRecordSize(2, KeyIdSize), func(b []byte) []byte {
+		return b[:keyRecordSize(2, KeyIdSize)]
+	})
+
+	if err := os.Rename(keyFile+".v2", keyFile); err != nil {
+		tb.Fatalf("key file rename failed: %v", err)
+	}
+	downgradeChanges(tb, open, legacy, dir)
+
+	if err := writeFormat(NewOSFS(), dir, 2); err != nil {
+		tb.Fatalf("format write failed: %v", err)
+	}
+}
+
+// downgradeLSMToV2 rewrites the tables of the closed lsm collection in dir
+// without record versions and drops the format from its manifest.
+func downgradeLSMToV2(tb testing.TB, dir string) {
+	b, err := os.ReadFile(filepath.Join(dir, "manifest"))
+	if err != nil {
+		tb.Fatalf("manifest read failed: %v", err)
+	}
+
+	manifest := map[string]any{}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		tb.Fatalf("manifest decode failed: %v", err)
+	}
+
+	size := uint16(KeyIdSize + lsmHeaderSize + BookSize)
+	off := KeyIdSize + lsmSeqSize + lsmExpirySize
+	for _, id := range manifest["tables"].([]any) {
+		table := filepath.Join(dir, fmt.Sprintf("table-%06d", uint64(id.(float64))))
+		copyRecords(tb, NewStorage, NewStorage, table, size, table+".v2", size-lsmVersionSize, func(b []byte) []byte {
+			return append(append([]byte{}, b[:off]...), b[off+lsmVersionSize:]...)
+		})
+
+		if err := os.Rename(table+".v2", table); err != nil {
+			tb.Fatalf("table rename failed: %v", err)
+		}
+	}
+
+	downgradeChanges(tb, NewStorage, NewStorage, dir)
+
+	delete(manifest, "format")
+	if b, err = json.Marshal(manifest); err != nil {
+		tb.Fatalf("manifest encode failed: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "manifest"), b, 0644); err != nil {
+		tb.Fatalf("manifest write failed: %v", err)
+	}
+}
+
+// downgradeChanges rewrites the change log records in dir without the key
+// version, the way format versions before 4 stored them.
+func downgradeChanges(tb testing.TB, read storageOpener, write storageOpener, dir string) {
+	changes := filepath.Join(dir, "changes")
+	off := changeSeqSize + changeOpSize + changeExpirySize
+	copyRecords(tb, read, write, changes, changeRecordSize(4, KeyIdSize, BookSize), changes+".v3", changeRecordSize(3, KeyIdSize, BookSize), func(b []byte) []byte {
+		return append(append([]byte{}, b[:off]...), b[off+changeVersionSize:]...)
+	})
+
+	if err := os.Rename(changes+".v3", changes); err != nil {
+		tb.Fatalf("change log rename failed: %v", err)
+	}
+}
+
+func copyRecords(tb testing.TB, read storageOpener, write storageOpener, src string, srcSize uint16, dst string, dstSize uint16, fn func([]byte) []byte) {
+	s, err := read(src, srcSize)
+	if err != nil {
+		tb.Fatalf("storage open failed: %v", err)
+	}
+	defer s.Close()
+
+	d, err := write(dst, dstSize)
+	if err != nil {
+		tb.Fatalf("storage open failed: %v", err)
+	}
+	defer d.Close()
+
+	count, err := s.Count()
+	if err != nil {
+		tb.Fatalf("storage count failed: %v", err)
+	}
+
+	b := make([]byte, srcSize)
+	for off := int64(0); off < count; off++ {
+		if _, err := s.ReadOffset(b, off); err != nil {
+			tb.Fatalf("storage read failed: %v", err)
+		}
+
+		if _, err := d.WriteOffset(fn(b), off); err != nil {
+			tb.Fatalf("storage write failed: %v", err)
+		}
+	}
+}
+
+func TestFormatUpgradeVersions(t *testing.T) {
+	dir := "./data/test/v2"
+	tests := map[string]struct {
+		open      func(...Option) (Collection, error)
+		downgrade func(testing.TB, string, ...Option)
+		opts      []Option
+	}{
+		"Sorted": {opts: []Option{WithIndex(IndexSorted)}},
+		"Hash":   {opts: []Option{WithIndex(IndexHash)}},
+		"Encrypted": {
+			opts: []Option{WithEncryption(NewStaticKeyProvider("k1", testKeys))},
+		},
+		"LSM": {
+			open: func(opts ...Option) (Collection, error) {
+				return NewLSMCollection(dir, KeyIdSize, BookSize, opts...)
+			},
+			downgrade: func(tb testing.TB, dir string, _ ...Option) { downgradeLSMToV2(tb, dir) },
+			opts:      []Option{WithMemtableSize(4)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			open, downgrade := test.open, test.downgrade
+			if open == nil {
+				open = func(opts ...Option) (Collection, error) {
+					return NewCollection(dir, KeySize, KeyIdSize, BookSize, opts...)
+				}
+				downgrade = downgradeToV2
+			}
+
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatalf("directory removal failed: %v", err)
+			}
+
+			c, err := open(test.opts...)
+			if err != nil {
+				t.Fatalf("collection creation failed: %v", err)
+			}
+
+			ids := make([]uuid.UUID, 40)
+			for i := range ids {
+				ids[i] = uuid.New()
+				if err := c.Put(&ids[i], &Book{Title: fmt.Sprintf("Book %d", i), Year: uint16(i)}); err != nil {
+					t.Fatalf("collection put failed: %v", err)
+				}
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatalf("collection close failed: %v", err)
+			}
+
+			downgrade(t, dir, test.opts...)
+
+			for reopen := 0; reopen < 2; reopen++ {
+				c, err := open(test.opts...)
+				if err != nil {
+					t.Fatalf("collection open failed: %v", err)
+				}
+
+				for i := range ids {
+					book := Book{}
+					v, err := c.GetWithVersion(&ids[i], &book)
+					if err != nil {
+						t.Fatalf("collection get failed: %v", err)
+					}
+
+					if v != 1 || book.Year != uint16(i) {
+						t.Fatalf("expected book %d at version 1; got %+v at version %d", i, book, v)
+					}
+				}
+
+				if err := c.Close(); err != nil {
+					t.Fatalf("collection close failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatUpgradeChanges(t *testing.T) {
+	dir := "./data/test/v3"
+	tests := map[string]struct {
+		open      func() (Collection, error)
+		downgrade func(testing.TB, string)
+	}{
+		"Collection": {
+			open: func() (Collection, error) {
+				return NewCollection(dir, KeySize, KeyIdSize, BookSize)
+			},
+			downgrade: func(tb testing.TB, dir string) {
+				downgradeChanges(tb, NewStorage, NewStorage, dir)
+				if err := writeFormat(NewOSFS(), dir, 3); err != nil {
+					tb.Fatalf("format write failed: %v", err)
+				}
+			},
+		},
+		// An lsm collection that never flushed has no manifest before format
+		// version 4, only its change log.
+		"LSMWithoutManifest": {
+			open: func() (Collection, error) {
+				return NewLSMCollection(dir, KeyIdSize, BookSize)
+			},
+			downgrade: func(tb testing.TB, dir string) {
+				downgradeChanges(tb, NewStorage, NewStorage, dir)
+				if err := os.Remove(filepath.Join(dir, "manifest")); err != nil {
+					tb.Fatalf("manifest removal failed: %v", err)
+				}
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatalf("directory removal failed: %v", err)
+			}
+
+			c, err := test.open()
+			if err != nil {
+				t.Fatalf("collection creation failed: %v", err)
+			}
+
+			id := uuid.New()
+			for _, book := range fixtureBooks[:2] {
+				if err := c.Put(&id, &book); err != nil {
+					t.Fatalf("collection put failed: %v", err)
+				}
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatalf("collection close failed: %v", err)
+			}
+
+			test.downgrade(t, dir)
+
+			if c, err = test.open(); err != nil {
+				t.Fatalf("collection open failed: %v", err)
+			}
+			defer c.Close()
+
+			book := Book{}
+			if v, err := c.GetWithVersion(&id, &book); err != nil || v != 2 || book != fixtureBooks[1] {
+				t.Fatalf("expected %+v at version 2; got %+v at version %d (%v)", fixtureBooks[1], book, v, err)
+			}
+
+			// Changes recorded before version 4 have no version.
+			if err := c.Put(&id, &fixtureBooks[2]); err != nil {
+				t.Fatalf("collection put failed: %v", err)
+			}
+
+			var versions []uint64
+			err = c.Changes(1, func(change Change) error {
+				versions = append(versions, change.Version)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("changes read failed: %v", err)
+			}
+
+			if fmt.Sprint(versions) != "[0 0 3]" {
+				t.Fatalf("expected change versions [0 0 3]; got %v", versions)
+			}
+		})
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+)
+
+const hashBucketSize = 16
+const hashBucketSlots = hashBucketSize + 1
+const hashHeaderSize = 1 + 2 + 8
+
+// hashIndexer is an extendible hash index. The storage holds buckets of
+// hashBucketSlots slots: a header with the bucket's local depth, entry count
+// and hash pattern, followed by its entries. The directory mapping hash
+// prefixes to buckets is kept in memory and rebuilt from the bucket headers.
+type hashIndexer struct {
+	keySize uint16
+	storage Storage
+	depth   uint
+	dir     []int64
+	buckets int64
+	count   int64
+}
+
+type hashBucket struct {
+	depth   uint
+	count   int
+	pattern uint64
+}
+
+func (idx *hashIndexer) hash(id []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(id)
+	return h.Sum64()
+}
+
+func (idx *hashIndexer) readBucket(s Storage, bucket int64) (*hashBucket, error) {
+	b := make([]byte, s.ItemSize())
+	if _, err := s.ReadOffset(b, bucket*hashBucketSlots); err != nil {
+		return nil, err
+	}
+
+	return &hashBucket{
+		depth:   uint(b[0]),
+		count:   int(binary.LittleEndian.Uint16(b[1:])),
+		pattern: binary.LittleEndian.Uint64(b[3:]),
+	}, nil
+}
+
+func (idx *hashIndexer) writeBucket(s Storage, bucket int64, hb *hashBucket) error {
+	b := make([]byte, s.ItemSize())
+	b[0] = byte(hb.depth)
+	binary.LittleEndian.PutUint16(b[1:], uint16(hb.count))
+	binary.LittleEndian.PutUint64(b[3:], hb.pattern)
+	_, err := s.WriteOffset(b, bucket*hashBucketSlots)
+	return err
+}
+
+func (idx *hashIndexer) readEntries(s Storage, bucket int64, hb *hashBucket) ([][]byte, error) {
+	entries := make([][]byte, hb.count)
+	for i := range entries {
+		entries[i] = make([]byte, s.ItemSize())
+		if _, err := s.ReadOffset(entries[i], bucket*hashBucketSlots+1+int64(i)); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// load rebuilds the directory whenever the storage changed under the index,
+// for example after it was reset. Deeper buckets take their slots over from
+// shallower ones, so a bucket written by an interrupted split holds its half of
+// the split bucket, which is then compacted as split would have. Trailing
+// buckets that split never committed are dropped.
+func (idx *hashIndexer) load(s Storage) error {
+	if uint16(s.ItemSize()) < hashHeaderSize || s.ItemSize() < idx.keySize {
+		return errors.New("item size too small for hash index")
+	}
+
+	slots, err := s.Count()
+	if err != nil {
+		return err
+	}
+
+	if idx.storage == withoutContext(s) && slots == idx.buckets*hashBucketSlots {
+		return nil
+	}
+
+	buckets := slots / hashBucketSlots
+	headers := make([]*hashBucket, 0, buckets)
+	depth := uint(0)
+	for bucket := int64(0); bucket < buckets; bucket++ {
+		hb, err := idx.readBucket(s, bucket)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, hb)
+		if hb.depth > depth {
+			depth = hb.depth
+		}
+	}
+
+	for len(headers) > 1 && headers[len(headers)-1].depth == 0 {
+		headers = headers[:len(headers)-1]
+	}
+
+	if int64(len(headers))*hashBucketSlots != slots {
+		if err := s.Truncate(int64(len(headers)) * hashBucketSlots); err != nil {
+			return err
+		}
+	}
+
+	dir := make([]int64, 1<<depth)
+	for d := uint(0); d <= depth; d++ {
+		for bucket, hb := range headers {
+			if hb.depth != d {
+				continue
+			}
+			for i := hb.pattern; i < uint64(len(dir)); i += 1 << hb.depth {
+				dir[i] = int64(bucket)
+			}
+		}
+	}
+
+	count := int64(0)
+	for bucket, hb := range headers {
+		for i := hb.pattern; i < uint64(len(dir)); i += 1 << hb.depth {
+			if dir[i] == int64(bucket) {
+				continue
+			}
+
+			mask := uint64(len(dir) - 1)
+			keep := func(e []byte) bool { return dir[idx.hash(e[:idx.keySize])&mask] == int64(bucket) }
+			if hb, err = idx.compact(s, int64(bucket), hb, keep); err != nil {
+				return err
+			}
+			headers[bucket] = hb
+			break
+		}
+		count += int64(hb.count)
+	}
+
+	idx.storage = withoutContext(s)
+	idx.depth = depth
+	idx.dir = dir
+	idx.buckets = int64(len(headers))
+	idx.count = count
+	return nil
+}
+
+// create writes the first bucket of an empty index.
+func (idx *hashIndexer) create(s Storage) error {
+	if err := idx.writeBucket(s, 0, &hashBucket{}); err != nil {
+		return err
+	}
+	if err := s.Truncate(hashBucketSlots); err != nil {
+		return err
+	}
+
+	idx.buckets = 1
+	return nil
+}
+
+func (idx *hashIndexer) bucketOf(id []byte) int64 {
+	return idx.dir[idx.hash(id)&(1<<idx.depth-1)]
+}
+
+func (idx *hashIndexer) find(s Storage, id []byte) (int64, *hashBucket, int64, error) {
+	if idx.buckets == 0 {
+		return 0, &hashBucket{}, -1, nil
+	}
+
+	bucket := idx.bucketOf(id)
+	hb, err := idx.readBucket(s, bucket)
+	if err != nil {
+		return 0, nil, -1, err
+	}
+
+	b := make([]byte, s.ItemSize())
+	for i := 0; i < hb.count; i++ {
+		off := bucket*hashBucketSlots + 1 + int64(i)
+		if _, err := s.ReadOffset(b, off); err != nil {
+			return 0, nil, -1, err
+		}
+
+		if bytes.Equal(b[:idx.keySize], id) {
+			return bucket, hb, off, nil
+		}
+	}
+
+	return bucket, hb, -1, nil
+}
+
+// split moves the entries of a full bucket whose next hash bit is set into a
+// new bucket, doubling the directory first when the bucket is already as deep
+// as the directory. The new bucket is written past the others and committed
+// by its header before the split bucket is compacted, so that an interrupted
+// split loses no entries; load finishes it.
+func (idx *hashIndexer) split(s Storage, bucket int64, hb *hashBucket) error {
+	entries, err := idx.readEntries(s, bucket, hb)
+	if err != nil {
+		return err
+	}
+
+	bit := uint64(1) << hb.depth
+	newBucket := idx.buckets
+	split := &hashBucket{depth: hb.depth + 1, pattern: hb.pattern | bit}
+	for _, e := range entries {
+		if idx.hash(e[:idx.keySize])&bit == 0 {
+			continue
+		}
+
+		if _, err := s.WriteOffset(e, newBucket*hashBucketSlots+1+int64(split.count)); err != nil {
+			return err
+		}
+		split.count++
+	}
+
+	if err := s.Truncate((newBucket + 1) * hashBucketSlots); err != nil {
+		return err
+	}
+
+	if err := idx.writeBucket(s, newBucket, split); err != nil {
+		return err
+	}
+
+	keep := func(e []byte) bool { return idx.hash(e[:idx.keySize])&bit == 0 }
+	if _, err := idx.compact(s, bucket, hb, keep); err != nil {
+		return err
+	}
+
+	if hb.depth == idx.depth {
+		idx.dir = append(idx.dir, idx.dir...)
+		idx.depth++
+	}
+
+	idx.buckets++
+	for i := range idx.dir {
+		if idx.dir[i] == bucket && uint64(i)&bit != 0 {
+			idx.dir[i] = newBucket
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the entries of a bucket being split that keep says stay in
+// it, then commits it one level deeper. It keeps the last copy of an entry, as
+// an interrupted compaction leaves earlier slots holding copies of later ones.
+func (idx *hashIndexer) compact(s Storage, bucket int64, hb *hashBucket, keep func(e []byte) bool) (*hashBucket, error) {
+	entries, err := idx.readEntries(s, bucket, hb)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(map[string]int, len(entries))
+	for i, e := range entries {
+		last[string(e[:idx.keySize])] = i
+	}
+
+	old := &hashBucket{depth: hb.depth + 1, pattern: hb.pattern}
+	for i, e := range entries {
+		if last[string(e[:idx.keySize])] != i || !keep(e) {
+			continue
+		}
+
+		if old.count != i {
+			if _, err := s.WriteOffset(e, bucket*hashBucketSlots+1+int64(old.count)); err != nil {
+				return nil, err
+			}
+		}
+		old.count++
+	}
+
+	if err := idx.writeBucket(s, bucket, old); err != nil {
+		return nil, err
+	}
+
+	return old, nil
+}
+
+func (idx *hashIndexer) Insert(s Storage, item Item) (int64, error) {
+	if err := idx.load(s); err != nil {
+		return -1, err
+	}
+
+	b, err := item.MarshalBinary()
+	if err != nil {
+		return -1, err
+	}
+
+	if idx.buckets == 0 {
+		if err := idx.create(s); err != nil {
+			idx.storage = nil
+			return -1, err
+		}
+	}
+
+	id := b[:idx.keySize]
+	for {
+		bucket, hb, off, err := idx.find(s, id)
+		if err != nil {
+			return -1, err
+		}
+
+		if off >= 0 {
+			if _, err := s.WriteOffset(b, off); err != nil {
+				return -1, err
+			}
+			return off, nil
+		}
+
+		if hb.count < hashBucketSize {
+			off = bucket*hashBucketSlots + 1 + int64(hb.count)
+			if _, err := s.WriteOffset(b, off); err != nil {
+				return -1, err
+			}
+
+			hb.count++
+			if err := idx.writeBucket(s, bucket, hb); err != nil {
+				hb.count--
+				if undoErr := idx.writeBucket(s, bucket, hb); undoErr != nil {
+					return -1, errors.Wrapf(undoErr, "undoing insert after %v", err)
+				}
+				return -1, err
+			}
+
+			idx.count++
+			return off, nil
+		}
+
+		if hb.depth >= 63 {
+			return -1, errors.New("hash index bucket cannot be split")
+		}
+
+		if err := idx.split(s, bucket, hb); err != nil {
+			idx.storage = nil
+			return -1, err
+		}
+	}
+}
+
+func (idx *hashIndexer) Find(s Storage, keyId KeyId) (int64, error) {
+	b, err := keyId.MarshalBinary()
+	if err != nil {
+		return -1, err
+	}
+
+	if uint16(len(b)) != idx.keySize {
+		return -1, errors.New("invalid key id size")
+	}
+
+	if err := idx.load(s); err != nil {
+		return -1, err
+	}
+
+	_, _, off, err := idx.find(s, b)
+	return off, err
+}
+
+func (idx *hashIndexer) Remove(s Storage, keyId KeyId) error {
+	b, err := keyId.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if uint16(len(b)) != idx.keySize {
+		return errors.New("invalid key id size")
+	}
+
+	if err := idx.load(s); err != nil {
+		return err
+	}
+
+	bucket, hb, off, err := idx.find(s, b)
+	if err != nil || off < 0 {
+		return err
+	}
+
+	removed := make([]byte, s.ItemSize())
+	if _, err := s.ReadOffset(removed, off); err != nil {
+		return err
+	}
+
+	last := bucket*hashBucketSlots + int64(hb.count)
+	if off != last {
+		e := make([]byte, s.ItemSize())
+		if _, err := s.ReadOffset(e, last); err != nil {
+			return err
+		}
+
+		if _, err := s.WriteOffset(e, off); err != nil {
+			return idx.undoRemove(s, bucket, hb, removed, off, err)
+		}
+	}
+
+	hb.count--
+	if err := idx.writeBucket(s, bucket, hb); err != nil {
+		hb.count++
+		return idx.undoRemove(s, bucket, hb, removed, off, err)
+	}
+
+	idx.count--
+	return nil
+}
+
+// undoRemove puts the removed entry back in its slot and the bucket header as
+// it was after Remove failed with err.
+func (idx *hashIndexer) undoRemove(s Storage, bucket int64, hb *hashBucket, removed []byte, off int64, err error) error {
+	if _, undoErr := s.WriteOffset(removed, off); undoErr != nil {
+		return errors.Wrapf(undoErr, "undoing remove after %v", err)
+	}
+
+	if undoErr := idx.writeBucket(s, bucket, hb); undoErr != nil {
+		return errors.Wrapf(undoErr, "undoing remove after %v", err)
+	}
+	return err
+}
+
+func (idx *hashIndexer) Count(s Storage) (int64, error) {
+	if err := idx.load(s); err != nil {
+		return 0, err
+	}
+
+	return idx.count, nil
+}
+
+func (idx *hashIndexer) Scan(s Storage, fn func(int64) error) error {
+	if err := idx.load(s); err != nil {
+		return err
+	}
+
+	for bucket := int64(0); bucket < idx.buckets; bucket++ {
+		hb, err := idx.readBucket(s, bucket)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < hb.count; i++ {
+			if err := fn(bucket*hashBucketSlots + 1 + int64(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (idx *hashIndexer) KeySize() uint16 {
+	return idx.keySize
+}
+
+func NewHashIndexer(keySize uint16) Indexer {
+	return &hashIndexer{keySize: keySize}
+}
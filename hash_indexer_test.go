@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func setupHashIndexerTest(tb testing.TB, n int) (func(tb testing.TB), Storage, Indexer, []uuid.UUID) {
+	if err := os.MkdirAll("./data/test", os.ModePerm); err != nil {
+		tb.Fatalf("storage data directory creation failed: %v", err)
+	}
+
+	s, err := NewStorage("./data/test/hash-indexer", KeySize)
+	if err != nil {
+		tb.Fatalf("storage creation failed: %v", err)
+	}
+
+	if err := s.Reset(); err != nil {
+		tb.Fatalf("storage reset failed: %v", err)
+	}
+
+	indexer := NewHashIndexer(KeyIdSize)
+
+	ids := make([]uuid.UUID, n)
+	for i := range ids {
+		ids[i] = uuid.New()
+		keyItem := &key{id: &ids[i], offset: uint64(i)}
+		if _, err := indexer.Insert(s, keyItem); err != nil {
+			tb.Fatalf("indexer insertion failed: %v", err)
+		}
+	}
+
+	return func(tb testing.TB) {
+		s.Close()
+	}, s, indexer, ids
+}
+
+func expectHashIndexerFinds(t *testing.T, s Storage, indexer Indexer, ids []uuid.UUID) {
+	readKey := &key{id: &uuid.NullUUID{}}
+	b := make([]byte, KeySize)
+	for i, id := range ids {
+		off, err := indexer.Find(s, &id)
+		if err != nil {
+			t.Fatalf("indexer find failed: %v", err)
+		}
+
+		if off < 0 {
+			t.Fatalf("expected id %v to be found", id)
+		}
+
+		if _, err := s.ReadOffset(b, off); err != nil {
+			t.Fatalf("storage read offset failed: %v", err)
+		}
+
+		if err := readKey.UnmarshalBinary(b); err != nil {
+			t.Fatalf("key binary unmarshalling failed: %v", err)
+		}
+
+		if readKey.id.(*uuid.NullUUID).UUID != id {
+			t.Fatalf("expected to get id %v; got %v", id, readKey.id)
+		}
+
+		if readKey.offset != uint64(i) {
+			t.Fatalf("expected key item offset to be %d; got %d", i, readKey.offset)
+		}
+	}
+}
+
+func TestHashIndexerInsertFind(t *testing.T) {
+	teardown, s, indexer, ids := setupHashIndexerTest(t, 500)
+	defer teardown(t)
+
+	expectHashIndexerFinds(t, s, indexer, ids)
+
+	count, err := indexer.Count(s)
+	if err != nil {
+		t.Fatalf("indexer count failed: %v", err)
+	}
+
+	if count != 500 {
+		t.Fatalf("expected count to be 500; got %d", count)
+	}
+
+	if indexer.(*hashIndexer).buckets < 500/hashBucketSize {
+		t.Fatalf("expected buckets to split; got %d buckets", indexer.(*hashIndexer).buckets)
+	}
+}
+
+func TestHashIndexerInsertAlreadyExists(t *testing.T) {
+	teardown, s, indexer, ids := setupHashIndexerTest(t, 5)
+	defer teardown(t)
+
+	if _, err := indexer.Insert(s, &key{id: &ids[2], offset: 2}); err != nil {
+		t.Fatalf("indexer re-insertion failed: %v", err)
+	}
+
+	count, err := indexer.Count(s)
+	if err != nil {
+		t.Fatalf("indexer count failed: %v", err)
+	}
+
+	if count != 5 {
+		t.Fatalf("expected count to be 5; got %d", count)
+	}
+}
+
+func TestHashIndexerFindDoesNotExist(t *testing.T) {
+	teardown, s, indexer, _ := setupHashIndexerTest(t, 50)
+	defer teardown(t)
+
+	unsavedId := uuid.New()
+	off, err := indexer.Find(s, &unsavedId)
+	if err != nil {
+		t.Fatalf("indexer find failed: %v", err)
+	}
+
+	if off != -1 {
+		t.Fatalf("expected offset to be %d; got %d", -1, off)
+	}
+}
+
+func TestHashIndexerRemove(t *testing.T) {
+	teardown, s, indexer, ids := setupHashIndexerTest(t, 100)
+	defer teardown(t)
+
+	for _, id := range ids[:50] {
+		if err := indexer.Remove(s, &id); err != nil {
+			t.Fatalf("indexer remove failed: %v", err)
+		}
+	}
+
+	for _, id := range ids[:50] {
+		off, err := indexer.Find(s, &id)
+		if err != nil {
+			t.Fatalf("indexer find failed: %v", err)
+		}
+
+		if off != -1 {
+			t.Fatalf("expected removed id to not be found")
+		}
+	}
+
+	count, err := indexer.Count(s)
+	if err != nil {
+		t.Fatalf("indexer count failed: %v", err)
+	}
+
+	if count != 50 {
+		t.Fatalf("expected count to be 50; got %d", count)
+	}
+
+	scanned := 0
+	err = indexer.Scan(s, func(int64) error {
+		scanned++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("indexer scan failed: %v", err)
+	}
+
+	if scanned != 50 {
+		t.Fatalf("expected 50 scanned keys; got %d", scanned)
+	}
+}
+
+func TestHashIndexerReload(t *testing.T) {
+	teardown, s, _, ids := setupHashIndexerTest(t, 300)
+	defer teardown(t)
+
+	expectHashIndexerFinds(t, s, NewHashIndexer(KeyIdSize), ids)
+}
+
+func TestHashIndexerKeepsDirectoryAcrossContexts(t *testing.T) {
+	teardown, s, indexer, ids := setupHashIndexerTest(t, 300)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expectHashIndexerFinds(t, withContext(ctx, s), indexer, ids)
+	if indexer.(*hashIndexer).storage != s {
+		t.Fatal("expected the directory to stay loaded for the storage under the context")
+	}
+}
+
+func TestCollectionIndexRecorded(t *testing.T) {
+	dir := "./data/test/index-recorded"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithIndex(IndexHash))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+	c.Close()
+
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(*collection).indexer.(*hashIndexer); !ok {
+		t.Fatalf("expected reopened collection to use the hash index")
+	}
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithIndex(IndexSorted)); err == nil {
+		t.Fatal("expected reopening with a different index to fail")
+	}
+}
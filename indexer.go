@@ -47,6 +47,11 @@ func (idx *indexer) Insert(s Storage, item Item) (int64, error) {
 		return -1, err
 	}
 
+	count, err := s.Count()
+	if err != nil {
+		return -1, err
+	}
+
 	off, found, err := idx.binarySearch(s, b[:idx.keySize])
 	if err != nil {
 		return -1, err
@@ -59,6 +64,17 @@ func (idx *indexer) Insert(s Storage, item Item) (int64, error) {
 	}
 
 	if _, err := s.WriteOffset(b, off); err != nil {
+		if !found {
+			// An append shifted nothing, so only its torn slot is dropped.
+			undo := func() error { return s.ShiftLeft(off) }
+			if off == count {
+				undo = func() error { return s.Truncate(count) }
+			}
+
+			if undoErr := undo(); undoErr != nil {
+				return -1, errors.Wrapf(undoErr, "undoing insert after %v", err)
+			}
+		}
 		return -1, err
 	}
 
@@ -109,6 +125,132 @@ func (idx *indexer) Find(s Storage, keyId KeyId) (int64, error) {
 	return off, nil
 }
 
+func (idx *indexer) Count(s Storage) (int64, error) {
+	return s.Count()
+}
+
+func (idx *indexer) Scan(s Storage, fn func(int64) error) error {
+	return idx.scanFrom(s, 0, fn)
+}
+
+// afterScanner is implemented by indexers that visit keys in key order and
+// can start past a given key id.
+type afterScanner interface {
+	ScanAfter(s Storage, after []byte, fn func(int64) error) error
+}
+
+// ScanAfter is Scan starting at the first key id greater than after.
+func (idx *indexer) ScanAfter(s Storage, after []byte, fn func(int64) error) error {
+	off, err := idx.seekAfter(s, after)
+	if err != nil {
+		return err
+	}
+
+	return idx.scanFrom(s, off, fn)
+}
+
+// seekAfter returns the offset of the first key id greater than after.
+func (idx *indexer) seekAfter(s Storage, after []byte) (int64, error) {
+	if after == nil {
+		return 0, nil
+	}
+
+	off, found, err := idx.binarySearch(s, after)
+	if err != nil {
+		return 0, err
+	}
+
+	if found {
+		off++
+	}
+
+	return off, nil
+}
+
+func (idx *indexer) scanFrom(s Storage, from int64, fn func(int64) error) error {
+	count, err := s.Count()
+	if err != nil {
+		return err
+	}
+
+	for off := from; off < count; off++ {
+		if err := fn(off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertSorted merges sorted key records into the storage in a single pass,
+// moving every existing record at most once, starting from the end. A failed
+// write leaves the storage as it was, unless undoing the merge fails too.
+func (idx *indexer) insertSorted(s Storage, keys [][]byte) error {
+	count, err := s.Count()
+	if err != nil {
+		return err
+	}
+
+	old := make([]byte, s.ItemSize())
+	oldOffset := count - 1
+	oldLoaded := false
+	next := len(keys) - 1
+
+	for w := count + int64(len(keys)) - 1; next >= 0; w-- {
+		if oldOffset >= 0 && !oldLoaded {
+			if _, err := s.ReadOffset(old, oldOffset); err != nil {
+				return err
+			}
+			oldLoaded = true
+		}
+
+		if oldLoaded && bytes.Compare(old[:idx.keySize], keys[next][:idx.keySize]) == 1 {
+			if _, err := s.WriteOffset(old, w); err != nil {
+				return idx.undoInsertSorted(s, count, keys[next+1:], oldOffset+1, w+1, err)
+			}
+			oldOffset -= 1
+			oldLoaded = false
+			continue
+		}
+
+		if _, err := s.WriteOffset(keys[next], w); err != nil {
+			return idx.undoInsertSorted(s, count, keys[next+1:], oldOffset+1, w+1, err)
+		}
+		next -= 1
+	}
+
+	return nil
+}
+
+// undoInsertSorted restores the storage after insertSorted failed with err.
+// The records from merged on hold the merged keys and the old records that
+// belong from restored on, which are moved back before the storage is
+// truncated to its old count.
+func (idx *indexer) undoInsertSorted(s Storage, count int64, merged [][]byte, restored int64, from int64, err error) error {
+	b := make([]byte, s.ItemSize())
+	for r := from; restored < count; r++ {
+		if _, readErr := s.ReadOffset(b, r); readErr != nil {
+			return readErr
+		}
+
+		if len(merged) > 0 && bytes.Equal(b[:idx.keySize], merged[0][:idx.keySize]) {
+			merged = merged[1:]
+			continue
+		}
+
+		if _, writeErr := s.WriteOffset(b, restored); writeErr != nil {
+			return writeErr
+		}
+		restored++
+	}
+
+	if truncateErr := s.Truncate(count); truncateErr != nil {
+		return truncateErr
+	}
+
+	return err
+}
+
 func (idx *indexer) KeySize() uint16 {
 	return idx.keySize
 }
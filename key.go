@@ -2,15 +2,26 @@ package main
 
 import (
 	"encoding/binary"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
 
 const KeyOffsetSize = 8
+const KeyExpirySize = 8
+const KeyVersionSize = 8
+const KeyMetaSize = KeyOffsetSize + KeyExpirySize + KeyVersionSize
 
 type key struct {
-	id     KeyId
-	offset uint64
+	id        KeyId
+	offset    uint64
+	expiresAt int64
+	version   uint64
+}
+
+func (k *key) expired(now time.Time) bool {
+	return k.expiresAt != 0 && k.expiresAt <= now.UnixNano()
 }
 
 func (k *key) MarshalBinary() ([]byte, error) {
@@ -20,14 +31,16 @@ func (k *key) MarshalBinary() ([]byte, error) {
 	}
 
 	idSize := len(id)
-	b := make([]byte, idSize+KeyOffsetSize)
+	b := make([]byte, idSize+KeyMetaSize)
 	copy(b[:idSize], id[:])
 	binary.LittleEndian.PutUint64(b[idSize:], k.offset)
+	binary.LittleEndian.PutUint64(b[idSize+KeyOffsetSize:], uint64(k.expiresAt))
+	binary.LittleEndian.PutUint64(b[idSize+KeyOffsetSize+KeyExpirySize:], k.version)
 	return b, nil
 }
 
 func (k *key) UnmarshalBinary(b []byte) error {
-	idSize := len(b) - KeyOffsetSize
+	idSize := len(b) - KeyMetaSize
 	if idSize <= 0 {
 		return errors.New("invalid slice size")
 	}
@@ -37,5 +50,21 @@ func (k *key) UnmarshalBinary(b []byte) error {
 	}
 
 	k.offset = binary.LittleEndian.Uint64(b[idSize:])
+	k.expiresAt = int64(binary.LittleEndian.Uint64(b[idSize+KeyOffsetSize:]))
+	k.version = binary.LittleEndian.Uint64(b[idSize+KeyOffsetSize+KeyExpirySize:])
+	return nil
+}
+
+func newKeyId() KeyId {
+	return &uuid.NullUUID{}
+}
+
+// checkKeyIdSize rejects key id sizes other than the one of the ids newKeyId
+// decodes.
+func checkKeyIdSize(size uint16) error {
+	if size != KeyIdSize {
+		return errors.Errorf("key ids must be %d bytes; got %d", KeyIdSize, size)
+	}
+
 	return nil
 }
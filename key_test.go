@@ -10,8 +10,10 @@ func TestKeyBinaryMarshallingAndUnmarshalling(t *testing.T) {
 	id := uuid.MustParse("a4a39129-7fb5-4855-9f80-6d290d52b812")
 
 	keyItem := key{
-		id:     &id,
-		offset: 1024,
+		id:        &id,
+		offset:    1024,
+		expiresAt: 1700000000000000000,
+		version:   7,
 	}
 
 	b, err := keyItem.MarshalBinary()
@@ -41,12 +43,20 @@ func TestKeyBinaryMarshallingAndUnmarshalling(t *testing.T) {
 	if newKeyItem.offset != 1024 {
 		t.Fatalf("expected key offset to be %d; got %d", 1024, newKeyItem.offset)
 	}
+
+	if newKeyItem.expiresAt != 1700000000000000000 {
+		t.Fatalf("expected key expiry to be %d; got %d", int64(1700000000000000000), newKeyItem.expiresAt)
+	}
+
+	if newKeyItem.version != 7 {
+		t.Fatalf("expected key version to be %d; got %d", 7, newKeyItem.version)
+	}
 }
 
 func TestKeyUnmarshallBinaryInvalidByteSliceSize(t *testing.T) {
 	keyItem := key{id: &uuid.NullUUID{}}
 
-	b := make([]byte, 8)
+	b := make([]byte, KeyMetaSize)
 	err := keyItem.UnmarshalBinary(b)
 	if err == nil {
 		t.Fatal("expected error to exist; got nil")
@@ -55,7 +65,7 @@ func TestKeyUnmarshallBinaryInvalidByteSliceSize(t *testing.T) {
 		t.Fatalf(`expected error to be "invalid slice size"; got "%s"`, err.Error())
 	}
 
-	b = make([]byte, 9)
+	b = make([]byte, KeyMetaSize+1)
 	err = keyItem.UnmarshalBinary(b)
 	if err == nil {
 		t.Fatal("expected error to exist; got nil")
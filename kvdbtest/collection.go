@@ -0,0 +1,272 @@
+package kvdbtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// CollectionConfig describes the collection under test.
+type CollectionConfig struct {
+	// Open opens the collection kept in dir, creating it when dir holds none.
+	Open func(dir string) (Collection, error)
+	// KeySize and ItemSize are the sizes of the marshalled key ids and items
+	// the collection stores.
+	KeySize  int
+	ItemSize int
+	// NotFound is the error Get fails with for absent keys.
+	NotFound error
+	// Ordered says that Scan visits the keys in ascending byte order.
+	Ordered bool
+}
+
+// compareCollection checks that c holds exactly the items of model, through
+// its count, its scan and a get of each key in keys.
+func compareCollection(c Collection, config CollectionConfig, model map[string][]byte, keys [][]byte) error {
+	count, err := c.Count()
+	if err != nil {
+		return fmt.Errorf("collection count failed: %v", err)
+	}
+
+	if count != int64(len(model)) {
+		return fmt.Errorf("expected item count to be %d; got %d", len(model), count)
+	}
+
+	for _, key := range keys {
+		if err := compareGet(c, config, model, key); err != nil {
+			return err
+		}
+	}
+
+	scanned := [][]byte{}
+	err = c.Scan(&Bytes{}, func(id KeyId, item Item) error {
+		key, err := id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		value, err := item.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		expected, ok := model[string(key)]
+		if !ok {
+			return fmt.Errorf("scan visited unknown key %x", key)
+		}
+
+		if !bytes.Equal(value, expected) {
+			return fmt.Errorf("expected scan to visit key %x with %x; got %x", key, expected, value)
+		}
+
+		scanned = append(scanned, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("collection scan failed: %v", err)
+	}
+
+	if len(scanned) != len(model) {
+		return fmt.Errorf("expected scan to visit %d keys; got %d", len(model), len(scanned))
+	}
+
+	if config.Ordered && !isSorted(scanned) {
+		return fmt.Errorf("expected scan to visit keys in order; got %x", scanned)
+	}
+
+	return nil
+}
+
+func compareGet(c Collection, config CollectionConfig, model map[string][]byte, key []byte) error {
+	k := Bytes(key)
+	item := Bytes{}
+	err := c.Get(&k, &item)
+
+	expected, ok := model[string(key)]
+	if !ok {
+		if !errors.Is(err, config.NotFound) {
+			return fmt.Errorf("expected get of absent key %x to fail with %v; got %v", key, config.NotFound, err)
+		}
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("collection get of key %x failed: %v", key, err)
+	}
+
+	if !bytes.Equal(item, expected) {
+		return fmt.Errorf("expected key %x to hold %x; got %x", key, expected, []byte(item))
+	}
+
+	return nil
+}
+
+// TestCollection checks a Collection implementation. Each case opens a new
+// collection in a directory of its own.
+func TestCollection(t *testing.T, config CollectionConfig) {
+	open := func(t *testing.T, dir string) Collection {
+		c, err := config.Open(dir)
+		if err != nil {
+			t.Fatalf("collection creation failed: %v", err)
+		}
+		return c
+	}
+
+	expect := func(t *testing.T, c Collection, model map[string][]byte, keys [][]byte) {
+		t.Helper()
+
+		if err := compareCollection(c, config, model, keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put := func(t *testing.T, c Collection, model map[string][]byte, key []byte, value []byte) {
+		t.Helper()
+
+		k, item := Bytes(key), Bytes(value)
+		if err := c.Put(&k, &item); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+		model[string(key)] = value
+	}
+
+	r := rand.New(rand.NewSource(1))
+	keys := randomKeys(r, 8, config.KeySize)
+	values := randomKeys(r, 8, config.ItemSize)
+
+	t.Run("PutGet", func(t *testing.T) {
+		c := open(t, t.TempDir())
+		defer c.Close()
+
+		model := map[string][]byte{}
+		expect(t, c, model, keys)
+
+		for i, key := range keys[:5] {
+			put(t, c, model, key, values[i])
+		}
+		expect(t, c, model, keys)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		c := open(t, t.TempDir())
+		defer c.Close()
+
+		model := map[string][]byte{}
+		put(t, c, model, keys[0], values[0])
+		put(t, c, model, keys[1], values[1])
+		put(t, c, model, keys[0], values[2])
+		expect(t, c, model, keys)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		c := open(t, t.TempDir())
+		defer c.Close()
+
+		model := map[string][]byte{}
+		for i, key := range keys {
+			put(t, c, model, key, values[i])
+		}
+
+		for _, key := range keys[1:4] {
+			k := Bytes(key)
+			if err := c.Remove(&k); err != nil {
+				t.Fatalf("collection remove failed: %v", err)
+			}
+			delete(model, string(key))
+		}
+		expect(t, c, model, keys)
+
+		// Removed keys can be put again.
+		put(t, c, model, keys[2], values[0])
+		expect(t, c, model, keys)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		dir := t.TempDir()
+		c := open(t, dir)
+
+		model := map[string][]byte{}
+		for i, key := range keys[:4] {
+			put(t, c, model, key, values[i])
+		}
+
+		k := Bytes(keys[1])
+		if err := c.Remove(&k); err != nil {
+			t.Fatalf("collection remove failed: %v", err)
+		}
+		delete(model, string(keys[1]))
+
+		if err := c.Close(); err != nil {
+			t.Fatalf("collection close failed: %v", err)
+		}
+
+		c = open(t, dir)
+		defer c.Close()
+		expect(t, c, model, keys)
+	})
+
+	t.Run("Model", func(t *testing.T) {
+		testCollectionModel(t, config)
+	})
+}
+
+// testCollectionModel applies random puts, removes and reopens to a
+// collection and to a map, comparing gets and counts after each step and the
+// whole collection every few steps.
+func testCollectionModel(t *testing.T, config CollectionConfig) {
+	r := rand.New(rand.NewSource(2))
+	keys := randomKeys(r, 24, config.KeySize)
+	model := map[string][]byte{}
+
+	dir := t.TempDir()
+	c, err := config.Open(dir)
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer func() { c.Close() }()
+
+	for step := 0; step < modelSteps; step++ {
+		key := keys[r.Intn(len(keys))]
+		k := Bytes(key)
+		var op string
+
+		switch n := r.Intn(20); {
+		case n < 11:
+			item := Bytes(randomBytes(r, config.ItemSize))
+			op = fmt.Sprintf("put %x", key)
+			err = c.Put(&k, &item)
+			model[string(key)] = item
+		case n < 17:
+			op = fmt.Sprintf("remove %x", key)
+			err = c.Remove(&k)
+			delete(model, string(key))
+		case n < 19:
+			op = fmt.Sprintf("get %x", key)
+		default:
+			op = "reopen"
+			if err = c.Close(); err == nil {
+				c, err = config.Open(dir)
+			}
+		}
+
+		if err != nil {
+			t.Fatalf("step %d: %s failed: %v", step, op, err)
+		}
+
+		if err := compareGet(c, config, model, key); err != nil {
+			t.Fatalf("step %d: after %s: %v", step, op, err)
+		}
+
+		if step%20 == 19 {
+			if err := compareCollection(c, config, model, keys); err != nil {
+				t.Fatalf("step %d: after %s: %v", step, op, err)
+			}
+		}
+	}
+
+	if err := compareCollection(c, config, model, keys); err != nil {
+		t.Fatalf("after %d steps: %v", modelSteps, err)
+	}
+}
@@ -0,0 +1,416 @@
+package kvdbtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// CrashConfig describes the collection under test for TestCrash.
+type CrashConfig struct {
+	// Open opens the collection kept in vfs, creating it when vfs holds none.
+	Open func(vfs VFS) (Collection, error)
+	// Repair, when set, repairs the collection kept in vfs after a crash.
+	Repair func(vfs VFS) error
+	// NewVFS returns an empty file system.
+	NewVFS func() VFS
+	// KeySize and ItemSize are the sizes of the marshalled key ids and items
+	// the collection stores.
+	KeySize  int
+	ItemSize int
+	// NotFound is the error Get fails with for absent keys.
+	NotFound error
+	// SyncsCommits says that every mutation is synced before it returns,
+	// rather than when the collection is closed.
+	SyncsCommits bool
+	// LiveSlots, when set, returns how many data slots of c hold items, which
+	// has to match its count after a repair.
+	LiveSlots func(c Collection) (int64, error)
+}
+
+const (
+	crashKeys = 6
+	crashOps  = 24
+	// crashCheckpoint is how many operations a run applies between closing
+	// and reopening the collection.
+	crashCheckpoint = 8
+)
+
+// crashOp puts value under key, or removes key when value is nil.
+type crashOp struct {
+	key   int
+	value []byte
+}
+
+type crashModel map[int][]byte
+
+func (m crashModel) apply(op crashOp) crashModel {
+	next := crashModel{}
+	for k, v := range m {
+		next[k] = v
+	}
+
+	if op.value == nil {
+		delete(next, op.key)
+	} else {
+		next[op.key] = op.value
+	}
+
+	return next
+}
+
+// only returns the state of key alone.
+func (m crashModel) only(key int) crashModel {
+	if value, ok := m[key]; ok {
+		return crashModel{key: value}
+	}
+
+	return crashModel{}
+}
+
+// randomCrashOps returns random keys and operations on them, and the state
+// of the collection before each operation and after the last.
+func randomCrashOps(config CrashConfig, seed int64) ([][]byte, []crashOp, []crashModel) {
+	r := rand.New(rand.NewSource(seed))
+	keys := randomKeys(r, crashKeys, config.KeySize)
+
+	ops := make([]crashOp, crashOps)
+	states := []crashModel{{}}
+	for i := range ops {
+		ops[i] = crashOp{key: r.Intn(crashKeys)}
+		if r.Intn(3) != 0 {
+			ops[i].value = randomBytes(r, config.ItemSize)
+		}
+		states = append(states, states[i].apply(ops[i]))
+	}
+
+	return keys, ops, states
+}
+
+func applyCrashOp(c Collection, keys [][]byte, op crashOp) error {
+	k := Bytes(keys[op.key])
+	if op.value == nil {
+		return c.Remove(&k)
+	}
+
+	item := Bytes(op.value)
+	return c.Put(&k, &item)
+}
+
+// crashRun is how far a run of operations got before it failed.
+type crashRun struct {
+	done     int  // operations completed
+	synced   int  // operations completed when the collection was last closed
+	inFlight bool // the operation after the completed ones had started
+}
+
+// acceptable returns the states from the one after operation from to the
+// one after the operation in flight.
+func (r crashRun) acceptable(states []crashModel, from int) []crashModel {
+	to := r.done
+	if r.inFlight {
+		to++
+	}
+
+	return states[from : to+1]
+}
+
+// runCrashOps opens the collection and applies ops until one of them fails,
+// closing it at the end and, unless checkpoint is 0, closing and reopening
+// it every checkpoint operations.
+func runCrashOps(config CrashConfig, vfs VFS, keys [][]byte, ops []crashOp, checkpoint int) (crashRun, error) {
+	run := crashRun{}
+	c, err := config.Open(vfs)
+	if err != nil {
+		return run, err
+	}
+
+	for i, op := range ops {
+		if checkpoint > 0 && i > 0 && i%checkpoint == 0 {
+			if err := c.Close(); err != nil {
+				return run, err
+			}
+			run.synced = i
+
+			if c, err = config.Open(vfs); err != nil {
+				return run, err
+			}
+		}
+
+		if err := applyCrashOp(c, keys, op); err != nil {
+			run.inFlight = true
+			return run, err
+		}
+		run.done++
+	}
+
+	if err := c.Close(); err != nil {
+		return run, err
+	}
+	run.synced = len(ops)
+
+	return run, nil
+}
+
+// readCrashCollection reopens the collection and returns its items, checking
+// that its count, scan and gets agree and, when repaired, that no data slot
+// leaked.
+func readCrashCollection(t *testing.T, config CrashConfig, vfs VFS, keys [][]byte, repaired bool) crashModel {
+	t.Helper()
+
+	c, err := config.Open(vfs)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	indexes := map[string]int{}
+	for i, key := range keys {
+		indexes[string(key)] = i
+	}
+
+	items := crashModel{}
+	err = c.Scan(&Bytes{}, func(id KeyId, item Item) error {
+		key, err := id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		i, ok := indexes[string(key)]
+		if !ok {
+			return fmt.Errorf("unknown key %x", key)
+		}
+
+		if _, ok := items[i]; ok {
+			return fmt.Errorf("key %x scanned twice", key)
+		}
+
+		value, err := item.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		items[i] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("collection scan failed: %v", err)
+	}
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("collection count failed: %v", err)
+	}
+
+	if count != int64(len(items)) {
+		t.Fatalf("expected item count to be %d; got %d", len(items), count)
+	}
+
+	for i, key := range keys {
+		k, item := Bytes(key), Bytes{}
+		err := c.Get(&k, &item)
+		if expected, ok := items[i]; ok && (err != nil || !bytes.Equal(item, expected)) {
+			t.Fatalf("expected key %d to hold %x; got %x, %v", i, expected, []byte(item), err)
+		}
+		if _, ok := items[i]; !ok && !errors.Is(err, config.NotFound) {
+			t.Fatalf("expected key %d to be absent; got %v", i, err)
+		}
+	}
+
+	if !repaired || config.LiveSlots == nil {
+		return items
+	}
+
+	live, err := config.LiveSlots(c)
+	if err != nil {
+		t.Fatalf("counting live slots failed: %v", err)
+	}
+
+	if live != count {
+		t.Fatalf("expected %d live data slots; got %d", count, live)
+	}
+
+	return items
+}
+
+// expectCrashState checks that each key holds its value from one of the
+// acceptable states.
+func expectCrashState(t *testing.T, items crashModel, acceptable ...crashModel) {
+	t.Helper()
+
+	for key := 0; key < crashKeys; key++ {
+		value, ok := items[key]
+		matched := false
+		for _, state := range acceptable {
+			if expected, present := state[key]; present == ok && bytes.Equal(expected, value) {
+				matched = true
+			}
+		}
+
+		if !matched {
+			t.Fatalf("key %d holds %x (present %v), which no acceptable state has", key, value, ok)
+		}
+	}
+}
+
+// reopenCrashed opens the collection left by a crash once, so that it
+// recovers, and repairs it when the config can.
+func reopenCrashed(t *testing.T, config CrashConfig, vfs VFS) {
+	t.Helper()
+
+	c, err := config.Open(vfs)
+	if err != nil {
+		t.Fatalf("reopening after the crash failed: %v", err)
+	}
+	c.Close()
+
+	if config.Repair != nil {
+		if err := config.Repair(vfs); err != nil {
+			t.Fatalf("repair failed: %v", err)
+		}
+	}
+}
+
+// countCrashWrites returns how many writes a run of ops without faults takes.
+func countCrashWrites(t *testing.T, config CrashConfig, keys [][]byte, ops []crashOp, checkpoint int) int {
+	counter := NewFaultFS(config.NewVFS(), Fault{})
+	if _, err := runCrashOps(config, counter, keys, ops, checkpoint); err != nil {
+		t.Fatalf("running operations failed: %v", err)
+	}
+
+	return counter.Writes()
+}
+
+// TestCrash checks that a collection recovers from crashes and failed writes
+// at each write of random operation sequences. The collection is reopened
+// and, when the config can, repaired after each crash.
+func TestCrash(t *testing.T, config CrashConfig) {
+	t.Run("Crash", func(t *testing.T) {
+		testCrashRecovery(t, config)
+	})
+
+	t.Run("PowerLoss", func(t *testing.T) {
+		testPowerLossRecovery(t, config)
+	})
+
+	t.Run("FailedWrites", func(t *testing.T) {
+		testFailedWrites(t, config)
+	})
+}
+
+// testCrashRecovery crashes a random operation sequence at each of its
+// writes, leaving the write whole or torn. Every key has to hold its value
+// from before or after the operation in flight.
+func testCrashRecovery(t *testing.T, config CrashConfig) {
+	for seed := int64(1); seed <= 3; seed++ {
+		keys, ops, states := randomCrashOps(config, seed)
+
+		writes := countCrashWrites(t, config, keys, ops, crashCheckpoint)
+		for write := 1; write <= writes; write++ {
+			for _, torn := range []bool{false, true} {
+				vfs := NewFaultFS(config.NewVFS(), Fault{Write: write, Torn: torn, Crash: true})
+				run, err := runCrashOps(config, vfs, keys, ops, crashCheckpoint)
+				if !errors.Is(err, ErrInjected) {
+					t.Fatalf("seed %d write %d: expected the crash to fail the run; got %v", seed, write, err)
+				}
+
+				underlying, err := vfs.Crash(false)
+				if err != nil {
+					t.Fatalf("crash failed: %v", err)
+				}
+
+				reopenCrashed(t, config, underlying)
+				items := readCrashCollection(t, config, underlying, keys, config.Repair != nil)
+				expectCrashState(t, items, run.acceptable(states, run.done)...)
+			}
+		}
+	}
+}
+
+// testPowerLossRecovery crashes as testCrashRecovery does but also drops
+// every write not synced. What the collection held when last closed, or
+// after every completed operation when the config syncs commits, has to
+// survive.
+func testPowerLossRecovery(t *testing.T, config CrashConfig) {
+	keys, ops, states := randomCrashOps(config, 4)
+
+	writes := countCrashWrites(t, config, keys, ops, crashCheckpoint)
+	for write := 1; write <= writes; write++ {
+		vfs := NewFaultFS(config.NewVFS(), Fault{Write: write, Crash: true})
+		run, _ := runCrashOps(config, vfs, keys, ops, crashCheckpoint)
+
+		underlying, err := vfs.Crash(true)
+		if err != nil {
+			t.Fatalf("crash failed: %v", err)
+		}
+
+		from := run.synced
+		if config.SyncsCommits {
+			from = run.done
+		}
+
+		reopenCrashed(t, config, underlying)
+		items := readCrashCollection(t, config, underlying, keys, config.Repair != nil)
+		expectCrashState(t, items, run.acceptable(states, from)...)
+	}
+}
+
+// testFailedWrites fails single writes of a random operation sequence
+// without crashing. The failed operation has to leave its key as it was
+// before or after it, and the others have to apply normally.
+func testFailedWrites(t *testing.T, config CrashConfig) {
+	keys, ops, _ := randomCrashOps(config, 5)
+
+	writes := countCrashWrites(t, config, keys, ops, 0)
+	for write := 1; write <= writes; write++ {
+		vfs := NewFaultFS(config.NewVFS(), Fault{Write: write})
+		state := crashModel{}
+
+		c, err := config.Open(vfs)
+		if err != nil {
+			// The fault is spent, so opening again succeeds.
+			if c, err = config.Open(vfs); err != nil {
+				t.Fatalf("write %d: collection creation failed: %v", write, err)
+			}
+		}
+
+		for i, op := range ops {
+			err := applyCrashOp(c, keys, op)
+			next := state.apply(op)
+			if err == nil {
+				state = next
+				continue
+			}
+
+			if !errors.Is(err, ErrInjected) {
+				t.Fatalf("write %d: operation %d failed: %v", write, i, err)
+			}
+
+			k, item := Bytes(keys[op.key]), Bytes{}
+			err = c.Get(&k, &item)
+			if err != nil && !errors.Is(err, config.NotFound) {
+				t.Fatalf("write %d: collection get failed: %v", write, err)
+			}
+
+			items := crashModel{}
+			if err == nil {
+				items[op.key] = item
+			}
+
+			expectCrashState(t, items, state.only(op.key), next.only(op.key))
+			if err == nil {
+				state[op.key] = item
+			} else {
+				delete(state, op.key)
+			}
+		}
+
+		if err := c.Close(); err != nil {
+			t.Fatalf("write %d: collection close failed: %v", write, err)
+		}
+
+		expectCrashState(t, readCrashCollection(t, config, vfs, keys, false), state)
+	}
+}
@@ -0,0 +1,346 @@
+package kvdbtest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// File and VFS mirror the file system interfaces of kv-db. Its files satisfy
+// File as they are; its file systems need an adapter, since OpenFile returns
+// kv-db's own File type.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type VFS interface {
+	OpenFile(name string, flag int) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string) error
+	SyncDir(name string) error
+	Lock(name string) (io.Closer, error)
+}
+
+// ErrInjected is what the writes a FaultFS fails return unless its Fault
+// says otherwise.
+var ErrInjected = errors.New("injected fault")
+
+// Fault says which write a FaultFS fails and how. Writes are counted across
+// every file and include truncations, renames and removals.
+type Fault struct {
+	Write int   // 1-based index of the write to fail; 0 never fails
+	Err   error // returned by the failing writes, ErrInjected when nil
+	Torn  bool  // the failing write stores the first half of its bytes
+	Crash bool  // every later write fails too, as after a crash
+}
+
+// FaultFS wraps a VFS, failing writes as its Fault says. It remembers what
+// files held when opened and when last synced, so that a crash can drop
+// what was written since.
+type FaultFS struct {
+	VFS
+	mu      sync.Mutex
+	fault   Fault
+	writes  int
+	crashed bool
+	synced  map[string][]byte
+	files   map[*faultFile]bool
+	locks   []io.Closer
+}
+
+func NewFaultFS(vfs VFS, f Fault) *FaultFS {
+	fs := &FaultFS{VFS: vfs, synced: map[string][]byte{}, files: map[*faultFile]bool{}}
+	fs.SetFault(f)
+	return fs
+}
+
+// SetFault replaces the fault of f. Its Write still counts from the first
+// write through f.
+func (f *FaultFS) SetFault(fault Fault) {
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fault = fault
+}
+
+// Writes returns how many writes went through f.
+func (f *FaultFS) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writes
+}
+
+// OpenFiles returns how many files opened through f are still open.
+func (f *FaultFS) OpenFiles() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.files)
+}
+
+// write counts a write and returns whether it stores the first half of its
+// bytes and the error to fail it with.
+func (f *FaultFS) write() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return false, f.fault.Err
+	}
+
+	f.writes++
+	if f.fault.Write == 0 || f.writes < f.fault.Write {
+		return false, nil
+	}
+
+	if f.writes == f.fault.Write {
+		f.crashed = f.fault.Crash
+		return f.fault.Torn, f.fault.Err
+	}
+
+	return false, nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int) (File, error) {
+	name = filepath.Clean(name)
+	if flag&os.O_TRUNC != 0 {
+		if _, err := f.write(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := f.VFS.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.synced[name]; !ok {
+		b, err := readAll(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.synced[name] = b
+	}
+
+	ff := &faultFile{File: file, fs: f, name: name}
+	f.files[ff] = true
+	return ff, nil
+}
+
+func under(name string, path string) bool {
+	return name == path || strings.HasPrefix(name, path+string(filepath.Separator))
+}
+
+func (f *FaultFS) Rename(oldpath string, newpath string) error {
+	if _, err := f.write(); err != nil {
+		return err
+	}
+
+	if err := f.VFS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	moved := map[string][]byte{}
+	for name, b := range f.synced {
+		if under(name, oldpath) {
+			delete(f.synced, name)
+			moved[newpath+name[len(oldpath):]] = b
+		}
+	}
+	for name, b := range moved {
+		f.synced[name] = b
+	}
+	for ff := range f.files {
+		if under(ff.name, oldpath) {
+			ff.name = newpath + ff.name[len(oldpath):]
+		}
+	}
+
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if _, err := f.write(); err != nil {
+		return err
+	}
+
+	if err := f.VFS.Remove(name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.synced, filepath.Clean(name))
+	return nil
+}
+
+func (f *FaultFS) RemoveAll(path string) error {
+	if _, err := f.write(); err != nil {
+		return err
+	}
+
+	if err := f.VFS.RemoveAll(path); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for name := range f.synced {
+		if under(name, filepath.Clean(path)) {
+			delete(f.synced, name)
+		}
+	}
+
+	return nil
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	lock, err := f.VFS.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.locks = append(f.locks, lock)
+	return lock, nil
+}
+
+// Crash makes every later write through f fail and releases the locks taken
+// through it, as the death of the process would. With dropUnsynced, files
+// lose what was written to them since they were last synced, as they would
+// in a power loss. It returns the wrapped VFS to reopen the files with.
+func (f *FaultFS) Crash(dropUnsynced bool) (VFS, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crashed = true
+	for _, lock := range f.locks {
+		lock.Close()
+	}
+	f.locks = nil
+
+	if dropUnsynced {
+		for name, b := range f.synced {
+			if err := writeFile(f.VFS, name, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.VFS, nil
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	torn, err := f.fs.write()
+	if err != nil {
+		if !torn {
+			return 0, err
+		}
+
+		n, _ := f.File.WriteAt(b[:len(b)/2], off)
+		return n, err
+	}
+
+	return f.File.WriteAt(b, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.fs.write(); err != nil {
+		return err
+	}
+
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+
+	b, err := readAll(f.File)
+	if err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.crashed {
+		return f.fs.fault.Err
+	}
+
+	f.fs.synced[f.name] = b
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mu.Lock()
+	delete(f.fs.files, f)
+	f.fs.mu.Unlock()
+
+	return f.File.Close()
+}
+
+func readAll(f File) ([]byte, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func writeFile(vfs VFS, name string, b []byte) error {
+	f, err := vfs.OpenFile(name, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(b, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
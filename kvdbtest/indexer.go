@@ -0,0 +1,221 @@
+package kvdbtest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// IndexerConfig describes the indexer under test.
+type IndexerConfig struct {
+	// New returns an indexer of keys of keySize bytes.
+	New        func(keySize uint16) Indexer
+	NewStorage StorageFactory
+	// Ordered says that Scan visits the keys in ascending byte order.
+	Ordered bool
+}
+
+const indexerKeySize = 16
+const indexerItemSize = indexerKeySize + 8
+
+// indexRecord returns an index record of key followed by payload.
+func indexRecord(key []byte, payload []byte) *Bytes {
+	b := Bytes(append(append([]byte{}, key...), payload...))
+	return &b
+}
+
+// compareIndex checks that idx finds each key of model in s, that it misses
+// the absent ones, and that its count and scan agree with model.
+func compareIndex(idx Indexer, s Storage, model map[string][]byte, absent [][]byte, ordered bool) error {
+	count, err := idx.Count(s)
+	if err != nil {
+		return fmt.Errorf("indexer count failed: %v", err)
+	}
+
+	if count != int64(len(model)) {
+		return fmt.Errorf("expected key count to be %d; got %d", len(model), count)
+	}
+
+	b := make([]byte, s.ItemSize())
+	for _, key := range sortedKeys(model) {
+		k := Bytes(key)
+		off, err := idx.Find(s, &k)
+		if err != nil {
+			return fmt.Errorf("indexer find failed: %v", err)
+		}
+
+		if off < 0 {
+			return fmt.Errorf("expected key %x to be found", key)
+		}
+
+		if _, err := s.ReadOffset(b, off); err != nil {
+			return fmt.Errorf("storage read offset failed: %v", err)
+		}
+
+		if expected := *indexRecord([]byte(key), model[key]); !bytes.Equal(b, expected) {
+			return fmt.Errorf("expected record %x at offset %d; got %x", expected, off, b)
+		}
+	}
+
+	for _, key := range absent {
+		if _, ok := model[string(key)]; ok {
+			continue
+		}
+
+		k := Bytes(key)
+		off, err := idx.Find(s, &k)
+		if err != nil {
+			return fmt.Errorf("indexer find failed: %v", err)
+		}
+
+		if off >= 0 {
+			return fmt.Errorf("expected key %x not to be found; got offset %d", key, off)
+		}
+	}
+
+	scanned := [][]byte{}
+	err = idx.Scan(s, func(off int64) error {
+		if _, err := s.ReadOffset(b, off); err != nil {
+			return err
+		}
+
+		scanned = append(scanned, append([]byte{}, b[:indexerKeySize]...))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("indexer scan failed: %v", err)
+	}
+
+	if len(scanned) != len(model) {
+		return fmt.Errorf("expected scan to visit %d keys; got %d", len(model), len(scanned))
+	}
+
+	for _, key := range scanned {
+		if _, ok := model[string(key)]; !ok {
+			return fmt.Errorf("scan visited unknown key %x", key)
+		}
+	}
+
+	if ordered && !isSorted(scanned) {
+		return fmt.Errorf("expected scan to visit keys in order; got %x", scanned)
+	}
+
+	return nil
+}
+
+// TestIndexer checks an Indexer implementation.
+func TestIndexer(t *testing.T, config IndexerConfig) {
+	open := func(t *testing.T) (Indexer, Storage) {
+		s := config.NewStorage(t, indexerItemSize)
+		t.Cleanup(func() { s.Close() })
+
+		idx := config.New(indexerKeySize)
+		if size := idx.KeySize(); size != indexerKeySize {
+			t.Fatalf("expected key size to be %d; got %d", indexerKeySize, size)
+		}
+		return idx, s
+	}
+
+	expect := func(t *testing.T, idx Indexer, s Storage, model map[string][]byte, absent [][]byte) {
+		t.Helper()
+
+		if err := compareIndex(idx, s, model, absent, config.Ordered); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	keys := randomKeys(r, 8, indexerKeySize)
+
+	t.Run("InsertFind", func(t *testing.T) {
+		idx, s := open(t)
+		expect(t, idx, s, map[string][]byte{}, keys)
+
+		model := map[string][]byte{}
+		for i, key := range keys[:5] {
+			model[string(key)] = record(i)[:indexerItemSize-indexerKeySize]
+			if _, err := idx.Insert(s, indexRecord(key, model[string(key)])); err != nil {
+				t.Fatalf("indexer insert failed: %v", err)
+			}
+		}
+		expect(t, idx, s, model, keys)
+	})
+
+	t.Run("InsertExisting", func(t *testing.T) {
+		idx, s := open(t)
+		model := map[string][]byte{}
+		for i := 0; i < 3; i++ {
+			model[string(keys[0])] = record(i)[:indexerItemSize-indexerKeySize]
+			if _, err := idx.Insert(s, indexRecord(keys[0], model[string(keys[0])])); err != nil {
+				t.Fatalf("indexer insert failed: %v", err)
+			}
+		}
+		expect(t, idx, s, model, keys)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		idx, s := open(t)
+		model := map[string][]byte{}
+		for i, key := range keys {
+			model[string(key)] = record(i)[:indexerItemSize-indexerKeySize]
+			if _, err := idx.Insert(s, indexRecord(key, model[string(key)])); err != nil {
+				t.Fatalf("indexer insert failed: %v", err)
+			}
+		}
+
+		for _, key := range keys[2:5] {
+			k := Bytes(key)
+			if err := idx.Remove(s, &k); err != nil {
+				t.Fatalf("indexer remove failed: %v", err)
+			}
+			delete(model, string(key))
+		}
+		expect(t, idx, s, model, keys)
+
+		// Removing an absent key changes nothing.
+		k := Bytes(keys[2])
+		if err := idx.Remove(s, &k); err != nil {
+			t.Fatalf("indexer remove failed: %v", err)
+		}
+		expect(t, idx, s, model, keys)
+	})
+
+	t.Run("Model", func(t *testing.T) {
+		idx, s := open(t)
+		testIndexerModel(t, idx, s, config.Ordered)
+	})
+}
+
+// testIndexerModel applies random inserts and removals to idx and to a map.
+func testIndexerModel(t *testing.T, idx Indexer, s Storage, ordered bool) {
+	r := rand.New(rand.NewSource(2))
+	keys := randomKeys(r, 40, indexerKeySize)
+	model := map[string][]byte{}
+
+	for step := 0; step < modelSteps; step++ {
+		key := keys[r.Intn(len(keys))]
+		var op string
+		var err error
+
+		if r.Intn(3) < 2 {
+			payload := randomBytes(r, indexerItemSize-indexerKeySize)
+			op = fmt.Sprintf("insert %x", key)
+			_, err = idx.Insert(s, indexRecord(key, payload))
+			model[string(key)] = payload
+		} else {
+			k := Bytes(key)
+			op = fmt.Sprintf("remove %x", key)
+			err = idx.Remove(s, &k)
+			delete(model, string(key))
+		}
+
+		if err != nil {
+			t.Fatalf("step %d: %s failed: %v", step, op, err)
+		}
+
+		if err := compareIndex(idx, s, model, keys, ordered); err != nil {
+			t.Fatalf("step %d: after %s: %v", step, op, err)
+		}
+	}
+}
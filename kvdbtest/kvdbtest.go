@@ -0,0 +1,103 @@
+// Package kvdbtest checks implementations of the kv-db storage, indexer and
+// collection interfaces. Each suite takes a factory for the implementation
+// under test and runs fixed cases followed by a model-based test, which
+// applies a random operation sequence to the implementation and to a plain
+// Go reference and compares them after each step. TestCrash runs a
+// collection on a FaultFS, which fails chosen writes and simulates crashes
+// and power losses.
+//
+// The interfaces mirror the ones of kv-db. Its storages satisfy Storage as
+// they are; indexers and collections need a thin adapter, since their
+// methods take kv-db's own Storage, KeyId and Item types.
+package kvdbtest
+
+import (
+	"bytes"
+	"encoding"
+	"math/rand"
+	"sort"
+)
+
+type Storage interface {
+	ReadOffset([]byte, int64) (int, error)
+	WriteOffset([]byte, int64) (int, error)
+	ShiftLeft(int64) error
+	ShiftRight(int64) error
+	Count() (int64, error)
+	Truncate(int64) error
+	ItemSize() uint16
+	Reset() error
+	Close() error
+}
+
+type KeyId interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+type Item interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+type Indexer interface {
+	Insert(Storage, Item) (int64, error)
+	Find(Storage, KeyId) (int64, error)
+	Remove(Storage, KeyId) error
+	Count(Storage) (int64, error)
+	Scan(Storage, func(int64) error) error
+	KeySize() uint16
+}
+
+type Collection interface {
+	Put(KeyId, Item) error
+	Get(KeyId, Item) error
+	Remove(KeyId) error
+	Scan(Item, func(KeyId, Item) error) error
+	Count() (int64, error)
+	Close() error
+}
+
+// Bytes is a key id or item holding raw bytes.
+type Bytes []byte
+
+func (b *Bytes) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, *b...), nil
+}
+
+func (b *Bytes) UnmarshalBinary(data []byte) error {
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// modelSteps is the length of the random operation sequences.
+const modelSteps = 400
+
+func randomBytes(r *rand.Rand, size int) []byte {
+	b := make([]byte, size)
+	r.Read(b)
+	return b
+}
+
+func randomKeys(r *rand.Rand, n int, size int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = randomBytes(r, size)
+	}
+	return keys
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isSorted(keys [][]byte) bool {
+	return sort.SliceIsSorted(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
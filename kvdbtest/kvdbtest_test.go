@@ -0,0 +1,240 @@
+package kvdbtest
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+// sliceStorage and mapCollection are the simplest implementations passing
+// the suites, which checks the suites themselves.
+type sliceStorage struct {
+	itemSize uint16
+	items    [][]byte
+}
+
+func (s *sliceStorage) ReadOffset(b []byte, off int64) (int, error) {
+	if off >= int64(len(s.items)) {
+		return 0, errors.New("offset out of range")
+	}
+	return copy(b, s.items[off]), nil
+}
+
+func (s *sliceStorage) WriteOffset(b []byte, off int64) (int, error) {
+	for int64(len(s.items)) <= off {
+		s.items = append(s.items, make([]byte, s.itemSize))
+	}
+	s.items[off] = append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (s *sliceStorage) ShiftLeft(off int64) error {
+	s.items = append(s.items[:off], s.items[off+1:]...)
+	return nil
+}
+
+func (s *sliceStorage) ShiftRight(off int64) error {
+	s.items = append(s.items[:off+1], s.items[off:]...)
+	return nil
+}
+
+func (s *sliceStorage) Count() (int64, error) {
+	return int64(len(s.items)), nil
+}
+
+func (s *sliceStorage) Truncate(count int64) error {
+	for int64(len(s.items)) < count {
+		s.items = append(s.items, make([]byte, s.itemSize))
+	}
+	s.items = s.items[:count]
+	return nil
+}
+
+func (s *sliceStorage) ItemSize() uint16 {
+	return s.itemSize
+}
+
+func (s *sliceStorage) Reset() error {
+	s.items = nil
+	return nil
+}
+
+func (s *sliceStorage) Close() error {
+	return nil
+}
+
+// sliceIndexer keeps its records sorted by key.
+type sliceIndexer struct {
+	keySize uint16
+}
+
+func (idx sliceIndexer) search(s Storage, key []byte) (int64, bool, error) {
+	count, err := s.Count()
+	if err != nil {
+		return 0, false, err
+	}
+
+	b := make([]byte, s.ItemSize())
+	var searchErr error
+	off := sort.Search(int(count), func(i int) bool {
+		if _, err := s.ReadOffset(b, int64(i)); err != nil {
+			searchErr = err
+		}
+		return string(b[:idx.keySize]) >= string(key)
+	})
+	if searchErr != nil || int64(off) == count {
+		return int64(off), false, searchErr
+	}
+
+	if _, err := s.ReadOffset(b, int64(off)); err != nil {
+		return 0, false, err
+	}
+
+	return int64(off), string(b[:idx.keySize]) == string(key), nil
+}
+
+func (idx sliceIndexer) Insert(s Storage, item Item) (int64, error) {
+	b, _ := item.MarshalBinary()
+	off, found, err := idx.search(s, b[:idx.keySize])
+	if err != nil {
+		return -1, err
+	}
+
+	if !found {
+		if count, _ := s.Count(); off < count {
+			if err := s.ShiftRight(off); err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	_, err = s.WriteOffset(b, off)
+	return off, err
+}
+
+func (idx sliceIndexer) Find(s Storage, id KeyId) (int64, error) {
+	key, _ := id.MarshalBinary()
+	off, found, err := idx.search(s, key)
+	if err != nil || !found {
+		return -1, err
+	}
+	return off, nil
+}
+
+func (idx sliceIndexer) Remove(s Storage, id KeyId) error {
+	key, _ := id.MarshalBinary()
+	off, found, err := idx.search(s, key)
+	if err != nil || !found {
+		return err
+	}
+	return s.ShiftLeft(off)
+}
+
+func (idx sliceIndexer) Count(s Storage) (int64, error) {
+	return s.Count()
+}
+
+func (idx sliceIndexer) Scan(s Storage, fn func(int64) error) error {
+	count, err := s.Count()
+	if err != nil {
+		return err
+	}
+
+	for off := int64(0); off < count; off++ {
+		if err := fn(off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx sliceIndexer) KeySize() uint16 {
+	return idx.keySize
+}
+
+var errNotFound = errors.New("not found")
+
+type mapCollection struct {
+	items map[string][]byte
+}
+
+func (c *mapCollection) Put(id KeyId, item Item) error {
+	key, _ := id.MarshalBinary()
+	c.items[string(key)], _ = item.MarshalBinary()
+	return nil
+}
+
+func (c *mapCollection) Get(id KeyId, item Item) error {
+	key, _ := id.MarshalBinary()
+	b, ok := c.items[string(key)]
+	if !ok {
+		return errNotFound
+	}
+	return item.UnmarshalBinary(b)
+}
+
+func (c *mapCollection) Remove(id KeyId) error {
+	key, _ := id.MarshalBinary()
+	delete(c.items, string(key))
+	return nil
+}
+
+func (c *mapCollection) Scan(item Item, fn func(KeyId, Item) error) error {
+	keys := []string{}
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := item.UnmarshalBinary(c.items[key]); err != nil {
+			return err
+		}
+
+		id := Bytes(key)
+		if err := fn(&id, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mapCollection) Count() (int64, error) {
+	return int64(len(c.items)), nil
+}
+
+func (c *mapCollection) Close() error {
+	return nil
+}
+
+func newSliceStorage(t *testing.T, itemSize uint16) Storage {
+	return &sliceStorage{itemSize: itemSize}
+}
+
+func TestSliceStorage(t *testing.T) {
+	TestStorage(t, newSliceStorage)
+}
+
+func TestSliceIndexer(t *testing.T) {
+	TestIndexer(t, IndexerConfig{
+		New:        func(keySize uint16) Indexer { return sliceIndexer{keySize: keySize} },
+		NewStorage: newSliceStorage,
+		Ordered:    true,
+	})
+}
+
+func TestMapCollection(t *testing.T) {
+	collections := map[string]*mapCollection{}
+	TestCollection(t, CollectionConfig{
+		Open: func(dir string) (Collection, error) {
+			if collections[dir] == nil {
+				collections[dir] = &mapCollection{items: map[string][]byte{}}
+			}
+			return collections[dir], nil
+		},
+		KeySize:  16,
+		ItemSize: 32,
+		NotFound: errNotFound,
+		Ordered:  true,
+	})
+}
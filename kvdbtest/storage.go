@@ -0,0 +1,197 @@
+package kvdbtest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// StorageFactory returns an empty storage of items of itemSize bytes. The
+// suites close it when done.
+type StorageFactory func(t *testing.T, itemSize uint16) Storage
+
+const storageItemSize = 24
+
+func record(i int) []byte {
+	return bytes.Repeat([]byte{byte('a' + i%26)}, storageItemSize)
+}
+
+func fillStorage(t *testing.T, s Storage, n int) [][]byte {
+	records := [][]byte{}
+	for i := 0; i < n; i++ {
+		records = append(records, record(i))
+		if _, err := s.WriteOffset(records[i], int64(i)); err != nil {
+			t.Fatalf("storage write offset failed: %v", err)
+		}
+	}
+	return records
+}
+
+// compareRecords checks that s holds exactly records.
+func compareRecords(s Storage, records [][]byte) error {
+	count, err := s.Count()
+	if err != nil {
+		return fmt.Errorf("storage count failed: %v", err)
+	}
+
+	if count != int64(len(records)) {
+		return fmt.Errorf("expected item count to be %d; got %d", len(records), count)
+	}
+
+	b := make([]byte, s.ItemSize())
+	for i, r := range records {
+		if _, err := s.ReadOffset(b, int64(i)); err != nil {
+			return fmt.Errorf("storage read offset %d failed: %v", i, err)
+		}
+
+		if !bytes.Equal(b, r) {
+			return fmt.Errorf("expected record %d to be %q; got %q", i, r, b)
+		}
+	}
+
+	return nil
+}
+
+func expectRecords(t *testing.T, s Storage, records [][]byte) {
+	t.Helper()
+
+	if err := compareRecords(s, records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStorage checks a Storage implementation.
+func TestStorage(t *testing.T, newStorage StorageFactory) {
+	open := func(t *testing.T) Storage {
+		s := newStorage(t, storageItemSize)
+		t.Cleanup(func() { s.Close() })
+
+		if size := s.ItemSize(); size != storageItemSize {
+			t.Fatalf("expected item size to be %d; got %d", storageItemSize, size)
+		}
+		return s
+	}
+
+	t.Run("WriteRead", func(t *testing.T) {
+		s := open(t)
+		expectRecords(t, s, [][]byte{})
+
+		records := fillStorage(t, s, 3)
+		records[1] = record(7)
+		if _, err := s.WriteOffset(records[1], 1); err != nil {
+			t.Fatalf("storage write offset failed: %v", err)
+		}
+		expectRecords(t, s, records)
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		s := open(t)
+		records := fillStorage(t, s, 4)
+
+		if err := s.Truncate(2); err != nil {
+			t.Fatalf("storage truncate failed: %v", err)
+		}
+		expectRecords(t, s, records[:2])
+
+		if err := s.Truncate(3); err != nil {
+			t.Fatalf("storage truncate failed: %v", err)
+		}
+		expectRecords(t, s, append(records[:2:2], make([]byte, storageItemSize)))
+	})
+
+	t.Run("ShiftRight", func(t *testing.T) {
+		s := open(t)
+		records := fillStorage(t, s, 4)
+
+		if err := s.ShiftRight(1); err != nil {
+			t.Fatalf("storage shift right failed: %v", err)
+		}
+		expectRecords(t, s, [][]byte{records[0], records[1], records[1], records[2], records[3]})
+	})
+
+	t.Run("ShiftLeft", func(t *testing.T) {
+		s := open(t)
+		records := fillStorage(t, s, 4)
+
+		if err := s.ShiftLeft(1); err != nil {
+			t.Fatalf("storage shift left failed: %v", err)
+		}
+		expectRecords(t, s, [][]byte{records[0], records[2], records[3]})
+
+		if err := s.ShiftLeft(2); err != nil {
+			t.Fatalf("storage shift left failed: %v", err)
+		}
+		expectRecords(t, s, [][]byte{records[0], records[2]})
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		s := open(t)
+		fillStorage(t, s, 3)
+
+		if err := s.Reset(); err != nil {
+			t.Fatalf("storage reset failed: %v", err)
+		}
+		expectRecords(t, s, [][]byte{})
+
+		records := fillStorage(t, s, 2)
+		expectRecords(t, s, records)
+	})
+
+	t.Run("Model", func(t *testing.T) {
+		testStorageModel(t, open(t))
+	})
+}
+
+// testStorageModel applies random writes, shifts and truncations to s and to
+// a slice of records.
+func testStorageModel(t *testing.T, s Storage) {
+	r := rand.New(rand.NewSource(1))
+	model := [][]byte{}
+
+	for step := 0; step < modelSteps; step++ {
+		n := int64(len(model))
+		var op string
+		var err error
+
+		switch k := r.Intn(10); {
+		case k < 4 || n == 0:
+			off := r.Int63n(n + 1)
+			b := randomBytes(r, storageItemSize)
+			op = fmt.Sprintf("write offset %d", off)
+			_, err = s.WriteOffset(b, off)
+			if off == n {
+				model = append(model, b)
+			} else {
+				model[off] = b
+			}
+		case k < 6:
+			off := r.Int63n(n)
+			op = fmt.Sprintf("shift right %d", off)
+			err = s.ShiftRight(off)
+			model = append(model[:off+1], model[off:]...)
+		case k < 8:
+			off := r.Int63n(n)
+			op = fmt.Sprintf("shift left %d", off)
+			err = s.ShiftLeft(off)
+			model = append(model[:off], model[off+1:]...)
+		case k < 9:
+			count := r.Int63n(n + 1)
+			op = fmt.Sprintf("truncate %d", count)
+			err = s.Truncate(count)
+			model = model[:count]
+		default:
+			op = "reset"
+			err = s.Reset()
+			model = [][]byte{}
+		}
+
+		if err != nil {
+			t.Fatalf("step %d: %s failed: %v", step, op, err)
+		}
+
+		if err := compareRecords(s, model); err != nil {
+			t.Fatalf("step %d: after %s: %v", step, op, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/cipher"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+)
+
+// kitIndexer and kitCollection adapt the engine's types to the interfaces of
+// kvdbtest, whose methods take its own Storage, KeyId and Item types.
+type kitIndexer struct {
+	Indexer
+}
+
+func (idx kitIndexer) Insert(s kvdbtest.Storage, item kvdbtest.Item) (int64, error) {
+	return idx.Indexer.Insert(s, item)
+}
+
+func (idx kitIndexer) Find(s kvdbtest.Storage, id kvdbtest.KeyId) (int64, error) {
+	return idx.Indexer.Find(s, id)
+}
+
+func (idx kitIndexer) Remove(s kvdbtest.Storage, id kvdbtest.KeyId) error {
+	return idx.Indexer.Remove(s, id)
+}
+
+func (idx kitIndexer) Count(s kvdbtest.Storage) (int64, error) {
+	return idx.Indexer.Count(s)
+}
+
+func (idx kitIndexer) Scan(s kvdbtest.Storage, fn func(int64) error) error {
+	return idx.Indexer.Scan(s, fn)
+}
+
+type kitCollection struct {
+	Collection
+}
+
+func (c kitCollection) Put(id kvdbtest.KeyId, item kvdbtest.Item) error {
+	return c.Collection.Put(id, item)
+}
+
+func (c kitCollection) Get(id kvdbtest.KeyId, item kvdbtest.Item) error {
+	return c.Collection.Get(id, item)
+}
+
+func (c kitCollection) Remove(id kvdbtest.KeyId) error {
+	return c.Collection.Remove(id)
+}
+
+func (c kitCollection) Scan(item kvdbtest.Item, fn func(kvdbtest.KeyId, kvdbtest.Item) error) error {
+	return c.Collection.Scan(item, func(id KeyId, item Item) error {
+		return fn(id, item)
+	})
+}
+
+// kitVFS and engineVFS adapt the engine's file systems to kvdbtest's and
+// back, since each OpenFile returns its package's own File type.
+type kitVFS struct {
+	VFS
+}
+
+func (v kitVFS) OpenFile(name string, flag int) (kvdbtest.File, error) {
+	return v.VFS.OpenFile(name, flag)
+}
+
+type engineVFS struct {
+	kvdbtest.VFS
+}
+
+func (v engineVFS) OpenFile(name string, flag int) (File, error) {
+	return v.VFS.OpenFile(name, flag)
+}
+
+// engine returns the engine's file system under vfs.
+func engine(vfs kvdbtest.VFS) VFS {
+	if v, ok := vfs.(kitVFS); ok {
+		return v.VFS
+	}
+
+	return engineVFS{vfs}
+}
+
+func kitStorage(open func(vfs VFS) storageOpener, vfs func() VFS) kvdbtest.StorageFactory {
+	return func(t *testing.T, itemSize uint16) kvdbtest.Storage {
+		dir, v := t.TempDir(), vfs()
+		if err := v.MkdirAll(dir); err != nil {
+			t.Fatalf("storage directory creation failed: %v", err)
+		}
+
+		s, err := open(v)(filepath.Join(dir, "storage"), itemSize)
+		if err != nil {
+			t.Fatalf("storage creation failed: %v", err)
+		}
+		return s
+	}
+}
+
+func encryptedKitStorage(vfs VFS) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		aead, err := newAEAD(testKeys["k1"])
+		if err != nil {
+			return nil, err
+		}
+
+		keys := &keyring{aeads: map[uint32]cipher.AEAD{}}
+		keys.add(1, aead)
+		return encryptedStorageOpener(vfs, keys)(filename, itemSize)
+	}
+}
+
+func osVFS() VFS {
+	return osFS{}
+}
+
+func TestStorageKit(t *testing.T) {
+	factories := map[string]kvdbtest.StorageFactory{
+		"File":       kitStorage(vfsStorageOpener, osVFS),
+		"Mem":        kitStorage(vfsStorageOpener, NewMemFS),
+		"Compressed": kitStorage(compressedStorageOpener, osVFS),
+		"Encrypted":  kitStorage(encryptedKitStorage, osVFS),
+	}
+
+	for name, newStorage := range factories {
+		t.Run(name, func(t *testing.T) {
+			kvdbtest.TestStorage(t, newStorage)
+		})
+	}
+}
+
+func TestIndexerKit(t *testing.T) {
+	configs := map[string]kvdbtest.IndexerConfig{
+		"Sorted": {
+			New:        func(keySize uint16) kvdbtest.Indexer { return kitIndexer{NewIndexer(keySize)} },
+			NewStorage: kitStorage(vfsStorageOpener, NewMemFS),
+			Ordered:    true,
+		},
+		"Hash": {
+			New:        func(keySize uint16) kvdbtest.Indexer { return kitIndexer{NewHashIndexer(keySize)} },
+			NewStorage: kitStorage(vfsStorageOpener, NewMemFS),
+		},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			kvdbtest.TestIndexer(t, config)
+		})
+	}
+}
+
+// testBackend is a collection configuration that the conformance tests and
+// the collection suite of kvdbtest run against.
+type testBackend struct {
+	lsm     bool
+	ordered bool
+	opts    func() []Option
+}
+
+func backendOptions(opts ...Option) func() []Option {
+	return func() []Option { return opts }
+}
+
+var testBackends = map[string]testBackend{
+	"Sorted":     {ordered: true},
+	"Hash":       {opts: backendOptions(WithIndex(IndexHash))},
+	"Compressed": {ordered: true, opts: backendOptions(WithCompression(CompressionFlate))},
+	"Encrypted":  {ordered: true, opts: backendOptions(WithEncryption(NewStaticKeyProvider("k1", testKeys)))},
+	"Bloom":      {ordered: true, opts: backendOptions(WithBloomFilter(100, 0.01))},
+	"Mem":        {ordered: true, opts: func() []Option { return []Option{WithVFS(NewMemFS())} }},
+	"LSM":        {lsm: true, ordered: true, opts: backendOptions(WithMemtableSize(2), WithCompactionThreshold(2))},
+}
+
+// open returns a function opening collections of the backend with items of
+// itemSize. Collections it opens share one file system.
+func (b testBackend) open(itemSize uint16) func(dir string, opts ...Option) (Collection, error) {
+	var base []Option
+	if b.opts != nil {
+		base = b.opts()
+	}
+
+	return func(dir string, opts ...Option) (Collection, error) {
+		opts = append(append([]Option{}, base...), opts...)
+		if b.lsm {
+			return NewLSMCollection(dir, KeyIdSize, itemSize, opts...)
+		}
+		return NewCollection(dir, KeySize, KeyIdSize, itemSize, opts...)
+	}
+}
+
+// useTestBackend makes newTestCollection open collections of the backend
+// for the rest of the test, in a directory of its own.
+func useTestBackend(t *testing.T, name string, backend testBackend) {
+	open := backend.open(BookSize)
+	newCollection := newTestCollection
+	newTestCollection = func(dir string, opts ...Option) (Collection, error) {
+		return open(filepath.Join(dir, strings.ToLower(name)), opts...)
+	}
+	t.Cleanup(func() {
+		newTestCollection = newCollection
+	})
+}
+
+func TestCollectionKit(t *testing.T) {
+	const itemSize = 32
+
+	for name, backend := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			open := backend.open(itemSize)
+			kvdbtest.TestCollection(t, kvdbtest.CollectionConfig{
+				Open: func(dir string) (kvdbtest.Collection, error) {
+					c, err := open(dir)
+					if err != nil {
+						return nil, err
+					}
+					return kitCollection{c}, nil
+				},
+				KeySize:  KeyIdSize,
+				ItemSize: itemSize,
+				NotFound: ErrNotFound,
+				Ordered:  backend.ordered,
+			})
+		})
+	}
+}
+
+// conformanceTests run against every backend through newTestCollection.
+var conformanceTests = map[string]func(*testing.T){
+	"PutGet":                    TestCollectionPutGet,
+	"Count":                     TestCollectionCount,
+	"Update":                    TestCollectionUpdate,
+	"Remove":                    TestCollectionRemove,
+	"Scan":                      TestCollectionScan,
+	"Load":                      TestCollectionLoad,
+	"LoadConflict":              TestCollectionLoadConflict,
+	"PutWithTTL":                TestCollectionPutWithTTL,
+	"Sweep":                     TestCollectionSweep,
+	"BackgroundSweep":           TestCollectionBackgroundSweep,
+	"WatchEvents":               TestWatchEvents,
+	"WatchRange":                TestWatchRange,
+	"ChangesRecordMutations":    TestChangesRecordMutations,
+	"ChangesSurviveReopen":      TestChangesSurviveReopen,
+	"TruncateChanges":           TestTruncateChanges,
+	"ExportImportJSONLines":     TestExportImportJSONLines,
+	"ExportImportCSV":           TestExportImportCSV,
+	"ImportConflictPolicies":    TestImportConflictPolicies,
+	"ReplicationBootstrap":      TestReplicationBootstrapAndStream,
+	"ReplicationFollowerResume": TestReplicationFollowerResume,
+	"ReplicationVersionsExpiry": TestReplicationVersionsAndExpiry,
+	"Snapshot":                  TestCollectionSnapshot,
+	"SnapshotReleases":          TestCollectionSnapshotReleasesVersions,
+	"SnapshotExpiry":            TestCollectionSnapshotExpiry,
+	"SnapshotPages":             TestCollectionSnapshotPages,
+	"PutIfAbsent":               TestCollectionPutIfAbsent,
+	"CompareAndSwap":            TestCollectionCompareAndSwap,
+	"RemoveIfVersion":           TestCollectionRemoveIfVersion,
+	"UpdateRetries":             TestCollectionUpdateRetries,
+	"VersionsSurviveReopen":     TestCollectionVersionsSurviveReopen,
+	"CloseTwice":                TestCollectionCloseTwice,
+	"Metrics":                   TestCollectionMetrics,
+	"Context":                   TestCollectionContext,
+	"Stats":                     TestCollectionStats,
+	"StatsEmpty":                TestCollectionStatsEmpty,
+}
+
+func TestCollectionConformance(t *testing.T) {
+	for name, backend := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			useTestBackend(t, name, backend)
+			for test, fn := range conformanceTests {
+				t.Run(test, fn)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// rwMutex is a readers-writer lock whose waits can be given up when a
+// context is done. Like sync.RWMutex, a waiting writer keeps new readers out.
+type rwMutex struct {
+	mu       sync.Mutex
+	readers  int
+	writer   bool
+	writers  int
+	released chan struct{}
+}
+
+// wake lets the waiters check the lock again.
+func (l *rwMutex) wake() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+func (l *rwMutex) acquire(ctx context.Context, write bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	if write {
+		l.writers++
+	}
+
+	for {
+		if write && !l.writer && l.readers == 0 {
+			l.writers--
+			l.writer = true
+			l.mu.Unlock()
+			return nil
+		}
+
+		if !write && !l.writer && l.writers == 0 {
+			l.readers++
+			l.mu.Unlock()
+			return nil
+		}
+
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+			l.mu.Lock()
+		case <-ctx.Done():
+			if write {
+				l.mu.Lock()
+				l.writers--
+				l.wake()
+				l.mu.Unlock()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *rwMutex) LockCtx(ctx context.Context) error {
+	return l.acquire(ctx, true)
+}
+
+func (l *rwMutex) RLockCtx(ctx context.Context) error {
+	return l.acquire(ctx, false)
+}
+
+func (l *rwMutex) Lock() {
+	l.acquire(context.Background(), true)
+}
+
+func (l *rwMutex) RLock() {
+	l.acquire(context.Background(), false)
+}
+
+func (l *rwMutex) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.writer {
+		panic("unlock of unlocked rwMutex")
+	}
+	l.writer = false
+	l.wake()
+}
+
+func (l *rwMutex) RUnlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.readers == 0 {
+		panic("runlock of unlocked rwMutex")
+	}
+	if l.readers--; l.readers == 0 {
+		l.wake()
+	}
+}
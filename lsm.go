@@ -0,0 +1,1480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const lsmSeqSize = 8
+const lsmExpirySize = 8
+const lsmVersionSize = 8
+const lsmFlagSize = 1
+const lsmHeaderSize = lsmSeqSize + lsmExpirySize + lsmVersionSize + lsmFlagSize
+
+const (
+	lsmValue byte = iota
+	lsmTombstone
+)
+
+type lsmEntry struct {
+	seq       uint64
+	expiresAt int64
+	version   uint64
+	tombstone bool
+	value     []byte
+}
+
+func (e *lsmEntry) live(now time.Time) bool {
+	return e != nil && !e.tombstone && (e.expiresAt == 0 || e.expiresAt > now.UnixNano())
+}
+
+// versionAt returns the version of the key, which is 0 for absent, removed
+// and expired keys.
+func (e *lsmEntry) versionAt(now time.Time) uint64 {
+	if !e.live(now) {
+		return 0
+	}
+
+	return e.version
+}
+
+type lsmTable struct {
+	id      uint64
+	count   int64
+	storage Storage
+}
+
+type lsmManifest struct {
+	Format      int      `json:"format"`
+	FlushedSeq  uint64   `json:"flushedSeq"`
+	NextTableId uint64   `json:"nextTableId"`
+	Tables      []uint64 `json:"tables"`
+}
+
+// lsmCollection is a log-structured merge tree. Mutations are appended to the
+// change log, which doubles as the write-ahead log, and buffered in a
+// memtable. Full memtables are flushed to immutable sorted table files that
+// are merged in the background by size-tiered compaction.
+type lsmCollection struct {
+	mu        rwMutex
+	dir       string
+	keyIdSize uint16
+	itemSize  uint16
+	opts      *options
+	memtable  map[string]*lsmEntry
+	tables    []*lsmTable
+	manifest  lsmManifest
+	indexer   Indexer
+	hub       *watchHub
+	changes   *changelog
+	versions  *versionStore
+	metrics   *metrics
+	lock      io.Closer
+	now       func() time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	compactMu   sync.Mutex
+	compacting  []*lsmTable
+	compactErr  error
+	wake        chan struct{}
+	compactDone chan struct{}
+}
+
+func (c *lsmCollection) recordSize() int {
+	return int(c.keyIdSize) + lsmHeaderSize + int(c.itemSize)
+}
+
+func (c *lsmCollection) encode(id []byte, e *lsmEntry) []byte {
+	b := make([]byte, c.recordSize())
+	copy(b, id)
+	off := int(c.keyIdSize)
+	binary.LittleEndian.PutUint64(b[off:], e.seq)
+	binary.LittleEndian.PutUint64(b[off+lsmSeqSize:], uint64(e.expiresAt))
+	binary.LittleEndian.PutUint64(b[off+lsmSeqSize+lsmExpirySize:], e.version)
+	if e.tombstone {
+		b[off+lsmSeqSize+lsmExpirySize+lsmVersionSize] = lsmTombstone
+	}
+	copy(b[off+lsmHeaderSize:], e.value)
+	return b
+}
+
+func (c *lsmCollection) decode(b []byte) ([]byte, *lsmEntry) {
+	off := int(c.keyIdSize)
+	e := &lsmEntry{
+		seq:       binary.LittleEndian.Uint64(b[off:]),
+		expiresAt: int64(binary.LittleEndian.Uint64(b[off+lsmSeqSize:])),
+		version:   binary.LittleEndian.Uint64(b[off+lsmSeqSize+lsmExpirySize:]),
+		tombstone: b[off+lsmSeqSize+lsmExpirySize+lsmVersionSize] == lsmTombstone,
+	}
+	if !e.tombstone {
+		e.value = b[off+lsmHeaderSize:]
+	}
+	return b[:off], e
+}
+
+func (c *lsmCollection) tablePath(id uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("table-%06d", id))
+}
+
+func (c *lsmCollection) saveManifest() error {
+	c.manifest.Tables = c.manifest.Tables[:0]
+	for _, t := range c.tables {
+		c.manifest.Tables = append(c.manifest.Tables, t.id)
+	}
+
+	return c.writeManifest()
+}
+
+func (c *lsmCollection) writeManifest() error {
+	b, err := json.Marshal(&c.manifest)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.opts.vfs, filepath.Join(c.dir, "manifest"), b)
+}
+
+func (c *lsmCollection) loadManifest() error {
+	// Collections write their manifest when created since format version 4,
+	// so one without a manifest but with a change log is older and has only
+	// been written to its log.
+	b, err := readFile(c.opts.vfs, filepath.Join(c.dir, "manifest"))
+	if os.IsNotExist(err) {
+		if _, err := c.opts.vfs.Stat(filepath.Join(c.dir, "changes")); os.IsNotExist(err) {
+			c.manifest.Format = DiskFormatVersion
+			return c.writeManifest()
+		} else if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(b, &c.manifest); err != nil {
+		return errors.Wrap(err, "invalid lsm manifest")
+	}
+
+	if c.manifest.Format > DiskFormatVersion {
+		return errors.Errorf("collection format version %d is newer than %d", c.manifest.Format, DiskFormatVersion)
+	}
+
+	if c.manifest.Format < DiskFormatVersion {
+		if err := c.upgrade(); err != nil {
+			return errors.Wrapf(err, "upgrading format version %d", c.manifest.Format)
+		}
+	}
+
+	for _, id := range c.manifest.Tables {
+		t, err := c.openTable(id)
+		if err != nil {
+			return err
+		}
+		c.tables = append(c.tables, t)
+	}
+
+	return finishUpgrade(c.opts.vfs, c.dir, "changes")
+}
+
+// upgrade rewrites the change log, and the tables of a manifest without a
+// format, in the current layout. The new change log is written to
+// changes.upgrade and moved over the old one once the manifest records the
+// new format.
+func (c *lsmCollection) upgrade() error {
+	open := vfsStorageOpener(c.opts.vfs)
+	if c.manifest.Format < 4 {
+		if err := rewriteFile(c.opts.vfs, c.dir, changesUpgrade(c.manifest.Format, c.keyIdSize, c.itemSize), open, open); err != nil {
+			return err
+		}
+	}
+
+	if c.manifest.Format < 3 {
+		return c.upgradeTables()
+	}
+
+	c.manifest.Format = DiskFormatVersion
+	return c.writeManifest()
+}
+
+// upgradeTables rewrites the tables of a manifest without a format, which
+// predate record versions, to new tables with every record at version 1. The
+// manifest switches to the new tables at once, after which the old ones are
+// removed.
+func (c *lsmCollection) upgradeTables() error {
+	oldSize := c.recordSize() - lsmVersionSize
+	off := int(c.keyIdSize) + lsmSeqSize + lsmExpirySize
+
+	var old []*lsmTable
+	defer func() {
+		for _, t := range old {
+			t.storage.Close()
+		}
+	}()
+
+	var tables []*lsmTable
+	for _, id := range c.manifest.Tables {
+		storage, err := vfsStorageOpener(c.opts.vfs)(c.tablePath(id), uint16(oldSize))
+		if err != nil {
+			return err
+		}
+		old = append(old, &lsmTable{id: id, storage: storage})
+
+		count, err := storage.Count()
+		if err != nil {
+			return err
+		}
+
+		t, err := c.writeTable(c.nextTableId(), func(add func([]byte) error) error {
+			b := make([]byte, oldSize)
+			for i := int64(0); i < count; i++ {
+				if _, err := storage.ReadOffset(b, i); err != nil {
+					return err
+				}
+
+				r := make([]byte, c.recordSize())
+				copy(r, b[:off])
+				binary.LittleEndian.PutUint64(r[off:], 1)
+				copy(r[off+lsmVersionSize:], b[off:])
+				if err := add(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, false)
+		if err != nil {
+			return err
+		}
+		t.storage.Close()
+		tables = append(tables, t)
+	}
+
+	c.manifest.Format = DiskFormatVersion
+	c.tables = tables
+	err := c.saveManifest()
+	c.tables = nil
+	if err != nil {
+		return err
+	}
+
+	err = c.removeTables(old)
+	old = nil
+	return err
+}
+
+func (c *lsmCollection) openTable(id uint64) (*lsmTable, error) {
+	storage, err := instrumentedStorageOpener(vfsStorageOpener(c.opts.vfs), c.metrics, c.opts.observer, c.dir)(c.tablePath(id), uint16(c.recordSize()))
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := storage.Count()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return &lsmTable{id: id, count: count, storage: storage}, nil
+}
+
+// removeTables closes and removes tables, except those being compacted, which
+// the compaction removes once it finds that they were dropped.
+func (c *lsmCollection) removeTables(tables []*lsmTable) error {
+	for _, t := range tables {
+		if c.isCompacting(t) {
+			continue
+		}
+
+		if err := t.storage.Close(); err != nil {
+			return err
+		}
+
+		if err := c.opts.vfs.Remove(c.tablePath(t.id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *lsmCollection) isCompacting(t *lsmTable) bool {
+	for _, r := range c.compacting {
+		if r == t {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the newest entry for id, which may be a tombstone, or nil
+// when the key was never written.
+func (c *lsmCollection) lookup(id []byte) (*lsmEntry, error) {
+	if e, ok := c.memtable[string(id)]; ok {
+		return e, nil
+	}
+
+	keyId := rawItem(id)
+	b := make([]byte, c.recordSize())
+	for _, t := range c.tables {
+		off, err := c.indexer.Find(t.storage, &keyId)
+		if err != nil {
+			return nil, err
+		}
+
+		if off < 0 {
+			continue
+		}
+
+		if _, err := t.storage.ReadOffset(b, off); err != nil {
+			return nil, err
+		}
+
+		_, e := c.decode(b)
+		return e, nil
+	}
+
+	return nil, nil
+}
+
+func (c *lsmCollection) sources() []recordIterator {
+	sources := []recordIterator{c.memtableRecords(nil)}
+	for _, t := range c.tables {
+		sources = append(sources, &storageRecords{s: t.storage, count: t.count, size: c.recordSize()})
+	}
+	return sources
+}
+
+// sourcesAfter is sources starting past the key id after.
+func (c *lsmCollection) sourcesAfter(after []byte) ([]recordIterator, error) {
+	idx := indexer{keySize: c.keyIdSize}
+	sources := []recordIterator{c.memtableRecords(after)}
+	for _, t := range c.tables {
+		off, err := idx.seekAfter(t.storage, after)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, &storageRecords{s: t.storage, off: off, count: t.count, size: c.recordSize()})
+	}
+	return sources, nil
+}
+
+// memtableRecords encodes the memtable entries past the key id after in key
+// order, or all of them when after is nil.
+func (c *lsmCollection) memtableRecords(after []byte) *sliceRecords {
+	ids := make([]string, 0, len(c.memtable))
+	for id := range c.memtable {
+		if after == nil || id > string(after) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	records := make([][]byte, len(ids))
+	for i, id := range ids {
+		records[i] = c.encode([]byte(id), c.memtable[id])
+	}
+
+	return &sliceRecords{records: records}
+}
+
+// commit logs the mutation, which assigns its sequence number, then applies
+// it to the memtable and notifies watchers.
+func (c *lsmCollection) commit(op Op, id []byte, e *lsmEntry, old []byte) error {
+	seq, err := c.changes.append(op, id, e.value, e.expiresAt, e.version)
+	if err != nil {
+		return err
+	}
+
+	if c.opts.syncOnCommit {
+		if err := c.changes.sync(); err != nil {
+			return err
+		}
+	}
+
+	e.seq = seq
+	c.memtable[string(id)] = e
+
+	if err := c.hub.notify(seq, op, id, old, e.value); err != nil {
+		return err
+	}
+
+	if len(c.memtable) >= c.opts.memtableSize {
+		return c.flush()
+	}
+
+	return nil
+}
+
+func (c *lsmCollection) oldValue(id []byte) ([]byte, error) {
+	if !c.hub.active() {
+		return nil, nil
+	}
+
+	e, err := c.lookup(id)
+	if err != nil || !e.live(c.now()) {
+		return nil, err
+	}
+
+	return append([]byte{}, e.value...), nil
+}
+
+func (c *lsmCollection) current(id []byte) (version, error) {
+	e, err := c.lookup(id)
+	if err != nil || e == nil || e.tombstone {
+		return version{}, err
+	}
+
+	return version{value: append([]byte{}, e.value...), expiresAt: e.expiresAt, keyVersion: e.version, present: true}, nil
+}
+
+// retain keeps the current version of id for open snapshots before the next
+// mutation replaces it.
+func (c *lsmCollection) retain(id []byte) error {
+	if !c.versions.active() {
+		return nil
+	}
+
+	v, err := c.current(id)
+	if err != nil {
+		return err
+	}
+
+	c.versions.record(id, c.changes.lastSeq()+1, v)
+	return nil
+}
+
+func (c *lsmCollection) Put(id KeyId, item Item) error {
+	return c.PutCtx(context.Background(), id, item)
+}
+
+func (c *lsmCollection) PutCtx(ctx context.Context, id KeyId, item Item) error {
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+
+	return c.put(id, item, 0, anyVersion, 0)
+}
+
+func (c *lsmCollection) PutWithTTL(id KeyId, item Item, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(id, item, c.now().Add(ttl).UnixNano(), anyVersion, 0)
+}
+
+// put writes item under id if its version is the expected one. The key is
+// given version next or, when next is 0, the sequence number of the put, so
+// that versions keep growing even across removes.
+func (c *lsmCollection) put(id KeyId, item Item, expiresAt int64, expected uint64, next uint64) (err error) {
+	defer c.metrics.put.observe(time.Now(), &err)
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	defer observeOp(c.opts.observer, c.dir, "put", idBytes)(&err)
+
+	if uint16(len(idBytes)) != c.keyIdSize {
+		return errors.New("invalid key id size")
+	}
+
+	b, err := item.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if uint16(len(b)) > c.itemSize {
+		return errors.New("slice length exceeded item size")
+	}
+
+	value := make([]byte, c.itemSize)
+	copy(value, b)
+
+	e, err := c.lookup(idBytes)
+	if err != nil {
+		return err
+	}
+
+	version := e.versionAt(c.now())
+	if err := checkVersion(idBytes, expected, version); err != nil {
+		return err
+	}
+
+	if next == 0 {
+		next = c.changes.lastSeq() + 1
+	}
+
+	old, err := c.oldValue(idBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := c.retain(idBytes); err != nil {
+		return err
+	}
+
+	return c.commit(OpPut, idBytes, &lsmEntry{expiresAt: expiresAt, version: next, value: value}, old)
+}
+
+func (c *lsmCollection) Get(id KeyId, item Item) error {
+	_, err := c.GetWithVersion(id, item)
+	return err
+}
+
+func (c *lsmCollection) GetCtx(ctx context.Context, id KeyId, item Item) error {
+	_, err := c.getWithVersion(ctx, id, item)
+	return err
+}
+
+func (c *lsmCollection) GetWithVersion(id KeyId, item Item) (uint64, error) {
+	return c.getWithVersion(context.Background(), id, item)
+}
+
+func (c *lsmCollection) getWithVersion(ctx context.Context, id KeyId, item Item) (_ uint64, err error) {
+	defer c.metrics.get.observe(time.Now(), &err)
+
+	if err := c.mu.RLockCtx(ctx); err != nil {
+		return 0, err
+	}
+	defer c.mu.RUnlock()
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	defer observeOp(c.opts.observer, c.dir, "get", idBytes)(&err)
+
+	e, err := c.lookup(idBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	if !e.live(c.now()) {
+		return 0, ErrNotFound
+	}
+
+	return e.version, item.UnmarshalBinary(e.value)
+}
+
+func (c *lsmCollection) PutIfAbsent(id KeyId, item Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(id, item, 0, 0, 0)
+}
+
+func (c *lsmCollection) CompareAndSwap(id KeyId, expectedVersion uint64, item Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.put(id, item, 0, expectedVersion, 0)
+}
+
+func (c *lsmCollection) RemoveIfVersion(id KeyId, expectedVersion uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return c.remove(idBytes, OpRemove, expectedVersion)
+}
+
+func (c *lsmCollection) Update(id KeyId, item Item, fn func(old Item) (Item, error)) error {
+	return update(c, id, item, fn)
+}
+
+func (c *lsmCollection) Remove(id KeyId) error {
+	return c.RemoveCtx(context.Background(), id)
+}
+
+func (c *lsmCollection) RemoveCtx(ctx context.Context, id KeyId) error {
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return c.remove(idBytes, OpRemove, anyVersion)
+}
+
+func (c *lsmCollection) remove(id []byte, op Op, expected uint64) (err error) {
+	defer c.metrics.remove.observe(time.Now(), &err)
+	defer observeOp(c.opts.observer, c.dir, "remove", id)(&err)
+
+	e, err := c.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVersion(id, expected, e.versionAt(c.now())); err != nil {
+		return err
+	}
+
+	if e == nil || e.tombstone {
+		return nil
+	}
+
+	if err := c.retain(id); err != nil {
+		return err
+	}
+
+	var old []byte
+	if c.hub.active() {
+		old = append([]byte{}, e.value...)
+	}
+
+	return c.commit(op, id, &lsmEntry{tombstone: true}, old)
+}
+
+// each calls fn with the newest entry of every key that is not removed.
+func (c *lsmCollection) each(fn func(id []byte, e *lsmEntry) error) error {
+	return c.eachAfter(nil, fn)
+}
+
+// eachAfter is each starting past the key id after.
+func (c *lsmCollection) eachAfter(after []byte, fn func(id []byte, e *lsmEntry) error) error {
+	sources, err := c.sourcesAfter(after)
+	if err != nil {
+		return err
+	}
+
+	return mergeRecords(sources, int(c.keyIdSize), func(b []byte) error {
+		id, e := c.decode(b)
+		if e.tombstone {
+			return nil
+		}
+		return fn(id, e)
+	})
+}
+
+func (c *lsmCollection) Scan(item Item, fn func(KeyId, Item) error) error {
+	return c.ScanCtx(context.Background(), item, fn)
+}
+
+func (c *lsmCollection) ScanCtx(ctx context.Context, item Item, fn func(KeyId, Item) error) (err error) {
+	defer observeOp(c.opts.observer, c.dir, "scan", nil)(&err)
+
+	if err := c.mu.RLockCtx(ctx); err != nil {
+		return err
+	}
+	defer c.mu.RUnlock()
+
+	now := c.now()
+	return c.each(func(idBytes []byte, e *lsmEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !e.live(now) {
+			return nil
+		}
+
+		id := newKeyId()
+		if err := id.UnmarshalBinary(idBytes); err != nil {
+			return err
+		}
+
+		if err := item.UnmarshalBinary(e.value); err != nil {
+			return err
+		}
+
+		return fn(id, item)
+	})
+}
+
+func (c *lsmCollection) Load(entries []Entry, onConflict ConflictPolicy) (int, error) {
+	return c.LoadCtx(context.Background(), entries, onConflict)
+}
+
+// LoadCtx is Load giving up when ctx is done before it starts writing. Once
+// it has, the whole batch is stored.
+func (c *lsmCollection) LoadCtx(ctx context.Context, entries []Entry, onConflict ConflictPolicy) (_ int, err error) {
+	defer observeOp(c.opts.observer, c.dir, "load", nil)(&err)
+
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return 0, err
+	}
+	defer c.mu.Unlock()
+
+	order := []string{}
+	latest := map[string]Entry{}
+	for _, e := range entries {
+		id, err := e.Id.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		if uint16(len(id)) != c.keyIdSize {
+			return 0, errors.New("invalid key id size")
+		}
+
+		if _, ok := latest[string(id)]; !ok {
+			latest[string(id)] = e
+			order = append(order, string(id))
+			continue
+		}
+
+		switch onConflict {
+		case ConflictOverwrite:
+			latest[string(id)] = e
+		case ConflictFail:
+			return 0, errors.Wrapf(ErrKeyExists, "duplicate key %x in batch", id)
+		}
+	}
+
+	now := c.now()
+	writes := []Entry{}
+	for _, id := range order {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		existing, err := c.lookup([]byte(id))
+		if err != nil {
+			return 0, err
+		}
+
+		if existing.live(now) {
+			switch onConflict {
+			case ConflictSkip:
+				continue
+			case ConflictFail:
+				return 0, errors.Wrapf(ErrKeyExists, "key %x", id)
+			}
+		}
+
+		writes = append(writes, latest[id])
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, e := range writes {
+		if err := c.put(e.Id, e.Item, 0, anyVersion, 0); err != nil {
+			return i, err
+		}
+	}
+
+	return len(writes), nil
+}
+
+func (c *lsmCollection) Sweep() (int, error) {
+	return c.SweepCtx(context.Background())
+}
+
+// SweepCtx is Sweep stopping when ctx is done. The keys removed by then stay
+// removed and are counted.
+func (c *lsmCollection) SweepCtx(ctx context.Context) (_ int, err error) {
+	defer observeOp(c.opts.observer, c.dir, "sweep", nil)(&err)
+
+	if err := c.mu.LockCtx(ctx); err != nil {
+		return 0, err
+	}
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expired := [][]byte{}
+	err = c.each(func(id []byte, e *lsmEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !e.live(now) {
+			expired = append(expired, append([]byte{}, id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range expired {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+
+		if err := c.remove(id, OpExpire, anyVersion); err != nil {
+			return i, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+func (c *lsmCollection) sweepEvery(interval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Sweep()
+		}
+	}
+}
+
+func (c *lsmCollection) Watch(ctx context.Context, opts WatchOptions) <-chan Event {
+	return c.hub.subscribe(ctx, opts)
+}
+
+func (c *lsmCollection) LastSeq() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.changes.lastSeq()
+}
+
+func (c *lsmCollection) Changes(from uint64, fn func(Change) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.changes.read(from, fn)
+}
+
+// TruncateChanges never drops changes that have not been flushed to a table
+// yet, because the change log is also the write-ahead log of the memtable.
+func (c *lsmCollection) TruncateChanges(below uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if below > c.manifest.FlushedSeq+1 {
+		below = c.manifest.FlushedSeq + 1
+	}
+
+	return c.changes.truncate(below)
+}
+
+func (c *lsmCollection) Apply(change Change) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch change.Op {
+	case OpPut:
+		item := rawItem(change.Value)
+		return c.put(change.Id, &item, change.ExpiresAt, anyVersion, change.Version)
+	case OpRemove, OpExpire:
+		id, err := change.Id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return c.remove(id, change.Op, anyVersion)
+	case OpReset:
+		return c.reset()
+	}
+
+	return errors.Errorf("unknown change operation %d", change.Op)
+}
+
+func (c *lsmCollection) Count() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	count := int64(0)
+	err := c.each(func([]byte, *lsmEntry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (c *lsmCollection) Metrics() Metrics {
+	return c.metrics.snapshot()
+}
+
+func (c *lsmCollection) Stats() (Stats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := Stats{}
+	var first, last []byte
+	err := c.each(func(id []byte, e *lsmEntry) error {
+		if first == nil {
+			first = append([]byte{}, id...)
+		}
+		last = append(last[:0], id...)
+		stats.Count++
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if stats.Files, stats.FileBytes, err = fileSizes(c.opts.vfs, c.dir); err != nil {
+		return Stats{}, err
+	}
+
+	if first != nil {
+		stats.MinKey, stats.MaxKey = newKeyId(), newKeyId()
+		if err := stats.MinKey.UnmarshalBinary(first); err != nil {
+			return Stats{}, err
+		}
+
+		if err := stats.MaxKey.UnmarshalBinary(last); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	return stats, nil
+}
+
+// Snapshot pins a read-only view of the collection at its last sequence
+// number.
+func (c *lsmCollection) Snapshot() (Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.changes.lastSeq()
+	c.versions.pin(seq)
+	return &snapshot{
+		seq:      seq,
+		mu:       &c.mu,
+		versions: c.versions,
+		at:       c.now(),
+		current:  c.current,
+		each: func(after []byte, fn func(id []byte, v version) error) error {
+			return c.eachAfter(after, func(id []byte, e *lsmEntry) error {
+				return fn(id, version{value: append([]byte{}, e.value...), expiresAt: e.expiresAt, keyVersion: e.version, present: true})
+			})
+		},
+		ordered: true,
+	}, nil
+}
+
+func (c *lsmCollection) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reset()
+}
+
+func (c *lsmCollection) reset() error {
+	if c.versions.active() {
+		seq := c.changes.lastSeq() + 1
+		err := c.each(func(id []byte, e *lsmEntry) error {
+			c.versions.record(id, seq, version{value: append([]byte{}, e.value...), expiresAt: e.expiresAt, keyVersion: e.version, present: true})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tables := c.tables
+	c.tables = nil
+	c.memtable = map[string]*lsmEntry{}
+	c.manifest.FlushedSeq = c.changes.lastSeq()
+	if err := c.saveManifest(); err != nil {
+		return err
+	}
+
+	if err := c.removeTables(tables); err != nil {
+		return err
+	}
+
+	seq, err := c.changes.append(OpReset, nil, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if c.opts.syncOnCommit {
+		if err := c.changes.sync(); err != nil {
+			return err
+		}
+	}
+
+	return c.hub.notify(seq, OpReset, nil, nil, nil)
+}
+
+// flush writes the memtable to a new table file and records it in the
+// manifest together with the last sequence number it covers, then wakes the
+// compactor.
+func (c *lsmCollection) flush() error {
+	if len(c.memtable) == 0 {
+		return nil
+	}
+
+	it := c.sources()[0]
+	t, err := c.writeTable(c.nextTableId(), func(add func([]byte) error) error {
+		for {
+			b, err := it.next()
+			if err != nil || b == nil {
+				return err
+			}
+
+			if err := add(b); err != nil {
+				return err
+			}
+		}
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	c.tables = append([]*lsmTable{t}, c.tables...)
+	c.manifest.FlushedSeq = c.changes.lastSeq()
+	if err := c.saveManifest(); err != nil {
+		return err
+	}
+
+	c.memtable = map[string]*lsmEntry{}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *lsmCollection) nextTableId() uint64 {
+	id := c.manifest.NextTableId
+	c.manifest.NextTableId++
+	return id
+}
+
+// writeTable writes the records that fill passes to add, in key order, to
+// the table file id. The table is removed again when writing it fails.
+func (c *lsmCollection) writeTable(id uint64, fill func(add func([]byte) error) error, dropTombstones bool) (_ *lsmTable, err error) {
+	t, err := c.openTable(id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			t.storage.Close()
+			c.opts.vfs.Remove(c.tablePath(id))
+		}
+	}()
+
+	if err := t.storage.Reset(); err != nil {
+		return nil, err
+	}
+
+	t.count = 0
+	err = fill(func(b []byte) error {
+		if _, e := c.decode(b); dropTombstones && e.tombstone {
+			return nil
+		}
+
+		if _, err := t.storage.WriteOffset(b, t.count); err != nil {
+			return err
+		}
+		t.count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The table is synced before the manifest can refer to it.
+	if err := syncStorage(t.storage); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (c *lsmCollection) tier(t *lsmTable) int {
+	tier := 0
+	for size := int64(c.opts.memtableSize); t.count > size; size *= int64(c.opts.compactionThreshold) {
+		tier++
+	}
+	return tier
+}
+
+// pickRun returns the first run of adjacent tables in the same size tier that
+// is long enough to be merged, and whether it includes the oldest table.
+func (c *lsmCollection) pickRun() ([]*lsmTable, bool) {
+	for i := 0; i < len(c.tables); {
+		j := i + 1
+		for j < len(c.tables) && c.tier(c.tables[j]) == c.tier(c.tables[i]) {
+			j++
+		}
+
+		if j-i >= c.opts.compactionThreshold {
+			return append([]*lsmTable{}, c.tables[i:j]...), j == len(c.tables)
+		}
+		i = j
+	}
+
+	return nil, false
+}
+
+// compactor runs compactions whenever a flush wakes it, until the collection
+// is closed. Their last error is returned by Close.
+func (c *lsmCollection) compactor() {
+	defer close(c.compactDone)
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.wake:
+			if err := c.compact(); err != nil {
+				c.mu.Lock()
+				c.compactErr = err
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// compact merges runs of adjacent tables in the same size tier until none is
+// left. A run is streamed into its new table without holding the lock, which
+// is only taken to pick the run and to swap the tables. Tombstones are
+// dropped when the run includes the oldest table, since nothing older can be
+// shadowed by them anymore.
+func (c *lsmCollection) compact() error {
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	for {
+		c.mu.Lock()
+		run, oldest := c.pickRun()
+		if run == nil {
+			c.mu.Unlock()
+			return nil
+		}
+		id := c.nextTableId()
+		c.compacting = run
+		c.mu.Unlock()
+
+		sources := make([]recordIterator, len(run))
+		for i, t := range run {
+			sources[i] = &storageRecords{s: t.storage, count: t.count, size: c.recordSize()}
+		}
+
+		t, err := c.writeTable(id, func(add func([]byte) error) error {
+			return mergeRecords(sources, int(c.keyIdSize), func(b []byte) error {
+				select {
+				case <-c.stop:
+					return errCompactionStopped
+				default:
+				}
+				return add(b)
+			})
+		}, oldest)
+		if err == errCompactionStopped {
+			c.mu.Lock()
+			c.compacting = nil
+			c.mu.Unlock()
+			return nil
+		}
+
+		c.mu.Lock()
+		err = c.swapTables(run, t, err)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errCompactionStopped = errors.New("compaction stopped")
+
+// swapTables replaces run with the table t merged from it, or removes both
+// when a reset dropped the run while it was being merged.
+func (c *lsmCollection) swapTables(run []*lsmTable, t *lsmTable, err error) error {
+	c.compacting = nil
+
+	start := -1
+	for i := range c.tables {
+		if c.tables[i] == run[0] {
+			start = i
+			break
+		}
+	}
+
+	if start < 0 {
+		if t != nil {
+			run = append(run, t)
+		}
+		return c.removeTables(run)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tables := c.tables
+	merged := append([]*lsmTable{}, tables[:start]...)
+	merged = append(merged, t)
+	c.tables = append(merged, tables[start+len(run):]...)
+	if err := c.saveManifest(); err != nil {
+		c.tables = tables
+		return err
+	}
+
+	return c.removeTables(run)
+}
+
+// replay rebuilds the memtable from the changes logged after the last flush.
+func (c *lsmCollection) replay() error {
+	return c.changes.read(c.manifest.FlushedSeq+1, func(change Change) error {
+		var id []byte
+		if change.Id != nil {
+			var err error
+			if id, err = change.Id.MarshalBinary(); err != nil {
+				return err
+			}
+		}
+
+		switch change.Op {
+		case OpPut:
+			version := change.Version
+			if version == 0 {
+				version = change.Seq
+			}
+			c.memtable[string(id)] = &lsmEntry{seq: change.Seq, expiresAt: change.ExpiresAt, version: version, value: change.Value}
+		case OpRemove, OpExpire:
+			c.memtable[string(id)] = &lsmEntry{seq: change.Seq, tombstone: true}
+		case OpReset:
+			tables := c.tables
+			c.tables = nil
+			c.memtable = map[string]*lsmEntry{}
+			if err := c.saveManifest(); err != nil {
+				return err
+			}
+			return c.removeTables(tables)
+		}
+		return nil
+	})
+}
+
+// Close stops the compactor and closes the collection's files. It returns the
+// error of the last compaction that failed, if any. Only the first call does
+// so; later calls return its error.
+func (c *lsmCollection) Close() error {
+	c.closeOnce.Do(func() { c.closeErr = c.close() })
+	return c.closeErr
+}
+
+func (c *lsmCollection) close() error {
+	if c.stop != nil {
+		close(c.stop)
+		if c.done != nil {
+			<-c.done
+		}
+		<-c.compactDone
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hub.close()
+
+	err := c.compactErr
+	for _, t := range c.tables {
+		if closeErr := t.storage.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if c.changes != nil {
+		if closeErr := c.changes.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := c.lock.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func NewLSMCollection(collectionDir string, keyIdSize uint16, itemSize uint16, opts ...Option) (Collection, error) {
+	o := newOptions(opts)
+
+	if err := checkKeyIdSize(keyIdSize); err != nil {
+		return nil, err
+	}
+
+	if int(keyIdSize)+lsmHeaderSize+int(itemSize) > math.MaxUint16 {
+		return nil, errors.New("item size too large for lsm table")
+	}
+
+	if o.memtableSize <= 0 || o.compactionThreshold < 2 {
+		return nil, errors.New("invalid lsm options")
+	}
+
+	if o.compression != "" && o.compression != CompressionNone {
+		return nil, errors.New("lsm collections do not support compression")
+	}
+
+	if o.keyProvider != nil {
+		return nil, errors.New("lsm collections do not support encryption")
+	}
+
+	if o.text != nil {
+		return nil, errors.New("lsm collections do not support text indexes")
+	}
+
+	if err := o.vfs.MkdirAll(collectionDir); err != nil {
+		return nil, err
+	}
+
+	lock, err := o.vfs.Lock(filepath.Join(collectionDir, "lock"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "collection %s", collectionDir)
+	}
+
+	m := o.metrics
+	if m == nil {
+		m = &metrics{}
+	}
+
+	c := &lsmCollection{
+		dir:       collectionDir,
+		keyIdSize: keyIdSize,
+		itemSize:  itemSize,
+		opts:      o,
+		memtable:  map[string]*lsmEntry{},
+		indexer:   NewIndexer(keyIdSize),
+		hub:       newWatchHub(),
+		versions:  newVersionStore(),
+		metrics:   m,
+		lock:      lock,
+		now:       time.Now,
+	}
+
+	if err := c.loadManifest(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.changes, err = openChangelog(o.vfs, filepath.Join(collectionDir, "changes"), keyIdSize, itemSize, instrumentedStorageOpener(vfsStorageOpener(o.vfs), m, o.observer, collectionDir))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.replay(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.stop = make(chan struct{})
+	c.wake = make(chan struct{}, 1)
+	c.compactDone = make(chan struct{})
+	go c.compactor()
+
+	if o.sweepInterval > 0 {
+		c.done = make(chan struct{})
+		go c.sweepEvery(o.sweepInterval)
+	}
+
+	return c, nil
+}
+
+type recordIterator interface {
+	next() ([]byte, error)
+}
+
+type sliceRecords struct {
+	records [][]byte
+	i       int
+}
+
+func (it *sliceRecords) next() ([]byte, error) {
+	if it.i >= len(it.records) {
+		return nil, nil
+	}
+
+	b := it.records[it.i]
+	it.i++
+	return b, nil
+}
+
+type storageRecords struct {
+	s     Storage
+	off   int64
+	count int64
+	size  int
+}
+
+func (it *storageRecords) next() ([]byte, error) {
+	if it.off >= it.count {
+		return nil, nil
+	}
+
+	b := make([]byte, it.size)
+	if _, err := it.s.ReadOffset(b, it.off); err != nil {
+		return nil, err
+	}
+
+	it.off++
+	return b, nil
+}
+
+// mergeRecords calls fn with the records of sorted sources in key order. When
+// several sources hold the same key, only the record of the first source,
+// which is the newest, is passed on.
+func mergeRecords(sources []recordIterator, idSize int, fn func([]byte) error) error {
+	heads := make([][]byte, len(sources))
+	for i, it := range sources {
+		b, err := it.next()
+		if err != nil {
+			return err
+		}
+		heads[i] = b
+	}
+
+	for {
+		min := -1
+		for i, b := range heads {
+			if b != nil && (min < 0 || bytes.Compare(b[:idSize], heads[min][:idSize]) == -1) {
+				min = i
+			}
+		}
+
+		if min < 0 {
+			return nil
+		}
+
+		rec := heads[min]
+		if err := fn(rec); err != nil {
+			return err
+		}
+
+		for i, b := range heads {
+			if b == nil || !bytes.Equal(b[:idSize], rec[:idSize]) {
+				continue
+			}
+
+			next, err := sources[i].next()
+			if err != nil {
+				return err
+			}
+			heads[i] = next
+		}
+	}
+}
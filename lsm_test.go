@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func setupLSMTest(tb testing.TB, opts ...Option) (func(tb testing.TB), *lsmCollection) {
+	c, err := NewLSMCollection("./data/test/lsm", KeyIdSize, BookSize, opts...)
+	if err != nil {
+		tb.Fatalf("lsm collection creation failed: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		tb.Fatalf("lsm collection reset failed: %v", err)
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c.(*lsmCollection)
+}
+
+func TestLSMReplaysMemtableOnReopen(t *testing.T) {
+	teardown, c := setupLSMTest(t)
+
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range ids {
+		if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("lsm put failed: %v", err)
+		}
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("lsm remove failed: %v", err)
+	}
+
+	if len(c.tables) != 0 {
+		t.Fatalf("expected no flushed tables; got %d", len(c.tables))
+	}
+	teardown(t)
+
+	reopened, err := NewLSMCollection("./data/test/lsm", KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("lsm collection reopening failed: %v", err)
+	}
+	defer reopened.Close()
+
+	book := &Book{}
+	if err := reopened.Get(&ids[0], book); err != nil {
+		t.Fatalf("lsm get after reopening failed: %v", err)
+	}
+
+	if book.Title != "Dune" {
+		t.Fatalf(`expected book title to be "Dune"; got "%s"`, book.Title)
+	}
+
+	if err := reopened.Get(&ids[1], book); err == nil {
+		t.Fatal("expected removed book to stay removed after reopening")
+	}
+}
+
+func TestLSMFlushAndCompaction(t *testing.T) {
+	teardown, c := setupLSMTest(t, WithMemtableSize(4), WithCompactionThreshold(2))
+	defer teardown(t)
+
+	ids := make([]uuid.UUID, 64)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: "Book", Year: uint16(i)}); err != nil {
+			t.Fatalf("lsm put failed: %v", err)
+		}
+	}
+
+	for _, id := range ids[:32] {
+		if err := c.Remove(&id); err != nil {
+			t.Fatalf("lsm remove failed: %v", err)
+		}
+	}
+
+	if err := c.compact(); err != nil {
+		t.Fatalf("lsm compaction failed: %v", err)
+	}
+
+	if len(c.tables) > 4 {
+		t.Fatalf("expected compaction to keep the table count low; got %d tables", len(c.tables))
+	}
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("lsm count failed: %v", err)
+	}
+
+	if count != 32 {
+		t.Fatalf("expected item count to be 32; got %d", count)
+	}
+
+	book := &Book{}
+	for i, id := range ids {
+		err := c.Get(&id, book)
+		if i < 32 && err == nil {
+			t.Fatalf("expected removed book %d to not be found", i)
+		}
+
+		if i >= 32 && (err != nil || book.Year != uint16(i)) {
+			t.Fatalf("expected book %d to be found; got %v, %v", i, *book, err)
+		}
+	}
+}
+
+func TestLSMCompactionDropsTombstones(t *testing.T) {
+	teardown, c := setupLSMTest(t, WithMemtableSize(2), WithCompactionThreshold(2))
+	defer teardown(t)
+
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range ids {
+		if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("lsm put failed: %v", err)
+		}
+	}
+
+	for _, id := range ids {
+		if err := c.Remove(&id); err != nil {
+			t.Fatalf("lsm remove failed: %v", err)
+		}
+	}
+
+	if err := c.compact(); err != nil {
+		t.Fatalf("lsm compaction failed: %v", err)
+	}
+
+	if len(c.tables) != 1 {
+		t.Fatalf("expected both tables to be merged into 1; got %d", len(c.tables))
+	}
+
+	if c.tables[0].count != 0 {
+		t.Fatalf("expected removed keys and their tombstones to be dropped; got %d records", c.tables[0].count)
+	}
+}
+
+func TestLSMCommitsDoNotWaitForCompaction(t *testing.T) {
+	teardown, c := setupLSMTest(t, WithMemtableSize(2), WithCompactionThreshold(2))
+	defer teardown(t)
+
+	// A compaction holding the compactor keeps later ones waiting.
+	c.compactMu.Lock()
+	ids := make([]uuid.UUID, 16)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: "Book", Year: uint16(i)}); err != nil {
+			c.compactMu.Unlock()
+			t.Fatalf("lsm put failed: %v", err)
+		}
+	}
+	c.compactMu.Unlock()
+
+	c.mu.RLock()
+	flushed := len(c.tables)
+	c.mu.RUnlock()
+	if flushed != 8 {
+		t.Fatalf("expected 8 flushed tables; got %d", flushed)
+	}
+
+	if err := c.compact(); err != nil {
+		t.Fatalf("lsm compaction failed: %v", err)
+	}
+
+	if len(c.tables) != 1 {
+		t.Fatalf("expected the tables to be merged into 1; got %d", len(c.tables))
+	}
+
+	book := &Book{}
+	for i, id := range ids {
+		if err := c.Get(&id, book); err != nil || book.Year != uint16(i) {
+			t.Fatalf("expected book %d to be found; got %v, %v", i, *book, err)
+		}
+	}
+}
+
+func TestLSMResetDuringCompaction(t *testing.T) {
+	teardown, c := setupLSMTest(t, WithMemtableSize(2), WithCompactionThreshold(2))
+	defer teardown(t)
+
+	ids := make([]uuid.UUID, 4)
+	c.compactMu.Lock()
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: "Book", Year: uint16(i)}); err != nil {
+			c.compactMu.Unlock()
+			t.Fatalf("lsm put failed: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	run, oldest := c.pickRun()
+	c.compacting = run
+	c.mu.Unlock()
+
+	if err := c.Reset(); err != nil {
+		c.compactMu.Unlock()
+		t.Fatalf("lsm reset failed: %v", err)
+	}
+
+	c.mu.Lock()
+	err := c.swapTables(run, nil, nil)
+	c.mu.Unlock()
+	c.compactMu.Unlock()
+	if err != nil {
+		t.Fatalf("swapping the tables of a dropped run failed: %v", err)
+	}
+
+	if !oldest || len(c.tables) != 0 {
+		t.Fatalf("expected the reset to drop every table; got %d", len(c.tables))
+	}
+
+	for _, r := range run {
+		if _, err := c.opts.vfs.Stat(c.tablePath(r.id)); !os.IsNotExist(err) {
+			t.Fatalf("expected table %d to be removed; got %v", r.id, err)
+		}
+	}
+}
+
+func TestLSMTruncateChangesKeepsUnflushed(t *testing.T) {
+	teardown, c := setupLSMTest(t)
+	defer teardown(t)
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("lsm put failed: %v", err)
+	}
+
+	if err := c.TruncateChanges(c.LastSeq() + 1); err != nil {
+		t.Fatalf("lsm truncate changes failed: %v", err)
+	}
+
+	changes := readChanges(t, c, c.LastSeq())
+	if len(changes) != 1 || changes[0].Op != OpPut {
+		t.Fatalf("expected the unflushed put to be retained; got %v", changes)
+	}
+}
@@ -1,20 +1,41 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/google/uuid"
 )
 
 func main() {
-	collection, err := NewBookCollection("./data")
-	if err != nil {
+	if err := runCommand(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
+}
+
+func runDemo(args []string) error {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	// The demo resets its collection, so it keeps apart from the data the
+	// other commands work on.
+	dataPath := fs.String("data", "./data/demo", "data directory")
+	keyFile := fs.String("key-file", "", "encryption key file")
+	fs.Parse(args)
+
+	opts, err := collectionOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	collection, err := NewBookCollection(*dataPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
 
 	if err := collection.Reset(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	keys := []uuid.UUID{
@@ -44,7 +65,7 @@ func main() {
 
 	for i := 0; i < 4; i++ {
 		if err := collection.Put(&keys[i], &books[i]); err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		fmt.Println("saved book:", keys[i], books[i])
@@ -53,11 +74,11 @@ func main() {
 	books[1].Title = "Harry Potter and the Order of the Phoenix"
 	books[1].Year = 2003
 	if err := collection.Put(&keys[1], &books[1]); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	if err := collection.Remove(&keys[2]); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	for _, key := range keys {
@@ -68,4 +89,6 @@ func main() {
 			fmt.Println("retrieved book:", key, book)
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+type IndexType string
+
+const (
+	IndexSorted IndexType = "sorted"
+	IndexHash   IndexType = "hash"
+)
+
+// collectionMeta records the choices made when a collection was created, so
+// that reopening it does not depend on the options passed again.
+type collectionMeta struct {
+	Index       IndexType       `json:"index"`
+	Compression Compression     `json:"compression,omitempty"`
+	Encryption  *encryptionMeta `json:"encryption,omitempty"`
+	DataKeys    bool            `json:"dataKeys,omitempty"`
+	ItemSize    uint16          `json:"itemSize,omitempty"`
+}
+
+func readMeta(vfs VFS, collectionDir string) (*collectionMeta, error) {
+	b, err := readFile(vfs, filepath.Join(collectionDir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &collectionMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, errors.Wrap(err, "invalid collection meta")
+	}
+
+	return meta, nil
+}
+
+func writeMeta(vfs VFS, collectionDir string, meta *collectionMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(vfs, filepath.Join(collectionDir, "meta"), b)
+}
+
+// openMeta reads the recorded meta of an existing collection, failing when the
+// item size or the options ask for something else, or records the options of
+// a new one. A collection without meta but with a key file predates it and is
+// sorted, uncompressed and unencrypted, and its data records do not carry
+// their key ids. Meta written before it recorded the item size gets it.
+func openMeta(collectionDir string, itemSize uint16, o *options) (*collectionMeta, error) {
+	meta, err := readMeta(o.vfs, collectionDir)
+	if err == nil {
+		if meta.ItemSize != 0 && meta.ItemSize != itemSize {
+			return nil, errors.Errorf("collection holds items of %d bytes; %d requested", meta.ItemSize, itemSize)
+		}
+		if o.index != "" && o.index != meta.Index {
+			return nil, errors.Errorf("collection uses %s index; %s requested", meta.Index, o.index)
+		}
+		if meta.Compression == "" {
+			meta.Compression = CompressionNone
+		}
+		if o.compression != "" && o.compression != meta.Compression {
+			return nil, errors.Errorf("collection uses %s compression; %s requested", meta.Compression, o.compression)
+		}
+		if meta.Encryption != nil && o.keyProvider == nil {
+			return nil, errors.New("collection is encrypted; a key provider is required")
+		}
+		if meta.Encryption == nil && o.keyProvider != nil {
+			return nil, errors.New("collection is not encrypted")
+		}
+		if meta.ItemSize == 0 {
+			meta.ItemSize = itemSize
+			if err := writeMeta(o.vfs, collectionDir, meta); err != nil {
+				return nil, err
+			}
+		}
+		return meta, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	meta = &collectionMeta{Index: o.index, Compression: o.compression, ItemSize: itemSize}
+	if meta.Index == "" {
+		meta.Index = IndexSorted
+	}
+	if meta.Compression == "" {
+		meta.Compression = CompressionNone
+	}
+
+	if _, err := o.vfs.Stat(filepath.Join(collectionDir, "key")); os.IsNotExist(err) {
+		meta.DataKeys = true
+	} else if err == nil {
+		if meta.Index != IndexSorted {
+			return nil, errors.New("existing collection uses sorted index")
+		}
+		if meta.Compression != CompressionNone {
+			return nil, errors.New("existing collection is not compressed")
+		}
+		if o.keyProvider != nil {
+			return nil, errors.New("existing collection is not encrypted")
+		}
+	}
+
+	if o.keyProvider != nil {
+		if meta.Compression != CompressionNone {
+			return nil, errors.New("compressed collections cannot be encrypted")
+		}
+
+		id, key, err := o.keyProvider.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+
+		k, _, err := newEncryptionKey(1, id, key)
+		if err != nil {
+			return nil, err
+		}
+		meta.Encryption = &encryptionMeta{Keys: []encryptionKey{k}}
+	}
+
+	if err := writeMeta(o.vfs, collectionDir, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
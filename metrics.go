@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LatencyBuckets are the upper bounds of the latency histograms.
+var LatencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// OpMetrics describes the calls of one operation. Buckets holds the number of
+// calls that took at most the matching LatencyBuckets bound, so it is
+// cumulative like a Prometheus histogram.
+type OpMetrics struct {
+	Count    uint64
+	Errors   uint64
+	Duration time.Duration
+	Buckets  []uint64
+}
+
+type Metrics struct {
+	Put          OpMetrics
+	Get          OpMetrics
+	Remove       OpMetrics
+	ShiftLeft    OpMetrics
+	ShiftRight   OpMetrics
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+type histogram struct {
+	buckets  [len(LatencyBuckets) + 1]atomic.Uint64
+	count    atomic.Uint64
+	errors   atomic.Uint64
+	duration atomic.Int64
+}
+
+// observe records a call that started at start and failed with *err, if
+// set. Absent keys are not counted as errors.
+func (h *histogram) observe(start time.Time, err *error) {
+	d := time.Since(start)
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.duration.Add(int64(d))
+	if *err != nil && !errors.Is(*err, ErrNotFound) {
+		h.errors.Add(1)
+	}
+}
+
+func (h *histogram) snapshot() OpMetrics {
+	m := OpMetrics{
+		Count:    h.count.Load(),
+		Errors:   h.errors.Load(),
+		Duration: time.Duration(h.duration.Load()),
+		Buckets:  make([]uint64, len(LatencyBuckets)),
+	}
+
+	total := uint64(0)
+	for i := range m.Buckets {
+		total += h.buckets[i].Load()
+		m.Buckets[i] = total
+	}
+
+	return m
+}
+
+type metrics struct {
+	put          histogram
+	get          histogram
+	remove       histogram
+	shiftLeft    histogram
+	shiftRight   histogram
+	shifts       shiftWindow
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+func (m *metrics) snapshot() Metrics {
+	return Metrics{
+		Put:          m.put.snapshot(),
+		Get:          m.get.snapshot(),
+		Remove:       m.remove.snapshot(),
+		ShiftLeft:    m.shiftLeft.snapshot(),
+		ShiftRight:   m.shiftRight.snapshot(),
+		BytesRead:    m.bytesRead.Load(),
+		BytesWritten: m.bytesWritten.Load(),
+	}
+}
+
+// instrumentedStorage counts the bytes read and written through a Storage
+// and times its shifts, reporting each call to the observer of its
+// collection if it has one.
+type instrumentedStorage struct {
+	Storage
+	m          *metrics
+	o          Observer
+	collection string
+	name       string
+}
+
+func (s *instrumentedStorage) op(name string, off int64, size int) Operation {
+	return Operation{Name: name, Collection: s.collection, Storage: s.name, Offset: off, Size: size}
+}
+
+func (s *instrumentedStorage) ReadOffset(b []byte, off int64) (n int, err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("read", off, len(b)))(&err)
+	}
+
+	n, err = s.Storage.ReadOffset(b, off)
+	s.m.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (s *instrumentedStorage) WriteOffset(b []byte, off int64) (n int, err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("write", off, len(b)))(&err)
+	}
+
+	n, err = s.Storage.WriteOffset(b, off)
+	s.m.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+func (s *instrumentedStorage) ShiftLeft(targetOffset int64) (err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("shift_left", targetOffset, 0))(&err)
+	}
+
+	defer s.m.shiftLeft.observe(time.Now(), &err)
+	return s.Storage.ShiftLeft(targetOffset)
+}
+
+// recordShift records how many items a right shift to targetOffset moves.
+// Only inserts into a sorted index shift right.
+func (s *instrumentedStorage) recordShift(targetOffset int64) error {
+	count, err := s.Storage.Count()
+	if err != nil {
+		return err
+	}
+
+	s.m.shifts.record(max(count-targetOffset, 0))
+	return nil
+}
+
+func (s *instrumentedStorage) ShiftRight(targetOffset int64) (err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("shift_right", targetOffset, 0))(&err)
+	}
+
+	defer s.m.shiftRight.observe(time.Now(), &err)
+	if err := s.recordShift(targetOffset); err != nil {
+		return err
+	}
+	return s.Storage.ShiftRight(targetOffset)
+}
+
+func (s *instrumentedStorage) ShiftLeftCtx(ctx context.Context, targetOffset int64) (err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("shift_left", targetOffset, 0))(&err)
+	}
+
+	defer s.m.shiftLeft.observe(time.Now(), &err)
+	return shiftLeftCtx(ctx, s.Storage, targetOffset)
+}
+
+func (s *instrumentedStorage) ShiftRightCtx(ctx context.Context, targetOffset int64) (err error) {
+	if s.o != nil {
+		defer observe(s.o, s.op("shift_right", targetOffset, 0))(&err)
+	}
+
+	defer s.m.shiftRight.observe(time.Now(), &err)
+	if err := s.recordShift(targetOffset); err != nil {
+		return err
+	}
+	return shiftRightCtx(ctx, s.Storage, targetOffset)
+}
+
+func (s *instrumentedStorage) Sync() error {
+	return syncStorage(s.Storage)
+}
+
+func instrumentedStorageOpener(open storageOpener, m *metrics, o Observer, collection string) storageOpener {
+	return func(filename string, itemSize uint16) (Storage, error) {
+		s, err := open(filename, itemSize)
+		if err != nil {
+			return nil, err
+		}
+
+		return &instrumentedStorage{Storage: s, m: m, o: o, collection: collection, name: filepath.Base(filename)}, nil
+	}
+}
+
+// unwrapStorage returns the Storage under an instrumentedStorage.
+func unwrapStorage(s Storage) Storage {
+	if i, ok := s.(*instrumentedStorage); ok {
+		return i.Storage
+	}
+
+	return s
+}
+
+// PublishExpvar publishes the metrics of c as the expvar variable name. Like
+// expvar.Publish, it panics when name is already in use.
+func PublishExpvar(name string, c Collection) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return c.Metrics()
+	}))
+}
+
+// NewMetricsHandler serves the metrics of the named collections in the
+// Prometheus text format at /metrics, liveness at /healthz and readiness,
+// meaning every collection answers a Count, at /readyz.
+func NewMetricsHandler(collections map[string]Collection) http.Handler {
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, names, collections)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range names {
+			if _, err := collections[name].Count(); err != nil {
+				http.Error(w, fmt.Sprintf("collection %s: %v", name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	return mux
+}
+
+func writePrometheus(w io.Writer, names []string, collections map[string]Collection) {
+	metrics := make([]Metrics, len(names))
+	for i, name := range names {
+		metrics[i] = collections[name].Metrics()
+	}
+
+	ops := []struct {
+		name string
+		get  func(Metrics) OpMetrics
+	}{
+		{"put", func(m Metrics) OpMetrics { return m.Put }},
+		{"get", func(m Metrics) OpMetrics { return m.Get }},
+		{"remove", func(m Metrics) OpMetrics { return m.Remove }},
+		{"shift_left", func(m Metrics) OpMetrics { return m.ShiftLeft }},
+		{"shift_right", func(m Metrics) OpMetrics { return m.ShiftRight }},
+	}
+
+	fmt.Fprintln(w, "# HELP kvdb_operation_duration_seconds Latency of collection and storage operations.")
+	fmt.Fprintln(w, "# TYPE kvdb_operation_duration_seconds histogram")
+	for i, name := range names {
+		for _, op := range ops {
+			m := op.get(metrics[i])
+			labels := fmt.Sprintf("collection=%q,op=%q", name, op.name)
+			for j, bound := range LatencyBuckets {
+				fmt.Fprintf(w, "kvdb_operation_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound.Seconds(), m.Buckets[j])
+			}
+			fmt.Fprintf(w, "kvdb_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.Count)
+			fmt.Fprintf(w, "kvdb_operation_duration_seconds_sum{%s} %g\n", labels, m.Duration.Seconds())
+			fmt.Fprintf(w, "kvdb_operation_duration_seconds_count{%s} %d\n", labels, m.Count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP kvdb_operation_errors_total Failed collection and storage operations.")
+	fmt.Fprintln(w, "# TYPE kvdb_operation_errors_total counter")
+	for i, name := range names {
+		for _, op := range ops {
+			fmt.Fprintf(w, "kvdb_operation_errors_total{collection=%q,op=%q} %d\n", name, op.name, op.get(metrics[i]).Errors)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP kvdb_storage_read_bytes_total Bytes read from storage.")
+	fmt.Fprintln(w, "# TYPE kvdb_storage_read_bytes_total counter")
+	for i, name := range names {
+		fmt.Fprintf(w, "kvdb_storage_read_bytes_total{collection=%q} %d\n", name, metrics[i].BytesRead)
+	}
+
+	fmt.Fprintln(w, "# HELP kvdb_storage_written_bytes_total Bytes written to storage.")
+	fmt.Fprintln(w, "# TYPE kvdb_storage_written_bytes_total counter")
+	for i, name := range names {
+		fmt.Fprintf(w, "kvdb_storage_written_bytes_total{collection=%q} %d\n", name, metrics[i].BytesWritten)
+	}
+}
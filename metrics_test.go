@@ -0,0 +1,135 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCollectionMetrics(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	book := &Book{}
+	if err := c.Get(&ids[0], book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	missing := uuid.New()
+	if err := c.Get(&missing, book); err == nil {
+		t.Fatal("expected get of a missing key to fail")
+	}
+
+	if err := c.CompareAndSwap(&ids[1], 42, &books[1]); err == nil {
+		t.Fatal("expected compare-and-swap with a wrong version to fail")
+	}
+
+	if err := c.Remove(&ids[2]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	m := c.Metrics()
+	if m.Put.Count != 5 || m.Put.Errors != 1 {
+		t.Fatalf("expected 5 puts with 1 error; got %+v", m.Put)
+	}
+
+	if m.Get.Count != 2 || m.Get.Errors != 0 {
+		t.Fatalf("expected 2 gets without errors; got %+v", m.Get)
+	}
+
+	if m.Remove.Count != 1 || m.Remove.Errors != 0 {
+		t.Fatalf("expected 1 remove without errors; got %+v", m.Remove)
+	}
+
+	if m.Put.Buckets[len(m.Put.Buckets)-1] > m.Put.Count || m.Put.Duration <= 0 {
+		t.Fatalf("expected cumulative buckets and a total duration; got %+v", m.Put)
+	}
+
+	if m.BytesRead == 0 || m.BytesWritten == 0 {
+		t.Fatalf("expected storage bytes to be counted; got %d read, %d written", m.BytesRead, m.BytesWritten)
+	}
+}
+
+func TestCollectionMetricsShifts(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	if err := c.Remove(&ids[0]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	m := c.Metrics()
+	if m.ShiftRight.Count == 0 || m.ShiftLeft.Count == 0 {
+		t.Fatalf("expected the sorted index to shift keys; got %+v, %+v", m.ShiftRight, m.ShiftLeft)
+	}
+}
+
+func get(t *testing.T, server *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response of %s failed: %v", path, err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	server := httptest.NewServer(NewMetricsHandler(map[string]Collection{"book": c}))
+	defer server.Close()
+
+	status, body := get(t, server, "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("expected metrics to be served; got status %d", status)
+	}
+
+	for _, line := range []string{
+		"# TYPE kvdb_operation_duration_seconds histogram",
+		`kvdb_operation_duration_seconds_count{collection="book",op="put"} 4`,
+		`kvdb_operation_duration_seconds_bucket{collection="book",op="put",le="+Inf"} 4`,
+		`kvdb_operation_errors_total{collection="book",op="get"} 0`,
+		`kvdb_storage_written_bytes_total{collection="book"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expected metrics to contain %q; got:\n%s", line, body)
+		}
+	}
+
+	if status, body := get(t, server, "/healthz"); status != http.StatusOK || body != "ok\n" {
+		t.Fatalf("expected healthy; got %d %q", status, body)
+	}
+
+	if status, _ := get(t, server, "/readyz"); status != http.StatusOK {
+		t.Fatalf("expected ready; got %d", status)
+	}
+
+	c.Close()
+	if status, _ := get(t, server, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected a closed collection to be unready; got %d", status)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	PublishExpvar("kvdb_test_book", c)
+
+	v := expvar.Get("kvdb_test_book")
+	if v == nil || !strings.Contains(v.String(), `"Put":{"Count":4`) {
+		t.Fatalf("expected the metrics to be published; got %v", v)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Migration converts the records of a collection from one item layout to
+// another. OldItem returns an empty item of the old layout, which Transform
+// turns into an item of the new one.
+type Migration struct {
+	Name        string
+	KeyIdSize   uint16
+	OldItemSize uint16
+	NewItemSize uint16
+	OldItem     func() Item
+	Transform   func(old Item) (Item, error)
+}
+
+type MigrationResult struct {
+	Migrated int64
+	Expired  int64
+	DryRun   bool
+}
+
+var migrationsMu sync.Mutex
+var migrations = map[string]*Migration{}
+
+// RegisterMigration makes a migration available to Migrate by name.
+func RegisterMigration(m *Migration) error {
+	if m.Name == "" || m.OldItem == nil || m.Transform == nil {
+		return errors.New("migration needs a name, an old item and a transform")
+	}
+
+	if m.OldItemSize == 0 || m.NewItemSize == 0 {
+		return errors.New("migration item sizes must be positive")
+	}
+
+	if err := checkKeyIdSize(m.KeyIdSize); err != nil {
+		return err
+	}
+
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if _, ok := migrations[m.Name]; ok {
+		return errors.Errorf("migration %q already registered", m.Name)
+	}
+
+	migrations[m.Name] = m
+	return nil
+}
+
+func lookupMigration(name string) (*Migration, error) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if m, ok := migrations[name]; ok {
+		return m, nil
+	}
+
+	return nil, errors.Errorf("unknown migration %q", name)
+}
+
+func Migrations() []string {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	names := make([]string, 0, len(migrations))
+	for name := range migrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func migrationDirs(collectionDir string) (string, string) {
+	return collectionDir + ".migrating", collectionDir + ".old"
+}
+
+// finishMigration finishes a swap interrupted after the old files were moved
+// aside. The old files are removed only once the migrated ones are in place.
+func finishMigration(vfs VFS, collectionDir string) error {
+	newDir, oldDir := migrationDirs(collectionDir)
+	if _, err := vfs.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := vfs.Stat(newDir); err == nil {
+		// The migrated files were not moved yet. Anything in their place can
+		// only be an empty directory created since, which Remove refuses
+		// otherwise.
+		if err := vfs.Remove(collectionDir); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "finishing interrupted migration")
+		}
+
+		if err := renameSynced(vfs, newDir, collectionDir); err != nil {
+			return errors.Wrap(err, "finishing interrupted migration")
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := vfs.Stat(filepath.Join(collectionDir, "key")); err != nil {
+		return errors.Wrap(err, "finishing interrupted migration")
+	}
+
+	return vfs.RemoveAll(oldDir)
+}
+
+// recoverMigration finishes an interrupted swap and drops what an
+// interrupted rewrite left behind.
+func recoverMigration(vfs VFS, collectionDir string) error {
+	if err := finishMigration(vfs, collectionDir); err != nil {
+		return err
+	}
+
+	newDir, _ := migrationDirs(collectionDir)
+	return vfs.RemoveAll(newDir)
+}
+
+// Migrate rewrites the fixed-size-record collection in collectionDir into new
+// files with the migration's item layout, keeping each key's expiry. Expired
+// keys are dropped. The new collection is checked to hold every migrated
+// record before it replaces the old one; a dry run stops short of that and
+// removes it. The rewrite starts a new change log, so followers have to
+// bootstrap again, and key versions restart at 1.
+func Migrate(collectionDir string, name string, dryRun bool, opts ...Option) (MigrationResult, error) {
+	m, err := lookupMigration(name)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	vfs := newOptions(opts).vfs
+	if err := recoverMigration(vfs, collectionDir); err != nil {
+		return MigrationResult{}, err
+	}
+
+	if _, err := vfs.Stat(collectionDir); err != nil {
+		return MigrationResult{}, err
+	}
+
+	if _, err := vfs.Stat(filepath.Join(collectionDir, "manifest")); err == nil {
+		return MigrationResult{}, errors.New("lsm collections cannot be migrated")
+	}
+
+	old, err := NewCollection(collectionDir, m.KeyIdSize+KeyMetaSize, m.KeyIdSize, m.OldItemSize, opts...)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	result, err := m.rewrite(old.(*collection), collectionDir, opts)
+	result.DryRun = dryRun
+	if closeErr := old.Close(); err == nil {
+		err = closeErr
+	}
+
+	newDir, oldDir := migrationDirs(collectionDir)
+	if err != nil || dryRun {
+		vfs.RemoveAll(newDir)
+		return result, err
+	}
+
+	if err := renameSynced(vfs, collectionDir, oldDir); err != nil {
+		vfs.RemoveAll(newDir)
+		return result, err
+	}
+
+	if err := renameSynced(vfs, newDir, collectionDir); err != nil {
+		return result, errors.Wrap(err, "swapping migrated collection")
+	}
+
+	return result, vfs.RemoveAll(oldDir)
+}
+
+// rewrite copies src into a new collection next to collectionDir and checks
+// that it holds every migrated record.
+func (m *Migration) rewrite(src *collection, collectionDir string, opts []Option) (MigrationResult, error) {
+	newDir, _ := migrationDirs(collectionDir)
+	opts = append(append([]Option{}, opts...), WithIndex(src.meta.Index), WithCompression(src.meta.Compression))
+	dst, err := NewCollection(newDir, m.KeyIdSize+KeyMetaSize, m.KeyIdSize, m.NewItemSize, opts...)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	result, err := m.copy(src, dst.(*collection))
+	if err == nil {
+		err = verifyMigration(dst, result)
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	return result, err
+}
+
+func (m *Migration) copy(src *collection, dst *collection) (MigrationResult, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	result := MigrationResult{}
+	now := src.now()
+	err := src.each(func(idBytes []byte, v version) error {
+		if !v.visible(now) {
+			result.Expired++
+			return nil
+		}
+
+		id := newKeyId()
+		if err := id.UnmarshalBinary(idBytes); err != nil {
+			return err
+		}
+
+		item := m.OldItem()
+		if err := item.UnmarshalBinary(v.value); err != nil {
+			return errors.Wrapf(err, "reading item %x", idBytes)
+		}
+
+		updated, err := m.Transform(item)
+		if err != nil {
+			return errors.Wrapf(err, "transforming item %x", idBytes)
+		}
+
+		b, err := updated.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if len(b) != int(m.NewItemSize) {
+			return errors.Errorf("transformed item %x is %d bytes; expected %d", idBytes, len(b), m.NewItemSize)
+		}
+
+		if err := dst.put(context.Background(), id, updated, v.expiresAt, anyVersion, 0); err != nil {
+			return err
+		}
+
+		result.Migrated++
+		return nil
+	})
+
+	return result, err
+}
+
+func verifyMigration(c Collection, result MigrationResult) error {
+	count, err := c.Count()
+	if err != nil {
+		return err
+	}
+
+	if count != result.Migrated {
+		return errors.Errorf("migrated collection holds %d records; expected %d", count, result.Migrated)
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andyautida/kv-db/kvdbtest"
+	"github.com/google/uuid"
+)
+
+const pagedBookSize = BookSize + 2
+
+type pagedBook struct {
+	Book
+	Pages uint16
+}
+
+func (b *pagedBook) MarshalBinary() ([]byte, error) {
+	book, err := b.Book.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return binary.LittleEndian.AppendUint16(book, b.Pages), nil
+}
+
+func (b *pagedBook) UnmarshalBinary(data []byte) error {
+	if len(data) != pagedBookSize {
+		return errors.New("invalid paged book size")
+	}
+
+	b.Pages = binary.LittleEndian.Uint16(data[BookSize:])
+	return b.Book.UnmarshalBinary(data[:BookSize])
+}
+
+var errUnknownPages = errors.New("unknown page count")
+
+func init() {
+	err := RegisterMigration(&Migration{
+		Name:        "test-book-pages",
+		KeyIdSize:   KeyIdSize,
+		OldItemSize: BookSize,
+		NewItemSize: pagedBookSize,
+		OldItem:     func() Item { return &Book{} },
+		Transform: func(old Item) (Item, error) {
+			book := old.(*Book)
+			if book.Title == "" {
+				return nil, errUnknownPages
+			}
+			return &pagedBook{Book: *book, Pages: 100}, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func setupMigrationTest(tb testing.TB) (string, []uuid.UUID) {
+	dir := "./data/test/migrate"
+	for _, d := range []string{dir, dir + ".migrating", dir + ".old"} {
+		if err := os.RemoveAll(d); err != nil {
+			tb.Fatalf("migration cleanup failed: %v", err)
+		}
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for i, id := range ids {
+		if err := c.Put(&id, &Book{Title: "Dune", Year: uint16(1965 + i)}); err != nil {
+			tb.Fatalf("put failed: %v", err)
+		}
+	}
+
+	expiring := uuid.New()
+	if err := c.PutWithTTL(&expiring, &Book{Title: "Gone", Year: 2000}, time.Nanosecond); err != nil {
+		tb.Fatalf("put with ttl failed: %v", err)
+	}
+
+	return dir, ids
+}
+
+func TestMigrateRewritesRecords(t *testing.T) {
+	dir, ids := setupMigrationTest(t)
+
+	result, err := Migrate(dir, "test-book-pages", false)
+	if err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	if result.Migrated != 3 || result.Expired != 1 {
+		t.Fatalf("expected 3 migrated and 1 expired record; got %+v", result)
+	}
+
+	for _, d := range []string{dir + ".migrating", dir + ".old"} {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed; got %v", d, err)
+		}
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize); err == nil {
+		t.Fatal("expected opening with the item size from before the migration to fail")
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, pagedBookSize)
+	if err != nil {
+		t.Fatalf("migrated collection opening failed: %v", err)
+	}
+	defer c.Close()
+
+	count, err := c.Count()
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 migrated records; got %d, %v", count, err)
+	}
+
+	for i, id := range ids {
+		book := &pagedBook{}
+		if err := c.Get(&id, book); err != nil {
+			t.Fatalf("get after migration failed: %v", err)
+		}
+
+		if book.Title != "Dune" || book.Year != uint16(1965+i) || book.Pages != 100 {
+			t.Fatalf("expected migrated book %d; got %+v", i, *book)
+		}
+	}
+}
+
+func TestMigrateDryRunLeavesCollection(t *testing.T) {
+	dir, ids := setupMigrationTest(t)
+
+	result, err := Migrate(dir, "test-book-pages", true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+
+	if !result.DryRun || result.Migrated != 3 {
+		t.Fatalf("expected a dry run of 3 records; got %+v", result)
+	}
+
+	if _, err := os.Stat(dir + ".migrating"); !os.IsNotExist(err) {
+		t.Fatalf("expected the dry run output to be removed; got %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection opening failed: %v", err)
+	}
+	defer c.Close()
+
+	book := &Book{}
+	if err := c.Get(&ids[0], book); err != nil || book.Title != "Dune" {
+		t.Fatalf("expected the old layout to be untouched; got %v, %v", *book, err)
+	}
+}
+
+func TestMigrateFailureLeavesCollection(t *testing.T) {
+	dir, ids := setupMigrationTest(t)
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection opening failed: %v", err)
+	}
+
+	untitled := uuid.New()
+	if err := c.Put(&untitled, &Book{Year: 1}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	c.Close()
+
+	if _, err := Migrate(dir, "test-book-pages", false); !errors.Is(err, errUnknownPages) {
+		t.Fatalf("expected the transform error; got %v", err)
+	}
+
+	if _, err := os.Stat(dir + ".migrating"); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial output to be removed; got %v", err)
+	}
+
+	c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	book := &Book{}
+	if err := c.Get(&ids[0], book); err != nil || book.Title != "Dune" {
+		t.Fatalf("expected the old layout to be untouched; got %v, %v", *book, err)
+	}
+}
+
+func TestMigrateFinishesInterruptedSwap(t *testing.T) {
+	dir, _ := setupMigrationTest(t)
+
+	if err := os.Rename(dir, dir+".migrating"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	if err := os.MkdirAll(dir+".old", os.ModePerm); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	// An empty directory in the collection's place does not stop the swap.
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection opening failed: %v", err)
+	}
+	c.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "key")); err != nil {
+		t.Fatalf("expected the migrated collection to be moved into place: %v", err)
+	}
+
+	if _, err := os.Stat(dir + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("expected the old collection to be removed; got %v", err)
+	}
+}
+
+func TestMigrateUnknownMigration(t *testing.T) {
+	if _, err := Migrate("./data/test/migrate", "missing", false); err == nil {
+		t.Fatal("expected an unknown migration to fail")
+	}
+}
+
+func TestMigrateKeepsOldFilesUntilSwapped(t *testing.T) {
+	dir, _ := setupMigrationTest(t)
+
+	if err := os.MkdirAll(dir+".old", os.ModePerm); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	if err := os.Rename(dir, dir+".old/moved"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize); err == nil {
+		t.Fatal("expected opening without the migrated files to fail")
+	}
+
+	if _, err := os.Stat(dir + ".old/moved/key"); err != nil {
+		t.Fatalf("expected the old files to be kept; got %v", err)
+	}
+}
+
+func TestMigrateSurvivesCrash(t *testing.T) {
+	books := []Book{{Title: "Dune", Year: 1965}, {Title: "Emma", Year: 1815}, {Title: "Ulysses", Year: 1922}}
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+
+	for write := 1; ; write++ {
+		vfs := newFaultFS(NewMemFS(), kvdbtest.Fault{})
+		c, err := NewCollection("migrate", KeySize, KeyIdSize, BookSize, WithVFS(vfs))
+		if err != nil {
+			t.Fatalf("collection creation failed: %v", err)
+		}
+
+		for i := range ids {
+			if err := c.Put(&ids[i], &books[i]); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+		}
+		c.Close()
+
+		vfs.SetFault(kvdbtest.Fault{Write: vfs.Writes() + write, Crash: true})
+		_, err = Migrate("migrate", "test-book-pages", false, WithVFS(vfs))
+		if err != nil && !errors.Is(err, kvdbtest.ErrInjected) {
+			t.Fatalf("expected migration to fail at write %d; got %v", write, err)
+		}
+
+		underlying, crashErr := vfs.crash(false)
+		if crashErr != nil {
+			t.Fatalf("crash failed: %v", crashErr)
+		}
+
+		// The swap starts by moving the old files aside; from then on the
+		// migrated files are the collection.
+		_, statErr := underlying.Stat("migrate.old")
+		migrated := err == nil || statErr == nil
+
+		itemSize := uint16(BookSize)
+		if migrated {
+			itemSize = pagedBookSize
+		}
+
+		c, openErr := NewCollection("migrate", KeySize, KeyIdSize, itemSize, WithVFS(underlying))
+		if openErr != nil {
+			t.Fatalf("collection opening after a crash at write %d failed: %v", write, openErr)
+		}
+
+		for i := range ids {
+			var item Item = &Book{}
+			if migrated {
+				item = &pagedBook{}
+			}
+
+			if err := c.Get(&ids[i], item); err != nil {
+				t.Fatalf("get after a crash at write %d failed: %v", write, err)
+			}
+
+			book, pages := item, uint16(0)
+			if p, ok := item.(*pagedBook); ok {
+				book, pages = &p.Book, p.Pages
+			}
+
+			if *book.(*Book) != books[i] || migrated && pages != 100 {
+				t.Fatalf("expected book %d after a crash at write %d; got %+v", i, write, item)
+			}
+		}
+		c.Close()
+
+		if _, err := underlying.Stat("migrate.old"); !os.IsNotExist(err) {
+			t.Fatalf("expected the old files to be removed after a crash at write %d; got %v", write, err)
+		}
+
+		if err == nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operation describes a collection or storage operation reported to an
+// Observer. Collection operations (put, get, remove, scan, load and sweep)
+// carry the key they act on, if any; storage operations (read, write,
+// shift_left and shift_right) carry the storage file, the slot offset and
+// the number of bytes. Offset is -1 when it does not apply.
+type Operation struct {
+	Name       string
+	Collection string
+	Storage    string
+	Key        []byte
+	Offset     int64
+	Size       int
+}
+
+// Observer is called before and after each operation of the collections it
+// is given to with WithObserver. It must be safe for concurrent use and must
+// not call back into the collection.
+type Observer interface {
+	Before(op Operation)
+	After(op Operation, d time.Duration, err error)
+}
+
+// NopObserver ignores every operation. Collections without an observer skip
+// reporting altogether, so it is only useful to embed.
+type NopObserver struct{}
+
+func (NopObserver) Before(Operation) {}
+
+func (NopObserver) After(Operation, time.Duration, error) {}
+
+// observe reports op to o and returns the function that reports its outcome,
+// meant to be deferred.
+func observe(o Observer, op Operation) func(err *error) {
+	o.Before(op)
+	start := time.Now()
+	return func(err *error) {
+		o.After(op, time.Since(start), *err)
+	}
+}
+
+// SlogObserver logs operations to a slog.Logger: failed ones at error level,
+// ones that took at least SlowThreshold at warn level and the others, along
+// with their start, at debug level.
+type SlogObserver struct {
+	Logger        *slog.Logger
+	SlowThreshold time.Duration
+}
+
+func NewSlogObserver(logger *slog.Logger, slowThreshold time.Duration) *SlogObserver {
+	return &SlogObserver{Logger: logger, SlowThreshold: slowThreshold}
+}
+
+func (o *SlogObserver) attrs(op Operation) []slog.Attr {
+	attrs := []slog.Attr{slog.String("op", op.Name), slog.String("collection", op.Collection)}
+	if op.Storage != "" {
+		attrs = append(attrs, slog.String("storage", op.Storage))
+	}
+	if op.Key != nil {
+		attrs = append(attrs, slog.String("key", hex.EncodeToString(op.Key)))
+	}
+	if op.Offset >= 0 {
+		attrs = append(attrs, slog.Int64("offset", op.Offset))
+	}
+	if op.Size > 0 {
+		attrs = append(attrs, slog.Int("size", op.Size))
+	}
+
+	return attrs
+}
+
+func (o *SlogObserver) Before(op Operation) {
+	if !o.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	o.Logger.LogAttrs(context.Background(), slog.LevelDebug, "operation started", o.attrs(op)...)
+}
+
+func (o *SlogObserver) After(op Operation, d time.Duration, err error) {
+	level, msg := slog.LevelDebug, "operation finished"
+	switch {
+	case err != nil && !errors.Is(err, ErrNotFound):
+		level, msg = slog.LevelError, "operation failed"
+	case o.SlowThreshold > 0 && d >= o.SlowThreshold:
+		level, msg = slog.LevelWarn, "slow operation"
+	}
+
+	if !o.Logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	attrs := append(o.attrs(op), slog.Duration("duration", d))
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	o.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+func ignoreOutcome(*error) {}
+
+// observeOp reports a collection operation on key to o, which may be nil.
+func observeOp(o Observer, collection string, name string, key []byte) func(err *error) {
+	if o == nil {
+		return ignoreOutcome
+	}
+
+	return observe(o, Operation{Name: name, Collection: collection, Key: key, Offset: -1})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type observedOp struct {
+	op    Operation
+	after bool
+	err   error
+}
+
+type recordingObserver struct {
+	mu  sync.Mutex
+	ops []observedOp
+}
+
+func (o *recordingObserver) Before(op Operation) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ops = append(o.ops, observedOp{op: op})
+}
+
+func (o *recordingObserver) After(op Operation, d time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ops = append(o.ops, observedOp{op: op, after: true, err: err})
+}
+
+func (o *recordingObserver) take() []observedOp {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ops := o.ops
+	o.ops = nil
+	return ops
+}
+
+func setupObserverTest(tb testing.TB, o Observer) (func(tb testing.TB), Collection) {
+	c, err := NewCollection("./data/test/observed", KeySize, KeyIdSize, BookSize, WithObserver(o))
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		tb.Fatalf("collection reset failed: %v", err)
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c
+}
+
+func TestObserverSeesOperations(t *testing.T) {
+	o := &recordingObserver{}
+	teardown, c := setupObserverTest(t, o)
+	defer teardown(t)
+	o.take()
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	ops := o.take()
+	first, last := ops[0], ops[len(ops)-1]
+	if first.op.Name != "put" || first.after || last.op.Name != "put" || !last.after || last.err != nil {
+		t.Fatalf("expected the put to enclose its storage operations; got %+v", ops)
+	}
+
+	idBytes, _ := id.MarshalBinary()
+	if !bytes.Equal(first.op.Key, idBytes) || first.op.Offset != -1 {
+		t.Fatalf("expected the put to carry its key; got %+v", first.op)
+	}
+
+	writes := map[string]bool{}
+	for _, op := range ops[1 : len(ops)-1] {
+		if op.op.Name == "write" && op.after {
+			writes[op.op.Storage] = true
+			if op.op.Offset < 0 || op.op.Size == 0 || op.op.Collection != "./data/test/observed" {
+				t.Fatalf("expected the write to carry its offset and size; got %+v", op.op)
+			}
+		}
+	}
+
+	if !writes["data"] || !writes["key"] || !writes["changes"] {
+		t.Fatalf("expected writes to the data, key and changes storages; got %v", writes)
+	}
+
+	missing := uuid.New()
+	if err := c.Get(&missing, &Book{}); err == nil {
+		t.Fatal("expected get of a missing key to fail")
+	}
+
+	ops = o.take()
+	if last := ops[len(ops)-1]; last.op.Name != "get" || !errors.Is(last.err, ErrNotFound) {
+		t.Fatalf("expected the get to report ErrNotFound; got %+v", last)
+	}
+}
+
+func TestSlogObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	observer := NewSlogObserver(logger, time.Hour)
+	teardown, c := setupObserverTest(t, observer)
+	defer teardown(t)
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Get(&id, &Book{}); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	missing := uuid.New()
+	c.Get(&missing, &Book{})
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected fast and not-found operations below warn level; got:\n%s", buf)
+	}
+
+	if err := c.CompareAndSwap(&id, 7, &Book{Title: "Dune", Year: 1965}); err == nil {
+		t.Fatal("expected compare-and-swap with a wrong version to fail")
+	}
+
+	log := buf.String()
+	if !strings.Contains(log, "level=ERROR msg=\"operation failed\" op=put") || !strings.Contains(log, "error=") {
+		t.Fatalf("expected the failed put to be logged; got:\n%s", log)
+	}
+
+	buf.Reset()
+	observer.SlowThreshold = time.Nanosecond
+	if err := c.Get(&id, &Book{}); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "level=WARN msg=\"slow operation\" op=get") {
+		t.Fatalf("expected the slow get to be logged; got:\n%s", buf)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import "time"
+
+const defaultMemtableSize = 1024
+const defaultCompactionThreshold = 4
+
+type options struct {
+	sweepInterval       time.Duration
+	memtableSize        int
+	compactionThreshold int
+	index               IndexType
+	bloomItems          int
+	bloomFPRate         float64
+	compression         Compression
+	keyProvider         KeyProvider
+	maxOpenCollections  int
+	text                *textField
+	metrics             *metrics
+	observer            Observer
+	vfs                 VFS
+	syncOnCommit        bool
+}
+
+type Option func(*options)
+
+func WithSweepInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.sweepInterval = interval
+	}
+}
+
+// WithMemtableSize sets how many keys an LSM collection buffers in memory
+// before flushing them to a table file.
+func WithMemtableSize(size int) Option {
+	return func(o *options) {
+		o.memtableSize = size
+	}
+}
+
+// WithCompactionThreshold sets how many similarly sized LSM tables are merged
+// into one.
+func WithCompactionThreshold(threshold int) Option {
+	return func(o *options) {
+		o.compactionThreshold = threshold
+	}
+}
+
+// WithIndex selects the key index of a new collection. Existing collections
+// keep the index recorded when they were created.
+func WithIndex(index IndexType) Option {
+	return func(o *options) {
+		o.index = index
+	}
+}
+
+// WithBloomFilter keeps a Bloom filter of the stored key ids, sized for the
+// expected number of items at the given false-positive rate, so that lookups
+// of absent keys skip the index.
+func WithBloomFilter(expectedItems int, falsePositiveRate float64) Option {
+	return func(o *options) {
+		o.bloomItems = expectedItems
+		o.bloomFPRate = falsePositiveRate
+	}
+}
+
+// WithCompression selects how a new collection compresses its data file.
+// Existing collections keep the compression recorded when they were created.
+func WithCompression(compression Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithEncryption encrypts a new collection with the current key of p, or
+// opens an encrypted one. When the current key differs from the one the
+// collection was written with, the collection is re-encrypted in the
+// background.
+func WithEncryption(p KeyProvider) Option {
+	return func(o *options) {
+		o.keyProvider = p
+	}
+}
+
+// WithTextIndex keeps an inverted index of the words of the string field
+// that text returns for the items made by newItem, for use by Search.
+func WithTextIndex(newItem func() Item, text func(Item) string) Option {
+	return func(o *options) {
+		o.text = &textField{newItem: newItem, text: text}
+	}
+}
+
+// WithMaxOpenCollections sets how many collections a DB keeps open before
+// closing the least recently used idle one.
+func WithMaxOpenCollections(n int) Option {
+	return func(o *options) {
+		o.maxOpenCollections = n
+	}
+}
+
+// WithObserver reports the operations of a collection and its storage to o.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// WithSyncOnCommit syncs the files of a collection after every mutation,
+// before watchers hear of it, so that it survives a power loss. Without it,
+// mutations are synced when the collection is closed.
+func WithSyncOnCommit() Option {
+	return func(o *options) {
+		o.syncOnCommit = true
+	}
+}
+
+// WithVFS keeps the files of a collection in vfs instead of the operating
+// system's filesystem.
+func WithVFS(vfs VFS) Option {
+	return func(o *options) {
+		o.vfs = vfs
+	}
+}
+
+// withMetrics makes a collection add to m, so that its metrics outlive it.
+func withMetrics(m *metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		memtableSize:        defaultMemtableSize,
+		compactionThreshold: defaultCompactionThreshold,
+		maxOpenCollections:  defaultMaxOpenCollections,
+		vfs:                 osFS{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// RepairReport describes what Repair changed: how many key records it
+// wrote, dropped and recovered from data records, how many data slots it
+// freed and whether the key records were out of order. Changes holds one
+// line per dropped, recovered or freed record.
+type RepairReport struct {
+	Keys      int
+	Dropped   int
+	Recovered int
+	Freed     int
+	Reordered bool
+	Changes   []string
+}
+
+func (r *RepairReport) note(format string, args ...any) {
+	r.Changes = append(r.Changes, fmt.Sprintf(format, args...))
+}
+
+// Repair rebuilds the sorted key index of the fixed-size-record collection in
+// collectionDir from its data records. Key records that cannot be read, point
+// past the data file or at a free slot, or disagree with the key id of their
+// data record are dropped, and duplicates keep their highest version. Data
+// records no key points to are indexed again when their key is missing, with
+// version 1 and no expiry, and released to the free list otherwise.
+//
+// A removed record whose slot never made it to the free list looks like a
+// record whose key was lost. It is kept removed when the retained change log
+// shows the removal, or a reset the key was not put again after, and is
+// indexed again otherwise.
+//
+// When the keys change, a reset and a put of every repaired key are appended
+// to the change log, so that followers end up with the repaired keys. The
+// Bloom filter and text index are rebuilt on the next open.
+func Repair(collectionDir string, keyIdSize uint16, itemSize uint16, opts ...Option) (*RepairReport, error) {
+	vfs := newOptions(opts).vfs
+	if _, err := vfs.Stat(filepath.Join(collectionDir, "manifest")); err == nil {
+		return nil, errors.New("lsm collections cannot be repaired")
+	}
+
+	meta, err := readMeta(vfs, collectionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Index != IndexSorted {
+		return nil, errors.Errorf("collections with a %s index cannot be repaired", meta.Index)
+	}
+
+	if !meta.DataKeys {
+		return nil, errors.New("collection data records do not carry their key ids; migrate it first")
+	}
+
+	// Open without the derived indexes, which would read the damaged keys,
+	// and drop the Bloom filter so that it is rebuilt from the repaired ones.
+	opts = append(append([]Option{}, opts...), func(o *options) {
+		o.bloomItems = 0
+		o.text = nil
+		o.sweepInterval = 0
+	})
+	if err := vfs.Remove(filepath.Join(collectionDir, "bloom")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	opened, err := NewCollection(collectionDir, keyIdSize+KeyMetaSize, keyIdSize, itemSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := opened.(*collection)
+	report, err := c.repair()
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+
+	return report, err
+}
+
+func (c *collection) repair() (*RepairReport, error) {
+	if c.keys != nil {
+		if err := c.WaitKeyRotation(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := &RepairReport{}
+	dataCount, err := c.dataStorage.Count()
+	if err != nil {
+		return nil, err
+	}
+
+	free, err := c.repairFreeSlots(dataCount, report)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.repairKeys(dataCount, free, report)
+	if err != nil {
+		return nil, err
+	}
+
+	history := c.readChangeHistory(report)
+
+	owned := map[uint64]bool{}
+	ids := map[string]bool{}
+	for _, k := range keys {
+		owned[k.offset] = true
+		ids[string(k.id)] = true
+	}
+
+	freed := []int64{}
+	for off := int64(0); off < dataCount; off++ {
+		if free[off] || owned[uint64(off)] {
+			continue
+		}
+
+		id, err := c.readDataKey(off)
+		if err != nil {
+			freed = append(freed, off)
+			report.Freed++
+			report.note("freed unreadable data slot %d: %v", off, err)
+			continue
+		}
+
+		if ids[string(id)] {
+			freed = append(freed, off)
+			report.Freed++
+			report.note("freed data slot %d holding a stale value of key %x", off, id)
+			continue
+		}
+
+		if history.removed(id) {
+			freed = append(freed, off)
+			report.Freed++
+			report.note("freed data slot %d of key %x, which the change log shows removed", off, id)
+			continue
+		}
+
+		keys = append(keys, repairKey{id: id, offset: uint64(off), version: 1})
+		ids[string(id)] = true
+		report.Recovered++
+		report.note("recovered key %x from data slot %d", id, off)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].id, keys[j].id) < 0
+	})
+
+	if err := c.writeRepairedKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if err := c.writeFreeSlots(free, freed); err != nil {
+		return nil, err
+	}
+
+	if report.Dropped > 0 || report.Recovered > 0 {
+		if err := c.logRepairedKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	report.Keys = len(keys)
+	return report, nil
+}
+
+// changeHistory is the last retained change of each key, and whether a reset
+// was retained.
+type changeHistory struct {
+	last  map[string]Op
+	reset bool
+}
+
+func (h *changeHistory) removed(id []byte) bool {
+	op, ok := h.last[string(id)]
+	if !ok {
+		return h.reset
+	}
+
+	return op != OpPut
+}
+
+func (c *collection) readChangeHistory(report *RepairReport) *changeHistory {
+	h := &changeHistory{last: map[string]Op{}}
+	err := c.changes.read(c.changes.first, func(change Change) error {
+		if change.Op == OpReset {
+			h.last = map[string]Op{}
+			h.reset = true
+			return nil
+		}
+
+		id, err := change.Id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		h.last[string(id)] = change.Op
+		return nil
+	})
+	if err != nil {
+		report.note("ignored unreadable change log: %v", err)
+		return &changeHistory{last: map[string]Op{}}
+	}
+
+	return h
+}
+
+// logRepairedKeys appends a reset and a put of every key to the change log.
+func (c *collection) logRepairedKeys(keys []repairKey) error {
+	if err := c.emit(OpReset, nil, 0, 0, nil, nil); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		value, err := c.readData(int64(k.offset))
+		if err != nil {
+			return err
+		}
+
+		if err := c.emit(OpPut, k.id, k.expiresAt, k.version, nil, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// repairKey is a key record read back from the index, its id marshalled.
+type repairKey struct {
+	id        []byte
+	offset    uint64
+	expiresAt int64
+	version   uint64
+}
+
+func (c *collection) readDataKey(off int64) ([]byte, error) {
+	b := make([]byte, c.dataStorage.ItemSize())
+	if _, err := c.dataStorage.ReadOffset(b, off); err != nil {
+		return nil, err
+	}
+
+	return b[:c.dataKeySize], nil
+}
+
+// repairFreeSlots returns the valid, distinct slots of the free list.
+func (c *collection) repairFreeSlots(dataCount int64, report *RepairReport) (map[int64]bool, error) {
+	count, err := c.freeStorage.Count()
+	if err != nil {
+		return nil, err
+	}
+
+	free := map[int64]bool{}
+	b := make([]byte, freeSlotSize)
+	for i := int64(0); i < count; i++ {
+		if _, err := c.freeStorage.ReadOffset(b, i); err != nil {
+			report.note("dropped unreadable free list entry %d", i)
+			continue
+		}
+
+		off := int64(binary.LittleEndian.Uint64(b))
+		switch {
+		case off < 0 || off >= dataCount:
+			report.note("dropped free slot %d past the end of the data file", off)
+		case free[off]:
+			report.note("dropped duplicate free slot %d", off)
+		default:
+			free[off] = true
+		}
+	}
+
+	return free, nil
+}
+
+// repairKeys reads back the key records that agree with the data file,
+// keeping the highest version of each key.
+func (c *collection) repairKeys(dataCount int64, free map[int64]bool, report *RepairReport) ([]repairKey, error) {
+	count, err := c.keyStorage.Count()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []repairKey{}
+	var prev []byte
+	for off := int64(0); off < count; off++ {
+		key, err := c.readKey(off)
+		if err != nil {
+			report.Dropped++
+			report.note("dropped unreadable key record %d", off)
+			continue
+		}
+
+		id, err := key.id.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		if prev != nil && bytes.Compare(id, prev) <= 0 {
+			report.Reordered = true
+		}
+		prev = id
+
+		slot := int64(key.offset)
+		if key.offset >= uint64(dataCount) {
+			report.Dropped++
+			report.note("dropped key %x pointing past the end of the data file", id)
+			continue
+		}
+
+		if free[slot] {
+			report.Dropped++
+			report.note("dropped key %x pointing to free data slot %d", id, slot)
+			continue
+		}
+
+		dataId, err := c.readDataKey(slot)
+		if err != nil {
+			report.Dropped++
+			report.note("dropped key %x pointing to unreadable data slot %d", id, slot)
+			continue
+		}
+
+		if !bytes.Equal(dataId, id) {
+			report.Dropped++
+			report.note("dropped key %x pointing to data slot %d of key %x", id, slot, dataId)
+			continue
+		}
+
+		candidates = append(candidates, repairKey{id: id, offset: key.offset, expiresAt: key.expiresAt, version: key.version})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].version > candidates[j].version
+	})
+
+	keys := []repairKey{}
+	ids := map[string]bool{}
+	slots := map[uint64]bool{}
+	for _, k := range candidates {
+		if ids[string(k.id)] || slots[k.offset] {
+			report.Dropped++
+			report.note("dropped duplicate key %x version %d", k.id, k.version)
+			continue
+		}
+
+		ids[string(k.id)] = true
+		slots[k.offset] = true
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (c *collection) writeRepairedKeys(keys []repairKey) error {
+	for i, k := range keys {
+		id := newKeyId()
+		if err := id.UnmarshalBinary(k.id); err != nil {
+			return err
+		}
+
+		if err := c.writeKey(&key{id: id, offset: k.offset, expiresAt: k.expiresAt, version: k.version}, int64(i)); err != nil {
+			return err
+		}
+	}
+
+	return c.keyStorage.Truncate(int64(len(keys)))
+}
+
+func (c *collection) writeFreeSlots(free map[int64]bool, freed []int64) error {
+	slots := append([]int64{}, freed...)
+	for off := range free {
+		slots = append(slots, off)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	if err := c.freeStorage.Reset(); err != nil {
+		return err
+	}
+
+	for _, off := range slots {
+		if err := c.release(off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const repairTestDir = "./data/test/repair"
+
+// setupRepairTest leaves a closed collection holding books 0, 2 and 3, the
+// data slot of book 1 being free and book 3 at version 2.
+func setupRepairTest(tb testing.TB) ([]uuid.UUID, []Book) {
+	if err := os.RemoveAll(repairTestDir); err != nil {
+		tb.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(repairTestDir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+	defer c.Close()
+
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	books := []Book{
+		{Title: "Game of Thrones", Year: 1996},
+		{Title: "Harry Potter", Year: 1997},
+		{Title: "Lord of the Rings", Year: 1954},
+		{Title: "The Little Prince", Year: 1943},
+	}
+	for i := range ids {
+		if err := c.Put(&ids[i], &books[i]); err != nil {
+			tb.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		tb.Fatalf("collection remove failed: %v", err)
+	}
+
+	books[3].Year = 1946
+	if err := c.Put(&ids[3], &books[3]); err != nil {
+		tb.Fatalf("collection put failed: %v", err)
+	}
+
+	return ids, books
+}
+
+func readKeyRecords(tb testing.TB) [][]byte {
+	b, err := os.ReadFile(repairTestDir + "/key")
+	if err != nil {
+		tb.Fatalf("reading key file failed: %v", err)
+	}
+
+	records := [][]byte{}
+	for len(b) >= KeySize {
+		records = append(records, b[:KeySize])
+		b = b[KeySize:]
+	}
+
+	return records
+}
+
+func writeKeyRecords(tb testing.TB, records [][]byte) {
+	if err := os.WriteFile(repairTestDir+"/key", bytes.Join(records, nil), 0644); err != nil {
+		tb.Fatalf("writing key file failed: %v", err)
+	}
+}
+
+func expectRepairedBooks(t *testing.T, ids []uuid.UUID, books []Book) {
+	c, err := NewCollection(repairTestDir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("collection count failed: %v", err)
+	}
+
+	if count != 3 {
+		t.Fatalf("expected item count to be 3; got %d", count)
+	}
+
+	book := &Book{}
+	for i := range ids {
+		_, err := c.GetWithVersion(&ids[i], book)
+		if i == 1 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected the removed key to stay removed; got %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("collection get failed: %v", err)
+		}
+
+		if *book != books[i] {
+			t.Fatalf("expected book %v; got %v", books[i], *book)
+		}
+	}
+}
+
+func TestRepairReordersAndRecoversKeys(t *testing.T) {
+	ids, books := setupRepairTest(t)
+
+	// Reverse the key records and lose the last one, leaving half of it.
+	records := readKeyRecords(t)
+	reversed := [][]byte{}
+	for i := len(records) - 1; i >= 0; i-- {
+		reversed = append(reversed, records[i])
+	}
+	last := reversed[len(reversed)-1]
+	reversed[len(reversed)-1] = last[:KeySize/2]
+	writeKeyRecords(t, reversed)
+
+	report, err := Repair(repairTestDir, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if !report.Reordered || report.Recovered != 1 || report.Dropped != 0 || report.Keys != 3 {
+		t.Fatalf("expected 1 key recovered out of 3 reordered ones; got %+v", report)
+	}
+
+	if len(report.Changes) != 1 {
+		t.Fatalf("expected 1 change; got %v", report.Changes)
+	}
+
+	expectRepairedBooks(t, ids, books)
+}
+
+func TestRepairDropsDanglingAndDuplicateKeys(t *testing.T) {
+	ids, books := setupRepairTest(t)
+
+	records := readKeyRecords(t)
+	k := &key{id: &uuid.NullUUID{}}
+	if err := k.UnmarshalBinary(records[0]); err != nil {
+		t.Fatalf("key unmarshalling failed: %v", err)
+	}
+
+	// A duplicate at a lower version, a key past the end of the data file
+	// and one pointing at the free slot of the removed book.
+	k.version = 0
+	duplicate, _ := k.MarshalBinary()
+
+	k.id = &ids[0]
+	k.offset = 99
+	dangling, _ := k.MarshalBinary()
+
+	k.id = &ids[1]
+	k.offset = 1
+	k.version = 1
+	removed, _ := k.MarshalBinary()
+
+	writeKeyRecords(t, append(records, duplicate, dangling, removed))
+
+	report, err := Repair(repairTestDir, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if report.Dropped != 3 || report.Recovered != 0 || report.Keys != 3 {
+		t.Fatalf("expected 3 dropped keys out of 6; got %+v", report)
+	}
+
+	expectRepairedBooks(t, ids, books)
+}
+
+func TestRepairFreesStaleDataSlots(t *testing.T) {
+	ids, books := setupRepairTest(t)
+
+	// Append a stale copy of book 0 to the data file.
+	stale, err := (&Book{Title: "A Game of Thrones", Year: 1995}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("book binary marshalling failed: %v", err)
+	}
+
+	f, err := os.OpenFile(repairTestDir+"/data", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("opening data file failed: %v", err)
+	}
+	f.Write(append(append([]byte{}, ids[0][:]...), stale...))
+	f.Close()
+
+	report, err := Repair(repairTestDir, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if report.Freed != 1 || report.Dropped != 0 || report.Recovered != 0 {
+		t.Fatalf("expected 1 freed data slot; got %+v", report)
+	}
+
+	expectRepairedBooks(t, ids, books)
+
+	c, err := NewCollection(repairTestDir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.DataSlots != 5 || stats.DeadSlots != 2 {
+		t.Fatalf("expected 2 of 5 data slots to be free; got %+v", stats)
+	}
+}
+
+func TestRepairRejectsDataWithoutKeys(t *testing.T) {
+	setupRepairTest(t)
+
+	if err := os.WriteFile(repairTestDir+"/meta", []byte(`{"index":"sorted"}`), 0644); err != nil {
+		t.Fatalf("writing meta failed: %v", err)
+	}
+
+	if _, err := Repair(repairTestDir, KeyIdSize, BookSize); err == nil {
+		t.Fatal("expected repair of a collection without keyed data records to fail")
+	}
+}
+
+func TestRepairLogsRepairedKeys(t *testing.T) {
+	ids, books := setupRepairTest(t)
+
+	// Point the key of book 3, at version 2, past the end of the data file,
+	// so that it is recovered from its data record at version 1.
+	records := readKeyRecords(t)
+	k := &key{id: &uuid.NullUUID{}}
+	for i, record := range records {
+		if err := k.UnmarshalBinary(record); err != nil {
+			t.Fatalf("key unmarshalling failed: %v", err)
+		}
+
+		if k.id.(*uuid.NullUUID).UUID == ids[3] {
+			k.offset = 99
+			records[i], _ = k.MarshalBinary()
+		}
+	}
+	writeKeyRecords(t, records)
+
+	report, err := Repair(repairTestDir, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if report.Dropped != 1 || report.Recovered != 1 {
+		t.Fatalf("expected book 3 to be dropped and recovered; got %+v", report)
+	}
+
+	c, err := NewCollection(repairTestDir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	followerDir := repairTestDir + "-follower"
+	if err := os.RemoveAll(followerDir); err != nil {
+		t.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	follower, err := NewCollection(followerDir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+	defer follower.Close()
+
+	if err := c.Changes(1, follower.Apply); err != nil {
+		t.Fatalf("replaying changes failed: %v", err)
+	}
+
+	book := &Book{}
+	for i := range ids {
+		expected, expectedErr := c.GetWithVersion(&ids[i], book)
+		version, err := follower.GetWithVersion(&ids[i], book)
+		if i == 1 {
+			if !errors.Is(err, ErrNotFound) || !errors.Is(expectedErr, ErrNotFound) {
+				t.Fatalf("expected the removed key to stay removed; got %v, %v", expectedErr, err)
+			}
+			continue
+		}
+
+		if err != nil || version != expected || *book != books[i] {
+			t.Fatalf("expected the follower to hold book %v at version %d; got %v at %d, %v", books[i], expected, *book, version, err)
+		}
+	}
+}
+
+func TestRepairKeepsRemovedKeysRemoved(t *testing.T) {
+	ids, books := setupRepairTest(t)
+
+	// Lose the free list, which holds the slot of the removed book.
+	if err := os.Truncate(repairTestDir+"/free", 0); err != nil {
+		t.Fatalf("truncating free list failed: %v", err)
+	}
+
+	report, err := Repair(repairTestDir, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if report.Freed != 1 || report.Recovered != 0 {
+		t.Fatalf("expected the slot of the removed book to be freed; got %+v", report)
+	}
+
+	expectRepairedBooks(t, ids, books)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const replBatchSize = 256
+
+var replHeartbeatInterval = time.Second
+var replRetryInterval = 100 * time.Millisecond
+var replWriteTimeout = 10 * time.Second
+
+var ErrReadOnly = errors.New("collection is read-only")
+
+var errStopBatch = errors.New("stop batch")
+
+type replKind byte
+
+const (
+	replSnapshot replKind = iota
+	replEntry
+	replSnapshotEnd
+	replChange
+	replHeartbeat
+)
+
+type replHello struct {
+	From uint64
+}
+
+type replMessage struct {
+	Kind      replKind
+	Seq       uint64
+	LastSeq   uint64
+	Op        Op
+	Id        []byte
+	Value     []byte
+	ExpiresAt int64
+	Version   uint64
+}
+
+// replEncoder sends messages with a write deadline, so that a follower that
+// stops reading cannot hold up the primary.
+type replEncoder struct {
+	conn net.Conn
+	enc  *gob.Encoder
+}
+
+func (e *replEncoder) encode(msg *replMessage) error {
+	if err := e.conn.SetWriteDeadline(time.Now().Add(replWriteTimeout)); err != nil {
+		return err
+	}
+
+	return e.enc.Encode(msg)
+}
+
+type rawItem []byte
+
+func (r *rawItem) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, *r...), nil
+}
+
+func (r *rawItem) UnmarshalBinary(b []byte) error {
+	*r = append((*r)[:0], b...)
+	return nil
+}
+
+type Primary struct {
+	c      Collection
+	ln     net.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// ServePrimary streams the change log of c to every follower connecting to
+// addr, starting with a snapshot for followers that have none or have fallen
+// behind the retained log.
+func ServePrimary(c Collection, addr string) (*Primary, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Primary{c: c, ln: ln, ctx: ctx, cancel: cancel}
+
+	p.wg.Add(1)
+	go p.accept()
+
+	return p, nil
+}
+
+func (p *Primary) Addr() net.Addr {
+	return p.ln.Addr()
+}
+
+func (p *Primary) accept() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer conn.Close()
+			if err := p.serve(conn); err != nil && p.ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				log.Printf("replication to %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (p *Primary) serve(conn net.Conn) error {
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var hello replHello
+	if err := gob.NewDecoder(conn).Decode(&hello); err != nil {
+		return err
+	}
+
+	events := p.c.Watch(ctx, WatchOptions{Buffer: 1, Policy: WatchDrop})
+	enc := &replEncoder{conn: conn, enc: gob.NewEncoder(conn)}
+
+	next := hello.From
+	if p.needsSnapshot(next) {
+		seq, err := p.sendSnapshot(enc)
+		if err != nil {
+			return err
+		}
+		next = seq + 1
+	}
+
+	heartbeat := time.NewTicker(replHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		batch := make([]Change, 0, replBatchSize)
+		err := p.c.Changes(next, func(change Change) error {
+			batch = append(batch, change)
+			if len(batch) == replBatchSize {
+				return errStopBatch
+			}
+			return nil
+		})
+		if err != nil && err != errStopBatch {
+			return err
+		}
+
+		lastSeq := p.c.LastSeq()
+		for _, change := range batch {
+			msg := replMessage{
+				Kind:      replChange,
+				Seq:       change.Seq,
+				LastSeq:   lastSeq,
+				Op:        change.Op,
+				Value:     change.Value,
+				ExpiresAt: change.ExpiresAt,
+				Version:   change.Version,
+			}
+			if change.Id != nil {
+				if msg.Id, err = change.Id.MarshalBinary(); err != nil {
+					return err
+				}
+			}
+
+			if err := enc.encode(&msg); err != nil {
+				return err
+			}
+			next = change.Seq + 1
+		}
+
+		if len(batch) == replBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-events:
+		case <-heartbeat.C:
+			if err := enc.encode(&replMessage{Kind: replHeartbeat, LastSeq: p.c.LastSeq()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Primary) needsSnapshot(from uint64) bool {
+	if from == 0 || from > p.c.LastSeq()+1 {
+		return true
+	}
+
+	err := p.c.Changes(from, func(Change) error { return errStopBatch })
+	return errors.Is(err, ErrChangesTruncated)
+}
+
+// sendSnapshot sends every live entry of a snapshot with its expiry and
+// version, and returns the sequence number of the snapshot, after which the
+// follower continues from the change log. The entries are read under the
+// collection's lock and sent after it is released.
+func (p *Primary) sendSnapshot(enc *replEncoder) (uint64, error) {
+	snap, err := p.c.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Close()
+
+	seq := snap.Seq()
+	if err := enc.encode(&replMessage{Kind: replSnapshot, Seq: seq, LastSeq: seq}); err != nil {
+		return 0, err
+	}
+
+	err = snap.Entries(func(change Change) error {
+		b, err := change.Id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		return enc.encode(&replMessage{Kind: replEntry, Op: OpPut, Id: b, Value: change.Value, ExpiresAt: change.ExpiresAt, Version: change.Version})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := enc.encode(&replMessage{Kind: replSnapshotEnd, Seq: seq, LastSeq: p.c.LastSeq()}); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (p *Primary) Close() error {
+	p.cancel()
+	err := p.ln.Close()
+	p.wg.Wait()
+	return err
+}
+
+type FollowerStatus struct {
+	Connected  bool
+	AppliedSeq uint64
+	PrimarySeq uint64
+	Lag        uint64
+	Snapshots  int
+}
+
+type Follower struct {
+	c         Collection
+	addr      string
+	stateFile string
+	vfs       VFS
+
+	mu      sync.Mutex
+	status  FollowerStatus
+	hasSeq  bool
+	conn    net.Conn
+	closed  bool
+	stopped chan struct{}
+}
+
+// StartFollower replicates the primary at addr into c, persisting the last
+// applied sequence number in stateFile so that a restarted follower resumes
+// from the change log instead of a new snapshot. Only the VFS option applies.
+func StartFollower(c Collection, addr string, stateFile string, opts ...Option) (*Follower, error) {
+	f := &Follower{c: c, addr: addr, stateFile: stateFile, vfs: newOptions(opts).vfs, stopped: make(chan struct{})}
+
+	b, err := readFile(f.vfs, stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) == 8 {
+		f.status.AppliedSeq = binary.LittleEndian.Uint64(b)
+		f.hasSeq = true
+	}
+
+	go f.run()
+	return f, nil
+}
+
+func (f *Follower) Collection() Collection {
+	return &readOnlyCollection{Collection: f.c}
+}
+
+func (f *Follower) Status() FollowerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.status
+}
+
+func (f *Follower) Lag() uint64 {
+	return f.Status().Lag
+}
+
+func (f *Follower) run() {
+	defer close(f.stopped)
+
+	for {
+		f.mu.Lock()
+		closed := f.closed
+		f.mu.Unlock()
+		if closed {
+			return
+		}
+
+		f.replicate()
+
+		f.mu.Lock()
+		f.status.Connected = false
+		f.mu.Unlock()
+
+		time.Sleep(replRetryInterval)
+	}
+}
+
+func (f *Follower) replicate() error {
+	conn, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.status.Connected = true
+	from := uint64(0)
+	if f.hasSeq {
+		from = f.status.AppliedSeq + 1
+	}
+	f.mu.Unlock()
+
+	if err := gob.NewEncoder(conn).Encode(&replHello{From: from}); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(conn)
+	for {
+		var msg replMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+
+		if err := f.handle(&msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Follower) handle(msg *replMessage) error {
+	change := Change{Seq: msg.Seq, Op: msg.Op, Value: msg.Value, ExpiresAt: msg.ExpiresAt, Version: msg.Version}
+	if msg.Id != nil {
+		change.Id = newKeyId()
+		if err := change.Id.UnmarshalBinary(msg.Id); err != nil {
+			return err
+		}
+	}
+
+	switch msg.Kind {
+	case replSnapshot:
+		if err := f.clearSeq(); err != nil {
+			return err
+		}
+		if err := f.c.Apply(Change{Op: OpReset}); err != nil {
+			return err
+		}
+	case replEntry:
+		if err := f.c.Apply(change); err != nil {
+			return err
+		}
+	case replSnapshotEnd:
+		if err := f.saveSeq(msg.Seq); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.status.Snapshots++
+		f.mu.Unlock()
+	case replChange:
+		if err := f.c.Apply(change); err != nil {
+			return err
+		}
+		if err := f.saveSeq(msg.Seq); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if msg.LastSeq > f.status.PrimarySeq || msg.Kind == replSnapshot {
+		f.status.PrimarySeq = msg.LastSeq
+	}
+	f.status.Lag = 0
+	if f.status.PrimarySeq > f.status.AppliedSeq {
+		f.status.Lag = f.status.PrimarySeq - f.status.AppliedSeq
+	}
+
+	return nil
+}
+
+func (f *Follower) saveSeq(seq uint64) error {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, seq)
+	if err := writeFileAtomic(f.vfs, f.stateFile, b); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.status.AppliedSeq = seq
+	f.hasSeq = true
+	return nil
+}
+
+func (f *Follower) clearSeq() error {
+	if err := f.vfs.Remove(f.stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.hasSeq = false
+	return nil
+}
+
+// Close stops replicating. It does not close the follower's collection.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+
+	<-f.stopped
+	return nil
+}
+
+type readOnlyCollection struct {
+	Collection
+}
+
+func (c *readOnlyCollection) Put(KeyId, Item) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) PutWithTTL(KeyId, Item, time.Duration) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) Remove(KeyId) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) PutIfAbsent(KeyId, Item) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) CompareAndSwap(KeyId, uint64, Item) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) RemoveIfVersion(KeyId, uint64) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) Update(KeyId, Item, func(Item) (Item, error)) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) Load([]Entry, ConflictPolicy) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *readOnlyCollection) Sweep() (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *readOnlyCollection) PutCtx(context.Context, KeyId, Item) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) RemoveCtx(context.Context, KeyId) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) LoadCtx(context.Context, []Entry, ConflictPolicy) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *readOnlyCollection) SweepCtx(context.Context) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *readOnlyCollection) Apply(Change) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) TruncateChanges(uint64) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) Reset() error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyCollection) Close() error {
+	return nil
+}
+
+func (c *readOnlyCollection) Search(query string) ([]SearchResult, error) {
+	return Search(c.Collection, query)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func setupReplicaCollection(tb testing.TB, name string) (Collection, string) {
+	dir := filepath.Join("./data/test/replication", name)
+	c, err := newTestCollection(dir)
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		tb.Fatalf("collection reset failed: %v", err)
+	}
+
+	stateFile := filepath.Join(dir, "replica")
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		tb.Fatalf("replica state removal failed: %v", err)
+	}
+
+	return c, stateFile
+}
+
+func waitForFollower(t *testing.T, f *Follower, primary Collection) FollowerStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := f.Status()
+		if status.AppliedSeq == primary.LastSeq() && status.Lag == 0 {
+			return status
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for follower to catch up: %+v; primary at %d", status, primary.LastSeq())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectReplicated(t *testing.T, c Collection, expected map[uuid.UUID]*Book) {
+	count, err := c.Count()
+	if err != nil {
+		t.Fatalf("follower count failed: %v", err)
+	}
+
+	if count != int64(len(expected)) {
+		t.Fatalf("expected follower to have %d items; got %d", len(expected), count)
+	}
+
+	book := &Book{}
+	for id, want := range expected {
+		if err := c.Get(&id, book); err != nil {
+			t.Fatalf("follower get failed: %v", err)
+		}
+
+		if *book != *want {
+			t.Fatalf("expected replicated book to be %v; got %v", *want, *book)
+		}
+	}
+}
+
+func TestReplicationBootstrapAndStream(t *testing.T) {
+	teardown, primary, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	p, err := ServePrimary(primary, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("primary start failed: %v", err)
+	}
+	defer p.Close()
+
+	expected := map[uuid.UUID]*Book{}
+	for i, id := range ids {
+		expected[id] = &books[i]
+	}
+
+	followers := []*Follower{}
+	for _, name := range []string{"follower1", "follower2"} {
+		c, stateFile := setupReplicaCollection(t, name)
+		defer c.Close()
+
+		f, err := StartFollower(c, p.Addr().String(), stateFile)
+		if err != nil {
+			t.Fatalf("follower start failed: %v", err)
+		}
+		defer f.Close()
+
+		followers = append(followers, f)
+	}
+
+	for _, f := range followers {
+		status := waitForFollower(t, f, primary)
+		if status.Snapshots != 1 {
+			t.Fatalf("expected follower to bootstrap from 1 snapshot; got %d", status.Snapshots)
+		}
+		expectReplicated(t, f.Collection(), expected)
+	}
+
+	updated := &Book{Title: "A Clash of Kings", Year: 1998}
+	if err := primary.Put(&ids[0], updated); err != nil {
+		t.Fatalf("primary put failed: %v", err)
+	}
+	expected[ids[0]] = updated
+
+	if err := primary.Remove(&ids[1]); err != nil {
+		t.Fatalf("primary remove failed: %v", err)
+	}
+	delete(expected, ids[1])
+
+	for _, f := range followers {
+		waitForFollower(t, f, primary)
+		expectReplicated(t, f.Collection(), expected)
+	}
+
+	if err := followers[0].Collection().Put(&ids[2], updated); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected error to be %v; got %v", ErrReadOnly, err)
+	}
+}
+
+func TestReplicationFollowerResume(t *testing.T) {
+	teardown, primary, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	p, err := ServePrimary(primary, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("primary start failed: %v", err)
+	}
+	defer p.Close()
+
+	c, stateFile := setupReplicaCollection(t, "follower1")
+	defer c.Close()
+
+	f, err := StartFollower(c, p.Addr().String(), stateFile)
+	if err != nil {
+		t.Fatalf("follower start failed: %v", err)
+	}
+	waitForFollower(t, f, primary)
+	f.Close()
+
+	newId := uuid.New()
+	newBook := &Book{Title: "Dune", Year: 1965}
+	if err := primary.Put(&newId, newBook); err != nil {
+		t.Fatalf("primary put failed: %v", err)
+	}
+
+	f, err = StartFollower(c, p.Addr().String(), stateFile)
+	if err != nil {
+		t.Fatalf("follower restart failed: %v", err)
+	}
+	defer f.Close()
+
+	status := waitForFollower(t, f, primary)
+	if status.Snapshots != 0 {
+		t.Fatalf("expected restarted follower to resume without a snapshot; got %d snapshots", status.Snapshots)
+	}
+
+	expected := map[uuid.UUID]*Book{newId: newBook}
+	for i, id := range ids {
+		expected[id] = &books[i]
+	}
+	expectReplicated(t, f.Collection(), expected)
+}
+
+func TestReplicationSnapshotAfterTruncation(t *testing.T) {
+	teardown, primary, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	p, err := ServePrimary(primary, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("primary start failed: %v", err)
+	}
+	defer p.Close()
+
+	c, stateFile := setupReplicaCollection(t, "follower1")
+	defer c.Close()
+
+	f, err := StartFollower(c, p.Addr().String(), stateFile)
+	if err != nil {
+		t.Fatalf("follower start failed: %v", err)
+	}
+	waitForFollower(t, f, primary)
+	f.Close()
+
+	if err := primary.Remove(&ids[0]); err != nil {
+		t.Fatalf("primary remove failed: %v", err)
+	}
+
+	if err := primary.TruncateChanges(primary.LastSeq() + 1); err != nil {
+		t.Fatalf("primary truncate changes failed: %v", err)
+	}
+
+	f, err = StartFollower(c, p.Addr().String(), stateFile)
+	if err != nil {
+		t.Fatalf("follower restart failed: %v", err)
+	}
+	defer f.Close()
+
+	status := waitForFollower(t, f, primary)
+	if status.Snapshots != 1 {
+		t.Fatalf("expected follower to bootstrap again after truncation; got %d snapshots", status.Snapshots)
+	}
+
+	expected := map[uuid.UUID]*Book{}
+	for i, id := range ids[1:] {
+		expected[id] = &books[i+1]
+	}
+	expectReplicated(t, f.Collection(), expected)
+}
+
+func TestReplicationVersionsAndExpiry(t *testing.T) {
+	teardown, primary, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	// The primary's versions run ahead of the follower's own numbering.
+	for i := 0; i < 3; i++ {
+		if err := primary.Put(&ids[0], &books[0]); err != nil {
+			t.Fatalf("primary put failed: %v", err)
+		}
+	}
+
+	if err := primary.PutWithTTL(&ids[1], &books[1], time.Hour); err != nil {
+		t.Fatalf("primary put with ttl failed: %v", err)
+	}
+
+	p, err := ServePrimary(primary, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("primary start failed: %v", err)
+	}
+	defer p.Close()
+
+	c, stateFile := setupReplicaCollection(t, "follower1")
+	defer c.Close()
+
+	vfs := NewMemFS()
+	if err := vfs.MkdirAll(filepath.Dir(stateFile)); err != nil {
+		t.Fatalf("directory creation failed: %v", err)
+	}
+
+	f, err := StartFollower(c, p.Addr().String(), stateFile, WithVFS(vfs))
+	if err != nil {
+		t.Fatalf("follower start failed: %v", err)
+	}
+	defer f.Close()
+
+	expectVersions := func() {
+		t.Helper()
+		waitForFollower(t, f, primary)
+
+		for _, id := range ids[:2] {
+			want, err := primary.GetWithVersion(&id, &Book{})
+			if err != nil {
+				t.Fatalf("primary get failed: %v", err)
+			}
+
+			got, err := c.GetWithVersion(&id, &Book{})
+			if err != nil {
+				t.Fatalf("follower get failed: %v", err)
+			}
+
+			if got != want {
+				t.Fatalf("expected follower version %d; got %d", want, got)
+			}
+		}
+	}
+
+	// Once from the snapshot, then from the change log.
+	expectVersions()
+	version, err := primary.GetWithVersion(&ids[0], &Book{})
+	if err != nil {
+		t.Fatalf("primary get failed: %v", err)
+	}
+
+	if err := primary.CompareAndSwap(&ids[0], version, &books[2]); err != nil {
+		t.Fatalf("primary compare and swap failed: %v", err)
+	}
+	expectVersions()
+
+	if _, err := vfs.Stat(stateFile); err != nil {
+		t.Fatalf("expected follower state in its vfs: %v", err)
+	}
+
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("expected no follower state on disk; got %v", err)
+	}
+
+	// The expiry of the snapshot entry replicated with it.
+	if err := primary.PutWithTTL(&ids[2], &books[2], time.Hour); err != nil {
+		t.Fatalf("primary put with ttl failed: %v", err)
+	}
+	waitForFollower(t, f, primary)
+
+	setClock(c, func() time.Time { return time.Now().Add(2 * time.Hour) })
+	defer setClock(c, time.Now)
+	for _, id := range ids[1:3] {
+		if err := c.Get(&id, &Book{}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected replicated book to expire; got %v", err)
+		}
+	}
+}
+
+func TestReplicationSnapshotWriteTimeout(t *testing.T) {
+	teardown, primary, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	timeout := replWriteTimeout
+	replWriteTimeout = 100 * time.Millisecond
+	defer func() { replWriteTimeout = timeout }()
+
+	p := &Primary{c: primary, ctx: context.Background()}
+	conn, follower := net.Pipe()
+	defer follower.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- p.serve(conn) }()
+
+	// A follower that asks for a snapshot and stops reading after its start.
+	if err := gob.NewEncoder(follower).Encode(&replHello{}); err != nil {
+		t.Fatalf("hello failed: %v", err)
+	}
+
+	var msg replMessage
+	if err := gob.NewDecoder(follower).Decode(&msg); err != nil || msg.Kind != replSnapshot {
+		t.Fatalf("expected snapshot start; got %+v (%v)", msg, err)
+	}
+
+	// Writes go on while the snapshot is stalled, which is given up.
+	for i := range ids {
+		if err := primary.Put(&ids[i], &books[len(books)-1-i]); err != nil {
+			t.Fatalf("primary put failed: %v", err)
+		}
+	}
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected error to be %v; got %v", os.ErrDeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("primary blocked on a stalled follower")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is a read-only view of a collection as of the sequence number it
+// is pinned to. It must be closed so that the versions it keeps alive can be
+// garbage-collected.
+type Snapshot interface {
+	Seq() uint64
+	Get(id KeyId, item Item) error
+	Scan(item Item, fn func(KeyId, Item) error) error
+	// Entries visits the keys seen like Scan, as puts carrying their expiry
+	// and version.
+	Entries(fn func(Change) error) error
+	Close() error
+}
+
+// version is the state of a key before the mutation with sequence number seq
+// replaced it.
+type version struct {
+	seq        uint64
+	value      []byte
+	expiresAt  int64
+	keyVersion uint64
+	present    bool
+}
+
+func (v version) visible(now time.Time) bool {
+	return v.present && (v.expiresAt == 0 || v.expiresAt > now.UnixNano())
+}
+
+// versionStore keeps the replaced versions of keys for as long as a snapshot
+// pinned before their replacement is open. Callers guard it with the lock of
+// their collection.
+type versionStore struct {
+	pins   map[uint64]int
+	chains map[string][]version
+}
+
+func newVersionStore() *versionStore {
+	return &versionStore{pins: map[uint64]int{}, chains: map[string][]version{}}
+}
+
+func (s *versionStore) active() bool {
+	return len(s.pins) > 0
+}
+
+func (s *versionStore) pin(seq uint64) {
+	s.pins[seq]++
+}
+
+func (s *versionStore) unpin(seq uint64) {
+	if s.pins[seq]--; s.pins[seq] <= 0 {
+		delete(s.pins, seq)
+	}
+	s.prune()
+}
+
+func (s *versionStore) record(id []byte, seq uint64, v version) {
+	v.seq = seq
+	s.chains[string(id)] = append(s.chains[string(id)], v)
+}
+
+// prune drops the versions replaced at or before the oldest pinned sequence
+// number, which no open snapshot can see.
+func (s *versionStore) prune() {
+	if len(s.pins) == 0 {
+		clear(s.chains)
+		return
+	}
+
+	oldest := uint64(0)
+	for seq := range s.pins {
+		if oldest == 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+
+	for id, chain := range s.chains {
+		i := sort.Search(len(chain), func(i int) bool { return chain[i].seq > oldest })
+		if i == len(chain) {
+			delete(s.chains, id)
+		} else if i > 0 {
+			s.chains[id] = append([]version{}, chain[i:]...)
+		}
+	}
+}
+
+// lookup returns the version of id seen at seq, which is the one replaced by
+// the first mutation after seq. It returns false when id has not changed
+// since, meaning the current state is the one seen.
+func (s *versionStore) lookup(id []byte, seq uint64) (version, bool) {
+	chain := s.chains[string(id)]
+	i := sort.Search(len(chain), func(i int) bool { return chain[i].seq > seq })
+	if i == len(chain) {
+		return version{}, false
+	}
+
+	return chain[i], true
+}
+
+// snapshot reads through the version store of a collection, falling back to
+// its current state for keys that have not changed since seq. Expiry is
+// judged as of at, the time the snapshot was taken.
+type snapshot struct {
+	seq      uint64
+	mu       *rwMutex
+	versions *versionStore
+	at       time.Time
+	current  func(id []byte) (version, error)
+	// each visits the current keys past the key id after, in key order when
+	// ordered is set.
+	each    func(after []byte, fn func(id []byte, v version) error) error
+	ordered bool
+	closed  bool
+}
+
+func (s *snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *snapshot) get(id []byte) (version, error) {
+	if v, ok := s.versions.lookup(id, s.seq); ok {
+		return v, nil
+	}
+
+	return s.current(id)
+}
+
+func (s *snapshot) Get(id KeyId, item Item) error {
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return errors.New("snapshot closed")
+	}
+
+	v, err := s.get(idBytes)
+	if err != nil {
+		return err
+	}
+
+	if !v.visible(s.at) {
+		return ErrNotFound
+	}
+
+	return item.UnmarshalBinary(v.value)
+}
+
+type snapshotEntry struct {
+	id []byte
+	v  version
+}
+
+// snapshotPage is how many entries Scan and Entries collect under the
+// collection's read lock at a time.
+const snapshotPage = 256
+
+// errPageFull stops the visit of ordered keys once they are past the page.
+var errPageFull = errors.New("snapshot page full")
+
+// Scan visits the keys seen at the snapshot's sequence number in key order.
+// They are collected a page at a time under the collection's read lock,
+// which is released before fn is called.
+func (s *snapshot) Scan(item Item, fn func(KeyId, Item) error) error {
+	return s.iterate(func(e snapshotEntry) error {
+		id := newKeyId()
+		if err := id.UnmarshalBinary(e.id); err != nil {
+			return err
+		}
+
+		if err := item.UnmarshalBinary(e.v.value); err != nil {
+			return err
+		}
+
+		return fn(id, item)
+	})
+}
+
+func (s *snapshot) Entries(fn func(Change) error) error {
+	return s.iterate(func(e snapshotEntry) error {
+		change := Change{Seq: s.seq, Op: OpPut, Id: newKeyId(), Value: e.v.value, ExpiresAt: e.v.expiresAt, Version: e.v.keyVersion}
+		if err := change.Id.UnmarshalBinary(e.id); err != nil {
+			return err
+		}
+
+		return fn(change)
+	})
+}
+
+func (s *snapshot) iterate(fn func(snapshotEntry) error) error {
+	var after []byte
+	for {
+		entries, err := s.page(after)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < snapshotPage {
+			return nil
+		}
+		after = entries[len(entries)-1].id
+	}
+}
+
+// page returns the first snapshotPage entries seen past the key id after,
+// or all of them from the start when after is nil, in key order. Unordered
+// collections are scanned whole for every page.
+func (s *snapshot) page(after []byte) ([]snapshotEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, errors.New("snapshot closed")
+	}
+
+	entries := []snapshotEntry{}
+	var last []byte
+	add := func(id []byte, v version) {
+		if after != nil && bytes.Compare(id, after) <= 0 || !v.visible(s.at) {
+			return
+		}
+
+		if last != nil && bytes.Compare(id, last) >= 0 {
+			return
+		}
+
+		entries = append(entries, snapshotEntry{id: append([]byte{}, id...), v: v})
+		if len(entries) == 2*snapshotPage {
+			entries = trimEntries(entries)
+			last = entries[len(entries)-1].id
+		}
+	}
+
+	err := s.each(after, func(id []byte, v version) error {
+		if s.ordered && last != nil && bytes.Compare(id, last) >= 0 {
+			return errPageFull
+		}
+
+		// Keys with a version replaced since seq are added from the chains.
+		if _, ok := s.versions.lookup(id, s.seq); !ok {
+			add(id, v)
+		}
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return nil, err
+	}
+
+	for id := range s.versions.chains {
+		if v, ok := s.versions.lookup([]byte(id), s.seq); ok {
+			add([]byte(id), v)
+		}
+	}
+
+	return trimEntries(entries), nil
+}
+
+// trimEntries sorts entries by key and keeps the first snapshotPage.
+func trimEntries(entries []snapshotEntry) []snapshotEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].id, entries[j].id) == -1
+	})
+
+	if len(entries) > snapshotPage {
+		entries = entries[:snapshotPage]
+	}
+	return entries
+}
+
+func (s *snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.versions.unpin(s.seq)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func scanTitles(t *testing.T, s Snapshot) map[uuid.UUID]string {
+	titles := map[uuid.UUID]string{}
+	err := s.Scan(&Book{}, func(id KeyId, item Item) error {
+		titles[id.(*uuid.NullUUID).UUID] = item.(*Book).Title
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("snapshot scan failed: %v", err)
+	}
+
+	return titles
+}
+
+func TestCollectionSnapshot(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	s, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+	defer s.Close()
+
+	if s.Seq() != c.LastSeq() {
+		t.Fatalf("expected snapshot seq to be %d; got %d", c.LastSeq(), s.Seq())
+	}
+
+	added := uuid.New()
+	if err := c.Put(&added, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "A Clash of Kings", Year: 1998}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "A Storm of Swords", Year: 2000}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	book := &Book{}
+	for i, id := range ids {
+		if err := s.Get(&id, book); err != nil {
+			t.Fatalf("snapshot get failed: %v", err)
+		}
+
+		if *book != books[i] {
+			t.Fatalf("expected snapshot book to be %v; got %v", books[i], *book)
+		}
+	}
+
+	if err := s.Get(&added, book); err == nil {
+		t.Fatalf("expected key added after the snapshot to be absent")
+	}
+
+	later, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+	defer later.Close()
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("collection reset failed: %v", err)
+	}
+
+	titles := scanTitles(t, s)
+	if len(titles) != len(ids) {
+		t.Fatalf("expected %d scanned books; got %d", len(ids), len(titles))
+	}
+
+	for i, id := range ids {
+		if titles[id] != books[i].Title {
+			t.Fatalf("expected scanned title to be %s; got %s", books[i].Title, titles[id])
+		}
+	}
+
+	titles = scanTitles(t, later)
+	if len(titles) != len(ids) || titles[ids[0]] != "A Storm of Swords" || titles[added] != "Dune" {
+		t.Fatalf("expected later snapshot to see the updates; got %v", titles)
+	}
+
+	if _, ok := titles[ids[1]]; ok {
+		t.Fatalf("expected later snapshot not to see the removed book")
+	}
+}
+
+func TestCollectionSnapshotReleasesVersions(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	first, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "A Clash of Kings", Year: 1998}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	second, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+
+	if err := c.Put(&ids[1], &Book{Title: "Harry Potter and the Goblet of Fire", Year: 2000}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	versions := snapshotVersions(c)
+	if len(versions.chains) != 2 {
+		t.Fatalf("expected 2 retained keys; got %d", len(versions.chains))
+	}
+
+	first.Close()
+	if len(versions.chains) != 1 {
+		t.Fatalf("expected 1 retained key after closing the first snapshot; got %d", len(versions.chains))
+	}
+
+	second.Close()
+	if len(versions.chains) != 0 {
+		t.Fatalf("expected no retained keys after closing all snapshots; got %d", len(versions.chains))
+	}
+
+	if err := first.Get(&ids[0], &Book{}); err == nil {
+		t.Fatalf("expected get on a closed snapshot to fail")
+	}
+}
+
+func TestCollectionSnapshotExpiry(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	now := time.Now()
+	setClock(c, func() time.Time { return now })
+
+	id := uuid.New()
+	if err := c.PutWithTTL(&id, &Book{Title: "Dune", Year: 1965}, time.Minute); err != nil {
+		t.Fatalf("collection put with ttl failed: %v", err)
+	}
+
+	s, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+	defer s.Close()
+
+	now = now.Add(time.Hour)
+	if err := c.Get(&id, &Book{}); err == nil {
+		t.Fatalf("expected the expired book to be absent from the collection")
+	}
+
+	if err := s.Get(&id, &Book{}); err != nil {
+		t.Fatalf("snapshot get failed: %v", err)
+	}
+
+	if titles := scanTitles(t, s); titles[id] != "Dune" {
+		t.Fatalf("expected snapshot scan to see the expired book; got %v", titles)
+	}
+}
+
+func TestCollectionSnapshotPages(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	expected := map[uuid.UUID]string{}
+	for i, id := range ids {
+		expected[id] = books[i].Title
+	}
+
+	for i := 0; i < 2*snapshotPage+10; i++ {
+		id := uuid.New()
+		title := fmt.Sprintf("Book %d", i)
+		if err := c.Put(&id, &Book{Title: title, Year: 2000}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+		expected[id] = title
+	}
+
+	s, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("collection snapshot failed: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 50; i++ {
+		added := uuid.New()
+		if err := c.Put(&added, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "A Clash of Kings", Year: 1998}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	var last []byte
+	scanned := map[uuid.UUID]string{}
+	err = s.Scan(&Book{}, func(id KeyId, item Item) error {
+		b, err := id.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if last != nil && bytes.Compare(last, b) != -1 {
+			return fmt.Errorf("key %x scanned after %x", b, last)
+		}
+		last = b
+
+		scanned[id.(*uuid.NullUUID).UUID] = item.(*Book).Title
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("snapshot scan failed: %v", err)
+	}
+
+	if len(scanned) != len(expected) {
+		t.Fatalf("expected %d scanned books; got %d", len(expected), len(scanned))
+	}
+
+	for id, title := range expected {
+		if scanned[id] != title {
+			t.Fatalf("expected scanned title of %s to be %s; got %s", id, title, scanned[id])
+		}
+	}
+}
+
+func snapshotVersions(c Collection) *versionStore {
+	switch c := c.(type) {
+	case *collection:
+		return c.versions
+	case *lsmCollection:
+		return c.versions
+	}
+	return nil
+}
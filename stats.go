@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+)
+
+const shiftWindowSize = 1024
+
+// ShiftStats describes how many key records the recent inserts into a sorted
+// index had to move.
+type ShiftStats struct {
+	Samples int
+	Average float64
+	Max     int64
+}
+
+// shiftWindow keeps the shift distances of the last inserts.
+type shiftWindow struct {
+	mu        sync.Mutex
+	distances [shiftWindowSize]int64
+	n         int
+}
+
+func (w *shiftWindow) record(distance int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.distances[w.n%shiftWindowSize] = distance
+	w.n++
+}
+
+func (w *shiftWindow) stats() ShiftStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := ShiftStats{Samples: min(w.n, shiftWindowSize)}
+	total := int64(0)
+	for _, d := range w.distances[:stats.Samples] {
+		total += d
+		stats.Max = max(stats.Max, d)
+	}
+
+	if stats.Samples > 0 {
+		stats.Average = float64(total) / float64(stats.Samples)
+	}
+
+	return stats
+}
+
+// fileSizes returns the size of each file in dir and their total.
+func fileSizes(vfs VFS, dir string) (map[string]int64, int64, error) {
+	entries, err := vfs.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sizes := map[string]int64{}
+	total := int64(0)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		sizes[e.Name()] = info.Size()
+		total += info.Size()
+	}
+
+	return sizes, total, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCollectionStats(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	if err := c.Remove(&ids[0]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.Count != 3 {
+		t.Fatalf("expected item count to be 3; got %d", stats.Count)
+	}
+
+	total := int64(0)
+	for _, size := range stats.Files {
+		total += size
+	}
+
+	if len(stats.Files) == 0 || total != stats.FileBytes {
+		t.Fatalf("expected file sizes adding up to %d bytes; got %v", stats.FileBytes, stats.Files)
+	}
+
+	remaining := append([]uuid.UUID{}, ids[1:]...)
+	sort.Slice(remaining, func(i, j int) bool {
+		return bytes.Compare(remaining[i][:], remaining[j][:]) < 0
+	})
+
+	for _, k := range []struct {
+		id       KeyId
+		expected uuid.UUID
+	}{{stats.MinKey, remaining[0]}, {stats.MaxKey, remaining[2]}} {
+		if k.id == nil {
+			t.Fatal("expected the key range to be set")
+		}
+
+		b, err := k.id.MarshalBinary()
+		if err != nil {
+			t.Fatalf("key id marshalling failed: %v", err)
+		}
+
+		if !bytes.Equal(b, k.expected[:]) {
+			t.Fatalf("expected key %v; got %x", k.expected, b)
+		}
+	}
+}
+
+func TestCollectionStatsEmpty(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("collection reset failed: %v", err)
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.Count != 0 || stats.MinKey != nil || stats.MaxKey != nil {
+		t.Fatalf("expected no keys; got %+v", stats)
+	}
+}
+
+func TestCollectionStatsDeadSlotsAndShifts(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	// Data records carry their key id.
+	slotSize := int64(KeyIdSize + BookSize)
+	if stats.DataSlots != 4 || stats.DeadSlots != 1 || stats.DeadBytes != slotSize {
+		t.Fatalf("expected 4 data slots, 1 of them dead; got %+v", stats)
+	}
+
+	if stats.Files["data"] != 4*slotSize {
+		t.Fatalf("expected data file size to be %d; got %d", 4*slotSize, stats.Files["data"])
+	}
+
+	if stats.Shifts.Samples != 4 || stats.Shifts.Max > 3 {
+		t.Fatalf("expected 4 inserts shifting at most 3 records; got %+v", stats.Shifts)
+	}
+
+	if err := c.Put(&ids[1], &books[1]); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if stats, err = c.Stats(); err != nil {
+		t.Fatalf("collection stats failed: %v", err)
+	}
+
+	if stats.DataSlots != 4 || stats.DeadSlots != 0 {
+		t.Fatalf("expected the dead slot to be reused; got %+v", stats)
+	}
+}
+
+func TestShiftWindow(t *testing.T) {
+	w := &shiftWindow{}
+	if stats := w.stats(); stats != (ShiftStats{}) {
+		t.Fatalf("expected empty stats; got %+v", stats)
+	}
+
+	for i := 0; i < shiftWindowSize+2; i++ {
+		w.record(int64(i % 4))
+	}
+	w.record(10)
+
+	stats := w.stats()
+	if stats.Samples != shiftWindowSize || stats.Max != 10 {
+		t.Fatalf("expected %d samples up to 10; got %+v", shiftWindowSize, stats)
+	}
+}
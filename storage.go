@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/pkg/errors"
 )
 
 type storage struct {
-	f        *os.File
+	f        File
 	itemSize uint16
 }
 
@@ -38,89 +39,264 @@ func (s *storage) WriteOffset(b []byte, off int64) (int, error) {
 }
 
 func (s *storage) ShiftLeft(targetOffset int64) error {
-	count, err := s.Count()
+	return shiftItemsLeft(context.Background(), s, targetOffset)
+}
+
+func (s *storage) ShiftRight(targetOffset int64) error {
+	return shiftItemsRight(context.Background(), s, targetOffset)
+}
+
+func (s *storage) ShiftLeftCtx(ctx context.Context, targetOffset int64) error {
+	return shiftItemsLeft(ctx, s, targetOffset)
+}
+
+func (s *storage) ShiftRightCtx(ctx context.Context, targetOffset int64) error {
+	return shiftItemsRight(ctx, s, targetOffset)
+}
+
+func (s *storage) Count() (int64, error) {
+	size, err := s.f.Size()
 	if err != nil {
+		return 0, errors.Wrap(err, "counting items in storage failed")
+	}
+
+	return size / int64(s.itemSize), nil
+}
+
+func (s *storage) Truncate(count int64) error {
+	if err := s.f.Truncate(count * int64(s.itemSize)); err != nil {
+		return errors.Wrap(err, "truncating storage failed")
+	}
+
+	return nil
+}
+
+func (s *storage) Reset() error {
+	return s.f.Truncate(0)
+}
+
+func (s *storage) ItemSize() uint16 {
+	return s.itemSize
+}
+
+func (s *storage) Close() error {
+	return s.f.Close()
+}
+
+func (s *storage) Sync() error {
+	return s.f.Sync()
+}
+
+func NewStorage(filename string, itemSize uint16) (Storage, error) {
+	return newStorage(osFS{}, filename, itemSize)
+}
+
+func newStorage(vfs VFS, filename string, itemSize uint16) (Storage, error) {
+	f, err := vfs.OpenFile(filename, os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage{f: f, itemSize: itemSize}, nil
+}
+
+// contextShifter is implemented by storages whose shifts stop when a context
+// is done, leaving the storage as it was.
+type contextShifter interface {
+	ShiftLeftCtx(ctx context.Context, targetOffset int64) error
+	ShiftRightCtx(ctx context.Context, targetOffset int64) error
+}
+
+// syncer is implemented by storages that can flush their writes to stable
+// storage.
+type syncer interface {
+	Sync() error
+}
+
+func syncStorage(s Storage) error {
+	if ss, ok := s.(syncer); ok {
+		return ss.Sync()
+	}
+
+	return nil
+}
+
+func shiftLeftCtx(ctx context.Context, s Storage, targetOffset int64) error {
+	if cs, ok := s.(contextShifter); ok {
+		return cs.ShiftLeftCtx(ctx, targetOffset)
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if count == 0 {
-		return nil
+	return s.ShiftLeft(targetOffset)
+}
+
+func shiftRightCtx(ctx context.Context, s Storage, targetOffset int64) error {
+	if cs, ok := s.(contextShifter); ok {
+		return cs.ShiftRightCtx(ctx, targetOffset)
 	}
 
-	currentOffset := targetOffset
-	lastOffset := count - 1
-	b := make([]byte, s.itemSize)
-	for currentOffset < lastOffset {
-		if _, err := s.ReadOffset(b, currentOffset+1); err != nil {
-			return err
-		}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-		if _, err := s.WriteOffset(b, currentOffset); err != nil {
-			return err
-		}
+	return s.ShiftRight(targetOffset)
+}
+
+// contextStorage hands ctx to the shifts of a Storage for indexers, whose
+// methods take no context.
+type contextStorage struct {
+	Storage
+	ctx context.Context
+}
+
+func (s *contextStorage) ShiftLeft(targetOffset int64) error {
+	return shiftLeftCtx(s.ctx, s.Storage, targetOffset)
+}
+
+func (s *contextStorage) ShiftRight(targetOffset int64) error {
+	return shiftRightCtx(s.ctx, s.Storage, targetOffset)
+}
+
+func (s *contextStorage) Sync() error {
+	return syncStorage(s.Storage)
+}
 
-		currentOffset += 1
+func withContext(ctx context.Context, s Storage) Storage {
+	if ctx.Done() == nil {
+		return s
 	}
 
-	return s.f.Truncate((count - 1) * int64(s.itemSize))
+	return &contextStorage{Storage: s, ctx: ctx}
 }
 
-func (s *storage) ShiftRight(targetOffset int64) error {
-	currentOffset, err := s.Count()
+// withoutContext returns the Storage withContext wrapped, so that indexers can
+// tell it is the same one from call to call.
+func withoutContext(s Storage) Storage {
+	if cs, ok := s.(*contextStorage); ok {
+		return cs.Storage
+	}
+
+	return s
+}
+
+// shiftItemsLeft removes the item at targetOffset by moving the ones after it
+// one slot left. When ctx is done or a write fails midway, the moved items
+// are put back and the removed one restored before returning the error.
+func shiftItemsLeft(ctx context.Context, s Storage, targetOffset int64) error {
+	count, err := s.Count()
 	if err != nil {
 		return err
 	}
 
-	b := make([]byte, s.itemSize)
-	for currentOffset > targetOffset {
-		if _, err := s.ReadOffset(b, currentOffset-1); err != nil {
+	if count == 0 {
+		return nil
+	}
+
+	done := ctx.Done()
+	b := make([]byte, s.ItemSize())
+	var removed []byte
+	if targetOffset < count {
+		removed = make([]byte, s.ItemSize())
+		if _, err := s.ReadOffset(removed, targetOffset); err != nil {
 			return err
 		}
+	}
 
-		if _, err := s.WriteOffset(b, currentOffset); err != nil {
+	for off := targetOffset; off < count-1; off++ {
+		select {
+		case <-done:
+			return undoShiftLeft(s, targetOffset, off, removed, ctx.Err())
+		default:
+		}
+
+		if _, err := s.ReadOffset(b, off+1); err != nil {
 			return err
 		}
 
-		currentOffset -= 1
+		if _, err := s.WriteOffset(b, off); err != nil {
+			return undoShiftLeft(s, targetOffset, off, removed, err)
+		}
+	}
+
+	if err := s.Truncate(count - 1); err != nil {
+		return undoShiftLeft(s, targetOffset, count-1, removed, err)
 	}
 
 	return nil
 }
 
-func (s *storage) Count() (int64, error) {
-	stat, err := s.f.Stat()
-	if err != nil {
-		return 0, errors.Wrap(err, "counting items in storage failed")
+func undoShiftLeft(s Storage, targetOffset int64, off int64, removed []byte, cause error) error {
+	b := make([]byte, s.ItemSize())
+	for ; off > targetOffset; off-- {
+		if _, err := s.ReadOffset(b, off-1); err != nil {
+			return errors.Wrapf(err, "undoing shift after %v", cause)
+		}
+
+		if _, err := s.WriteOffset(b, off); err != nil {
+			return errors.Wrapf(err, "undoing shift after %v", cause)
+		}
 	}
 
-	return stat.Size() / int64(s.itemSize), nil
+	if removed != nil {
+		if _, err := s.WriteOffset(removed, targetOffset); err != nil {
+			return errors.Wrapf(err, "undoing shift after %v", cause)
+		}
+	}
+
+	return cause
 }
 
-func (s *storage) Reset() error {
-	if err := s.f.Truncate(0); err != nil {
+// shiftItemsRight frees the slot at targetOffset by moving the items from it
+// on one slot right. When ctx is done or a write fails midway, the moved
+// items are put back before returning the error.
+func shiftItemsRight(ctx context.Context, s Storage, targetOffset int64) error {
+	count, err := s.Count()
+	if err != nil {
 		return err
 	}
 
-	if _, err := s.f.Seek(0, 0); err != nil {
-		return err
+	done := ctx.Done()
+	b := make([]byte, s.ItemSize())
+	for off := count; off > targetOffset; off-- {
+		select {
+		case <-done:
+			return undoShiftRight(s, off, count, ctx.Err())
+		default:
+		}
+
+		if _, err := s.ReadOffset(b, off-1); err != nil {
+			return err
+		}
+
+		if _, err := s.WriteOffset(b, off); err != nil {
+			return undoShiftRight(s, off, count, err)
+		}
 	}
 
 	return nil
 }
 
-func (s *storage) ItemSize() uint16 {
-	return s.itemSize
-}
+// undoShiftRight moves the items after off back one slot left, rewriting the
+// one at off in case it was partly overwritten, and drops the slot appended
+// at count.
+func undoShiftRight(s Storage, off int64, count int64, cause error) error {
+	b := make([]byte, s.ItemSize())
+	for ; off < count; off++ {
+		if _, err := s.ReadOffset(b, off+1); err != nil {
+			return errors.Wrapf(err, "undoing shift after %v", cause)
+		}
 
-func (s *storage) Close() error {
-	return s.f.Close()
-}
+		if _, err := s.WriteOffset(b, off); err != nil {
+			return errors.Wrapf(err, "undoing shift after %v", cause)
+		}
+	}
 
-func NewStorage(filename string, itemSize uint16) (Storage, error) {
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
+	if err := s.Truncate(count); err != nil {
+		return errors.Wrapf(err, "undoing shift after %v", cause)
 	}
 
-	return &storage{f: f, itemSize: itemSize}, nil
+	return cause
 }
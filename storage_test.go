@@ -257,3 +257,21 @@ func TestStorageItemSize(t *testing.T) {
 		t.Fatalf("expected item size to be %d; got %d", BookSize, itemSize)
 	}
 }
+
+func TestStorageTruncate(t *testing.T) {
+	teardown, s, _ := setupStorageTest(t)
+	defer teardown(t)
+
+	if err := s.Truncate(1); err != nil {
+		t.Fatalf("storage truncate failed: %v", err)
+	}
+
+	count, err := s.Count()
+	if err != nil {
+		t.Fatalf("storage count failed: %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected count of items saved in storage to be 1; got %d", count)
+	}
+}
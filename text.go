@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const textWordSize = 32
+const textPositionSize = 2
+
+var ErrNoTextIndex = errors.New("collection has no text index")
+
+// Searcher is implemented by collections that can be opened with a text
+// index. Search fails with ErrNoTextIndex when they were not.
+type Searcher interface {
+	Search(query string) ([]SearchResult, error)
+}
+
+type SearchResult struct {
+	Id    KeyId
+	Score float64
+}
+
+// Search runs query against the text index of c.
+func Search(c Collection, query string) ([]SearchResult, error) {
+	s, ok := c.(Searcher)
+	if !ok {
+		return nil, ErrNoTextIndex
+	}
+
+	return s.Search(query)
+}
+
+// textField extracts the indexed string field from the items of a
+// collection.
+type textField struct {
+	newItem func() Item
+	text    func(Item) string
+}
+
+// tokenize splits s into lowercase words of letters and digits, cut to the
+// size of a posting.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, w := range words {
+		for len(w) > textWordSize {
+			_, size := utf8.DecodeLastRuneInString(w)
+			w = w[:len(w)-size]
+		}
+		words[i] = w
+	}
+
+	return words
+}
+
+var stemSuffixes = []string{"ingly", "edly", "ing", "ies", "ed", "ly", "es", "s"}
+
+// stem strips a common English suffix from word. A stem is always a prefix
+// of its word, which phrase prefix matching relies on.
+func stem(word string) string {
+	for _, suffix := range stemSuffixes {
+		if suffix == "s" && strings.HasSuffix(word, "ss") {
+			continue
+		}
+
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 {
+			return word[:len(word)-len(suffix)]
+		}
+	}
+
+	return word
+}
+
+// textClause matches a word, or a phrase of consecutive words whose last one
+// is matched as a prefix.
+type textClause struct {
+	words  []string
+	prefix bool
+}
+
+// parseTextQuery reads space-separated clauses, all of which must match, in
+// groups separated by OR, any of which may. Quoted phrases match as a phrase
+// prefix; a bare AND is ignored.
+func parseTextQuery(query string) ([][]textClause, error) {
+	groups := [][]textClause{}
+	group := []textClause{}
+
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated phrase in query")
+			}
+
+			if words := tokenize(query[1 : end+1]); len(words) > 0 {
+				group = append(group, textClause{words: words, prefix: true})
+			}
+			query = query[end+2:]
+			continue
+		}
+
+		field := query
+		if i := strings.IndexFunc(query, func(r rune) bool { return unicode.IsSpace(r) || r == '"' }); i >= 0 {
+			field = query[:i]
+		}
+		query = query[len(field):]
+
+		switch field {
+		case "OR":
+			if len(group) == 0 {
+				return nil, errors.New("OR without terms before it")
+			}
+			groups = append(groups, group)
+			group = []textClause{}
+		case "AND":
+		default:
+			for _, w := range tokenize(field) {
+				group = append(group, textClause{words: []string{w}})
+			}
+		}
+	}
+
+	if len(group) == 0 {
+		if len(groups) > 0 {
+			return nil, errors.New("OR without terms after it")
+		}
+		return nil, errors.New("empty query")
+	}
+
+	return append(groups, group), nil
+}
+
+type textDoc struct {
+	words []string
+	slots []int64
+}
+
+// textIndex is an inverted index of the words of one string field, mapping
+// their stems to the keys and positions they occur at. It is kept in memory
+// and mirrored in a storage of one occurrence per slot, freed slots being
+// zeroed. The first slot records whether the index was closed cleanly; when
+// it was not, the collection rebuilds it.
+type textIndex struct {
+	storage  Storage
+	field    *textField
+	postings map[string]map[string][]int
+	docs     map[string]*textDoc
+	free     []int64
+	count    int64
+}
+
+func textSlotSize(keyIdSize uint16) uint16 {
+	return textWordSize + keyIdSize + textPositionSize
+}
+
+// openTextIndex loads the index in s, returning false when it must be
+// rebuilt.
+func openTextIndex(s Storage, field *textField) (*textIndex, bool, error) {
+	t := &textIndex{storage: s, field: field}
+	t.clear()
+
+	count, err := s.Count()
+	if err != nil {
+		return nil, false, err
+	}
+
+	b := make([]byte, s.ItemSize())
+	if count > 0 {
+		if _, err := s.ReadOffset(b, 0); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if count == 0 || b[0] != 1 {
+		return t, false, t.reset()
+	}
+
+	keyIdSize := int(s.ItemSize()) - textWordSize - textPositionSize
+	for off := int64(1); off < count; off++ {
+		if _, err := s.ReadOffset(b, off); err != nil {
+			return nil, false, err
+		}
+
+		word := string(bytes.TrimRight(b[:textWordSize], "\x00"))
+		if word == "" {
+			t.free = append(t.free, off)
+			continue
+		}
+
+		id := string(b[textWordSize : textWordSize+keyIdSize])
+		pos := int(binary.LittleEndian.Uint16(b[textWordSize+keyIdSize:]))
+		t.add(id, word, pos, off)
+	}
+	t.count = count
+
+	return t, true, t.setClean(false)
+}
+
+func (t *textIndex) clear() {
+	t.postings = map[string]map[string][]int{}
+	t.docs = map[string]*textDoc{}
+	t.free = nil
+	t.count = 1
+}
+
+func (t *textIndex) setClean(clean bool) error {
+	b := make([]byte, t.storage.ItemSize())
+	if clean {
+		b[0] = 1
+	}
+
+	_, err := t.storage.WriteOffset(b, 0)
+	return err
+}
+
+func (t *textIndex) reset() error {
+	if err := t.storage.Reset(); err != nil {
+		return err
+	}
+
+	t.clear()
+	return t.setClean(false)
+}
+
+func (t *textIndex) add(id string, word string, pos int, slot int64) {
+	doc := t.docs[id]
+	if doc == nil {
+		doc = &textDoc{}
+		t.docs[id] = doc
+	}
+
+	for len(doc.words) <= pos {
+		doc.words = append(doc.words, "")
+	}
+	doc.words[pos] = word
+	doc.slots = append(doc.slots, slot)
+
+	s := stem(word)
+	if t.postings[s] == nil {
+		t.postings[s] = map[string][]int{}
+	}
+	t.postings[s][id] = append(t.postings[s][id], pos)
+}
+
+// index replaces the words indexed for id with those of value.
+func (t *textIndex) index(id []byte, value []byte) error {
+	if err := t.remove(id); err != nil {
+		return err
+	}
+
+	item := t.field.newItem()
+	if err := item.UnmarshalBinary(value); err != nil {
+		return err
+	}
+
+	words := tokenize(t.field.text(item))
+	if len(words) > math.MaxUint16 {
+		words = words[:math.MaxUint16]
+	}
+
+	b := make([]byte, t.storage.ItemSize())
+	for pos, word := range words {
+		slot := t.count
+		if n := len(t.free); n > 0 {
+			slot = t.free[n-1]
+			t.free = t.free[:n-1]
+		} else {
+			t.count++
+		}
+
+		clear(b)
+		copy(b, word)
+		copy(b[textWordSize:], id)
+		binary.LittleEndian.PutUint16(b[len(b)-textPositionSize:], uint16(pos))
+		if _, err := t.storage.WriteOffset(b, slot); err != nil {
+			return err
+		}
+
+		t.add(string(id), word, pos, slot)
+	}
+
+	return nil
+}
+
+func (t *textIndex) remove(id []byte) error {
+	doc := t.docs[string(id)]
+	if doc == nil {
+		return nil
+	}
+
+	zero := make([]byte, t.storage.ItemSize())
+	for _, slot := range doc.slots {
+		if _, err := t.storage.WriteOffset(zero, slot); err != nil {
+			return err
+		}
+		t.free = append(t.free, slot)
+	}
+
+	for _, word := range doc.words {
+		s := stem(word)
+		delete(t.postings[s], string(id))
+		if len(t.postings[s]) == 0 {
+			delete(t.postings, s)
+		}
+	}
+	delete(t.docs, string(id))
+
+	return nil
+}
+
+func (t *textIndex) apply(op Op, id []byte, value []byte) error {
+	switch op {
+	case OpPut:
+		return t.index(id, value)
+	case OpRemove, OpExpire:
+		return t.remove(id)
+	case OpReset:
+		return t.reset()
+	}
+
+	return nil
+}
+
+// candidates returns the keys that may match clause: those with the stem of
+// its first word or, for a single prefix, with any stem compatible with it.
+func (t *textIndex) candidates(clause textClause) map[string]bool {
+	ids := map[string]bool{}
+
+	first := clause.words[0]
+	if len(clause.words) > 1 || !clause.prefix {
+		for id := range t.postings[stem(first)] {
+			ids[id] = true
+		}
+		return ids
+	}
+
+	for s, postings := range t.postings {
+		if strings.HasPrefix(s, first) || strings.HasPrefix(first, s) {
+			for id := range postings {
+				ids[id] = true
+			}
+		}
+	}
+
+	return ids
+}
+
+// occurrences counts where the words of doc match clause.
+func (t *textIndex) occurrences(doc *textDoc, clause textClause) int {
+	n := 0
+	for start := 0; start+len(clause.words) <= len(doc.words); start++ {
+		matched := true
+		for i, w := range clause.words {
+			word := doc.words[start+i]
+			if clause.prefix && i == len(clause.words)-1 {
+				matched = strings.HasPrefix(word, w)
+			} else {
+				matched = stem(word) == stem(w)
+			}
+			if !matched {
+				break
+			}
+		}
+
+		if matched {
+			n++
+		}
+	}
+
+	return n
+}
+
+type textMatch struct {
+	id    string
+	score float64
+}
+
+// search scores each key by the sum over its matching groups of their
+// clauses' occurrence counts weighted by how rare the clause is, and returns
+// the keys by decreasing score.
+func (t *textIndex) search(groups [][]textClause) []textMatch {
+	total := float64(len(t.docs))
+	scores := map[string]float64{}
+
+	for _, group := range groups {
+		var groupScores map[string]float64
+		for _, clause := range group {
+			clauseScores := map[string]float64{}
+			for id := range t.candidates(clause) {
+				if groupScores != nil {
+					if _, ok := groupScores[id]; !ok {
+						continue
+					}
+				}
+
+				if n := t.occurrences(t.docs[id], clause); n > 0 {
+					clauseScores[id] = float64(n)
+				}
+			}
+
+			idf := math.Log(1 + total/float64(len(clauseScores)+1))
+			for id, tf := range clauseScores {
+				clauseScores[id] = groupScores[id] + tf*idf
+			}
+			groupScores = clauseScores
+		}
+
+		for id, score := range groupScores {
+			scores[id] += score
+		}
+	}
+
+	matches := make([]textMatch, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, textMatch{id: id, score: score})
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	return matches
+}
+
+func (t *textIndex) close() error {
+	err := t.setClean(true)
+	if closeErr := t.storage.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
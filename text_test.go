@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var textTestTitles = []string{
+	"The Lord of the Rings",
+	"The Hobbit",
+	"Running with Scissors",
+	"Lord of the Flies",
+	"The Runner",
+}
+
+func setupTextTest(tb testing.TB, opts ...Option) (func(tb testing.TB), Collection, []uuid.UUID) {
+	if err := os.RemoveAll("./data/test/search"); err != nil {
+		tb.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection("./data/test/search", KeySize, KeyIdSize, BookSize, append(opts, WithBookTitleIndex())...)
+	if err != nil {
+		tb.Fatalf("collection creation failed: %v", err)
+	}
+
+	ids := make([]uuid.UUID, len(textTestTitles))
+	for i, title := range textTestTitles {
+		ids[i] = uuid.New()
+		if err := c.Put(&ids[i], &Book{Title: title, Year: uint16(1950 + i)}); err != nil {
+			tb.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	return func(tb testing.TB) {
+		c.Close()
+	}, c, ids
+}
+
+// searchTitles returns the indices in textTestTitles of the search results.
+func searchTitles(t *testing.T, c Collection, ids []uuid.UUID, query string) []int {
+	results, err := Search(c, query)
+	if err != nil {
+		t.Fatalf("search %q failed: %v", query, err)
+	}
+
+	found := []int{}
+	for _, r := range results {
+		for i := range ids {
+			if *r.Id.(*uuid.NullUUID) == (uuid.NullUUID{UUID: ids[i], Valid: true}) {
+				found = append(found, i)
+			}
+		}
+	}
+
+	return found
+}
+
+func expectTitles(t *testing.T, c Collection, ids []uuid.UUID, query string, expected ...int) {
+	found := searchTitles(t, c, ids, query)
+	sort.Ints(found)
+	if len(expected) == 0 {
+		expected = []int{}
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected search %q to find %v; got %v", query, expected, found)
+	}
+}
+
+func TestTokenizeAndStem(t *testing.T) {
+	words := tokenize("The Runner's RUNNING-shoes, 2nd ed.")
+	expected := []string{"the", "runner", "s", "running", "shoes", "2nd", "ed"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Fatalf("expected words %v; got %v", expected, words)
+	}
+
+	stems := map[string]string{
+		"running": "runn",
+		"rings":   "ring",
+		"flies":   "fli",
+		"boxes":   "box",
+		"glass":   "glass",
+		"lord":    "lord",
+	}
+	for word, expected := range stems {
+		if s := stem(word); s != expected {
+			t.Fatalf("expected stem of %q to be %q; got %q", word, expected, s)
+		}
+	}
+}
+
+func TestParseTextQuery(t *testing.T) {
+	groups, err := parseTextQuery(`lord AND "the ri" OR hobbit`)
+	if err != nil {
+		t.Fatalf("query parsing failed: %v", err)
+	}
+
+	expected := [][]textClause{
+		{{words: []string{"lord"}}, {words: []string{"the", "ri"}, prefix: true}},
+		{{words: []string{"hobbit"}}},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected clauses %v; got %v", expected, groups)
+	}
+
+	for _, query := range []string{"", "OR lord", "lord OR", `"lord`} {
+		if _, err := parseTextQuery(query); err == nil {
+			t.Fatalf("expected query %q to be rejected", query)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	teardown, c, ids := setupTextTest(t)
+	defer teardown(t)
+
+	expectTitles(t, c, ids, "hobbit", 1)
+	expectTitles(t, c, ids, "LORD", 0, 3)
+	expectTitles(t, c, ids, "lord rings", 0)
+	expectTitles(t, c, ids, "hobbit OR flies", 1, 3)
+	expectTitles(t, c, ids, "ring", 0)
+	expectTitles(t, c, ids, "running", 2)
+	expectTitles(t, c, ids, "run")
+	expectTitles(t, c, ids, `"lord of the ri"`, 0)
+	expectTitles(t, c, ids, `"lord of the"`, 0, 3)
+	expectTitles(t, c, ids, `"run"`, 2, 4)
+	expectTitles(t, c, ids, `"the lord"`, 0)
+	expectTitles(t, c, ids, "dune")
+}
+
+func TestSearchRanksRarerTermsHigher(t *testing.T) {
+	teardown, c, ids := setupTextTest(t)
+	defer teardown(t)
+
+	found := searchTitles(t, c, ids, "the OR hobbit")
+	if len(found) != 4 || found[0] != 1 || found[1] != 0 {
+		t.Fatalf("expected The Hobbit, then the title with the most matches first; got %v", found)
+	}
+
+	results, err := Search(c, "the OR hobbit")
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Fatalf("expected results by decreasing score; got %v", results)
+		}
+	}
+}
+
+func TestSearchFollowsMutations(t *testing.T) {
+	teardown, c, ids := setupTextTest(t)
+	defer teardown(t)
+
+	if err := c.Put(&ids[1], &Book{Title: "The Silmarillion", Year: 1977}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+	expectTitles(t, c, ids, "hobbit")
+	expectTitles(t, c, ids, "silmarillion", 1)
+
+	if err := c.Remove(&ids[0]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+	expectTitles(t, c, ids, "lord", 3)
+
+	now := time.Now()
+	setClock(c, func() time.Time { return now })
+	if err := c.PutWithTTL(&ids[0], &Book{Title: "Lord Jim", Year: 1900}, time.Minute); err != nil {
+		t.Fatalf("collection put with ttl failed: %v", err)
+	}
+	expectTitles(t, c, ids, "lord", 0, 3)
+
+	setClock(c, func() time.Time { return now.Add(time.Hour) })
+	expectTitles(t, c, ids, "lord", 3)
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("collection reset failed: %v", err)
+	}
+	expectTitles(t, c, ids, "lord")
+}
+
+func TestSearchIndexSurvivesReopen(t *testing.T) {
+	teardown, c, ids := setupTextTest(t)
+	if err := c.Remove(&ids[3]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+	teardown(t)
+
+	c, err := NewCollection("./data/test/search", KeySize, KeyIdSize, BookSize, WithBookTitleIndex())
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+
+	if c.(*collection).text.count == 1 {
+		t.Fatal("expected the postings to be loaded from disk")
+	}
+	expectTitles(t, c, ids, "lord", 0)
+
+	c.Close()
+
+	// Simulate a crash by marking the index dirty.
+	f, err := os.OpenFile("./data/test/search/text", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("opening text index failed: %v", err)
+	}
+	f.WriteAt([]byte{0}, 0)
+	f.Close()
+
+	c, err = NewCollection("./data/test/search", KeySize, KeyIdSize, BookSize, WithBookTitleIndex())
+	if err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	expectTitles(t, c, ids, "lord", 0)
+	expectTitles(t, c, ids, "hobbit", 1)
+}
+
+func TestSearchWithoutTextIndex(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	if _, err := Search(c, "lord"); !errors.Is(err, ErrNoTextIndex) {
+		t.Fatalf("expected ErrNoTextIndex; got %v", err)
+	}
+}
+
+func TestSearchEncrypted(t *testing.T) {
+	teardown, c, ids := setupTextTest(t, WithEncryption(NewStaticKeyProvider("k1", testKeys)))
+	defer teardown(t)
+
+	expectTitles(t, c, ids, "hobbit", 1)
+
+	b, err := os.ReadFile("./data/test/search/text")
+	if err != nil {
+		t.Fatalf("reading text index failed: %v", err)
+	}
+
+	if bytes.Contains(b, []byte("hobbit")) {
+		t.Fatal("expected the text index to be encrypted")
+	}
+}
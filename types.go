@@ -1,6 +1,10 @@
 package main
 
-import "encoding"
+import (
+	"context"
+	"encoding"
+	"time"
+)
 
 type Item interface {
 	encoding.BinaryMarshaler
@@ -12,12 +16,42 @@ type KeyId interface {
 	encoding.BinaryUnmarshaler
 }
 
+type Entry struct {
+	Id   KeyId
+	Item Item
+}
+
+type ConflictPolicy int
+
+const (
+	ConflictOverwrite ConflictPolicy = iota
+	ConflictSkip
+	ConflictFail
+)
+
+// Stats describes the contents of a collection. The slot fields only apply
+// to collections of fixed-size records; MinKey and MaxKey are nil when the
+// collection is empty.
+type Stats struct {
+	Count     int64
+	DataSlots int64
+	DeadSlots int64
+	DeadBytes int64
+	Files     map[string]int64
+	FileBytes int64
+	Shifts    ShiftStats
+	MinKey    KeyId
+	MaxKey    KeyId
+	Bloom     *BloomStats
+}
+
 type Storage interface {
 	ReadOffset([]byte, int64) (int, error)
 	WriteOffset([]byte, int64) (int, error)
 	ShiftLeft(int64) error
 	ShiftRight(int64) error
 	Count() (int64, error)
+	Truncate(int64) error
 	ItemSize() uint16
 	Reset() error
 	Close() error
@@ -27,14 +61,45 @@ type Indexer interface {
 	Insert(Storage, Item) (int64, error)
 	Find(Storage, KeyId) (int64, error)
 	Remove(Storage, KeyId) error
+	Count(Storage) (int64, error)
+	Scan(Storage, func(int64) error) error
 	KeySize() uint16
 }
 
 type Collection interface {
 	Put(KeyId, Item) error
+	PutWithTTL(KeyId, Item, time.Duration) error
 	Get(KeyId, Item) error
 	Remove(KeyId) error
+	Scan(Item, func(KeyId, Item) error) error
+	Load([]Entry, ConflictPolicy) (int, error)
+	Sweep() (int, error)
+	PutCtx(context.Context, KeyId, Item) error
+	GetCtx(context.Context, KeyId, Item) error
+	RemoveCtx(context.Context, KeyId) error
+	ScanCtx(context.Context, Item, func(KeyId, Item) error) error
+	LoadCtx(context.Context, []Entry, ConflictPolicy) (int, error)
+	SweepCtx(context.Context) (int, error)
+	Watch(context.Context, WatchOptions) <-chan Event
+	// The change log keeps every mutation until TruncateChanges drops the
+	// ones below a sequence number. Nothing else truncates it, so callers
+	// must once they no longer need them, for example once followers have
+	// applied them.
+	LastSeq() uint64
+	Changes(uint64, func(Change) error) error
+	TruncateChanges(uint64) error
+	Apply(Change) error
+	// GetWithVersion also returns the version of the key, which every put
+	// raises, even after the key was removed.
+	GetWithVersion(KeyId, Item) (uint64, error)
+	PutIfAbsent(KeyId, Item) error
+	CompareAndSwap(id KeyId, expectedVersion uint64, item Item) error
+	RemoveIfVersion(id KeyId, expectedVersion uint64) error
+	Update(id KeyId, item Item, fn func(old Item) (Item, error)) error
+	Snapshot() (Snapshot, error)
 	Count() (int64, error)
+	Stats() (Stats, error)
+	Metrics() Metrics
 	Reset() error
 	Close() error
 }
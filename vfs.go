@@ -0,0 +1,587 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrLocked = errors.New("file is locked")
+
+// File is a file opened through a VFS for reading and writing.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// VFS is the filesystem collections keep their files in. Missing files are
+// reported with errors for which os.IsNotExist holds.
+type VFS interface {
+	// OpenFile opens name for reading and writing. flag may add os.O_CREATE
+	// and os.O_TRUNC.
+	OpenFile(name string, flag int) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string) error
+	// SyncDir flushes the entries of directory name to stable storage, so
+	// that files renamed into or out of it stay so after a power loss.
+	SyncDir(name string) error
+	// Lock takes an exclusive lock on name, creating it if needed, until the
+	// returned Closer is closed. It fails with ErrLocked when the lock is
+	// already held.
+	Lock(name string) (io.Closer, error)
+}
+
+func readFile(vfs VFS, name string) ([]byte, error) {
+	f, err := vfs.OpenFile(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func writeFile(vfs VFS, name string, b []byte) error {
+	f, err := vfs.OpenFile(name, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(b, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeFileAtomic replaces name with b through a temporary file, so that
+// name holds either its old or its new contents, even after a crash.
+func writeFileAtomic(vfs VFS, name string, b []byte) error {
+	tmp := name + ".tmp"
+	if err := writeFile(vfs, tmp, b); err != nil {
+		return err
+	}
+
+	return renameSynced(vfs, tmp, name)
+}
+
+// renameSynced renames oldpath to newpath and syncs the directories of both,
+// so that the rename survives a power loss.
+func renameSynced(vfs VFS, oldpath string, newpath string) error {
+	if err := vfs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	if err := vfs.SyncDir(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(oldpath); dir != filepath.Dir(newpath) {
+		return vfs.SyncDir(dir)
+	}
+
+	return nil
+}
+
+type osFS struct{}
+
+// NewOSFS returns the VFS of the operating system, which collections use by
+// default.
+func NewOSFS() VFS {
+	return osFS{}
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+func (osFS) OpenFile(name string, flag int) (File, error) {
+	f, err := os.OpenFile(name, flag|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) MkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+func (osFS) SyncDir(name string) error {
+	return syncDir(name)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// memFS is a VFS kept in memory. Like on Unix, open files keep their
+// contents when they are renamed or removed.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+type memData struct {
+	mu      sync.Mutex
+	b       []byte
+	locked  bool
+	modTime time.Time
+}
+
+// NewMemFS returns an empty VFS kept in memory, for tests and throwaway
+// collections.
+func NewMemFS() VFS {
+	return &memFS{files: map[string]*memData{}, dirs: map[string]bool{".": true, "/": true}}
+}
+
+func memPathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// checkDir fails when the parent directory of name does not exist.
+func (m *memFS) checkDir(op string, name string) error {
+	if !m.dirs[filepath.Dir(name)] {
+		return memPathError(op, name, fs.ErrNotExist)
+	}
+
+	return nil
+}
+
+func (m *memFS) OpenFile(name string, flag int) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	d := m.files[name]
+	if d == nil {
+		if flag&os.O_CREATE == 0 || m.dirs[name] {
+			return nil, memPathError("open", name, fs.ErrNotExist)
+		}
+
+		if err := m.checkDir("open", name); err != nil {
+			return nil, err
+		}
+
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.b = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+
+	return &memFile{name: name, d: d}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	d := m.files[name]
+	if d == nil {
+		return nil, memPathError("stat", name, fs.ErrNotExist)
+	}
+
+	return d.info(filepath.Base(name)), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, memPathError("readdir", name, fs.ErrNotExist)
+	}
+
+	entries := []fs.DirEntry{}
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: filepath.Base(dir), dir: true}))
+		}
+	}
+	for file, d := range m.files {
+		if filepath.Dir(file) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(d.info(filepath.Base(file))))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// under reports whether name is path or inside it.
+func under(name string, path string) bool {
+	return name == path || strings.HasPrefix(name, path+string(filepath.Separator))
+}
+
+func (m *memFS) Rename(oldpath string, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := m.checkDir("rename", newpath); err != nil {
+		return err
+	}
+
+	if d := m.files[oldpath]; d != nil {
+		if m.dirs[newpath] {
+			return memPathError("rename", newpath, fs.ErrExist)
+		}
+
+		delete(m.files, oldpath)
+		m.files[newpath] = d
+		return nil
+	}
+
+	if !m.dirs[oldpath] {
+		return memPathError("rename", oldpath, fs.ErrNotExist)
+	}
+
+	if m.files[newpath] != nil || under(newpath, oldpath) {
+		return memPathError("rename", newpath, fs.ErrInvalid)
+	}
+
+	if m.dirs[newpath] {
+		return memPathError("rename", newpath, fs.ErrExist)
+	}
+
+	for dir := range m.dirs {
+		if under(dir, oldpath) {
+			delete(m.dirs, dir)
+			m.dirs[newpath+strings.TrimPrefix(dir, oldpath)] = true
+		}
+	}
+	for file, d := range m.files {
+		if under(file, oldpath) {
+			delete(m.files, file)
+			m.files[newpath+strings.TrimPrefix(file, oldpath)] = d
+		}
+	}
+
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if m.files[name] != nil {
+		delete(m.files, name)
+		return nil
+	}
+
+	if !m.dirs[name] {
+		return memPathError("remove", name, fs.ErrNotExist)
+	}
+
+	for file := range m.files {
+		if under(file, name) {
+			return memPathError("remove", name, errors.New("directory not empty"))
+		}
+	}
+	for dir := range m.dirs {
+		if dir != name && under(dir, name) {
+			return memPathError("remove", name, errors.New("directory not empty"))
+		}
+	}
+
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+	for file := range m.files {
+		if under(file, path) {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if under(dir, path) && dir != "." && dir != "/" {
+			delete(m.dirs, dir)
+		}
+	}
+
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := filepath.Clean(path); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if m.files[dir] != nil {
+			return memPathError("mkdir", dir, fs.ErrExist)
+		}
+		m.dirs[dir] = true
+	}
+
+	return nil
+}
+
+func (m *memFS) SyncDir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[filepath.Clean(name)] {
+		return memPathError("sync", name, fs.ErrNotExist)
+	}
+
+	return nil
+}
+
+func (m *memFS) Lock(name string) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	d := f.(*memFile).d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.locked {
+		return nil, errors.Wrap(ErrLocked, name)
+	}
+	d.locked = true
+
+	return memLock{d}, nil
+}
+
+type memLock struct {
+	d *memData
+}
+
+func (l memLock) Close() error {
+	l.d.mu.Lock()
+	defer l.d.mu.Unlock()
+
+	l.d.locked = false
+	return nil
+}
+
+func (d *memData) info(name string) memFileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return memFileInfo{name: name, size: int64(len(d.b)), modTime: d.modTime}
+}
+
+type memFile struct {
+	name   string
+	d      *memData
+	closed bool
+}
+
+func (f *memFile) check(op string) error {
+	if f.closed {
+		return memPathError(op, f.name, fs.ErrClosed)
+	}
+
+	return nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.d.b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.d.b[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+
+	if end := off + int64(len(b)); end > int64(len(f.d.b)) {
+		f.d.b = append(f.d.b, make([]byte, end-int64(len(f.d.b)))...)
+	}
+	f.d.modTime = time.Now()
+
+	return copy(f.d.b[off:], b), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.check("stat"); err != nil {
+		return 0, err
+	}
+
+	return int64(len(f.d.b)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+
+	if size < int64(len(f.d.b)) {
+		f.d.b = f.d.b[:size:size]
+	} else {
+		f.d.b = append(f.d.b, make([]byte, size-int64(len(f.d.b)))...)
+	}
+	f.d.modTime = time.Now()
+
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	return f.check("sync")
+}
+
+func (f *memFile) Close() error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string {
+	return i.name
+}
+
+func (i memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+func (i memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i memFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i memFileInfo) Sys() any {
+	return nil
+}
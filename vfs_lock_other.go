@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile does not lock on systems without flock; collections rely on being
+// opened by one process at a time there.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// syncDir does nothing on systems where directories cannot be opened for
+// syncing.
+func syncDir(name string) error {
+	return nil
+}
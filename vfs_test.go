@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMemCollectionPersistsInVFS(t *testing.T) {
+	dir := "./data/test/mem"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	vfs := NewMemFS()
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithVFS(vfs), WithBloomFilter(100, 0.01))
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	id := uuid.New()
+	if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithVFS(vfs)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected opening a collection twice to fail; got %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("collection close failed: %v", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written to disk; got %v", err)
+	}
+
+	if c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize, WithVFS(vfs), WithBloomFilter(100, 0.01)); err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	defer c.Close()
+
+	book := &Book{}
+	if err := c.Get(&id, book); err != nil {
+		t.Fatalf("collection get failed: %v", err)
+	}
+
+	if book.Title != "Dune" {
+		t.Fatalf(`expected book title to be "Dune"; got "%v"`, book.Title)
+	}
+}
+
+func TestCollectionLocked(t *testing.T) {
+	dir := "./data/test/locked"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("collection directory removal failed: %v", err)
+	}
+
+	c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize)
+	if err != nil {
+		t.Fatalf("collection creation failed: %v", err)
+	}
+
+	if _, err := NewCollection(dir, KeySize, KeyIdSize, BookSize); !errors.Is(err, ErrLocked) {
+		t.Skipf("file locks are not supported here: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("collection close failed: %v", err)
+	}
+
+	if c, err = NewCollection(dir, KeySize, KeyIdSize, BookSize); err != nil {
+		t.Fatalf("collection reopening failed: %v", err)
+	}
+	c.Close()
+}
+
+func TestMemFS(t *testing.T) {
+	vfs := NewMemFS()
+
+	if _, err := vfs.OpenFile("a/file", 0); !os.IsNotExist(err) {
+		t.Fatalf("expected opening a missing file to fail; got %v", err)
+	}
+
+	if _, err := vfs.OpenFile("a/file", os.O_CREATE); !os.IsNotExist(err) {
+		t.Fatalf("expected creating a file in a missing directory to fail; got %v", err)
+	}
+
+	if err := vfs.MkdirAll("a/b"); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	if err := writeFileAtomic(vfs, "a/b/file", []byte("hello")); err != nil {
+		t.Fatalf("writing file failed: %v", err)
+	}
+
+	// Renaming a directory moves its files along.
+	if err := vfs.Rename("a/b", "a/c"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	b, err := readFile(vfs, "a/c/file")
+	if err != nil {
+		t.Fatalf("reading file failed: %v", err)
+	}
+
+	if string(b) != "hello" {
+		t.Fatalf(`expected "hello"; got %q`, b)
+	}
+
+	entries, err := vfs.ReadDir("a/c")
+	if err != nil {
+		t.Fatalf("readdir failed: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "file" {
+		t.Fatalf("expected only the renamed file; got %v", entries)
+	}
+
+	if err := vfs.Remove("a/c"); err == nil {
+		t.Fatal("expected removing a non-empty directory to fail")
+	}
+
+	// An open file keeps its contents after being removed.
+	f, err := vfs.OpenFile("a/c/file", 0)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer f.Close()
+
+	if err := vfs.RemoveAll("a"); err != nil {
+		t.Fatalf("remove all failed: %v", err)
+	}
+
+	if _, err := vfs.Stat("a/c/file"); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be removed; got %v", err)
+	}
+
+	if size, err := f.Size(); err != nil || size != 5 {
+		t.Fatalf("expected the open file to keep 5 bytes; got %d, %v", size, err)
+	}
+
+	lock, err := vfs.Lock("lock")
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	if _, err := vfs.Lock("lock"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the second lock to fail; got %v", err)
+	}
+
+	lock.Close()
+	if lock, err = vfs.Lock("lock"); err != nil {
+		t.Fatalf("lock after release failed: %v", err)
+	}
+	lock.Close()
+}
+
+// syncDirFS records the renames and directory syncs made through it.
+type syncDirFS struct {
+	VFS
+	ops []string
+}
+
+func (f *syncDirFS) Rename(oldpath string, newpath string) error {
+	f.ops = append(f.ops, "rename "+filepath.Clean(newpath))
+	return f.VFS.Rename(oldpath, newpath)
+}
+
+func (f *syncDirFS) SyncDir(name string) error {
+	f.ops = append(f.ops, "sync "+filepath.Clean(name))
+	return f.VFS.SyncDir(name)
+}
+
+func TestRenamesSyncDirectory(t *testing.T) {
+	dir := "./data/test/syncdir"
+	tests := map[string]func(vfs VFS) error{
+		"WriteFileAtomic": func(vfs VFS) error {
+			if err := vfs.MkdirAll(dir); err != nil {
+				return err
+			}
+			return writeFileAtomic(vfs, filepath.Join(dir, "manifest"), []byte("manifest"))
+		},
+		"Migrate": func(vfs VFS) error {
+			c, err := NewCollection(dir, KeySize, KeyIdSize, BookSize, WithVFS(vfs))
+			if err != nil {
+				return err
+			}
+
+			id := uuid.New()
+			if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+				c.Close()
+				return err
+			}
+
+			if err := c.Close(); err != nil {
+				return err
+			}
+
+			_, err = Migrate(dir, "test-book-pages", false, WithVFS(vfs))
+			return err
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			vfs := &syncDirFS{VFS: NewMemFS()}
+			if err := test(vfs); err != nil {
+				t.Fatalf("%s failed: %v", name, err)
+			}
+
+			renames := 0
+			for i, op := range vfs.ops {
+				newpath, ok := strings.CutPrefix(op, "rename ")
+				if !ok {
+					continue
+				}
+
+				renames++
+				if sync := "sync " + filepath.Dir(newpath); i+1 == len(vfs.ops) || vfs.ops[i+1] != sync {
+					t.Fatalf("expected %q to be followed by %q; got %v", op, sync, vfs.ops)
+				}
+			}
+
+			if renames == 0 {
+				t.Fatalf("expected a rename; got %v", vfs.ops)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+type Op int
+
+const (
+	OpPut Op = iota
+	OpRemove
+	OpExpire
+	OpReset
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpRemove:
+		return "remove"
+	case OpExpire:
+		return "expire"
+	case OpReset:
+		return "reset"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Seq      uint64
+	Op       Op
+	Id       KeyId
+	OldValue []byte
+	NewValue []byte
+	Dropped  uint64
+}
+
+// KeyRange selects marshaled key ids in [Start, End). A nil bound is open.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+func PrefixRange(prefix []byte) KeyRange {
+	r := KeyRange{Start: prefix}
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			r.End = end[:i+1]
+			break
+		}
+	}
+	return r
+}
+
+func (r KeyRange) Contains(id []byte) bool {
+	if r.Start != nil && bytes.Compare(id, r.Start) == -1 {
+		return false
+	}
+	if r.End != nil && bytes.Compare(id, r.End) != -1 {
+		return false
+	}
+	return true
+}
+
+type WatchPolicy int
+
+const (
+	WatchDrop WatchPolicy = iota
+	WatchBlock
+)
+
+// WatchOptions select the events of a watch and how they are delivered. With
+// WatchBlock, a mutation waits for room in the buffer while holding the
+// collection's write lock, for up to BlockTimeout. A subscriber that does not
+// make room in time is dropped and its channel closed.
+type WatchOptions struct {
+	Range        KeyRange
+	Buffer       int
+	Policy       WatchPolicy
+	BlockTimeout time.Duration
+}
+
+const defaultWatchBuffer = 64
+const defaultWatchBlockTimeout = time.Second
+
+type subscriber struct {
+	ctx     context.Context
+	opts    WatchOptions
+	ch      chan Event
+	done    chan struct{} // closed with ch, when the subscription ends
+	dropped uint64
+}
+
+type watchHub struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{subs: map[*subscriber]struct{}{}}
+}
+
+func (h *watchHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs) > 0
+}
+
+func (h *watchHub) subscribe(ctx context.Context, opts WatchOptions) <-chan Event {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultWatchBuffer
+	}
+
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultWatchBlockTimeout
+	}
+
+	sub := &subscriber{ctx: ctx, opts: opts, ch: make(chan Event, opts.Buffer), done: make(chan struct{})}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(sub.ch)
+		return sub.ch
+	}
+
+	h.subs[sub] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.unsubscribe(sub)
+		case <-sub.done:
+		}
+	}()
+
+	return sub.ch
+}
+
+func (h *watchHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		h.end(sub)
+	}
+}
+
+// end removes sub from h, which has to be locked, and closes its channels.
+func (h *watchHub) end(sub *subscriber) {
+	delete(h.subs, sub)
+	close(sub.ch)
+	close(sub.done)
+}
+
+// publish delivers e to every subscriber whose range contains idBytes. A nil
+// idBytes matches every range. With WatchBlock the call waits for room in the
+// subscriber's buffer until its context ends or its block timeout passes,
+// which drops the subscriber; with WatchDrop the event is counted in the
+// subscriber's next delivered Event.Dropped instead.
+func (h *watchHub) publish(idBytes []byte, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if idBytes != nil && !sub.opts.Range.Contains(idBytes) {
+			continue
+		}
+
+		ev := e
+		ev.Dropped = sub.dropped
+
+		if sub.opts.Policy == WatchBlock {
+			timer := time.NewTimer(sub.opts.BlockTimeout)
+			select {
+			case sub.ch <- ev:
+				sub.dropped = 0
+			case <-sub.ctx.Done():
+			case <-timer.C:
+				h.end(sub)
+			}
+			timer.Stop()
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// notify publishes a committed change with the marshaled key id and values.
+func (h *watchHub) notify(seq uint64, op Op, id []byte, old []byte, new []byte) error {
+	if !h.active() {
+		return nil
+	}
+
+	e := Event{Seq: seq, Op: op, OldValue: old, NewValue: new}
+	if id != nil {
+		e.Id = newKeyId()
+		if err := e.Id.UnmarshalBinary(id); err != nil {
+			return err
+		}
+	}
+
+	h.publish(id, e)
+	return nil
+}
+
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subs {
+		h.end(sub)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("expected event; channel was closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestWatchEvents(t *testing.T) {
+	teardown, c, ids, books := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := c.Watch(ctx, WatchOptions{})
+
+	updated := &Book{Title: "A Clash of Kings", Year: 1998}
+	if err := c.Put(&ids[0], updated); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	if err := c.Remove(&ids[1]); err != nil {
+		t.Fatalf("collection remove failed: %v", err)
+	}
+
+	put := receiveEvent(t, events)
+	if put.Op != OpPut {
+		t.Fatalf("expected op to be %v; got %v", OpPut, put.Op)
+	}
+
+	id, err := put.Id.MarshalBinary()
+	if err != nil {
+		t.Fatalf("event id marshalling failed: %v", err)
+	}
+
+	if !bytes.Equal(id, ids[0][:]) {
+		t.Fatalf("expected event id to be %v; got %x", ids[0], id)
+	}
+
+	old := &Book{}
+	if err := old.UnmarshalBinary(put.OldValue); err != nil {
+		t.Fatalf("old value unmarshalling failed: %v", err)
+	}
+
+	if *old != books[0] {
+		t.Fatalf("expected old value to be %v; got %v", books[0], *old)
+	}
+
+	new := &Book{}
+	if err := new.UnmarshalBinary(put.NewValue); err != nil {
+		t.Fatalf("new value unmarshalling failed: %v", err)
+	}
+
+	if *new != *updated {
+		t.Fatalf("expected new value to be %v; got %v", *updated, *new)
+	}
+
+	remove := receiveEvent(t, events)
+	if remove.Op != OpRemove {
+		t.Fatalf("expected op to be %v; got %v", OpRemove, remove.Op)
+	}
+
+	if remove.Seq != put.Seq+1 {
+		t.Fatalf("expected sequence %d; got %d", put.Seq+1, remove.Seq)
+	}
+
+	if remove.NewValue != nil || remove.OldValue == nil {
+		t.Fatalf("expected remove event to carry only the old value")
+	}
+}
+
+func TestWatchRange(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := c.Watch(ctx, WatchOptions{Range: PrefixRange([]byte{0xab})})
+
+	outside := uuid.MustParse("00a39129-7fb5-4855-9f80-6d290d52b812")
+	inside := uuid.MustParse("aba39129-7fb5-4855-9f80-6d290d52b812")
+	for _, id := range []uuid.UUID{outside, inside} {
+		if err := c.Put(&id, &Book{Title: "Dune", Year: 1965}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	e := receiveEvent(t, events)
+	id, err := e.Id.MarshalBinary()
+	if err != nil {
+		t.Fatalf("event id marshalling failed: %v", err)
+	}
+
+	if !bytes.Equal(id, inside[:]) {
+		t.Fatalf("expected only event for %v; got %x", inside, id)
+	}
+}
+
+func TestWatchDropPolicy(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := c.Watch(ctx, WatchOptions{Buffer: 1, Policy: WatchDrop})
+
+	for i := 0; i < 3; i++ {
+		if err := c.Put(&ids[0], &Book{Title: "Dune", Year: uint16(1965 + i)}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	first := receiveEvent(t, events)
+	if first.Dropped != 0 {
+		t.Fatalf("expected no dropped events before the first; got %d", first.Dropped)
+	}
+
+	if err := c.Put(&ids[0], &Book{Title: "Dune", Year: 2000}); err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+
+	next := receiveEvent(t, events)
+	if next.Dropped != 2 {
+		t.Fatalf("expected 2 dropped events; got %d", next.Dropped)
+	}
+
+	if next.Seq != first.Seq+3 {
+		t.Fatalf("expected sequence %d; got %d", first.Seq+3, next.Seq)
+	}
+}
+
+func TestWatchBlockPolicy(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := c.Watch(ctx, WatchOptions{Buffer: 1, Policy: WatchBlock})
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := c.Put(&ids[0], &Book{Title: "Dune", Year: uint16(1965 + i)}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	var last Event
+	for i := 0; i < 3; i++ {
+		e := receiveEvent(t, events)
+		if e.Dropped != 0 {
+			t.Fatalf("expected no dropped events; got %d", e.Dropped)
+		}
+		if i > 0 && e.Seq != last.Seq+1 {
+			t.Fatalf("expected sequence %d; got %d", last.Seq+1, e.Seq)
+		}
+		last = e
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("collection put failed: %v", err)
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	teardown, c, _, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := c.Watch(ctx, WatchOptions{})
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected no events after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected channel to be closed after cancellation")
+	}
+}
+
+func TestWatchEndsWithHub(t *testing.T) {
+	h := newWatchHub()
+	before := runtime.NumGoroutine()
+
+	var subs []<-chan Event
+	for i := 0; i < 10; i++ {
+		subs = append(subs, h.subscribe(context.Background(), WatchOptions{}))
+	}
+	h.close()
+
+	for _, events := range subs {
+		if _, ok := <-events; ok {
+			t.Fatal("expected the channel to be closed with the hub")
+		}
+	}
+
+	// Subscriptions whose context never ends leave nothing running.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines; got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	r := PrefixRange([]byte{0x01, 0xff})
+
+	if !r.Contains([]byte{0x01, 0xff, 0x00}) {
+		t.Fatal("expected range to contain key with prefix")
+	}
+
+	if r.Contains([]byte{0x02, 0x00}) || r.Contains([]byte{0x01, 0xfe}) {
+		t.Fatal("expected range to not contain keys without prefix")
+	}
+
+	if !PrefixRange([]byte{0xff}).Contains([]byte{0xff, 0xff}) {
+		t.Fatal("expected unbounded range to contain key with prefix")
+	}
+}
+
+func TestWatchBlockTimeout(t *testing.T) {
+	teardown, c, ids, _ := setupCollectionTest(t)
+	defer teardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := c.Watch(ctx, WatchOptions{Buffer: 1, Policy: WatchBlock, BlockTimeout: 10 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if err := c.Put(&ids[0], &Book{Title: "Dune", Year: uint16(1965 + i)}); err != nil {
+			t.Fatalf("collection put failed: %v", err)
+		}
+	}
+
+	receiveEvent(t, events)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected the stalled subscriber to be dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected channel to be closed after the block timeout")
+	}
+}